@@ -194,15 +194,8 @@ func (u *BranchUsecase) GetByLocation(ctx context.Context, country string, cityI
 // CreateCategory creates a new category
 func (u *BranchUsecase) CreateCategory(ctx context.Context, category *entities.Category) (*entities.Category, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := u.UserRepo.GetByID(ctx, currentUserID)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionManageCatalog)
 	if err != nil {
-		log.Error(err)
-		cancelFunc()
-		return nil, errors.Wrap(err, "repository error while getting user")
-	}
-	if !currentUser.IsAdmin() {
-		err = errors.New("only admins are allowed to create categories")
 		log.Error(err)
 		cancelFunc()
 		return nil, err
@@ -220,15 +213,8 @@ func (u *BranchUsecase) CreateCategory(ctx context.Context, category *entities.C
 // EditCategory modifies the category fields.
 func (u *BranchUsecase) EditCategory(ctx context.Context, category *entities.Category) (*entities.Category, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := u.UserRepo.GetByID(ctx, currentUserID)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionManageCatalog)
 	if err != nil {
-		log.Error(err)
-		cancelFunc()
-		return nil, errors.Wrap(err, "repository error while getting user")
-	}
-	if !currentUser.IsAdmin() {
-		err = errors.New("only admins are allowed to edit categories")
 		log.Error(err)
 		cancelFunc()
 		return nil, err
@@ -246,15 +232,8 @@ func (u *BranchUsecase) EditCategory(ctx context.Context, category *entities.Cat
 
 func (u *BranchUsecase) DeleteCategory(ctx context.Context, categoryID uint) (*entities.Category, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := u.UserRepo.GetByID(ctx, currentUserID)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionManageCatalog)
 	if err != nil {
-		log.Error(err)
-		cancelFunc()
-		return nil, errors.Wrap(err, "repository error while getting user")
-	}
-	if !currentUser.IsAdmin() {
-		err = errors.New("only admins are allowed to delete categories")
 		log.Error(err)
 		cancelFunc()
 		return nil, err
@@ -339,16 +318,8 @@ func (u *BranchUsecase) GetCategories(ctx context.Context) ([]entities.Category,
 // CreateCity creates a new city
 func (u *BranchUsecase) CreateCity(ctx context.Context, city *entities.City) (*entities.City, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := u.UserRepo.GetByID(ctx, currentUserID)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionManageCatalog)
 	if err != nil {
-		err = errors.Wrap(err, "error getting current user")
-		log.Error(err)
-		cancelFunc()
-		return nil, err
-	}
-	if !currentUser.IsAdmin() {
-		err = errors.New("not authorized")
 		log.Error(err)
 		cancelFunc()
 		return nil, err
@@ -367,16 +338,8 @@ func (u *BranchUsecase) CreateCity(ctx context.Context, city *entities.City) (*e
 // DeleteCity deletes a city
 func (u *BranchUsecase) DeleteCity(ctx context.Context, cityID uint) (*entities.City, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := u.UserRepo.GetByID(ctx, currentUserID)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionManageCatalog)
 	if err != nil {
-		err = errors.Wrap(err, "error getting current user")
-		log.Error(err)
-		cancelFunc()
-		return nil, err
-	}
-	if !currentUser.IsAdmin() {
-		err = errors.New("not authorized")
 		log.Error(err)
 		cancelFunc()
 		return nil, err
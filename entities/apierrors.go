@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"math"
 )
 
 // ErrorMessage is the standard error message returned
@@ -40,6 +41,15 @@ func SendNotFoundError(c *gin.Context, message string, err error) {
 	})
 }
 
+// SendConflictError returns a conflict error message
+func SendConflictError(c *gin.Context, message string, err error) {
+	log.Error(err)
+	c.AbortWithStatusJSON(409, gin.H{
+		"error":   fmt.Sprintf("conflict : %s", err.Error()),
+		"message": message,
+	})
+}
+
 // SendAuthError returns an authentication error message
 func SendAuthError(c *gin.Context, message string, err error) {
 	log.Error(err)
@@ -66,3 +76,13 @@ func SendServerError(c *gin.Context, message string, err error) {
 		"message": message,
 	})
 }
+
+// SendTooManyAttemptsError returns a too many requests error message with the time to wait before retrying
+func SendTooManyAttemptsError(c *gin.Context, err *TooManyAttemptsError) {
+	log.Error(err)
+	c.Header("Retry-After", fmt.Sprintf("%d", int(math.Ceil(err.RetryAfter.Seconds()))))
+	c.AbortWithStatusJSON(429, gin.H{
+		"error":   fmt.Sprintf("too many attempts : %s", err.Error()),
+		"message": err.Error(),
+	})
+}
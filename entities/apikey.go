@@ -0,0 +1,92 @@
+package entities
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// APIKeyIDKey is the context key for the ID of the API key the request was authenticated with.
+const APIKeyIDKey key = "APIKeyID"
+
+// apiKeyPrefix starts every API key so that leaked keys are easy to recognize
+const apiKeyPrefix = "tsk"
+
+// APIKey lets the point of sale system of a partner consume offers without a user login.
+//
+// Only the hash of the key is stored. The key itself is shown once when it's created,
+// and its prefix identifies it in the list of keys of the partner.
+type APIKey struct {
+	gorm.Model
+	PartnerID  uint       `gorm:"index;not null" json:"partnerID"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `gorm:"unique_index;not null" json:"-"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+}
+
+// NewAPIKey returns a new API key of the given partner and the key to be given to them
+func NewAPIKey(partner *User, name string) (*APIKey, string, error) {
+	if !partner.IsPartner() || !partner.Can(PermissionManageAPIKeys) {
+		return nil, "", ErrForbidden
+	}
+	id := make([]byte, 4)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, "", err
+	}
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	prefix := apiKeyPrefix + "_" + hex.EncodeToString(id)
+	key := prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	return &APIKey{
+		PartnerID: partner.ID,
+		Name:      name,
+		Prefix:    prefix,
+		KeyHash:   HashAPIKey(key),
+	}, key, nil
+}
+
+// HashAPIKey returns the value of the API key stored in the database.
+// API keys are random so a fast hash is enough, and it allows looking the key up by it.
+func HashAPIKey(key string) string {
+	return HashRefreshToken(strings.TrimSpace(key))
+}
+
+// IsRevoked returns true if the key has been revoked
+func (k *APIKey) IsRevoked() bool {
+	return k.RevokedAt != nil
+}
+
+// Revoke stops the key from authenticating requests
+func (k *APIKey) Revoke(currentUser IUser) error {
+	if currentUser.GetID() != k.PartnerID || !currentUser.Can(PermissionManageAPIKeys) {
+		return ErrForbidden
+	}
+	if k.IsRevoked() {
+		return errors.New("API key is already revoked")
+	}
+	now := time.Now()
+	k.RevokedAt = &now
+	return nil
+}
+
+// Touch records the use of the key.
+// It returns false if the last use is recent enough to skip saving it.
+func (k *APIKey) Touch() bool {
+	if k.LastUsedAt != nil && time.Since(*k.LastUsedAt) < sessionTouchInterval {
+		return false
+	}
+	now := time.Now()
+	k.LastUsedAt = &now
+	return true
+}
@@ -0,0 +1,79 @@
+package entities
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewAPIKey(t *testing.T) {
+	partner := &User{AccountType: "partner", Role: RolePartner}
+	partner.ID = 1
+	apiKey, key, err := NewAPIKey(partner, "Front desk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiKey.PartnerID != partner.ID || !strings.HasPrefix(key, apiKey.Prefix+"_") {
+		t.Errorf("unexpected API key %+v", apiKey)
+	}
+	if apiKey.KeyHash != HashAPIKey(key) || strings.Contains(apiKey.KeyHash, key) {
+		t.Fail()
+	}
+	if HashAPIKey(" "+key+"\n") != apiKey.KeyHash {
+		t.Error("expected surrounding whitespace to be ignored")
+	}
+	_, other, err := NewAPIKey(partner, "Front desk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == key {
+		t.Fail()
+	}
+	t.Run("ByCashier", func(t *testing.T) {
+		cashier := &User{}
+		err := cashier.AssignCashier(partner, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = NewAPIKey(cashier, "Front desk")
+		if err != ErrForbidden {
+			t.Errorf("expected ErrForbidden, got %v", err)
+		}
+	})
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	partner := &User{AccountType: "partner", Role: RolePartner}
+	partner.ID = 1
+	other := &User{AccountType: "partner", Role: RolePartner}
+	other.ID = 2
+	apiKey, _, err := NewAPIKey(partner, "Front desk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiKey.Revoke(other) != ErrForbidden || apiKey.IsRevoked() {
+		t.Fail()
+	}
+	err = apiKey.Revoke(partner)
+	if err != nil || !apiKey.IsRevoked() {
+		t.Fail()
+	}
+	if apiKey.Revoke(partner) == nil {
+		t.Error("expected revoking twice to fail")
+	}
+}
+
+func TestTouchAPIKey(t *testing.T) {
+	apiKey := &APIKey{}
+	if !apiKey.Touch() || apiKey.LastUsedAt == nil {
+		t.Fail()
+	}
+	if apiKey.Touch() {
+		t.Error("expected recent use not to be saved again")
+	}
+	stale := time.Now().Add(-2 * sessionTouchInterval)
+	apiKey.LastUsedAt = &stale
+	if !apiKey.Touch() {
+		t.Fail()
+	}
+}
@@ -0,0 +1,151 @@
+package entities
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"math"
+	"time"
+)
+
+// LoginAttempt tracks the failed attempts made against a single key.
+//
+// Keys identify what is being attacked, e.g. an account or a client IP,
+// so the same failure is usually recorded against more than one key.
+type LoginAttempt struct {
+	gorm.Model
+	Key           string     `gorm:"unique_index;not null" json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"lastFailureAt"`
+	LockedUntil   *time.Time `json:"lockedUntil"`
+}
+
+// AttemptPolicy defines how failed attempts are throttled
+type AttemptPolicy struct {
+	// FreeAttempts is the number of failures allowed before any delay is applied
+	FreeAttempts int
+	// MaxAttempts is the number of failures that locks the key
+	MaxAttempts int
+	// BaseDelay is the delay after the first throttled failure, it doubles with every failure after it
+	BaseDelay time.Duration
+	// LockoutDuration is how long a key stays locked
+	LockoutDuration time.Duration
+	// Window is how long failures are remembered for
+	Window time.Duration
+}
+
+// LoginAttemptPolicy throttles password logins of a single account
+var LoginAttemptPolicy = AttemptPolicy{
+	FreeAttempts:    3,
+	MaxAttempts:     10,
+	BaseDelay:       2 * time.Second,
+	LockoutDuration: 30 * time.Minute,
+	Window:          time.Hour,
+}
+
+// VerificationAttemptPolicy throttles the short numeric verification codes
+var VerificationAttemptPolicy = AttemptPolicy{
+	FreeAttempts:    2,
+	MaxAttempts:     5,
+	BaseDelay:       5 * time.Second,
+	LockoutDuration: time.Hour,
+	Window:          time.Hour,
+}
+
+// ClientAttemptPolicy throttles all the attempts coming from a single client IP
+var ClientAttemptPolicy = AttemptPolicy{
+	FreeAttempts:    20,
+	MaxAttempts:     100,
+	BaseDelay:       time.Second,
+	LockoutDuration: time.Hour,
+	Window:          time.Hour,
+}
+
+// TooManyAttemptsError is returned when a key is throttled or locked
+type TooManyAttemptsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooManyAttemptsError) Error() string {
+	return fmt.Sprintf("too many failed attempts, please try again in %d seconds", int(math.Ceil(e.RetryAfter.Seconds())))
+}
+
+// RetryAfter returns how long the client has to wait before the next attempt is allowed
+func (a *LoginAttempt) RetryAfter(policy AttemptPolicy, now time.Time) time.Duration {
+	if a.LockedUntil != nil && now.Before(*a.LockedUntil) {
+		return a.LockedUntil.Sub(now)
+	}
+	if a.expired(policy, now) || a.Failures < policy.FreeAttempts {
+		return 0
+	}
+	next := a.LastFailureAt.Add(policy.delay(a.Failures))
+	if now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// RecordFailure counts a failed attempt. It returns true if the key got locked by it.
+func (a *LoginAttempt) RecordFailure(policy AttemptPolicy, now time.Time) bool {
+	if a.expired(policy, now) || (a.LockedUntil != nil && !now.Before(*a.LockedUntil)) {
+		a.Failures = 0
+		a.LockedUntil = nil
+	}
+	a.Failures++
+	a.LastFailureAt = now
+	if a.Failures >= policy.MaxAttempts && a.LockedUntil == nil {
+		lockedUntil := now.Add(policy.LockoutDuration)
+		a.LockedUntil = &lockedUntil
+		return true
+	}
+	return false
+}
+
+// Reserve counts an attempt before it's made, so concurrent attempts can't all pass the check before any of them fails.
+// It returns a TooManyAttemptsError if the key is throttled or locked, otherwise true if the reserved attempt locked the key.
+func (a *LoginAttempt) Reserve(policy AttemptPolicy, now time.Time) (bool, error) {
+	retryAfter := a.RetryAfter(policy, now)
+	if retryAfter > 0 {
+		return false, &TooManyAttemptsError{RetryAfter: retryAfter}
+	}
+	return a.RecordFailure(policy, now), nil
+}
+
+// IsLocked returns true if the key is locked at the given time
+func (a *LoginAttempt) IsLocked(now time.Time) bool {
+	return a.LockedUntil != nil && now.Before(*a.LockedUntil)
+}
+
+// Reset clears the failures and lock of the key
+func (a *LoginAttempt) Reset() {
+	a.Failures = 0
+	a.LockedUntil = nil
+}
+
+func (a *LoginAttempt) expired(policy AttemptPolicy, now time.Time) bool {
+	return now.Sub(a.LastFailureAt) > policy.Window
+}
+
+func (policy AttemptPolicy) delay(failures int) time.Duration {
+	throttled := failures - policy.FreeAttempts
+	if throttled < 0 {
+		return 0
+	}
+	if throttled > 16 {
+		throttled = 16
+	}
+	delay := policy.BaseDelay * time.Duration(1<<uint(throttled))
+	if delay > policy.LockoutDuration {
+		return policy.LockoutDuration
+	}
+	return delay
+}
+
+// AccountAttemptKey returns the attempt key of the given account for the given action
+func AccountAttemptKey(action string, account string) string {
+	return fmt.Sprintf("%s:account:%s", action, account)
+}
+
+// ClientAttemptKey returns the attempt key of the given client IP for the given action
+func ClientAttemptKey(action string, ip string) string {
+	return fmt.Sprintf("%s:ip:%s", action, ip)
+}
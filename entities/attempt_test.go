@@ -0,0 +1,101 @@
+package entities
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginAttemptThrottling(t *testing.T) {
+	now := time.Now()
+	a := LoginAttempt{}
+	for i := 0; i < VerificationAttemptPolicy.FreeAttempts-1; i++ {
+		a.RecordFailure(VerificationAttemptPolicy, now)
+	}
+	if a.RetryAfter(VerificationAttemptPolicy, now) != 0 {
+		t.Error("free attempts should not be delayed")
+	}
+	a.RecordFailure(VerificationAttemptPolicy, now)
+	first := a.RetryAfter(VerificationAttemptPolicy, now)
+	if first <= 0 {
+		t.Error("attempts after the free ones should be delayed")
+	}
+	a.RecordFailure(VerificationAttemptPolicy, now)
+	if a.RetryAfter(VerificationAttemptPolicy, now) <= first {
+		t.Error("delay should grow with every failure")
+	}
+	if a.RetryAfter(VerificationAttemptPolicy, now.Add(time.Minute)) != 0 {
+		t.Error("delay should pass")
+	}
+}
+
+func TestLoginAttemptLockout(t *testing.T) {
+	now := time.Now()
+	a := LoginAttempt{}
+	locked := false
+	for i := 0; i < LoginAttemptPolicy.MaxAttempts; i++ {
+		locked = a.RecordFailure(LoginAttemptPolicy, now)
+	}
+	if !locked || !a.IsLocked(now) {
+		t.Fatal("key should be locked after max attempts")
+	}
+	if a.RetryAfter(LoginAttemptPolicy, now) != LoginAttemptPolicy.LockoutDuration {
+		t.Fail()
+	}
+	after := now.Add(LoginAttemptPolicy.LockoutDuration + time.Second)
+	if a.IsLocked(after) {
+		t.Fail()
+	}
+	a.RecordFailure(LoginAttemptPolicy, after)
+	if a.Failures != 1 {
+		t.Error("failures should start over after the lockout")
+	}
+}
+
+func TestLoginAttemptWindow(t *testing.T) {
+	now := time.Now()
+	a := LoginAttempt{}
+	for i := 0; i < LoginAttemptPolicy.FreeAttempts+2; i++ {
+		a.RecordFailure(LoginAttemptPolicy, now)
+	}
+	later := now.Add(LoginAttemptPolicy.Window + time.Minute)
+	if a.RetryAfter(LoginAttemptPolicy, later) != 0 {
+		t.Fail()
+	}
+	a.RecordFailure(LoginAttemptPolicy, later)
+	if a.Failures != 1 {
+		t.Fail()
+	}
+}
+
+func TestLoginAttemptReserve(t *testing.T) {
+	now := time.Now()
+	a := LoginAttempt{}
+	for i := 0; i < VerificationAttemptPolicy.FreeAttempts; i++ {
+		_, err := a.Reserve(VerificationAttemptPolicy, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := a.Reserve(VerificationAttemptPolicy, now)
+	if _, ok := err.(*TooManyAttemptsError); !ok {
+		t.Fatalf("attempts made at once should only get the free ones, got %v", err)
+	}
+	if a.Failures != VerificationAttemptPolicy.FreeAttempts {
+		t.Errorf("a rejected attempt should not be counted, got %d failures", a.Failures)
+	}
+	locked := false
+	for !locked {
+		now = now.Add(VerificationAttemptPolicy.LockoutDuration)
+		locked, err = a.Reserve(VerificationAttemptPolicy, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.Failures != VerificationAttemptPolicy.MaxAttempts {
+		t.Errorf("expected the key to be locked by attempt %d, got %d", VerificationAttemptPolicy.MaxAttempts, a.Failures)
+	}
+	_, err = a.Reserve(VerificationAttemptPolicy, now)
+	if _, ok := err.(*TooManyAttemptsError); !ok {
+		t.Errorf("a locked key should not get more attempts, got %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package entities
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// Audit actions
+const (
+	AuditLoginFailed        = "login.failed"
+	AuditLoginLocked        = "login.locked"
+	AuditVerificationFailed = "verification.failed"
+	AuditVerificationLocked = "verification.locked"
+	AuditUnlocked           = "account.unlocked"
+	AuditEmailVerified      = "contact.email.verified"
+	AuditEmailChanged       = "contact.email.changed"
+	AuditMobileChanged      = "contact.mobile.changed"
+	AuditTwoFactorEnabled   = "2fa.enabled"
+	AuditTwoFactorDisabled  = "2fa.disabled"
+	AuditTwoFactorFailed    = "2fa.failed"
+	AuditTwoFactorLocked    = "2fa.locked"
+	AuditRecoveryCodeUsed   = "2fa.recovery_code_used"
+	AuditCashierCreated     = "cashier.created"
+	AuditCashierUpdated     = "cashier.updated"
+	AuditCashierDeleted     = "cashier.deleted"
+	AuditAPIKeyCreated      = "apikey.created"
+	AuditAPIKeyRevoked      = "apikey.revoked"
+)
+
+// AuditEntry records a security relevant event
+type AuditEntry struct {
+	gorm.Model
+	Action    string `gorm:"index;not null" json:"action"`
+	UserID    uint   `gorm:"index" json:"userID"`
+	ActorID   uint   `json:"actorID"`
+	IPAddress string `json:"ipAddress"`
+	Detail    string `json:"detail"`
+}
@@ -0,0 +1,74 @@
+package entities
+
+import (
+	"github.com/pkg/errors"
+)
+
+// AccountTypeCashier is the account type of the staff of a partner.
+// Cashiers can only scan offers on behalf of their partner.
+const AccountTypeCashier = "cashier"
+
+// IsCashier returns true if the user is a staff account of a partner
+func (user *User) IsCashier() bool {
+	return user.AccountType == AccountTypeCashier
+}
+
+// AssignCashier makes the user a cashier of the given partner.
+// The branch is optional and has to belong to the partner.
+func (user *User) AssignCashier(partner *User, branch *Branch) error {
+	if !partner.IsPartner() || !partner.Can(PermissionManageCashiers) {
+		return ErrForbidden
+	}
+	if user.ID != 0 && user.PartnerID != partner.ID {
+		return ErrForbidden
+	}
+	var branchID uint
+	if branch != nil {
+		if branch.OwnerID != partner.ID {
+			return errors.New("branch does not belong to the partner")
+		}
+		branchID = branch.ID
+	}
+	user.AccountType = AccountTypeCashier
+	user.Role = RoleCashier
+	user.PartnerID = partner.ID
+	user.BranchID = branchID
+	user.Country = partner.Country
+	user.CityID = partner.CityID
+	return nil
+}
+
+// CanManageCashier returns true if the user is the partner the given cashier works for
+func (user *User) CanManageCashier(cashier *User) bool {
+	return cashier.IsCashier() && cashier.PartnerID == user.ID && user.Can(PermissionManageCashiers)
+}
+
+// ScanningPartnerID returns the ID of the partner the offers scanned by the user are given by.
+// It returns 0 if the user can't scan offers.
+func (user *User) ScanningPartnerID() uint {
+	if !user.Can(PermissionScanOffers) {
+		return 0
+	}
+	if user.IsCashier() {
+		return user.PartnerID
+	}
+	return user.ID
+}
+
+// CanView returns true if the given user can see the offer and its customer.
+// That's the customer of the offer, the partner who consumed it or one of their cashiers, or staff with the permission to view offers.
+func (offer *Offer) CanView(viewer *User) bool {
+	if viewer.Can(PermissionViewOffers) || viewer.ID == offer.CustomerID {
+		return true
+	}
+	partnerID := viewer.ScanningPartnerID()
+	return partnerID != 0 && partnerID == offer.PartnerID
+}
+
+// SetScanner records the cashier who scanned the offer and the branch it was given at
+func (offer *Offer) SetScanner(scanner *User) {
+	if scanner.IsCashier() {
+		offer.CashierID = scanner.ID
+		offer.BranchID = scanner.BranchID
+	}
+}
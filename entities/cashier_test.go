@@ -0,0 +1,121 @@
+package entities
+
+import "testing"
+
+func TestAssignCashier(t *testing.T) {
+	partner := &User{AccountType: "partner", Role: RolePartner, Country: "turkey", CityID: 3}
+	partner.ID = 1
+	other := &User{AccountType: "partner", Role: RolePartner}
+	other.ID = 2
+	branch := &Branch{OwnerID: partner.ID}
+	branch.ID = 10
+	t.Run("ByPartner", func(t *testing.T) {
+		cashier := &User{}
+		err := cashier.AssignCashier(partner, branch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cashier.IsCashier() || cashier.GetRole() != RoleCashier || cashier.PartnerID != partner.ID || cashier.BranchID != branch.ID {
+			t.Errorf("unexpected cashier %+v", cashier)
+		}
+		if cashier.CityID != partner.CityID || cashier.Country != partner.Country {
+			t.Fail()
+		}
+	})
+	t.Run("ByCustomer", func(t *testing.T) {
+		customer := &User{AccountType: "user", Role: RoleCustomer}
+		customer.ID = 3
+		err := (&User{}).AssignCashier(customer, nil)
+		if err != ErrForbidden {
+			t.Errorf("expected ErrForbidden, got %v", err)
+		}
+	})
+	t.Run("BranchOfAnotherPartner", func(t *testing.T) {
+		err := (&User{}).AssignCashier(other, branch)
+		if err == nil {
+			t.Fail()
+		}
+	})
+	t.Run("CashierOfAnotherPartner", func(t *testing.T) {
+		cashier := &User{}
+		err := cashier.AssignCashier(partner, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cashier.ID = 4
+		err = cashier.AssignCashier(other, nil)
+		if err != ErrForbidden || cashier.PartnerID != partner.ID {
+			t.Fail()
+		}
+		if other.CanManageCashier(cashier) || !partner.CanManageCashier(cashier) {
+			t.Fail()
+		}
+	})
+}
+
+func TestScanningPartnerID(t *testing.T) {
+	partner := &User{AccountType: "partner", Role: RolePartner}
+	partner.ID = 1
+	cashier := &User{}
+	err := cashier.AssignCashier(partner, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cashier.ID = 2
+	customer := &User{AccountType: "user", Role: RoleCustomer}
+	customer.ID = 3
+	if partner.ScanningPartnerID() != partner.ID || cashier.ScanningPartnerID() != partner.ID || customer.ScanningPartnerID() != 0 {
+		t.Fail()
+	}
+	if cashier.Can(PermissionManageCashiers) || cashier.GetRole().IsStaff() {
+		t.Error("cashiers can only scan offers")
+	}
+	offer := &Offer{}
+	offer.SetScanner(partner)
+	if offer.CashierID != 0 {
+		t.Fail()
+	}
+	cashier.BranchID = 10
+	offer.SetScanner(cashier)
+	if offer.CashierID != cashier.ID || offer.BranchID != 10 {
+		t.Fail()
+	}
+}
+
+func TestCanViewOffer(t *testing.T) {
+	offer := &Offer{CustomerID: 4, PartnerID: 2}
+	customer := &User{AccountType: "customer", Role: RoleCustomer}
+	customer.ID = 4
+	otherCustomer := &User{AccountType: "customer", Role: RoleCustomer}
+	otherCustomer.ID = 6
+	partner := &User{AccountType: "partner", Role: RolePartner}
+	partner.ID = 2
+	cashier := &User{AccountType: AccountTypeCashier, Role: RoleCashier, PartnerID: 2}
+	cashier.ID = 5
+	otherPartner := &User{AccountType: "partner", Role: RolePartner}
+	otherPartner.ID = 3
+	otherCashier := &User{AccountType: AccountTypeCashier, Role: RoleCashier, PartnerID: 3}
+	otherCashier.ID = 7
+	support := &User{AccountType: "admin", Role: RoleSupport}
+	support.ID = 1
+	tests := []struct {
+		name   string
+		viewer *User
+		can    bool
+	}{
+		{"Customer", customer, true},
+		{"OtherCustomer", otherCustomer, false},
+		{"Partner", partner, true},
+		{"Cashier", cashier, true},
+		{"OtherPartner", otherPartner, false},
+		{"OtherCashier", otherCashier, false},
+		{"Staff", support, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if can := offer.CanView(test.viewer); can != test.can {
+				t.Errorf("expected %t, got %t", test.can, can)
+			}
+		})
+	}
+}
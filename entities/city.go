@@ -21,7 +21,7 @@ type City struct {
 
 // SetEnglishName sets the english name property
 func (c *City) SetEnglishName(currentUser IUser, name string) error {
-	if !currentUser.IsAdmin() {
+	if !currentUser.Can(PermissionManageCatalog) {
 		return errors.New("not authorized")
 	}
 	c.EnglishName = name
@@ -30,7 +30,7 @@ func (c *City) SetEnglishName(currentUser IUser, name string) error {
 
 // SetTurkishName sets the turkish name property
 func (c *City) SetTurkishName(currentUser IUser, name string) error {
-	if !currentUser.IsAdmin() {
+	if !currentUser.Can(PermissionManageCatalog) {
 		return errors.New("not authorized")
 	}
 	c.TurkishName = name
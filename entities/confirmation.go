@@ -0,0 +1,86 @@
+package entities
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Statuses of offers waiting for the confirmation of the customer, and of the ones that never got it
+const (
+	OfferPending  = "pending"
+	OfferRejected = "rejected"
+	OfferExpired  = "expired"
+)
+
+// DefaultConfirmationWindow is how long customers have to answer a pending offer when OFFER_CONFIRMATION_WINDOW isn't set
+const DefaultConfirmationWindow = 2 * time.Minute
+
+// ErrOfferNotPending is returned when answering an offer that has been answered or has expired
+var ErrOfferNotPending = errors.New("offer is no longer waiting for confirmation")
+
+// ConfirmationWindow returns how long customers have to answer a pending offer before it expires.
+// It's read from the OFFER_CONFIRMATION_WINDOW env variable as a duration, e.g. "2m".
+func ConfirmationWindow() (time.Duration, error) {
+	value := os.Getenv("OFFER_CONFIRMATION_WINDOW")
+	if value == "" {
+		return DefaultConfirmationWindow, nil
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		return 0, errors.Errorf("invalid OFFER_CONFIRMATION_WINDOW %q", value)
+	}
+	return window, nil
+}
+
+// RequireConfirmation makes the offer wait for the customer to accept it within the given window before it's consumed
+func (o *Offer) RequireConfirmation(now time.Time, window time.Duration) {
+	confirmBy := now.Add(window)
+	o.Status = OfferPending
+	o.ConfirmBy = &confirmBy
+}
+
+// IsPending returns true if the offer is waiting for the confirmation of the customer
+func (o *Offer) IsPending() bool {
+	return o.Status == OfferPending
+}
+
+// HasConfirmationExpired returns true if the customer can no longer answer the pending offer
+func (o *Offer) HasConfirmationExpired(now time.Time) bool {
+	return o.ConfirmBy != nil && now.After(*o.ConfirmBy)
+}
+
+// Answer records the answer of the customer to the pending offer.
+// An accepted offer is consumed, and a rejected one is never debited.
+func (o *Offer) Answer(customer *User, accepted bool, now time.Time) error {
+	if customer.ID != o.CustomerID {
+		return ErrForbidden
+	}
+	if !o.IsPending() || o.HasConfirmationExpired(now) {
+		return ErrOfferNotPending
+	}
+	if accepted {
+		o.Status = OfferConsumed
+	} else {
+		o.Status = OfferRejected
+	}
+	return nil
+}
+
+// Expire closes the pending offer after the customer didn't answer it in time
+func (o *Offer) Expire(now time.Time) error {
+	if !o.IsPending() || !o.HasConfirmationExpired(now) {
+		return ErrOfferNotPending
+	}
+	o.Status = OfferExpired
+	return nil
+}
+
+// ScannerID returns the ID of the cashier who scanned the offer, or else the partner
+func (o *Offer) ScannerID() uint {
+	if o.CashierID != 0 {
+		return o.CashierID
+	}
+	return o.PartnerID
+}
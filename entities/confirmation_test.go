@@ -0,0 +1,72 @@
+package entities
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnswerOffer(t *testing.T) {
+	now := time.Now()
+	customer := &User{AccountType: "user", Role: RoleCustomer}
+	customer.ID = 4
+	otherCustomer := &User{AccountType: "user", Role: RoleCustomer}
+	otherCustomer.ID = 5
+	newPendingOffer := func() *Offer {
+		offer := &Offer{CustomerID: 4, PartnerID: 2}
+		offer.RequireConfirmation(now, DefaultConfirmationWindow)
+		return offer
+	}
+	t.Run("Accepted", func(t *testing.T) {
+		offer := newPendingOffer()
+		if !offer.IsPending() || offer.ConfirmBy == nil {
+			t.Fatalf("expected the offer to be pending, got %+v", offer)
+		}
+		if err := offer.Answer(customer, true, now.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if offer.Status != OfferConsumed {
+			t.Errorf("expected the offer to be consumed, got %s", offer.Status)
+		}
+		if err := offer.Answer(customer, false, now.Add(time.Minute)); err != ErrOfferNotPending {
+			t.Errorf("expected ErrOfferNotPending, got %v", err)
+		}
+	})
+	t.Run("Rejected", func(t *testing.T) {
+		offer := newPendingOffer()
+		if err := offer.Answer(customer, false, now); err != nil {
+			t.Fatal(err)
+		}
+		if offer.Status != OfferRejected {
+			t.Errorf("expected the offer to be rejected, got %s", offer.Status)
+		}
+	})
+	t.Run("ByAnotherCustomer", func(t *testing.T) {
+		offer := newPendingOffer()
+		if err := offer.Answer(otherCustomer, true, now); err != ErrForbidden {
+			t.Errorf("expected ErrForbidden, got %v", err)
+		}
+	})
+	t.Run("Expired", func(t *testing.T) {
+		offer := newPendingOffer()
+		later := now.Add(DefaultConfirmationWindow + time.Second)
+		if err := offer.Answer(customer, true, later); err != ErrOfferNotPending {
+			t.Errorf("expected ErrOfferNotPending, got %v", err)
+		}
+		if err := offer.Expire(now); err != ErrOfferNotPending {
+			t.Errorf("expected the offer not to expire within the window, got %v", err)
+		}
+		if err := offer.Expire(later); err != nil {
+			t.Fatal(err)
+		}
+		if offer.Status != OfferExpired {
+			t.Errorf("expected the offer to be expired, got %s", offer.Status)
+		}
+	})
+	t.Run("PendingCantBeVoided", func(t *testing.T) {
+		offer := newPendingOffer()
+		admin := &User{AccountType: "admin", Role: RoleSuperAdmin}
+		if err := offer.Void(admin, "Wrong amount", now, DefaultVoidWindow); err == nil {
+			t.Error("expected a pending offer not to be voided")
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package entities
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Contact kinds
+const (
+	ContactEmail  = "email"
+	ContactMobile = "mobile"
+)
+
+// ContactCodeLifetime is how long a contact verification code stays valid
+const ContactCodeLifetime = 30 * time.Minute
+
+// ContactChange is a pending verification of an email address or a mobile number.
+//
+// The contact details of the user are only replaced by NewValue once the code sent
+// to it is confirmed, so the old value stays in use until then.
+type ContactChange struct {
+	gorm.Model
+	UserID      uint       `gorm:"index;not null" json:"userID"`
+	Kind        string     `gorm:"not null" json:"kind"`
+	NewValue    string     `gorm:"not null" json:"newValue"`
+	OldValue    string     `json:"-"`
+	HashedCode  []byte     `json:"-"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	ConfirmedAt *time.Time `json:"confirmedAt"`
+}
+
+// NewContactChange returns a pending change of the given kind of contact of the user
+func NewContactChange(user *User, kind string, newValue string, hashedCode []byte) (*ContactChange, error) {
+	change := &ContactChange{
+		UserID:     user.ID,
+		Kind:       kind,
+		NewValue:   newValue,
+		HashedCode: hashedCode,
+		ExpiresAt:  time.Now().Add(ContactCodeLifetime),
+	}
+	switch kind {
+	case ContactEmail:
+		change.OldValue = user.Email
+	case ContactMobile:
+		change.OldValue = user.Mobile
+	default:
+		return nil, errors.New("unknown contact kind")
+	}
+	return change, nil
+}
+
+// Expired returns true if the code of the change is no longer valid
+func (c *ContactChange) Expired() bool {
+	return time.Now().After(c.ExpiresAt)
+}
+
+// IsConfirmed returns true if the code of the change has been confirmed
+func (c *ContactChange) IsConfirmed() bool {
+	return c.ConfirmedAt != nil
+}
+
+// IsVerification returns true if the change verifies the current value instead of replacing it
+func (c *ContactChange) IsVerification() bool {
+	return c.NewValue == c.OldValue
+}
+
+// Confirm checks the given code and applies the change to the user
+func (c *ContactChange) Confirm(user *User, code string) error {
+	if c.UserID != user.ID {
+		return errors.New("contact change doesn't belong to the user")
+	}
+	if c.IsConfirmed() {
+		return errors.New("contact change is already confirmed")
+	}
+	if c.Expired() {
+		return errors.New("verification code has expired, please request a new one")
+	}
+	if !HashMatch(c.HashedCode, code) {
+		return errors.New("verification code doesn't match")
+	}
+	switch c.Kind {
+	case ContactEmail:
+		user.Email = c.NewValue
+		user.EmailVerified = true
+	case ContactMobile:
+		user.Mobile = c.NewValue
+		user.Verified = true
+	}
+	now := time.Now()
+	c.ConfirmedAt = &now
+	return nil
+}
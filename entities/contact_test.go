@@ -0,0 +1,86 @@
+package entities
+
+import (
+	"testing"
+	"time"
+)
+
+func TestContactChange(t *testing.T) {
+	hash, err := EncryptPassword("123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newChange := func(user *User, kind string, value string) *ContactChange {
+		change, err := NewContactChange(user, kind, value, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return change
+	}
+	t.Run("ChangeEmail", func(t *testing.T) {
+		user := &User{Email: "old@example.com"}
+		change := newChange(user, ContactEmail, "new@example.com")
+		if change.OldValue != "old@example.com" || change.IsVerification() {
+			t.Error(change)
+		}
+		err := change.Confirm(user, "000000")
+		if err == nil || user.Email != "old@example.com" {
+			t.Error("email should not change with a wrong code")
+		}
+		err = change.Confirm(user, "123456")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Email != "new@example.com" || !user.EmailVerified || !change.IsConfirmed() {
+			t.Error(user, change)
+		}
+		err = change.Confirm(user, "123456")
+		if err == nil {
+			t.Error("a change should only be confirmed once")
+		}
+	})
+	t.Run("VerifyEmail", func(t *testing.T) {
+		user := &User{Email: "old@example.com"}
+		change := newChange(user, ContactEmail, user.Email)
+		if !change.IsVerification() {
+			t.Fail()
+		}
+	})
+	t.Run("ChangeMobile", func(t *testing.T) {
+		user := &User{Mobile: "+905551112233"}
+		change := newChange(user, ContactMobile, "+905554445566")
+		err := change.Confirm(user, "123456")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Mobile != "+905554445566" || !user.Verified {
+			t.Error(user)
+		}
+	})
+	t.Run("Expired", func(t *testing.T) {
+		user := &User{Email: "old@example.com"}
+		change := newChange(user, ContactEmail, "new@example.com")
+		change.ExpiresAt = time.Now().Add(-time.Minute)
+		err := change.Confirm(user, "123456")
+		if err == nil || user.Email != "old@example.com" {
+			t.Error("expired changes should not be confirmed")
+		}
+	})
+	t.Run("OtherUser", func(t *testing.T) {
+		user := &User{Email: "old@example.com"}
+		user.ID = 1
+		change := newChange(user, ContactEmail, "new@example.com")
+		other := &User{Email: "other@example.com"}
+		other.ID = 2
+		err := change.Confirm(other, "123456")
+		if err == nil || other.Email != "other@example.com" {
+			t.Error("changes should only be confirmed by their user")
+		}
+	})
+	t.Run("UnknownKind", func(t *testing.T) {
+		_, err := NewContactChange(&User{}, "fax", "123", hash)
+		if err == nil {
+			t.Fail()
+		}
+	})
+}
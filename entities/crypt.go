@@ -1,17 +1,18 @@
 package entities
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"golang.org/x/crypto/bcrypt"
-	"os"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	log "github.com/sirupsen/logrus"
 )
 
-var jwtKey []byte
-
 // EncryptPassword returns the hash of the given password
 func EncryptPassword(password string) ([]byte, error) {
 	hpass, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -41,46 +42,75 @@ func (otp *OTP) VerifyPassword(code string) bool {
 	return bcrypt.CompareHashAndPassword(otp.HashedPassword, []byte(code)) == nil
 }
 
+// AccessTokenLifetime is how long an access token is valid for
+const AccessTokenLifetime = 15 * time.Minute
+
+// RefreshTokenLifetime is how long a refresh token is valid for
+const RefreshTokenLifetime = 30 * 24 * time.Hour
+
 // Claims defines a Clames struct for the id value
 type Claims struct {
-	ID uint `json:"id"`
+	ID        uint `json:"id"`
+	SessionID uint `json:"sid"`
 	jwt.StandardClaims
 }
 
 // GenerateAuthToken generates a login token with jwt
-// The login token expires in 7 days.
-// The token is the encrypted value of user ID.
-func GenerateAuthToken(id uint) (string, error) {
-	jwtKey = []byte(os.Getenv("JWT_SECRET_KEY"))
-
-	expirationTime := time.Now().Add(7 * 24 * 60 * time.Minute)
+// The login token expires after AccessTokenLifetime and is bound to the given session.
+// The token is signed with the active key of the current keyring.
+func GenerateAuthToken(id uint, sessionID uint) (string, error) {
+	expirationTime := time.Now().Add(AccessTokenLifetime)
 	claim := &Claims{
-		ID: id,
+		ID:        id,
+		SessionID: sessionID,
 		StandardClaims: jwt.StandardClaims{
 			// In JWT, the expiry time is expressed as unix milliseconds
 			ExpiresAt: expirationTime.Unix(),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claim)
-	tokenString, err := token.SignedString(jwtKey)
+	tokenString, err := CurrentKeyring().Sign(claim)
 	if err != nil {
 		return "", err
 	}
 	return tokenString, nil
 }
 
-// ParseToken gets the user ID out the token
-func ParseToken(tokenString string) (uint, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("JWT_SECRET_KEY")), nil
-	})
+// ParseAuthToken validates the given token and returns its claims
+func ParseAuthToken(tokenString string) (*Claims, error) {
+	token, err := CurrentKeyring().Parse(tokenString, &Claims{})
 	if err != nil {
 		log.Error(err)
-		return 0, err
+		return nil, err
 	}
 	claims, ok := token.Claims.(*Claims)
 	if !ok {
-		return 0, errors.New("could not retrieve id from token")
+		return nil, errors.New("could not retrieve id from token")
+	}
+	return claims, nil
+}
+
+// ParseToken gets the user ID out the token
+func ParseToken(tokenString string) (uint, error) {
+	claims, err := ParseAuthToken(tokenString)
+	if err != nil {
+		return 0, err
 	}
 	return claims.ID, nil
 }
+
+// GenerateRefreshToken returns a random opaque refresh token
+func GenerateRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashRefreshToken returns the value of the refresh token stored in the database.
+// Refresh tokens are random so a fast hash is enough, and it allows looking the session up by it.
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
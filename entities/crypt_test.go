@@ -32,3 +32,41 @@ func TestVerifyPassword(t *testing.T) {
 		}
 	})
 }
+
+func TestAuthTokenCarriesSession(t *testing.T) {
+	token, err := GenerateAuthToken(7, 42)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	claims, err := ParseAuthToken(token)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if claims.ID != 7 || claims.SessionID != 42 {
+		t.Fail()
+	}
+}
+
+func TestRefreshTokenHash(t *testing.T) {
+	token, err := GenerateRefreshToken()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	other, err := GenerateRefreshToken()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if token == other {
+		t.Fail()
+	}
+	if HashRefreshToken(token) != HashRefreshToken(token) {
+		t.Fail()
+	}
+	if HashRefreshToken(token) == HashRefreshToken(other) {
+		t.Fail()
+	}
+}
@@ -5,6 +5,12 @@ import (
 	"time"
 )
 
+// ErrNoRemainingOffers is returned when the customer has used all the offers of their subscription with a partner
+var ErrNoRemainingOffers = errors.New("customer doesn't have remaining offers left")
+
+// ErrSubscriptionEnded is returned when the customer consumes an offer with a subscription that has expired or been cancelled
+var ErrSubscriptionEnded = errors.New("subscription has expired, please renew or upgrade your subscription")
+
 // ICustomer represents a customer interface
 type ICustomer interface {
 	SetDateOfBirth(newDob time.Time, currentUser IUser) error
@@ -85,7 +91,7 @@ func (c *Customer) SubstractRemainingOffers(amount uint) error {
 		return errors.New("expired subscription")
 	}
 	if !c.Subscription.HasRemainingOffers() {
-		return errors.New("customer doesn't have remaining offers left")
+		return ErrNoRemainingOffers
 	}
 	c.Subscription.SubstractRemainingOffers(amount)
 	return nil
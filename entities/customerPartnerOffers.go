@@ -4,7 +4,8 @@ import (
 	"github.com/jinzhu/gorm"
 )
 
-// ICustomer represents a customer interface
+// CustomerPartnerOffersCount was the count of offers a customer had left with a partner.
+// It's replaced by the OfferLedgerEntry records and only kept to migrate existing counts.
 type CustomerPartnerOffersCount struct {
 	gorm.Model
 	CustomerID     uint
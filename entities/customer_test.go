@@ -17,3 +17,11 @@ func TestSetDateOfBirth(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestReplaceSubscription(t *testing.T) {
+	s := Subscription{ExpireDate: time.Now().AddDate(0, 1, 0)}
+	s.Replace()
+	if !s.IsExpired() || !s.ExpiryNotified {
+		t.Error("replaced subscription should be expired without an expiry notice")
+	}
+}
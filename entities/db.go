@@ -18,9 +18,14 @@ type DBConfig struct {
 	DBName   string
 }
 
+// ConnectionString returns the Postgres connection string of the DB
+func (c *DBConfig) ConnectionString() string {
+	return fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s sslmode=disable", c.Host, c.Port, c.User, c.DBName, c.Password)
+}
+
 // ConnectToDB establishes a connection with the DB
 func ConnectToDB(c *DBConfig) (*gorm.DB, error) {
-	connectStr := fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s sslmode=disable", c.Host, c.Port, c.User, c.DBName, c.Password)
+	connectStr := c.ConnectionString()
 	log.Info(connectStr)
 	db, err := gorm.Open("postgres", connectStr)
 	if err != nil {
@@ -48,9 +53,36 @@ func MigrateModels(db *gorm.DB) {
 	db.AutoMigrate(&Share{})
 	db.AutoMigrate(&PlanCategory{})
 	db.AutoMigrate(&CustomerPartnerOffersCount{})
+	db.AutoMigrate(&Session{})
+	db.AutoMigrate(&LoginAttempt{})
+	db.AutoMigrate(&AuditEntry{})
+	db.AutoMigrate(&ContactChange{})
+	db.AutoMigrate(&LoginChallenge{})
+	db.AutoMigrate(&RecoveryCode{})
+	db.AutoMigrate(&SigningKey{})
+	db.AutoMigrate(&APIKey{})
+	db.AutoMigrate(&UsedRedemptionToken{})
+	db.AutoMigrate(&UsedIdempotencyKey{})
+	db.AutoMigrate(&OfferLedgerEntry{})
+	db.AutoMigrate(&InboxMessage{})
+	db.AutoMigrate(&StreamTicket{})
+	db.AutoMigrate(&Payment{})
+	err := MigrateIdempotencyKeys(db)
+	if err != nil {
+		log.Error(err)
+	}
+	backfillRoles(db)
+	backfillOfferLedger(db)
 	Seed(db)
 }
 
+// backfillRoles gives a role to the users created before roles were introduced
+func backfillRoles(db *gorm.DB) {
+	db.Model(&User{}).Where("(role IS NULL OR role = '') AND account_type = ?", "admin").Update("role", RoleSuperAdmin)
+	db.Model(&User{}).Where("(role IS NULL OR role = '') AND account_type = ?", "partner").Update("role", RolePartner)
+	db.Model(&User{}).Where("role IS NULL OR role = ''").Update("role", RoleCustomer)
+}
+
 // Seed seeds the database with basic admin records
 func Seed(db *gorm.DB) {
 	istanbul := &City{
@@ -67,6 +99,7 @@ func Seed(db *gorm.DB) {
 		Verified:        true,
 		Mobile:          "1234567899",
 		AccountType:     "admin",
+		Role:            RoleSuperAdmin,
 		Country:         "turkey",
 		CityID:          istanbul.ID,
 		DateOfBirth:     time.Now(),
@@ -0,0 +1,98 @@
+package entities
+
+import (
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// IdempotencyKeyKey is the context key for the Idempotency-Key header of the request
+const IdempotencyKeyKey key = "IdempotencyKey"
+
+// DefaultIdempotencyWindow is how long an idempotency key is remembered when OFFER_IDEMPOTENCY_WINDOW isn't set
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// maxIdempotencyKeyLength is the length of the offers idempotency_key column
+const maxIdempotencyKeyLength = 255
+
+// Idempotency key errors
+var (
+	ErrInvalidIdempotencyKey = errors.New("Idempotency-Key must be at most 255 printable characters")
+	ErrIdempotencyKeyReused  = errors.New("Idempotency-Key has already been used for a different offer")
+	ErrIdempotencyKeyUsed    = errors.New("Idempotency-Key has already been used by another request")
+)
+
+// IdempotencyWindow returns how long the idempotency key of a consumed offer is remembered.
+// It's read from the OFFER_IDEMPOTENCY_WINDOW env variable as a duration, e.g. "24h".
+func IdempotencyWindow() (time.Duration, error) {
+	value := os.Getenv("OFFER_IDEMPOTENCY_WINDOW")
+	if value == "" {
+		return DefaultIdempotencyWindow, nil
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		return 0, errors.Errorf("invalid OFFER_IDEMPOTENCY_WINDOW %q", value)
+	}
+	return window, nil
+}
+
+// UsedIdempotencyKey records the request a partner consumed an offer with under an idempotency key,
+// so retries of the same request get the same offer until the key expires.
+type UsedIdempotencyKey struct {
+	gorm.Model
+	PartnerID       uint      `gorm:"unique_index:uix_used_idempotency_keys_partner_key;not null"`
+	Key             string    `gorm:"unique_index:uix_used_idempotency_keys_partner_key;not null"`
+	OfferID         uint      `gorm:"index"`
+	CustomerID      uint      `gorm:"not null"`
+	RedemptionNonce string    `gorm:"not null"`
+	Amount          float64   `gorm:"not null"`
+	ExpiresAt       time.Time `gorm:"index"`
+}
+
+// NewUsedIdempotencyKey returns the record of a request consuming an offer of the given partner with the given redemption token
+// and amount under the given idempotency key. The key is remembered until the given time.
+func NewUsedIdempotencyKey(partnerID uint, key string, claims *RedemptionClaims, amount float64, expiresAt time.Time) *UsedIdempotencyKey {
+	return &UsedIdempotencyKey{
+		PartnerID:       partnerID,
+		Key:             key,
+		CustomerID:      claims.CustomerID,
+		RedemptionNonce: claims.Nonce,
+		Amount:          amount,
+		ExpiresAt:       expiresAt,
+	}
+}
+
+// MigrateIdempotencyKeys drops the unique index idempotency keys used to have on offers.
+// Keys are unique in the used idempotency keys table instead, where they can expire without changing the offers.
+func MigrateIdempotencyKeys(db *gorm.DB) error {
+	dbt := db.Exec("DROP INDEX IF EXISTS uix_offers_partner_idempotency_key")
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error dropping offers idempotency key index")
+	}
+	return nil
+}
+
+// ValidateIdempotencyKey returns an error if the given key can't be stored with an offer
+func ValidateIdempotencyKey(key string) error {
+	if len(key) > maxIdempotencyKeyLength {
+		return ErrInvalidIdempotencyKey
+	}
+	for _, r := range key {
+		if r < 0x20 || r > 0x7e {
+			return ErrInvalidIdempotencyKey
+		}
+	}
+	return nil
+}
+
+// IsRetryOf returns nil if the key was used by a request the same as the given one being retried with it.
+// Reusing the key for a different partner, customer, redemption token or amount is a conflict rather than a retry.
+func (k *UsedIdempotencyKey) IsRetryOf(request *UsedIdempotencyKey) error {
+	if k.PartnerID != request.PartnerID || k.CustomerID != request.CustomerID ||
+		k.RedemptionNonce != request.RedemptionNonce || k.Amount != request.Amount {
+		return ErrIdempotencyKeyReused
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package entities
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyWindow(t *testing.T) {
+	previous := os.Getenv("OFFER_IDEMPOTENCY_WINDOW")
+	defer os.Setenv("OFFER_IDEMPOTENCY_WINDOW", previous)
+	cases := []struct {
+		value  string
+		window time.Duration
+		valid  bool
+	}{
+		{"", DefaultIdempotencyWindow, true},
+		{"30m", 30 * time.Minute, true},
+		{"48h", 48 * time.Hour, true},
+		{"0s", 0, false},
+		{"-1h", 0, false},
+		{"a day", 0, false},
+	}
+	for _, c := range cases {
+		os.Setenv("OFFER_IDEMPOTENCY_WINDOW", c.value)
+		window, err := IdempotencyWindow()
+		if (err == nil) != c.valid || window != c.window {
+			t.Errorf("%q: expected %v, got %v, %v", c.value, c.window, window, err)
+		}
+	}
+}
+
+func TestValidateIdempotencyKey(t *testing.T) {
+	valid := []string{"", "3f2b9c1e-8d4a-4b6f-9e0a-1c2d3e4f5a6b", strings.Repeat("a", 255)}
+	for _, key := range valid {
+		if err := ValidateIdempotencyKey(key); err != nil {
+			t.Errorf("expected %q to be valid, got %v", key, err)
+		}
+	}
+	invalid := []string{strings.Repeat("a", 256), "key\n", "clé"}
+	for _, key := range invalid {
+		if err := ValidateIdempotencyKey(key); err != ErrInvalidIdempotencyKey {
+			t.Errorf("expected %q to be invalid, got %v", key, err)
+		}
+	}
+}
+
+func TestUsedIdempotencyKeyIsRetryOf(t *testing.T) {
+	claims := &RedemptionClaims{CustomerID: 3, Nonce: "nonce"}
+	expiresAt := time.Now().Add(time.Hour)
+	key := NewUsedIdempotencyKey(1, "key", claims, 120.5, expiresAt)
+	if err := key.IsRetryOf(NewUsedIdempotencyKey(1, "key", claims, 120.5, expiresAt.Add(time.Minute))); err != nil {
+		t.Error(err)
+	}
+	for _, request := range []*UsedIdempotencyKey{
+		NewUsedIdempotencyKey(1, "key", claims, 99, expiresAt),
+		NewUsedIdempotencyKey(2, "key", claims, 120.5, expiresAt),
+		NewUsedIdempotencyKey(1, "key", &RedemptionClaims{CustomerID: 4, Nonce: "nonce"}, 120.5, expiresAt),
+		NewUsedIdempotencyKey(1, "key", &RedemptionClaims{CustomerID: 3, Nonce: "other"}, 120.5, expiresAt),
+	} {
+		if err := key.IsRetryOf(request); err != ErrIdempotencyKeyReused {
+			t.Errorf("expected ErrIdempotencyKeyReused for %+v, got %v", request, err)
+		}
+	}
+}
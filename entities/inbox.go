@@ -0,0 +1,63 @@
+package entities
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Kinds of inbox messages
+const (
+	InboxOffer        = "offer"
+	InboxOfferPrompt  = "offer_prompt"
+	InboxNotification = "notification"
+)
+
+// ErrInboxMessageNotFound is returned when acknowledging a message that isn't in the inbox of the user
+var ErrInboxMessageNotFound = errors.New("message not found")
+
+// InboxMessage is a message sent to a user over the hub.
+// Messages are kept until the user acknowledges them, so the ones sent while the user wasn't connected
+// are delivered when they connect again.
+type InboxMessage struct {
+	gorm.Model
+	UserID         uint       `gorm:"index;not null" json:"userID"`
+	Kind           string     `gorm:"not null" json:"kind"`
+	Payload        string     `gorm:"type:text" json:"payload"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty"`
+	AcknowledgedAt *time.Time `gorm:"index" json:"acknowledgedAt,omitempty"`
+}
+
+// NewOfferMessage returns a message sending the given offer to the user with the given ID.
+// Pending offers sent to their customer prompt them to answer the offer.
+func NewOfferMessage(userID uint, offer *Offer) (*InboxMessage, error) {
+	payload, err := json.Marshal(offer)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding offer message")
+	}
+	kind := InboxOffer
+	if offer.IsPending() && userID == offer.CustomerID {
+		kind = InboxOfferPrompt
+	}
+	return &InboxMessage{
+		UserID:  userID,
+		Kind:    kind,
+		Payload: string(payload),
+	}, nil
+}
+
+// NewNotificationMessage returns a message sending the given text to the user with the given ID
+func NewNotificationMessage(userID uint, text string) *InboxMessage {
+	return &InboxMessage{
+		UserID:  userID,
+		Kind:    InboxNotification,
+		Payload: text,
+	}
+}
+
+// IsDelivered returns true if the message has been sent to the user
+func (m *InboxMessage) IsDelivered() bool {
+	return m.DeliveredAt != nil
+}
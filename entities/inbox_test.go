@@ -0,0 +1,46 @@
+package entities
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNewOfferMessage(t *testing.T) {
+	offer := &Offer{CustomerID: 4, PartnerID: 2, Amount: 100, Status: OfferConsumed}
+	offer.ID = 7
+	message, err := NewOfferMessage(4, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.UserID != 4 || message.Kind != InboxOffer || message.IsDelivered() {
+		t.Errorf("unexpected message %+v", message)
+	}
+	var sent Offer
+	err = json.Unmarshal([]byte(message.Payload), &sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.ID != offer.ID || sent.Amount != offer.Amount || sent.Status != OfferConsumed {
+		t.Errorf("expected the payload to be the offer, got %+v", sent)
+	}
+}
+
+func TestNewOfferMessagePrompt(t *testing.T) {
+	offer := &Offer{CustomerID: 4, PartnerID: 2, Amount: 100, Status: OfferPending}
+	tests := []struct {
+		userID uint
+		kind   string
+	}{
+		{4, InboxOfferPrompt},
+		{2, InboxOffer},
+	}
+	for _, test := range tests {
+		message, err := NewOfferMessage(test.userID, offer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Kind != test.kind {
+			t.Errorf("expected the message sent to user %d to be %q, got %q", test.userID, test.kind, message.Kind)
+		}
+	}
+}
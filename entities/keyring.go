@@ -0,0 +1,140 @@
+package entities
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// keyringEntry is a parsed signing key
+type keyringEntry struct {
+	kid       string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// Keyring holds the key access tokens are signed with and the keys they are verified with.
+//
+// Tokens carry the ID of their key in the kid header.
+// Tokens without it were signed with the legacy JWT_SECRET_KEY, which keeps verifying them as long as it is set.
+type Keyring struct {
+	signing *keyringEntry
+	keys    map[string]*keyringEntry
+	public  []JWK
+}
+
+var (
+	keyringMu      sync.RWMutex
+	currentKeyring *Keyring
+)
+
+// NewKeyring returns the keyring of the given keys at the given time.
+// The legacy secret signs tokens until one of the keys becomes active.
+func NewKeyring(keys []SigningKey, legacySecret []byte, t time.Time) (*Keyring, error) {
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ActivatesAt.Before(keys[j].ActivatesAt)
+	})
+	k := &Keyring{
+		keys:   make(map[string]*keyringEntry),
+		public: []JWK{},
+	}
+	for i := range keys {
+		if !keys[i].IsVerifying(t) {
+			continue
+		}
+		method, signKey, verifyKey, err := keys[i].keys()
+		if err != nil {
+			return nil, err
+		}
+		entry := &keyringEntry{
+			kid:       keys[i].KID,
+			method:    method,
+			signKey:   signKey,
+			verifyKey: verifyKey,
+		}
+		k.keys[entry.kid] = entry
+		if keys[i].IsActive(t) {
+			k.signing = entry
+		}
+		if jwk, ok := newJWK(entry.kid, verifyKey); ok {
+			k.public = append(k.public, jwk)
+		}
+	}
+	if len(legacySecret) > 0 || k.signing == nil {
+		legacy := &keyringEntry{
+			method:    jwt.SigningMethodHS256,
+			signKey:   legacySecret,
+			verifyKey: legacySecret,
+		}
+		k.keys[""] = legacy
+		if k.signing == nil {
+			k.signing = legacy
+		}
+	}
+	return k, nil
+}
+
+// LegacySecret returns the JWT_SECRET_KEY tokens were signed with before signing keys were introduced
+func LegacySecret() []byte {
+	return []byte(os.Getenv("JWT_SECRET_KEY"))
+}
+
+// SetKeyring replaces the keyring used to sign and verify access tokens
+func SetKeyring(k *Keyring) {
+	keyringMu.Lock()
+	currentKeyring = k
+	keyringMu.Unlock()
+}
+
+// CurrentKeyring returns the keyring used to sign and verify access tokens.
+// It falls back to the legacy secret until a keyring is set.
+func CurrentKeyring() *Keyring {
+	keyringMu.RLock()
+	k := currentKeyring
+	keyringMu.RUnlock()
+	if k == nil {
+		k, _ = NewKeyring(nil, LegacySecret(), time.Now())
+	}
+	return k
+}
+
+// SigningKID returns the ID of the key new tokens are signed with
+func (k *Keyring) SigningKID() string {
+	return k.signing.kid
+}
+
+// Sign returns the signed token of the given claims
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.signing.method, claims)
+	if k.signing.kid != "" {
+		token.Header["kid"] = k.signing.kid
+	}
+	return token.SignedString(k.signing.signKey)
+}
+
+// Parse validates the given token with the key of its kid header and fills the given claims
+func (k *Keyring) Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		entry, ok := k.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if token.Method.Alg() != entry.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return entry.verifyKey, nil
+	})
+}
+
+// JWKS returns the public keys of the keyring. HS256 keys are never published.
+func (k *Keyring) JWKS() *JWKSet {
+	return &JWKSet{
+		Keys: k.public,
+	}
+}
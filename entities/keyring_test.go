@@ -0,0 +1,162 @@
+package entities
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func signTestToken(t *testing.T, k *Keyring) string {
+	token, err := k.Sign(&Claims{
+		ID:        7,
+		SessionID: 42,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(AccessTokenLifetime).Unix(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestKeyringAlgorithms(t *testing.T) {
+	now := time.Now()
+	for _, algorithm := range []string{SigningHS256, SigningRS256, SigningEdDSA} {
+		t.Run(algorithm, func(t *testing.T) {
+			key, err := NewSigningKey(algorithm, now.Add(-time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			k, err := NewKeyring([]SigningKey{*key}, nil, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k.SigningKID() != key.KID {
+				t.Errorf("expected %s to sign, got %s", key.KID, k.SigningKID())
+			}
+			token, err := k.Parse(signTestToken(t, k), &Claims{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.Header["kid"] != key.KID || token.Method.Alg() != algorithm {
+				t.Errorf("unexpected header %v", token.Header)
+			}
+			claims := token.Claims.(*Claims)
+			if claims.ID != 7 || claims.SessionID != 42 {
+				t.Fail()
+			}
+			published := len(k.JWKS().Keys) == 1
+			if published == (algorithm == SigningHS256) {
+				t.Errorf("unexpected JWKS %v", k.JWKS())
+			}
+		})
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	now := time.Now()
+	old, err := NewSigningKey(SigningHS256, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := NewSigningKey(SigningEdDSA, now.Add(SigningKeyPropagationDelay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Retire(next.ActivatesAt)
+	t.Run("PendingKeyOnlyVerifies", func(t *testing.T) {
+		k, err := NewKeyring([]SigningKey{*next, *old}, nil, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k.SigningKID() != old.KID {
+			t.Errorf("expected %s to sign, got %s", old.KID, k.SigningKID())
+		}
+		if len(k.JWKS().Keys) != 1 || k.JWKS().Keys[0].KID != next.KID {
+			t.Errorf("expected pending key to be published, got %v", k.JWKS())
+		}
+	})
+	t.Run("RetiredKeyVerifies", func(t *testing.T) {
+		before, err := NewKeyring([]SigningKey{*old, *next}, nil, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token := signTestToken(t, before)
+		after, err := NewKeyring([]SigningKey{*old, *next}, nil, next.ActivatesAt.Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after.SigningKID() != next.KID {
+			t.Errorf("expected %s to sign, got %s", next.KID, after.SigningKID())
+		}
+		_, err = after.Parse(token, &Claims{})
+		if err != nil {
+			t.Error(err)
+		}
+		expired, err := NewKeyring([]SigningKey{*old, *next}, nil, next.ActivatesAt.Add(AccessTokenLifetime))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = expired.Parse(token, &Claims{})
+		if err == nil {
+			t.Error("expected token of a dropped key to be rejected")
+		}
+	})
+}
+
+func TestKeyringLegacySecret(t *testing.T) {
+	now := time.Now()
+	legacy, err := NewKeyring(nil, []byte("legacy"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signTestToken(t, legacy)
+	key, err := NewSigningKey(SigningRS256, now.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewKeyring([]SigningKey{*key}, []byte("legacy"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.SigningKID() != key.KID {
+		t.Errorf("expected %s to sign, got %s", key.KID, k.SigningKID())
+	}
+	_, err = k.Parse(token, &Claims{})
+	if err != nil {
+		t.Error(err)
+	}
+	withoutLegacy, err := NewKeyring([]SigningKey{*key}, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = withoutLegacy.Parse(token, &Claims{})
+	if err == nil {
+		t.Error("expected token without kid to be rejected once the legacy secret is removed")
+	}
+}
+
+func TestKeyringRejectsAlgorithmMismatch(t *testing.T) {
+	now := time.Now()
+	key, err := NewSigningKey(SigningRS256, now.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewKeyring([]SigningKey{*key}, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An HS256 token signed with the public key of an RS256 key must not verify
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{ID: 7})
+	token.Header["kid"] = key.KID
+	forged, err := token.SignedString(key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = k.Parse(forged, &Claims{})
+	if err == nil {
+		t.Error("expected forged token to be rejected")
+	}
+}
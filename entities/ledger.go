@@ -0,0 +1,264 @@
+package entities
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of offer ledger entries
+const (
+	LedgerOpeningBalance = "opening_balance"
+	LedgerPlanGrant      = "plan_grant"
+	LedgerCarryOver      = "carry_over"
+	LedgerShareBonus     = "share_bonus"
+	LedgerConsumption    = "consumption"
+	LedgerVoid           = "void"
+	LedgerAdjustment     = "adjustment"
+	LedgerCancellation   = "cancellation"
+)
+
+// OfferLedgerEntry credits or debits the offers a customer has with partners during a subscription.
+//
+// Entries are never updated or deleted. The remaining offers of a customer with a partner are the sum of
+// the amounts of the entries of their subscription with that partner, or with no partner, which apply to every partner.
+type OfferLedgerEntry struct {
+	gorm.Model
+	CustomerID     uint   `gorm:"index;not null" json:"customerID"`
+	SubscriptionID uint   `gorm:"index;not null" json:"subscriptionID"`
+	PartnerID      uint   `gorm:"index" json:"partnerID"`
+	Kind           string `gorm:"not null" json:"kind"`
+	Amount         int    `gorm:"not null" json:"amount"`
+	Reason         string `json:"reason"`
+	ReferenceID    uint   `json:"referenceID"`
+	ActorID        uint   `json:"actorID"`
+}
+
+// NewPlanGrant returns the entry crediting the offers of the plan of the given subscription to every partner
+func NewPlanGrant(subscription *Subscription, plan *Plan) *OfferLedgerEntry {
+	return &OfferLedgerEntry{
+		CustomerID:     subscription.UserID,
+		SubscriptionID: subscription.ID,
+		Kind:           LedgerPlanGrant,
+		Amount:         int(plan.CountOfOffers),
+		Reason:         "Offers of the " + plan.EnglishName + " plan",
+		ReferenceID:    plan.ID,
+	}
+}
+
+// NewCarryOvers returns the entries moving the remaining offers in the given entries of a replaced subscription to the one replacing it
+func NewCarryOvers(from *Subscription, entries []OfferLedgerEntry, to *Subscription) []OfferLedgerEntry {
+	var carryOvers []OfferLedgerEntry
+	var partners []uint
+	balances := make(map[uint]int)
+	for _, entry := range entries {
+		if _, ok := balances[entry.PartnerID]; !ok {
+			partners = append(partners, entry.PartnerID)
+		}
+		balances[entry.PartnerID] += entry.Amount
+	}
+	for _, partnerID := range partners {
+		if balances[partnerID] == 0 {
+			continue
+		}
+		carryOvers = append(carryOvers, OfferLedgerEntry{
+			CustomerID:     to.UserID,
+			SubscriptionID: to.ID,
+			PartnerID:      partnerID,
+			Kind:           LedgerCarryOver,
+			Amount:         balances[partnerID],
+			Reason:         "Remaining offers of the previous subscription",
+			ReferenceID:    from.ID,
+		})
+	}
+	return carryOvers
+}
+
+// NewCancellations returns the entries removing the offers left in the given entries of a cancelled subscription
+func NewCancellations(subscription *Subscription, entries []OfferLedgerEntry, actorID uint, reason string) []OfferLedgerEntry {
+	var cancellations []OfferLedgerEntry
+	var partners []uint
+	balances := make(map[uint]int)
+	for _, entry := range entries {
+		if _, ok := balances[entry.PartnerID]; !ok {
+			partners = append(partners, entry.PartnerID)
+		}
+		balances[entry.PartnerID] += entry.Amount
+	}
+	for _, partnerID := range partners {
+		if balances[partnerID] == 0 {
+			continue
+		}
+		cancellations = append(cancellations, OfferLedgerEntry{
+			CustomerID:     subscription.UserID,
+			SubscriptionID: subscription.ID,
+			PartnerID:      partnerID,
+			Kind:           LedgerCancellation,
+			Amount:         -balances[partnerID],
+			Reason:         reason,
+			ReferenceID:    subscription.ID,
+			ActorID:        actorID,
+		})
+	}
+	return cancellations
+}
+
+// OffersUsed returns the count of offers consumed and not voided in the given ledger entries
+func OffersUsed(entries []OfferLedgerEntry) int {
+	var used int
+	for _, entry := range entries {
+		if entry.Kind == LedgerConsumption || entry.Kind == LedgerVoid {
+			used -= entry.Amount
+		}
+	}
+	return used
+}
+
+// NewShareBonus returns the entry crediting an offer with the given sharable partner for sharing the app
+func NewShareBonus(subscription *Subscription, partnerID uint, share *Share) *OfferLedgerEntry {
+	return &OfferLedgerEntry{
+		CustomerID:     subscription.UserID,
+		SubscriptionID: subscription.ID,
+		PartnerID:      partnerID,
+		Kind:           LedgerShareBonus,
+		Amount:         1,
+		Reason:         "Sharing the app",
+		ReferenceID:    share.ID,
+	}
+}
+
+// NewConsumption returns the entry debiting the given consumed offer.
+// The actor is the cashier who scanned it, or else the partner.
+func NewConsumption(offer *Offer) *OfferLedgerEntry {
+	return &OfferLedgerEntry{
+		CustomerID:     offer.CustomerID,
+		SubscriptionID: offer.SubsriptionID,
+		PartnerID:      offer.PartnerID,
+		Kind:           LedgerConsumption,
+		Amount:         -1,
+		Reason:         "Offer consumed",
+		ReferenceID:    offer.ID,
+		ActorID:        offer.ScannerID(),
+	}
+}
+
+// NewVoid returns the entry crediting back the given voided offer
+func NewVoid(offer *Offer, actorID uint, reason string) *OfferLedgerEntry {
+	return &OfferLedgerEntry{
+		CustomerID:     offer.CustomerID,
+		SubscriptionID: offer.SubsriptionID,
+		PartnerID:      offer.PartnerID,
+		Kind:           LedgerVoid,
+		Amount:         1,
+		Reason:         reason,
+		ReferenceID:    offer.ID,
+		ActorID:        actorID,
+	}
+}
+
+// NewAdjustment returns an entry correcting the remaining offers of the customer with the given partner by the given amount.
+// A partner ID of zero adjusts the offers with every partner.
+func NewAdjustment(currentUser IUser, subscription *Subscription, partnerID uint, amount int, reason string) (*OfferLedgerEntry, error) {
+	if !currentUser.Can(PermissionManageSubscriptions) {
+		return nil, ErrForbidden
+	}
+	if amount == 0 {
+		return nil, errors.New("amount can't be zero")
+	}
+	if reason == "" {
+		return nil, errors.New("reason is required")
+	}
+	return &OfferLedgerEntry{
+		CustomerID:     subscription.UserID,
+		SubscriptionID: subscription.ID,
+		PartnerID:      partnerID,
+		Kind:           LedgerAdjustment,
+		Amount:         amount,
+		Reason:         reason,
+		ActorID:        currentUser.GetID(),
+	}, nil
+}
+
+// RemainingOffers returns the offers left with the given partner from the given ledger entries of a subscription
+func RemainingOffers(entries []OfferLedgerEntry, partnerID uint) uint {
+	var balance int
+	for _, entry := range entries {
+		if entry.PartnerID == 0 || entry.PartnerID == partnerID {
+			balance += entry.Amount
+		}
+	}
+	if balance < 0 {
+		return 0
+	}
+	return uint(balance)
+}
+
+// RemainingOffersWithPartner returns the balance of the ledger of the given subscription with the given partner.
+// It's shared by the repositories that need it within their own transactions.
+func RemainingOffersWithPartner(db *gorm.DB, subscriptionID uint, partnerID uint) (int, error) {
+	var result struct {
+		Balance int
+	}
+	dbt := db.Model(&OfferLedgerEntry{}).
+		Select("COALESCE(SUM(amount), 0) AS balance").
+		Where("subscription_id = ? AND (partner_id = 0 OR partner_id = ?)", subscriptionID, partnerID).
+		Scan(&result)
+	if dbt.Error != nil {
+		return 0, errors.Wrap(dbt.Error, "error getting remaining offers")
+	}
+	return result.Balance, nil
+}
+
+// backfillOfferLedger moves the counts of offers kept before the ledger into it as opening balances.
+// Subscriptions that already have an entry applying to every partner are skipped, so it's safe to run on every start.
+func backfillOfferLedger(db *gorm.DB) {
+	const notMigrated = `s.deleted_at IS NULL AND NOT EXISTS (
+		SELECT 1 FROM offer_ledger_entries e WHERE e.subscription_id = s.id AND e.partner_id = 0 AND e.deleted_at IS NULL
+	)`
+	tx := db.Begin()
+	// Partners with a count get the difference from the offers of the subscription
+	dbt := tx.Exec(`
+		INSERT INTO offer_ledger_entries (created_at, updated_at, customer_id, subscription_id, partner_id, kind, amount, reason, reference_id, actor_id)
+		SELECT NOW(), NOW(), c.customer_id, c.subscription_id, c.partner_id, ?, CAST(c.count_of_offers AS INTEGER) - CAST(s.remaining_offers AS INTEGER), ?, c.id, 0
+		FROM customer_partner_offers_counts c JOIN subscriptions s ON s.id = c.subscription_id
+		WHERE c.deleted_at IS NULL AND CAST(c.count_of_offers AS INTEGER) <> CAST(s.remaining_offers AS INTEGER) AND `+notMigrated,
+		LedgerOpeningBalance, "Offers with the partner before the ledger")
+	if dbt.Error != nil {
+		tx.Rollback()
+		log.Error(errors.Wrap(dbt.Error, "error migrating counts of offers"))
+		return
+	}
+	// Sharable partners without a count would have given a bonus offer to customers who shared the app
+	dbt = tx.Exec(`
+		INSERT INTO offer_ledger_entries (created_at, updated_at, customer_id, subscription_id, partner_id, kind, amount, reason, reference_id, actor_id)
+		SELECT NOW(), NOW(), s.user_id, s.id, p.partner_id, ?, 1, ?, MIN(sh.id), 0
+		FROM subscriptions s
+		JOIN shares sh ON sh.customer_id = s.user_id AND sh.deleted_at IS NULL
+		JOIN partner_profiles p ON p.is_sharable = true AND p.deleted_at IS NULL
+		WHERE NOT EXISTS (
+			SELECT 1 FROM customer_partner_offers_counts c WHERE c.subscription_id = s.id AND c.partner_id = p.partner_id AND c.deleted_at IS NULL
+		) AND `+notMigrated+`
+		GROUP BY s.user_id, s.id, p.partner_id`,
+		LedgerShareBonus, "Sharing the app")
+	if dbt.Error != nil {
+		tx.Rollback()
+		log.Error(errors.Wrap(dbt.Error, "error migrating share bonuses"))
+		return
+	}
+	// The offers of the subscription apply to every partner
+	dbt = tx.Exec(`
+		INSERT INTO offer_ledger_entries (created_at, updated_at, customer_id, subscription_id, partner_id, kind, amount, reason, reference_id, actor_id)
+		SELECT NOW(), NOW(), s.user_id, s.id, 0, ?, s.remaining_offers, ?, s.id, 0
+		FROM subscriptions s
+		WHERE `+notMigrated,
+		LedgerOpeningBalance, "Offers of the subscription before the ledger")
+	if dbt.Error != nil {
+		tx.Rollback()
+		log.Error(errors.Wrap(dbt.Error, "error migrating subscription offers"))
+		return
+	}
+	dbt = tx.Commit()
+	if dbt.Error != nil {
+		log.Error(errors.Wrap(dbt.Error, "error migrating offers ledger"))
+	}
+}
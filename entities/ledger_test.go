@@ -0,0 +1,121 @@
+package entities
+
+import (
+	"testing"
+)
+
+func TestRemainingOffers(t *testing.T) {
+	subscription := &Subscription{UserID: 1}
+	subscription.ID = 10
+	plan := &Plan{CountOfOffers: 3}
+	share := &Share{CustomerID: 1}
+	entries := []OfferLedgerEntry{
+		*NewPlanGrant(subscription, plan),
+		*NewShareBonus(subscription, 2, share),
+		*NewConsumption(&Offer{CustomerID: 1, PartnerID: 2, SubsriptionID: 10}),
+		*NewConsumption(&Offer{CustomerID: 1, PartnerID: 3, SubsriptionID: 10}),
+	}
+	cases := map[uint]uint{
+		2: 3,
+		3: 2,
+		4: 3,
+	}
+	for partnerID, expected := range cases {
+		if remaining := RemainingOffers(entries, partnerID); remaining != expected {
+			t.Errorf("partner %d: expected %d remaining offers, got %d", partnerID, expected, remaining)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		entries = append(entries, *NewConsumption(&Offer{CustomerID: 1, PartnerID: 3, SubsriptionID: 10}))
+	}
+	if RemainingOffers(entries, 3) != 0 {
+		t.Error("expected the remaining offers not to go below zero")
+	}
+}
+
+func TestNewCarryOvers(t *testing.T) {
+	old := &Subscription{UserID: 1}
+	old.ID = 10
+	renewed := &Subscription{UserID: 1}
+	renewed.ID = 11
+	entries := []OfferLedgerEntry{
+		*NewPlanGrant(old, &Plan{CountOfOffers: 5}),
+		*NewConsumption(&Offer{CustomerID: 1, PartnerID: 2, SubsriptionID: 10}),
+		*NewConsumption(&Offer{CustomerID: 1, PartnerID: 3, SubsriptionID: 10}),
+		*NewVoid(&Offer{CustomerID: 1, PartnerID: 3, SubsriptionID: 10}, 1, "Scanned twice"),
+	}
+	carryOvers := NewCarryOvers(old, entries, renewed)
+	if len(carryOvers) != 2 {
+		t.Fatalf("expected carry overs for every partner and partner 2, got %+v", carryOvers)
+	}
+	for _, carryOver := range carryOvers {
+		if carryOver.SubscriptionID != renewed.ID || carryOver.ReferenceID != old.ID || carryOver.Kind != LedgerCarryOver {
+			t.Errorf("unexpected carry over %+v", carryOver)
+		}
+	}
+	entries = append(carryOvers, *NewPlanGrant(renewed, &Plan{CountOfOffers: 5}))
+	if RemainingOffers(entries, 2) != 9 || RemainingOffers(entries, 3) != 10 {
+		t.Errorf("expected the balances of the old subscription to be carried over, got %+v", entries)
+	}
+}
+
+func TestNewCancellations(t *testing.T) {
+	subscription := &Subscription{UserID: 1}
+	subscription.ID = 10
+	entries := []OfferLedgerEntry{
+		*NewPlanGrant(subscription, &Plan{CountOfOffers: 3}),
+		*NewShareBonus(subscription, 2, &Share{}),
+		*NewConsumption(&Offer{CustomerID: 1, PartnerID: 3, SubsriptionID: 10}),
+		*NewConsumption(&Offer{CustomerID: 1, PartnerID: 3, SubsriptionID: 10}),
+		*NewVoid(&Offer{CustomerID: 1, PartnerID: 3, SubsriptionID: 10}, 5, "Wrong amount"),
+	}
+	if used := OffersUsed(entries); used != 1 {
+		t.Errorf("expected 1 offer used, got %d", used)
+	}
+	entries = append(entries, NewCancellations(subscription, entries, 1, "Cancelled by the customer")...)
+	for _, partnerID := range []uint{2, 3, 4} {
+		if remaining := RemainingOffers(entries, partnerID); remaining != 0 {
+			t.Errorf("partner %d: expected no remaining offers, got %d", partnerID, remaining)
+		}
+	}
+	if used := OffersUsed(entries); used != 1 {
+		t.Errorf("expected cancellations not to count as used offers, got %d", used)
+	}
+}
+
+func TestNewConsumption(t *testing.T) {
+	offer := &Offer{CustomerID: 1, PartnerID: 2, SubsriptionID: 10}
+	offer.ID = 5
+	entry := NewConsumption(offer)
+	if entry.Amount != -1 || entry.ReferenceID != offer.ID || entry.ActorID != offer.PartnerID {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	offer.CashierID = 7
+	if NewConsumption(offer).ActorID != offer.CashierID {
+		t.Error("expected the cashier to be the actor")
+	}
+}
+
+func TestNewAdjustment(t *testing.T) {
+	subscription := &Subscription{UserID: 1}
+	subscription.ID = 10
+	admin := &User{AccountType: "admin", Role: RoleSuperAdmin}
+	admin.ID = 3
+	entry, err := NewAdjustment(admin, subscription, 2, -2, "Offers consumed by mistake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Amount != -2 || entry.ActorID != admin.ID || entry.PartnerID != 2 || entry.Kind != LedgerAdjustment {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if _, err := NewAdjustment(admin, subscription, 2, 0, "Nothing"); err == nil {
+		t.Error("expected a zero amount to be rejected")
+	}
+	if _, err := NewAdjustment(admin, subscription, 2, 1, ""); err == nil {
+		t.Error("expected an adjustment without a reason to be rejected")
+	}
+	partner := &User{AccountType: "partner", Role: RolePartner}
+	if _, err := NewAdjustment(partner, subscription, 2, 1, "Free offer"); err != ErrForbidden {
+		t.Errorf("expected ErrForbidden, got %v", err)
+	}
+}
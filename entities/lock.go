@@ -0,0 +1,37 @@
+package entities
+
+import (
+	"hash/fnv"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// RunExclusively runs the given job unless another instance of the server is running the job with the same name.
+// It holds a Postgres advisory lock for the name until the job returns, and returns false without running the job
+// if the lock is already held. The lock is released if the instance running the job loses its connection to the DB.
+func RunExclusively(db *gorm.DB, name string, job func() error) (bool, error) {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return false, errors.Wrap(tx.Error, "error starting lock transaction")
+	}
+	defer tx.Rollback()
+	var lock struct {
+		Locked bool
+	}
+	dbt := tx.Raw("SELECT pg_try_advisory_xact_lock(?) AS locked", lockKey(name)).Scan(&lock)
+	if dbt.Error != nil {
+		return false, errors.Wrapf(dbt.Error, "error locking %s", name)
+	}
+	if !lock.Locked {
+		return false, nil
+	}
+	return true, job()
+}
+
+// lockKey returns the advisory lock key of the job with the given name
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
@@ -0,0 +1,40 @@
+package entities
+
+import "testing"
+
+func TestRunExclusively(t *testing.T) {
+	conf := DBConfig{
+		Port:     5432,
+		Host:     "localhost",
+		User:     "tasarruf",
+		Password: "password",
+		DBName:   "tasarruftestdb",
+	}
+	db, err := ConnectToDB(&conf)
+	if err != nil {
+		t.Skip("test database isn't available : ", err)
+	}
+	defer db.Close()
+	var runs int
+	ran, err := RunExclusively(db, "test-job", func() error {
+		runs++
+		ran, err := RunExclusively(db, "test-job", func() error {
+			runs++
+			return nil
+		})
+		if err != nil || ran {
+			t.Errorf("expected the job not to run while it's locked, got %t and %v", ran, err)
+		}
+		return nil
+	})
+	if err != nil || !ran {
+		t.Fatalf("expected the job to run, got %t and %v", ran, err)
+	}
+	ran, err = RunExclusively(db, "test-job", func() error {
+		runs++
+		return nil
+	})
+	if err != nil || !ran || runs != 2 {
+		t.Errorf("expected the job to run again once unlocked, got %t, %v and %d runs", ran, err, runs)
+	}
+}
@@ -1,18 +1,30 @@
 package entities
 
 import (
+	"time"
+
 	"github.com/jinzhu/gorm"
 )
 
 // Offer represents an offer DB model
 type Offer struct {
 	gorm.Model
-	CustomerID    uint      `json:"customerID,omitempty"`
-	PartnerID     uint      `json:"partnerID,omitempty"`
-	SubsriptionID uint      `json:"subscriptionID"`
-	Amount        float64   `json:"amount,omitempty"`
-	Discount      float64   `json:"discount,omitempty"`
-	Total         float64   `json:"total,omitempty"`
-	Customer      *Customer `json:"customer,omitempty" gorm:"-"`
-	Partner       *Partner  `json:"partner,omitempty" gorm:"-"`
+	CustomerID     uint       `json:"customerID,omitempty"`
+	PartnerID      uint       `json:"partnerID,omitempty"`
+	SubsriptionID  uint       `json:"subscriptionID"`
+	Amount         float64    `json:"amount,omitempty"`
+	Discount       float64    `json:"discount,omitempty"`
+	Total          float64    `json:"total,omitempty"`
+	CashierID      uint       `gorm:"index" json:"cashierID,omitempty"`
+	BranchID       uint       `json:"branchID,omitempty"`
+	APIKeyID       uint       `json:"apiKeyID,omitempty"`
+	IdempotencyKey string     `gorm:"index" json:"idempotencyKey,omitempty"`
+	Status         string     `gorm:"default:'consumed'" json:"status"`
+	VoidedAt       *time.Time `json:"voidedAt,omitempty"`
+	VoidReason     string     `json:"voidReason,omitempty"`
+	VoidedByID     uint       `json:"voidedByID,omitempty"`
+	ConfirmBy      *time.Time `json:"confirmBy,omitempty"`
+	Cashier        *User      `json:"cashier,omitempty" gorm:"-"`
+	Customer       *Customer  `json:"customer,omitempty" gorm:"-"`
+	Partner        *Partner   `json:"partner,omitempty" gorm:"-"`
 }
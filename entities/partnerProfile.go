@@ -44,7 +44,7 @@ type PartnerProfile struct {
 
 // Approve sets the approved propety to true
 func (profile *PartnerProfile) Approve(currentUser IUser) error {
-	if !currentUser.IsAdmin() {
+	if !currentUser.Can(PermissionManagePartners) {
 		return errors.New("only admins are allowed to approve users")
 	}
 	profile.Approved = true
@@ -108,7 +108,7 @@ func (profile *PartnerProfile) AddPartnerPhoto(photo *PartnerPhoto) {
 
 // SetIsSharable sets the is sharable property of the partner profile
 func (profile *PartnerProfile) SetIsSharable(currentUser IUser, val bool) error {
-	if !currentUser.IsAdmin() {
+	if !currentUser.Can(PermissionManagePartners) {
 		return errors.New("only admins are allowed to set a partner to be shared")
 	}
 	profile.IsSharable = val
@@ -1,13 +1,148 @@
 package entities
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+
 	"github.com/ahmedaabouzied/iyzipay-go/iyzipay"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
 )
 
 // PaymentDetails represents a transaction
 type PaymentDetails struct {
-	User     *User
-	Plan     *Plan
-	Card     *iyzipay.PaymentCard
-	IDNumber string
+	User           *User
+	Plan           *Plan
+	Card           *iyzipay.PaymentCard
+	IDNumber       string
+	ConversationID string
+}
+
+// Statuses of payments
+const (
+	PaymentPending   = "pending"
+	PaymentSucceeded = "succeeded"
+	PaymentFailed    = "failed"
+	PaymentRefunded  = "refunded"
+)
+
+// PaymentCurrency is the currency customers are charged in
+const PaymentCurrency = "TRY"
+
+// Payment is the record of an attempt to charge a customer for a plan.
+//
+// It's created as pending before the provider is asked to charge the customer, and gets the status the provider answers with.
+// The conversation ID is sent to the provider with the payment, so the payment can be looked up at the provider
+// even if it failed or was never updated.
+type Payment struct {
+	gorm.Model
+	Provider          string     `gorm:"not null" json:"provider"`
+	ProviderPaymentID string     `gorm:"index" json:"providerPaymentID"`
+	ConversationID    string     `gorm:"unique_index;not null" json:"conversationID"`
+	UserID            uint       `gorm:"index;not null" json:"userID"`
+	PlanID            uint       `gorm:"not null" json:"planID"`
+	SubscriptionID    uint       `gorm:"index" json:"subscriptionID"`
+	Amount            float64    `gorm:"not null" json:"amount"`
+	Currency          string     `gorm:"not null" json:"currency"`
+	Status            string     `gorm:"index;not null" json:"status"`
+	RawResponse       string     `gorm:"type:text" json:"rawResponse"`
+	ReconciledAt      *time.Time `json:"reconciledAt"`
+	Discrepancy       string     `json:"discrepancy"`
+	RefundedAmount    float64    `gorm:"not null;default:0" json:"refundedAmount"`
+	RefundID          string     `json:"refundID"`
+	RefundedAt        *time.Time `json:"refundedAt"`
+	RefundResponse    string     `gorm:"type:text" json:"refundResponse"`
+}
+
+// PaymentFilter selects the payments listed to admins. Zero fields match every payment.
+type PaymentFilter struct {
+	UserID         uint
+	SubscriptionID uint
+	Provider       string
+	Status         string
+	From           time.Time
+	To             time.Time
+	Discrepancies  bool
+}
+
+// NewPayment returns a pending payment of the plan in the given details by the given provider, with a new conversation ID
+func NewPayment(provider string, details *PaymentDetails) (*Payment, error) {
+	id := make([]byte, 12)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating payment conversation id")
+	}
+	return &Payment{
+		Provider:       provider,
+		ConversationID: hex.EncodeToString(id),
+		UserID:         details.User.ID,
+		PlanID:         details.Plan.ID,
+		Amount:         details.Plan.Price,
+		Currency:       PaymentCurrency,
+		Status:         PaymentPending,
+	}, nil
+}
+
+// Succeed records that the provider charged the payment with the given ID
+func (p *Payment) Succeed(providerPaymentID string, rawResponse string) {
+	p.Status = PaymentSucceeded
+	p.ProviderPaymentID = providerPaymentID
+	p.RawResponse = rawResponse
+}
+
+// Fail records that the provider declined the payment or couldn't be reached
+func (p *Payment) Fail(rawResponse string) {
+	p.Status = PaymentFailed
+	p.RawResponse = rawResponse
+}
+
+// Refund records that the provider refunded the given amount of the payment with the refund of the given ID.
+// The payment is refunded once all of it has been refunded.
+func (p *Payment) Refund(refundID string, amount float64, rawResponse string, now time.Time) {
+	p.RefundedAmount += amount
+	p.RefundID = refundID
+	p.RefundedAt = &now
+	p.RefundResponse = rawResponse
+	if p.RefundedAmount >= p.Amount-0.005 {
+		p.Status = PaymentRefunded
+	}
+}
+
+// Reconcile compares the payment with the status and amount the provider has for it, where found is false
+// if the provider has no record of the payment. It returns false if they don't match and records why in the discrepancy.
+//
+// Pending payments were never updated after being submitted, so they take the status the provider has,
+// or fail if the provider never charged them. Succeeded payments that aren't linked to a subscription don't match either,
+// since the customer was charged without getting the plan. Refunds don't change the payment at the provider,
+// so refunded payments match succeeded ones.
+func (p *Payment) Reconcile(found bool, status string, amount float64, now time.Time) bool {
+	p.ReconciledAt = &now
+	p.Discrepancy = ""
+	if !found {
+		switch p.Status {
+		case PaymentPending:
+			p.Status = PaymentFailed
+		case PaymentSucceeded, PaymentRefunded:
+			p.Discrepancy = "payment not found at the provider"
+		}
+		return p.Discrepancy == ""
+	}
+	if p.Status == PaymentPending {
+		p.Status = status
+	}
+	charged := p.Status
+	if charged == PaymentRefunded {
+		charged = PaymentSucceeded
+	}
+	if charged != status {
+		p.Discrepancy = fmt.Sprintf("payment is %s at the provider", status)
+	} else if status == PaymentSucceeded && math.Abs(p.Amount-amount) >= 0.01 {
+		p.Discrepancy = fmt.Sprintf("provider charged %.2f instead of %.2f", amount, p.Amount)
+	} else if status == PaymentSucceeded && p.SubscriptionID == 0 {
+		p.Discrepancy = "customer was charged without getting a subscription"
+	}
+	return p.Discrepancy == ""
 }
@@ -0,0 +1,77 @@
+package entities
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewPayment(t *testing.T) {
+	user := &User{}
+	user.ID = 4
+	plan := &Plan{Price: 120}
+	plan.ID = 2
+	details := &PaymentDetails{User: user, Plan: plan}
+	p, err := NewPayment("fake", details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != PaymentPending || p.UserID != 4 || p.PlanID != 2 || p.Amount != 120 || p.Currency != PaymentCurrency || p.Provider != "fake" {
+		t.Errorf("unexpected payment %+v", p)
+	}
+	other, err := NewPayment("fake", details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ConversationID == "" || p.ConversationID == other.ConversationID {
+		t.Errorf("expected unique conversation ids, got %q and %q", p.ConversationID, other.ConversationID)
+	}
+}
+
+func TestReconcilePayment(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name         string
+		status       string
+		subscription uint
+		found        bool
+		remote       string
+		amount       float64
+		matches      bool
+		finalStatus  string
+	}{
+		{"Succeeded", PaymentSucceeded, 3, true, PaymentSucceeded, 120, true, PaymentSucceeded},
+		{"Failed", PaymentFailed, 3, false, "", 0, true, PaymentFailed},
+		{"FailedButCharged", PaymentFailed, 3, true, PaymentSucceeded, 120, false, PaymentFailed},
+		{"SucceededButMissing", PaymentSucceeded, 3, false, "", 0, false, PaymentSucceeded},
+		{"WrongAmount", PaymentSucceeded, 3, true, PaymentSucceeded, 100, false, PaymentSucceeded},
+		{"PendingCharged", PaymentPending, 3, true, PaymentSucceeded, 120, true, PaymentSucceeded},
+		{"PendingMissing", PaymentPending, 3, false, "", 0, true, PaymentFailed},
+		{"ChargedWithoutSubscription", PaymentPending, 0, true, PaymentSucceeded, 120, false, PaymentSucceeded},
+		{"Refunded", PaymentRefunded, 3, true, PaymentSucceeded, 120, true, PaymentRefunded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &Payment{Status: test.status, Amount: 120, SubscriptionID: test.subscription, Discrepancy: "old"}
+			matches := p.Reconcile(test.found, test.remote, test.amount, now)
+			if matches != test.matches || p.Status != test.finalStatus || p.ReconciledAt == nil {
+				t.Errorf("expected match %t with status %s, got %t with %+v", test.matches, test.finalStatus, matches, p)
+			}
+			if matches != (p.Discrepancy == "") {
+				t.Errorf("unexpected discrepancy %q", p.Discrepancy)
+			}
+		})
+	}
+}
+
+func TestRefundPayment(t *testing.T) {
+	now := time.Now()
+	p := &Payment{Amount: 120, Status: PaymentSucceeded}
+	p.Refund("refund-1", 20, "{}", now)
+	if p.Status != PaymentSucceeded || p.RefundedAmount != 20 || p.RefundID != "refund-1" || p.RefundedAt == nil {
+		t.Errorf("unexpected partly refunded payment %+v", p)
+	}
+	p.Refund("refund-2", 100, "{}", now)
+	if p.Status != PaymentRefunded || p.RefundedAmount != 120 || p.RefundID != "refund-2" {
+		t.Errorf("unexpected refunded payment %+v", p)
+	}
+}
@@ -0,0 +1,117 @@
+package entities
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// RedemptionTokenLifetime is how long a redemption token shown as a QR code by the customer app is valid for
+const RedemptionTokenLifetime = 2 * time.Minute
+
+// Redemption token errors
+var (
+	ErrInvalidRedemptionToken = errors.New("invalid redemption token")
+	ErrRedemptionTokenExpired = errors.New("redemption token has expired, please ask the customer to refresh the QR code")
+	ErrRedemptionTokenUsed    = errors.New("redemption token has already been used")
+)
+
+// RedemptionClaims are the contents of a redemption token.
+//
+// A token is formatted as customerID.expiresAt.nonce.signature where the signature
+// is the HMAC-SHA256 of the rest of the token with REDEMPTION_TOKEN_SECRET.
+type RedemptionClaims struct {
+	CustomerID uint
+	ExpiresAt  time.Time
+	Nonce      string
+}
+
+// UsedRedemptionToken records a redemption token that has been used to consume an offer, so that it can't be replayed
+type UsedRedemptionToken struct {
+	gorm.Model
+	Nonce      string    `gorm:"unique_index;not null"`
+	CustomerID uint      `gorm:"index"`
+	ExpiresAt  time.Time `gorm:"index"`
+}
+
+// RedemptionSecret returns the key redemption tokens are signed with
+func RedemptionSecret() ([]byte, error) {
+	secret := os.Getenv("REDEMPTION_TOKEN_SECRET")
+	if secret == "" {
+		return nil, errors.New("REDEMPTION_TOKEN_SECRET is not set")
+	}
+	return []byte(secret), nil
+}
+
+// NewRedemptionToken returns a redemption token of the given customer signed with the given secret
+func NewRedemptionToken(customer *User, secret []byte, now time.Time) (string, *RedemptionClaims, error) {
+	if customer.AccountType != "user" {
+		return "", nil, ErrForbidden
+	}
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", nil, err
+	}
+	claims := &RedemptionClaims{
+		CustomerID: customer.ID,
+		ExpiresAt:  now.Add(RedemptionTokenLifetime),
+		Nonce:      base64.RawURLEncoding.EncodeToString(nonce),
+	}
+	payload := fmt.Sprintf("%d.%d.%s", claims.CustomerID, claims.ExpiresAt.Unix(), claims.Nonce)
+	return payload + "." + signRedemptionPayload(payload, secret), claims, nil
+}
+
+// ParseRedemptionToken verifies the signature and expiry of the given token and returns its claims.
+// Checking that the token hasn't been used is left to the caller.
+func ParseRedemptionToken(token string, secret []byte, now time.Time) (*RedemptionClaims, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 4 {
+		return nil, ErrInvalidRedemptionToken
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(signRedemptionPayload(payload, secret))) {
+		return nil, ErrInvalidRedemptionToken
+	}
+	customerID, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidRedemptionToken
+	}
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidRedemptionToken
+	}
+	claims := &RedemptionClaims{
+		CustomerID: uint(customerID),
+		ExpiresAt:  time.Unix(expiresAt, 0),
+		Nonce:      parts[2],
+	}
+	if !now.Before(claims.ExpiresAt) {
+		return nil, ErrRedemptionTokenExpired
+	}
+	return claims, nil
+}
+
+// Use returns the record that marks the token as used
+func (claims *RedemptionClaims) Use() *UsedRedemptionToken {
+	return &UsedRedemptionToken{
+		Nonce:      claims.Nonce,
+		CustomerID: claims.CustomerID,
+		ExpiresAt:  claims.ExpiresAt,
+	}
+}
+
+func signRedemptionPayload(payload string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,74 @@
+package entities
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedemptionToken(t *testing.T) {
+	secret := []byte("redemption-secret")
+	customer := &User{AccountType: "user"}
+	customer.ID = 42
+	now := time.Now()
+	token, claims, err := NewRedemptionToken(customer, secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Valid", func(t *testing.T) {
+		parsed, err := ParseRedemptionToken(token, secret, now.Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.CustomerID != customer.ID || parsed.Nonce != claims.Nonce || parsed.ExpiresAt.Unix() != claims.ExpiresAt.Unix() {
+			t.Errorf("unexpected claims %+v", parsed)
+		}
+		used := parsed.Use()
+		if used.Nonce != claims.Nonce || used.CustomerID != customer.ID {
+			t.Fail()
+		}
+	})
+	t.Run("Expired", func(t *testing.T) {
+		_, err := ParseRedemptionToken(token, secret, now.Add(RedemptionTokenLifetime+time.Second))
+		if err != ErrRedemptionTokenExpired {
+			t.Errorf("expected ErrRedemptionTokenExpired, got %v", err)
+		}
+	})
+	t.Run("WrongSecret", func(t *testing.T) {
+		_, err := ParseRedemptionToken(token, []byte("other"), now)
+		if err != ErrInvalidRedemptionToken {
+			t.Errorf("expected ErrInvalidRedemptionToken, got %v", err)
+		}
+	})
+	t.Run("ForgedCustomer", func(t *testing.T) {
+		forged := "7" + strings.TrimPrefix(token, "42")
+		_, err := ParseRedemptionToken(forged, secret, now)
+		if err != ErrInvalidRedemptionToken {
+			t.Errorf("expected ErrInvalidRedemptionToken, got %v", err)
+		}
+	})
+	t.Run("Malformed", func(t *testing.T) {
+		for _, malformed := range []string{"", "42", "42.1.2", token + ".x"} {
+			_, err := ParseRedemptionToken(malformed, secret, now)
+			if err != ErrInvalidRedemptionToken {
+				t.Errorf("expected %q to be invalid, got %v", malformed, err)
+			}
+		}
+	})
+	t.Run("Unique", func(t *testing.T) {
+		other, _, err := NewRedemptionToken(customer, secret, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other == token {
+			t.Fail()
+		}
+	})
+	t.Run("PartnerCantRedeem", func(t *testing.T) {
+		partner := &User{AccountType: "partner"}
+		_, _, err := NewRedemptionToken(partner, secret, now)
+		if err != ErrForbidden {
+			t.Errorf("expected ErrForbidden, got %v", err)
+		}
+	})
+}
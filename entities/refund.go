@@ -0,0 +1,74 @@
+package entities
+
+import (
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultRefundWindow is how long customers get a full refund after paying when REFUND_WINDOW_DAYS isn't set
+const DefaultRefundWindow = 14 * 24 * time.Hour
+
+// Cancellation errors
+var (
+	ErrSubscriptionExpired   = errors.New("subscription has already expired")
+	ErrSubscriptionCancelled = errors.New("subscription has already been cancelled")
+	ErrCancelDefaultPlan     = errors.New("the free plan can't be cancelled")
+)
+
+// RefundWindow returns how long customers get a full refund after paying for a subscription.
+// It's read from the REFUND_WINDOW_DAYS env variable as a number of days, e.g. "14".
+func RefundWindow() (time.Duration, error) {
+	value := os.Getenv("REFUND_WINDOW_DAYS")
+	if value == "" {
+		return DefaultRefundWindow, nil
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 0 {
+		return 0, errors.Errorf("invalid REFUND_WINDOW_DAYS %q", value)
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// RefundAmount returns how much of the given payment for the subscription is refunded if it's cancelled at the given time.
+//
+// Customers who used offers during the subscription get no refund. Otherwise they get what's left of the payment
+// within the given window after paying, and after that the part of the payment for the time left until the subscription expires.
+func (s *Subscription) RefundAmount(payment *Payment, offersUsed int, now time.Time, window time.Duration) float64 {
+	if payment == nil || payment.Status != PaymentSucceeded || offersUsed > 0 {
+		return 0
+	}
+	refundable := payment.Amount - payment.RefundedAmount
+	if now.Before(payment.CreatedAt.Add(window)) {
+		return refundable
+	}
+	period := s.ExpireDate.Sub(payment.CreatedAt)
+	left := s.ExpireDate.Sub(now)
+	if period <= 0 || left <= 0 {
+		return 0
+	}
+	amount := math.Floor(payment.Amount*left.Seconds()/period.Seconds()*100) / 100
+	return math.Min(amount, refundable)
+}
+
+// Cancel expires the subscription because it was cancelled at the given time, and removes its remaining offers.
+// Its plan must be set, since subscriptions to the free plan can't be cancelled.
+func (s *Subscription) Cancel(now time.Time) error {
+	if s.CancelledAt != nil {
+		return ErrSubscriptionCancelled
+	}
+	if s.Expired {
+		return ErrSubscriptionExpired
+	}
+	if s.Plan.IsDefault {
+		return ErrCancelDefaultPlan
+	}
+	s.Expired = true
+	s.ExpiryNotified = true
+	s.RemainingOffers = 0
+	s.CancelledAt = &now
+	return nil
+}
@@ -0,0 +1,82 @@
+package entities
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRefundAmount(t *testing.T) {
+	now := time.Now()
+	window := DefaultRefundWindow
+	newPayment := func(age time.Duration) *Payment {
+		p := &Payment{Amount: 120, Status: PaymentSucceeded}
+		p.CreatedAt = now.Add(-age)
+		return p
+	}
+	subscription := &Subscription{ExpireDate: now.Add(30 * 24 * time.Hour)}
+	partlyRefunded := newPayment(0)
+	partlyRefunded.RefundedAmount = 100
+	tests := []struct {
+		name       string
+		payment    *Payment
+		offersUsed int
+		expected   float64
+	}{
+		{"WithinWindow", newPayment(24 * time.Hour), 0, 120},
+		{"ProRated", newPayment(90 * 24 * time.Hour), 0, 30},
+		{"OffersUsed", newPayment(24 * time.Hour), 1, 0},
+		{"NotPaid", nil, 0, 0},
+		{"Failed", &Payment{Amount: 120, Status: PaymentFailed}, 0, 0},
+		{"PartlyRefunded", partlyRefunded, 0, 20},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if amount := subscription.RefundAmount(test.payment, test.offersUsed, now, window); amount != test.expected {
+				t.Errorf("expected a refund of %.2f, got %.2f", test.expected, amount)
+			}
+		})
+	}
+	t.Run("Expired", func(t *testing.T) {
+		expired := &Subscription{ExpireDate: now.Add(-time.Hour)}
+		if amount := expired.RefundAmount(newPayment(400*24*time.Hour), 0, now, window); amount != 0 {
+			t.Errorf("expected no refund, got %.2f", amount)
+		}
+	})
+}
+
+func TestRefundWindow(t *testing.T) {
+	defer os.Unsetenv("REFUND_WINDOW_DAYS")
+	os.Setenv("REFUND_WINDOW_DAYS", "7")
+	window, err := RefundWindow()
+	if err != nil || window != 7*24*time.Hour {
+		t.Errorf("expected a window of 7 days, got %s and %v", window, err)
+	}
+	os.Setenv("REFUND_WINDOW_DAYS", "a week")
+	if _, err := RefundWindow(); err == nil {
+		t.Error("expected an error for an invalid window")
+	}
+}
+
+func TestCancelSubscription(t *testing.T) {
+	now := time.Now()
+	subscription := &Subscription{RemainingOffers: 3}
+	err := subscription.Cancel(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !subscription.IsExpired() || subscription.RemainingOffers != 0 || subscription.CancelledAt == nil {
+		t.Errorf("unexpected cancelled subscription %+v", subscription)
+	}
+	if err := subscription.Cancel(now); err != ErrSubscriptionCancelled {
+		t.Errorf("expected ErrSubscriptionCancelled, got %v", err)
+	}
+	expired := &Subscription{Expired: true}
+	if err := expired.Cancel(now); err != ErrSubscriptionExpired {
+		t.Errorf("expected ErrSubscriptionExpired, got %v", err)
+	}
+	free := &Subscription{Plan: Plan{IsDefault: true}}
+	if err := free.Cancel(now); err != ErrCancelDefaultPlan {
+		t.Errorf("expected ErrCancelDefaultPlan, got %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package entities
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Role is a named set of permissions given to a user
+type Role string
+
+// Permission is a single action a user can be allowed to perform
+type Permission string
+
+// Roles
+const (
+	RoleSuperAdmin Role = "super-admin"
+	RoleModerator  Role = "moderator"
+	RoleFinance    Role = "finance"
+	RoleSupport    Role = "support"
+	RolePartner    Role = "partner"
+	RoleCashier    Role = "cashier"
+	RoleCustomer   Role = "customer"
+)
+
+// Permissions
+const (
+	PermissionAccessAdmin         Permission = "admin:access"
+	PermissionViewUsers           Permission = "users:read"
+	PermissionManageUsers         Permission = "users:write"
+	PermissionManageRoles         Permission = "roles:write"
+	PermissionManagePartners      Permission = "partners:write"
+	PermissionViewOffers          Permission = "offers:read"
+	PermissionManagePlans         Permission = "plans:write"
+	PermissionManageSubscriptions Permission = "subscriptions:write"
+	PermissionViewPayments        Permission = "payments:read"
+	PermissionManageCatalog       Permission = "catalog:write"
+	PermissionManageSupport       Permission = "support:write"
+	PermissionScanOffers          Permission = "offers:scan"
+	PermissionVoidOffers          Permission = "offers:void"
+	PermissionManageCashiers      Permission = "cashiers:write"
+	PermissionManageAPIKeys       Permission = "api-keys:write"
+)
+
+// ErrForbidden is returned when the current user lacks the permission needed for a task
+var ErrForbidden = errors.New("you are not authorized to perform this task")
+
+var rolePermissions = map[Role][]Permission{
+	RoleSuperAdmin: {
+		PermissionAccessAdmin,
+		PermissionViewUsers,
+		PermissionManageUsers,
+		PermissionManageRoles,
+		PermissionManagePartners,
+		PermissionViewOffers,
+		PermissionVoidOffers,
+		PermissionManagePlans,
+		PermissionManageSubscriptions,
+		PermissionViewPayments,
+		PermissionManageCatalog,
+		PermissionManageSupport,
+	},
+	RoleModerator: {
+		PermissionAccessAdmin,
+		PermissionViewUsers,
+		PermissionManageUsers,
+		PermissionManagePartners,
+		PermissionViewOffers,
+		PermissionManageCatalog,
+		PermissionManageSupport,
+	},
+	RoleFinance: {
+		PermissionAccessAdmin,
+		PermissionViewUsers,
+		PermissionViewOffers,
+		PermissionVoidOffers,
+		PermissionManagePlans,
+		PermissionManageSubscriptions,
+		PermissionViewPayments,
+	},
+	RoleSupport: {
+		PermissionAccessAdmin,
+		PermissionViewUsers,
+		PermissionViewOffers,
+	},
+	RolePartner: {
+		PermissionScanOffers,
+		PermissionManageCashiers,
+		PermissionManageAPIKeys,
+	},
+	RoleCashier: {
+		PermissionScanOffers,
+	},
+	RoleCustomer: {},
+}
+
+// Valid returns true if the role is one of the known roles
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+// IsStaff returns true if the role is given to admin panel users
+func (r Role) IsStaff() bool {
+	return r.Valid() && r != RolePartner && r != RoleCashier && r != RoleCustomer
+}
+
+// Has returns true if the role grants the given permission
+func (r Role) Has(p Permission) bool {
+	for _, permission := range rolePermissions[r] {
+		if permission == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions returns the permissions granted by the role
+func (r Role) Permissions() []Permission {
+	return rolePermissions[r]
+}
+
+// DefaultRole returns the role given to new users of the given account type.
+// New admin accounts start with the least privileged staff role and are promoted by a super admin.
+func DefaultRole(accountType string) Role {
+	switch accountType {
+	case "admin":
+		return RoleSupport
+	case "partner":
+		return RolePartner
+	case AccountTypeCashier:
+		return RoleCashier
+	default:
+		return RoleCustomer
+	}
+}
@@ -0,0 +1,85 @@
+package entities
+
+import "testing"
+
+func TestRolePermissions(t *testing.T) {
+	t.Run("SupportIsReadOnly", func(t *testing.T) {
+		if !RoleSupport.Has(PermissionAccessAdmin) || !RoleSupport.Has(PermissionViewUsers) {
+			t.Fail()
+		}
+		if RoleSupport.Has(PermissionManageUsers) || RoleSupport.Has(PermissionManagePlans) {
+			t.Fail()
+		}
+	})
+	t.Run("CustomerHasNoAdminAccess", func(t *testing.T) {
+		if RoleCustomer.Has(PermissionAccessAdmin) || RolePartner.Has(PermissionAccessAdmin) {
+			t.Fail()
+		}
+	})
+	t.Run("UnknownRole", func(t *testing.T) {
+		if Role("owner").Valid() || Role("owner").Has(PermissionViewUsers) {
+			t.Fail()
+		}
+	})
+}
+
+func TestUserGetRole(t *testing.T) {
+	t.Run("LegacyAdmin", func(t *testing.T) {
+		u := User{AccountType: "admin"}
+		if u.GetRole() != RoleSuperAdmin {
+			t.Fail()
+		}
+	})
+	t.Run("Recorded", func(t *testing.T) {
+		u := User{AccountType: "admin", Role: RoleFinance}
+		if u.GetRole() != RoleFinance || u.Can(PermissionManageUsers) {
+			t.Fail()
+		}
+	})
+	t.Run("Customer", func(t *testing.T) {
+		u := User{AccountType: "user"}
+		if u.GetRole() != RoleCustomer {
+			t.Fail()
+		}
+	})
+}
+
+func TestSetRole(t *testing.T) {
+	superAdmin := &User{AccountType: "admin", Role: RoleSuperAdmin}
+	superAdmin.ID = 1
+	moderator := &User{AccountType: "admin", Role: RoleModerator}
+	moderator.ID = 2
+	t.Run("BySuperAdmin", func(t *testing.T) {
+		staff := &User{AccountType: "admin", Role: RoleSupport}
+		staff.ID = 3
+		err := staff.SetRole(RoleFinance, superAdmin)
+		if err != nil {
+			t.Error(err)
+		}
+		if staff.Role != RoleFinance {
+			t.Fail()
+		}
+	})
+	t.Run("ByModerator", func(t *testing.T) {
+		staff := &User{AccountType: "admin", Role: RoleSupport}
+		staff.ID = 3
+		err := staff.SetRole(RoleSuperAdmin, moderator)
+		if err == nil {
+			t.Fail()
+		}
+	})
+	t.Run("StaffRoleForCustomer", func(t *testing.T) {
+		customer := &User{AccountType: "user"}
+		customer.ID = 4
+		err := customer.SetRole(RoleSupport, superAdmin)
+		if err == nil {
+			t.Fail()
+		}
+	})
+	t.Run("OwnRole", func(t *testing.T) {
+		err := superAdmin.SetRole(RoleSupport, superAdmin)
+		if err == nil {
+			t.Fail()
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package entities
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// SessionIDKey is the context key for the ID of the session the request was authenticated with.
+const SessionIDKey key = "SessionID"
+
+// ClientInfoKey is the context key for the ClientInfo of the request.
+const ClientInfoKey key = "ClientInfo"
+
+// sessionTouchInterval is the minimum time between two updates of the last seen time of a session
+const sessionTouchInterval = time.Minute
+
+// ClientInfo describes the device a request is sent from
+type ClientInfo struct {
+	DeviceName string
+	Platform   string
+	IPAddress  string
+	UserAgent  string
+}
+
+// GetClientInfo reads the ClientInfo of the given request.
+// Apps send the name and platform of the device in the Device-Name and Device-Platform headers.
+func GetClientInfo(c *gin.Context) ClientInfo {
+	return ClientInfo{
+		DeviceName: c.GetHeader("Device-Name"),
+		Platform:   c.GetHeader("Device-Platform"),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.Request.UserAgent(),
+	}
+}
+
+// Session represents a login of a user.
+//
+// A session is created on login and holds the hash of the current refresh token.
+// Every refresh rotates the token and keeps the hash of the previous one
+// so that a replayed refresh token can be detected and the session revoked.
+type Session struct {
+	gorm.Model
+	UserID                   uint       `gorm:"index;not null" json:"userID"`
+	RefreshTokenHash         string     `gorm:"unique_index;not null" json:"-"`
+	PreviousRefreshTokenHash string     `gorm:"index" json:"-"`
+	ExpiresAt                time.Time  `json:"expiresAt"`
+	RevokedAt                *time.Time `json:"revokedAt"`
+	DeviceName               string     `json:"deviceName"`
+	Platform                 string     `json:"platform"`
+	IPAddress                string     `json:"ipAddress"`
+	UserAgent                string     `json:"userAgent"`
+	LastSeenAt               time.Time  `json:"lastSeenAt"`
+	Current                  bool       `gorm:"-" json:"current"`
+}
+
+// TokenPair holds the tokens returned to the client on login and refresh.
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Expired returns true if the refresh token of the session has expired
+func (s *Session) Expired() bool {
+	return time.Now().After(s.ExpiresAt)
+}
+
+// IsRevoked returns true if the session has been revoked
+func (s *Session) IsRevoked() bool {
+	return s.RevokedAt != nil
+}
+
+// IsActive returns true if the session can still be used to authenticate requests
+func (s *Session) IsActive() bool {
+	return !s.IsRevoked() && !s.Expired()
+}
+
+// Revoke marks the session as revoked
+func (s *Session) Revoke() {
+	if s.IsRevoked() {
+		return
+	}
+	now := time.Now()
+	s.RevokedAt = &now
+}
+
+// SetClientInfo records the device the session is used from
+func (s *Session) SetClientInfo(info ClientInfo) {
+	if info.DeviceName != "" {
+		s.DeviceName = info.DeviceName
+	}
+	if info.Platform != "" {
+		s.Platform = info.Platform
+	}
+	s.IPAddress = info.IPAddress
+	s.UserAgent = info.UserAgent
+	s.LastSeenAt = time.Now()
+}
+
+// NeedsTouch returns true if the last seen time of the session is stale enough to be updated
+func (s *Session) NeedsTouch() bool {
+	return time.Since(s.LastSeenAt) > sessionTouchInterval
+}
@@ -0,0 +1,45 @@
+package entities
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionIsActive(t *testing.T) {
+	t.Run("Active", func(t *testing.T) {
+		s := Session{ExpiresAt: time.Now().Add(time.Hour)}
+		if !s.IsActive() {
+			t.Fail()
+		}
+	})
+	t.Run("Expired", func(t *testing.T) {
+		s := Session{ExpiresAt: time.Now().Add(-time.Hour)}
+		if s.IsActive() {
+			t.Fail()
+		}
+	})
+	t.Run("Revoked", func(t *testing.T) {
+		s := Session{ExpiresAt: time.Now().Add(time.Hour)}
+		s.Revoke()
+		if s.IsActive() {
+			t.Fail()
+		}
+	})
+}
+
+func TestSessionSetClientInfo(t *testing.T) {
+	s := Session{DeviceName: "shop tablet", Platform: "android"}
+	if !s.NeedsTouch() {
+		t.Fail()
+	}
+	s.SetClientInfo(ClientInfo{IPAddress: "10.0.0.1", UserAgent: "okhttp"})
+	if s.DeviceName != "shop tablet" || s.Platform != "android" {
+		t.Error("empty device details should not override the recorded ones")
+	}
+	if s.IPAddress != "10.0.0.1" || s.UserAgent != "okhttp" {
+		t.Fail()
+	}
+	if s.NeedsTouch() {
+		t.Fail()
+	}
+}
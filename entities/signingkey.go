@@ -0,0 +1,217 @@
+package entities
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/jinzhu/gorm"
+)
+
+// Signing algorithms of access tokens
+const (
+	SigningHS256 = "HS256"
+	SigningRS256 = "RS256"
+	SigningEdDSA = "EdDSA"
+)
+
+// SigningKeyPropagationDelay is how long a new signing key is only used to verify tokens.
+// It gives every running instance the time to load the key before tokens signed with it reach them.
+const SigningKeyPropagationDelay = 5 * time.Minute
+
+// SigningKey is a key used to sign and verify access tokens.
+//
+// A key signs tokens from ActivatesAt until RetiresAt,
+// and keeps verifying the tokens it signed for AccessTokenLifetime after it retires.
+type SigningKey struct {
+	gorm.Model
+	KID         string `gorm:"unique_index"`
+	Algorithm   string
+	PrivateKey  []byte `json:"-"`
+	PublicKey   []byte
+	ActivatesAt time.Time
+	RetiresAt   *time.Time
+}
+
+// NewSigningKey generates a new key of the given algorithm that starts signing tokens at the given time
+func NewSigningKey(algorithm string, activatesAt time.Time) (*SigningKey, error) {
+	kid := make([]byte, 8)
+	_, err := rand.Read(kid)
+	if err != nil {
+		return nil, err
+	}
+	key := &SigningKey{
+		KID:         hex.EncodeToString(kid),
+		Algorithm:   algorithm,
+		ActivatesAt: activatesAt,
+	}
+	var private, public interface{}
+	switch algorithm {
+	case SigningHS256:
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		if err != nil {
+			return nil, err
+		}
+		key.PrivateKey = secret
+		return key, nil
+	case SigningRS256:
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		private, public = rsaKey, &rsaKey.PublicKey
+	case SigningEdDSA:
+		edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		private, public = edPrivate, edPublic
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %s", algorithm)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	key.PrivateKey = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	der, err = x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	key.PublicKey = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	return key, nil
+}
+
+// IsActive returns true if the key signs tokens at the given time
+func (k *SigningKey) IsActive(t time.Time) bool {
+	return !t.Before(k.ActivatesAt) && (k.RetiresAt == nil || t.Before(*k.RetiresAt))
+}
+
+// IsVerifying returns true if tokens signed by the key are still accepted at the given time
+func (k *SigningKey) IsVerifying(t time.Time) bool {
+	return k.RetiresAt == nil || t.Before(k.RetiresAt.Add(AccessTokenLifetime))
+}
+
+// Retire stops the key from signing tokens after the given time
+func (k *SigningKey) Retire(t time.Time) {
+	if k.RetiresAt == nil || t.Before(*k.RetiresAt) {
+		k.RetiresAt = &t
+	}
+}
+
+// keys parses the key material into the jwt signing method and the keys it signs and verifies with
+func (k *SigningKey) keys() (jwt.SigningMethod, interface{}, interface{}, error) {
+	if k.Algorithm == SigningHS256 {
+		return jwt.SigningMethodHS256, k.PrivateKey, k.PrivateKey, nil
+	}
+	block, _ := pem.Decode(k.PrivateKey)
+	if block == nil {
+		return nil, nil, nil, fmt.Errorf("invalid private key of signing key %s", k.KID)
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		if k.Algorithm == SigningRS256 {
+			return jwt.SigningMethodRS256, private, &private.PublicKey, nil
+		}
+	case ed25519.PrivateKey:
+		if k.Algorithm == SigningEdDSA {
+			return SigningMethodEdDSA, private, private.Public(), nil
+		}
+	}
+	return nil, nil, nil, fmt.Errorf("signing key %s doesn't match algorithm %s", k.KID, k.Algorithm)
+}
+
+// JWK describes a public key as a JSON Web Key (RFC 7517)
+type JWK struct {
+	KID       string `json:"kid"`
+	KeyType   string `json:"kty"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+// JWKSet is the list of public keys other services use to verify access tokens
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// newJWK returns the JWK of the given public key.
+// It returns false for HS256 keys since they can't be shared.
+func newJWK(kid string, verifyKey interface{}) (JWK, bool) {
+	switch public := verifyKey.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			KID:       kid,
+			KeyType:   "RSA",
+			Algorithm: SigningRS256,
+			Use:       "sig",
+			N:         base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}, true
+	case ed25519.PublicKey:
+		return JWK{
+			KID:       kid,
+			KeyType:   "OKP",
+			Algorithm: SigningEdDSA,
+			Use:       "sig",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(public),
+		}, true
+	}
+	return JWK{}, false
+}
+
+// signingMethodEdDSA implements the EdDSA algorithm (RFC 8037) with Ed25519 keys for jwt-go
+type signingMethodEdDSA struct{}
+
+// SigningMethodEdDSA signs tokens with an ed25519.PrivateKey and verifies them with an ed25519.PublicKey
+var SigningMethodEdDSA jwt.SigningMethod = &signingMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningEdDSA, func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return SigningEdDSA
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(private, []byte(signingString))), nil
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(public, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package entities
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// StreamTicketLifetime is how long a stream ticket can be used to open the event stream
+const StreamTicketLifetime = 30 * time.Second
+
+// ErrInvalidStreamTicket is returned when opening the event stream with a ticket that is unknown, used or expired
+var ErrInvalidStreamTicket = errors.New("invalid stream ticket")
+
+// StreamTicket authenticates opening a single event stream.
+// EventSource can't send headers, so browsers send a short lived ticket in the query instead of the auth token.
+type StreamTicket struct {
+	gorm.Model
+	UserID    uint      `gorm:"index;not null" json:"userID"`
+	TokenHash string    `gorm:"unique_index;not null" json:"-"`
+	ExpiresAt time.Time `gorm:"index;not null" json:"expiresAt"`
+}
+
+// NewStreamTicket returns a new ticket of the user with the given ID and its record
+func NewStreamTicket(userID uint, now time.Time) (string, *StreamTicket, error) {
+	ticket, err := GenerateRefreshToken()
+	if err != nil {
+		return "", nil, errors.Wrap(err, "error generating stream ticket")
+	}
+	return ticket, &StreamTicket{
+		UserID:    userID,
+		TokenHash: HashRefreshToken(ticket),
+		ExpiresAt: now.Add(StreamTicketLifetime),
+	}, nil
+}
@@ -0,0 +1,24 @@
+package entities
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewStreamTicket(t *testing.T) {
+	now := time.Now()
+	ticket, record, err := NewStreamTicket(1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.UserID != 1 || record.TokenHash != HashRefreshToken(ticket) || record.TokenHash == ticket {
+		t.Errorf("unexpected ticket record %+v", record)
+	}
+	if !record.ExpiresAt.Equal(now.Add(StreamTicketLifetime)) {
+		t.Errorf("expected the ticket to expire after %v, got %v", StreamTicketLifetime, record.ExpiresAt)
+	}
+	other, _, err := NewStreamTicket(1, now)
+	if err != nil || other == ticket {
+		t.Error("expected every ticket to be different")
+	}
+}
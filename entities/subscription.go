@@ -22,14 +22,16 @@ type ISubscription interface {
 // Subscription defines a user subscription to a plan
 type Subscription struct {
 	gorm.Model
-	UserID              uint      `gorm:"not null" json:"userID"`
-	PlanID              uint      `gorm:"not null" json:"planID"`
-	ExpireDate          time.Time `gorm:"not null" json:"expireDate"`
-	DelegationStartDate time.Time ` json:"-"`
-	RemainingOffers     uint      `gorm:"not null" json:"remainingOffers"`
-	Expired             bool      `gorm:"not null,default:fasle" json:"expired"`
-	PaymentID           string    `json:"omit"`
-	Plan                Plan      `json:"plan"`
+	UserID              uint       `gorm:"not null" json:"userID"`
+	PlanID              uint       `gorm:"not null" json:"planID"`
+	ExpireDate          time.Time  `gorm:"not null" json:"expireDate"`
+	DelegationStartDate time.Time  ` json:"-"`
+	RemainingOffers     uint       `gorm:"not null" json:"remainingOffers"`
+	Expired             bool       `gorm:"not null,default:fasle" json:"expired"`
+	PaymentID           string     `json:"omit"`
+	ExpiryNotified      bool       `gorm:"not null;default:false" json:"-"`
+	CancelledAt         *time.Time `json:"cancelledAt"`
+	Plan                Plan       `json:"plan"`
 }
 
 // Expire the subscription
@@ -37,14 +39,21 @@ func (s *Subscription) Expire() {
 	s.Expired = true
 }
 
+// Replace expires the subscription because the user moved to a new one.
+// Replaced subscriptions don't get an expiry notice.
+func (s *Subscription) Replace() {
+	s.Expired = true
+	s.ExpiryNotified = true
+}
+
 // HasExpirPassed returns true if the expire date has passed
 func (s *Subscription) HasExpirPassed() bool {
 	return time.Now().After(s.ExpireDate)
 }
 
-// IsExpired returns true if the expired field of the subscription is true
+// IsExpired returns true if the expired field of the subscription is true, or if it's being cancelled
 func (s *Subscription) IsExpired() bool {
-	return s.Expired
+	return s.Expired || s.CancelledAt != nil
 }
 
 // GetRemainingOffers returns the remaining offers
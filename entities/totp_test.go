@@ -0,0 +1,137 @@
+package entities
+
+import (
+	"encoding/base32"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHOTP(t *testing.T) {
+	// Test vectors of RFC 6238 for SHA1
+	key := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for unix, want := range vectors {
+		got := hotp(key, uint64(unix/totpPeriod), 8)
+		if got != want {
+			t.Errorf("at %d expected %s got %s", unix, want, got)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(59, 0)
+	t.Run("Valid", func(t *testing.T) {
+		step, ok := ValidateTOTP(secret, "287082", now, 0)
+		if !ok || step != 1 {
+			t.Error(step, ok)
+		}
+	})
+	t.Run("Skew", func(t *testing.T) {
+		_, ok := ValidateTOTP(secret, "287082", now.Add(totpPeriod*time.Second), 0)
+		if !ok {
+			t.Error("codes of the previous period should be accepted")
+		}
+		_, ok = ValidateTOTP(secret, "287082", now.Add(3*totpPeriod*time.Second), 0)
+		if ok {
+			t.Error("old codes should be rejected")
+		}
+	})
+	t.Run("Replay", func(t *testing.T) {
+		_, ok := ValidateTOTP(secret, "287082", now, 1)
+		if ok {
+			t.Error("used codes should be rejected")
+		}
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		_, ok := ValidateTOTP(secret, "123", now, 0)
+		if ok {
+			t.Fail()
+		}
+		_, ok = ValidateTOTP("not base32!", "287082", now, 0)
+		if ok {
+			t.Fail()
+		}
+	})
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	user := &User{Email: "admin@tasarruf.com"}
+	err := user.StartTOTPEnrollment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	err = user.FinishTOTPEnrollment("000000", now)
+	if err == nil || user.TOTPEnabled {
+		t.Error("wrong codes should not enable TOTP")
+	}
+	code, err := TOTPCode(user.TOTPSecret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.FinishTOTPEnrollment(code, now)
+	if err != nil || !user.TOTPEnabled {
+		t.Fatal(err)
+	}
+	if user.CheckTOTP(code, now) {
+		t.Error("codes should be accepted only once")
+	}
+	err = user.StartTOTPEnrollment()
+	if err == nil {
+		t.Error("enrollment should not restart while TOTP is enabled")
+	}
+	user.DisableTOTP()
+	if user.TOTPEnabled || user.TOTPSecret != "" {
+		t.Fail()
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("ABCDEF", "admin@tasarruf.com")
+	if !strings.HasPrefix(uri, "otpauth://totp/Tasarruf:admin@tasarruf.com?") || !strings.Contains(uri, "secret=ABCDEF") {
+		t.Error(uri)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, records, err := GenerateRecoveryCodes(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount || len(records) != RecoveryCodeCount {
+		t.Fatal(codes)
+	}
+	if len(codes[0]) != 11 || codes[0][5] != '-' {
+		t.Error(codes[0])
+	}
+	if HashRecoveryCode(strings.ToUpper(strings.Replace(codes[0], "-", "", 1))) != records[0].CodeHash {
+		t.Error("recovery codes should match without case and dash")
+	}
+}
+
+func TestNeedsTwoFactorSetup(t *testing.T) {
+	admin := &User{AccountType: "admin", Role: RoleSupport}
+	customer := &User{AccountType: "user"}
+	if admin.NeedsTwoFactorSetup() {
+		t.Error("two-factor authentication is not enforced by default")
+	}
+	defer os.Setenv("REQUIRE_STAFF_2FA", os.Getenv("REQUIRE_STAFF_2FA"))
+	os.Setenv("REQUIRE_STAFF_2FA", "true")
+	if !admin.NeedsTwoFactorSetup() || customer.NeedsTwoFactorSetup() {
+		t.Fail()
+	}
+	admin.TOTPEnabled = true
+	if admin.NeedsTwoFactorSetup() {
+		t.Fail()
+	}
+}
@@ -0,0 +1,146 @@
+package entities
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// LoginChallengeLifetime is how long the second login step can be completed in
+const LoginChallengeLifetime = 5 * time.Minute
+
+// RecoveryCodeCount is the number of recovery codes given to a user when enabling two-factor authentication
+const RecoveryCodeCount = 10
+
+const recoveryCodeLetters = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// LoginChallenge is issued when the password of a user with two-factor authentication is verified.
+// It is exchanged for the auth tokens together with a TOTP or recovery code.
+type LoginChallenge struct {
+	gorm.Model
+	UserID    uint       `gorm:"index;not null" json:"userID"`
+	TokenHash string     `gorm:"unique_index;not null" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt"`
+}
+
+// IsValid returns true if the challenge is neither used nor expired
+func (c *LoginChallenge) IsValid() bool {
+	return c.UsedAt == nil && time.Now().Before(c.ExpiresAt)
+}
+
+// Use marks the challenge as used
+func (c *LoginChallenge) Use() {
+	now := time.Now()
+	c.UsedAt = &now
+}
+
+// RecoveryCode is a single use code that replaces a TOTP code when the authenticator is lost
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint       `gorm:"index;not null" json:"userID"`
+	CodeHash string     `gorm:"index;not null" json:"-"`
+	UsedAt   *time.Time `json:"usedAt"`
+}
+
+// TwoFactorRequiredError is returned by logins that need a second step.
+// The challenge token has to be sent back with a TOTP or recovery code.
+type TwoFactorRequiredError struct {
+	ChallengeToken string
+	ExpiresAt      time.Time
+}
+
+func (e *TwoFactorRequiredError) Error() string {
+	return "two-factor authentication code required"
+}
+
+// StaffTwoFactorEnforced returns true if staff accounts have to enable two-factor authentication
+// before using the admin panel. It is enabled by setting REQUIRE_STAFF_2FA to true.
+func StaffTwoFactorEnforced() bool {
+	return os.Getenv("REQUIRE_STAFF_2FA") == "true"
+}
+
+// NeedsTwoFactorSetup returns true if the user is not allowed to use their permissions before enabling two-factor authentication
+func (user *User) NeedsTwoFactorSetup() bool {
+	return StaffTwoFactorEnforced() && user.GetRole().IsStaff() && !user.TOTPEnabled
+}
+
+// StartTOTPEnrollment sets a new TOTP secret to the user. It isn't used on login until enrollment is finished.
+func (user *User) StartTOTPEnrollment() error {
+	if user.TOTPEnabled {
+		return errors.New("two-factor authentication is already enabled")
+	}
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return errors.Wrap(err, "error generating TOTP secret")
+	}
+	user.TOTPSecret = secret
+	return nil
+}
+
+// FinishTOTPEnrollment enables two-factor authentication if the code matches the secret set on enrollment
+func (user *User) FinishTOTPEnrollment(code string, now time.Time) error {
+	if user.TOTPEnabled {
+		return errors.New("two-factor authentication is already enabled")
+	}
+	if user.TOTPSecret == "" {
+		return errors.New("two-factor authentication enrollment has not been started")
+	}
+	if !user.CheckTOTP(code, now) {
+		return errors.New("code doesn't match")
+	}
+	user.TOTPEnabled = true
+	return nil
+}
+
+// CheckTOTP returns true if the code matches the TOTP secret of the user.
+// A code is only accepted once.
+func (user *User) CheckTOTP(code string, now time.Time) bool {
+	step, ok := ValidateTOTP(user.TOTPSecret, code, now, user.TOTPLastStep)
+	if !ok {
+		return false
+	}
+	user.TOTPLastStep = step
+	return true
+}
+
+// DisableTOTP disables two-factor authentication and removes the secret of the user
+func (user *User) DisableTOTP() {
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+}
+
+// GenerateRecoveryCodes returns new recovery codes and their records for the given user
+func GenerateRecoveryCodes(userID uint) ([]string, []RecoveryCode, error) {
+	codes := make([]string, RecoveryCodeCount)
+	records := make([]RecoveryCode, RecoveryCodeCount)
+	max := big.NewInt(int64(len(recoveryCodeLetters)))
+	for i := range codes {
+		b := make([]byte, 10)
+		for j := range b {
+			n, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "error generating recovery code")
+			}
+			b[j] = recoveryCodeLetters[n.Int64()]
+		}
+		codes[i] = string(b[:5]) + "-" + string(b[5:])
+		records[i] = RecoveryCode{UserID: userID, CodeHash: HashRecoveryCode(codes[i])}
+	}
+	return codes, records, nil
+}
+
+// HashRecoveryCode returns the value of the recovery code stored in the database.
+// Codes are compared case insensitively and without the dash.
+func HashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
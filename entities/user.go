@@ -6,6 +6,7 @@ package entities
 import (
 	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
+	"strings"
 	"time"
 )
 
@@ -36,6 +37,8 @@ type IUser interface {
 	GetProfileImageKey() string
 	IsVerified() bool
 	IsAdmin() bool
+	GetRole() Role
+	Can(permission Permission) bool
 	GetID() uint
 	GetAccountType() string
 	ToggleActive(admin IUser) error
@@ -58,9 +61,16 @@ type User struct {
 	ProfileImageKey        string         `json:"profileImageKey"`
 	PartnerProfile         PartnerProfile `gorm:"foreignkey:PartnerProfileID" json:"partnerProfile,omitempty"`
 	Verified               bool           `gorm:"default:false" json:"verified"`
+	EmailVerified          bool           `gorm:"default:false" json:"emailVerified"`
+	TOTPSecret             string         `json:"-"`
+	TOTPEnabled            bool           `gorm:"default:false" json:"totpEnabled"`
+	TOTPLastStep           int64          `json:"-"`
 	OTP                    *OTP           `json:"-"`
 	City                   City           `json:"city" gorm:"-"`
 	Active                 bool           `json:"active" gorm:"default:true;not null"`
+	Role                   Role           `json:"role"`
+	PartnerID              uint           `gorm:"index" json:"partnerID,omitempty"`
+	BranchID               uint           `json:"branchID,omitempty"`
 }
 
 // IsPartner returns true if the user account type is partner
@@ -73,6 +83,44 @@ func (user *User) IsAdmin() bool {
 	return user.AccountType == "admin"
 }
 
+// GetRole returns the role of the user.
+// Users created before roles were introduced have no role recorded, admins among them keep full access.
+func (user *User) GetRole() Role {
+	if user.Role != "" {
+		return user.Role
+	}
+	if user.IsAdmin() {
+		return RoleSuperAdmin
+	}
+	return DefaultRole(user.AccountType)
+}
+
+// Can returns true if the role of the user grants the given permission
+func (user *User) Can(permission Permission) bool {
+	return user.GetRole().Has(permission)
+}
+
+// SetRole sets the role of the user. Staff roles can only be given to admin accounts.
+func (user *User) SetRole(role Role, currentUser IUser) error {
+	if !currentUser.Can(PermissionManageRoles) {
+		return ErrForbidden
+	}
+	if currentUser.GetID() == user.ID {
+		return errors.New("users cannot change their own role")
+	}
+	if !role.Valid() {
+		return errors.New("unknown role")
+	}
+	if role.IsStaff() != user.IsAdmin() {
+		return errors.New("staff roles can only be given to admin accounts")
+	}
+	if !role.IsStaff() && role != DefaultRole(user.AccountType) {
+		return errors.New("role does not match the account type")
+	}
+	user.Role = role
+	return nil
+}
+
 // GetID gets the user ID
 func (user *User) GetID() uint {
 	return user.ID
@@ -166,6 +214,11 @@ func (user *User) GetEmail() string {
 	return user.Email
 }
 
+// GetFullName returns the first and last names of the user
+func (user *User) GetFullName() string {
+	return strings.TrimSpace(user.FirstName + " " + user.LastName)
+}
+
 // GetMobile returns the user mobile
 func (user *User) GetMobile() string {
 	return user.Mobile
@@ -218,7 +271,7 @@ func (user *User) SetOTP(otp *OTP) {
 
 // ToggleActive toggles user active propery. Returns error if provided user is not admin.
 func (user *User) ToggleActive(admin IUser) error {
-	if !admin.IsAdmin() {
+	if !admin.Can(PermissionManageUsers) {
 		return errors.New("not authorized to toggle user active property")
 	}
 	user.Active = !user.Active
@@ -241,7 +294,7 @@ func (user *User) ValidatePassword(password string) error {
 }
 
 func verifyAuthorization(c1 IUser, c2 IUser) error {
-	if c1.GetID() == c2.GetID() || c2.IsAdmin() {
+	if c1.GetID() == c2.GetID() || c2.Can(PermissionManageUsers) {
 		return nil
 	}
 	return errors.New("Not Authroized")
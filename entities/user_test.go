@@ -195,3 +195,14 @@ func TestToggleActiveByNotAdmin(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestGetFullName(t *testing.T) {
+	u := User{FirstName: "Ahmed"}
+	if u.GetFullName() != "Ahmed" {
+		t.Error(u.GetFullName())
+	}
+	u.LastName = "Abouzied"
+	if u.GetFullName() != "Ahmed Abouzied" {
+		t.Error(u.GetFullName())
+	}
+}
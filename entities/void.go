@@ -0,0 +1,71 @@
+package entities
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Statuses of offers
+const (
+	OfferConsumed = "consumed"
+	OfferVoided   = "voided"
+)
+
+// DefaultVoidWindow is how long partners can void an offer after consuming it when OFFER_VOID_WINDOW isn't set
+const DefaultVoidWindow = 15 * time.Minute
+
+// Void errors
+var (
+	ErrOfferVoided      = errors.New("offer has already been voided")
+	ErrVoidWindowPassed = errors.New("offer can no longer be voided, please contact support")
+)
+
+// VoidWindow returns how long partners can void an offer after consuming it.
+// It's read from the OFFER_VOID_WINDOW env variable as a duration, e.g. "15m".
+func VoidWindow() (time.Duration, error) {
+	value := os.Getenv("OFFER_VOID_WINDOW")
+	if value == "" {
+		return DefaultVoidWindow, nil
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		return 0, errors.Errorf("invalid OFFER_VOID_WINDOW %q", value)
+	}
+	return window, nil
+}
+
+// IsVoided returns true if the offer has been voided
+func (o *Offer) IsVoided() bool {
+	return o.Status == OfferVoided
+}
+
+// Void cancels the offer for the given reason.
+// The partner who consumed the offer, or one of their cashiers, can void it within the given window after it was consumed.
+// Staff with the void permission can void it at any time.
+func (o *Offer) Void(voider *User, reason string, now time.Time, window time.Duration) error {
+	if !voider.Can(PermissionVoidOffers) {
+		partnerID := voider.ScanningPartnerID()
+		if partnerID == 0 || partnerID != o.PartnerID {
+			return ErrForbidden
+		}
+		if now.After(o.CreatedAt.Add(window)) {
+			return ErrVoidWindowPassed
+		}
+	}
+	if o.IsVoided() {
+		return ErrOfferVoided
+	}
+	if o.Status != OfferConsumed {
+		return errors.New("only consumed offers can be voided")
+	}
+	if reason == "" {
+		return errors.New("reason is required")
+	}
+	o.Status = OfferVoided
+	o.VoidedAt = &now
+	o.VoidReason = reason
+	o.VoidedByID = voider.ID
+	return nil
+}
@@ -0,0 +1,67 @@
+package entities
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVoidOffer(t *testing.T) {
+	now := time.Now()
+	partner := &User{AccountType: "partner", Role: RolePartner}
+	partner.ID = 2
+	cashier := &User{AccountType: AccountTypeCashier, Role: RoleCashier, PartnerID: 2}
+	cashier.ID = 5
+	otherPartner := &User{AccountType: "partner", Role: RolePartner}
+	otherPartner.ID = 3
+	finance := &User{AccountType: "admin", Role: RoleFinance}
+	finance.ID = 1
+	support := &User{AccountType: "admin", Role: RoleSupport}
+	newOffer := func(age time.Duration) *Offer {
+		offer := &Offer{CustomerID: 4, PartnerID: 2, Status: OfferConsumed}
+		offer.CreatedAt = now.Add(-age)
+		return offer
+	}
+	t.Run("ByPartner", func(t *testing.T) {
+		offer := newOffer(time.Minute)
+		err := offer.Void(partner, "Wrong amount", now, DefaultVoidWindow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !offer.IsVoided() || offer.VoidedByID != partner.ID || offer.VoidReason != "Wrong amount" || offer.VoidedAt == nil {
+			t.Errorf("unexpected offer %+v", offer)
+		}
+		if err := offer.Void(partner, "Wrong amount", now, DefaultVoidWindow); err != ErrOfferVoided {
+			t.Errorf("expected ErrOfferVoided, got %v", err)
+		}
+	})
+	t.Run("ByCashier", func(t *testing.T) {
+		offer := newOffer(time.Minute)
+		if err := offer.Void(cashier, "Wrong amount", now, DefaultVoidWindow); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("AfterWindow", func(t *testing.T) {
+		offer := newOffer(DefaultVoidWindow + time.Second)
+		if err := offer.Void(partner, "Wrong amount", now, DefaultVoidWindow); err != ErrVoidWindowPassed {
+			t.Errorf("expected ErrVoidWindowPassed, got %v", err)
+		}
+		if err := offer.Void(finance, "Refunded by support", now, DefaultVoidWindow); err != nil {
+			t.Errorf("expected staff to void the offer after the window, got %v", err)
+		}
+	})
+	t.Run("Forbidden", func(t *testing.T) {
+		offer := newOffer(time.Minute)
+		if err := offer.Void(otherPartner, "Wrong amount", now, DefaultVoidWindow); err != ErrForbidden {
+			t.Errorf("expected ErrForbidden for another partner, got %v", err)
+		}
+		if err := offer.Void(support, "Wrong amount", now, DefaultVoidWindow); err != ErrForbidden {
+			t.Errorf("expected ErrForbidden for support, got %v", err)
+		}
+	})
+	t.Run("WithoutReason", func(t *testing.T) {
+		offer := newOffer(time.Minute)
+		if err := offer.Void(partner, "", now, DefaultVoidWindow); err == nil || offer.IsVoided() {
+			t.Error("expected a void without a reason to be rejected")
+		}
+	})
+}
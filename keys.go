@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/ahmedaabouzied/tasarruf/entities"
+	"github.com/ahmedaabouzied/tasarruf/user"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// signingAlgorithm returns the algorithm of new signing keys.
+// It defaults to the JWT_SIGNING_ALGORITHM env variable, then HS256.
+func signingAlgorithm(algorithm string) string {
+	if algorithm == "" {
+		algorithm = os.Getenv("JWT_SIGNING_ALGORITHM")
+	}
+	if algorithm == "" {
+		algorithm = entities.SigningHS256
+	}
+	return algorithm
+}
+
+// rotateSigningKey adds a new signing key that replaces the current one after entities.SigningKeyPropagationDelay.
+// Running instances pick the new key up while the tokens signed with the old one stay valid until they expire.
+func rotateSigningKey(userRepo user.Repository, algorithm string) (*entities.SigningKey, error) {
+	key, err := entities.NewSigningKey(signingAlgorithm(algorithm), time.Now().Add(entities.SigningKeyPropagationDelay))
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating signing key")
+	}
+	err = userRepo.RotateSigningKey(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// loadKeyring sets the keyring of access tokens from the signing keys in the database
+func loadKeyring(userRepo user.Repository) error {
+	keys, err := userRepo.GetSigningKeys(context.Background())
+	if err != nil {
+		return err
+	}
+	keyring, err := entities.NewKeyring(keys, entities.LegacySecret(), time.Now())
+	if err != nil {
+		return errors.Wrap(err, "error loading signing keys")
+	}
+	entities.SetKeyring(keyring)
+	return nil
+}
+
+// refreshKeyring periodically reloads the signing keys so that rotated keys are picked up without a restart
+func refreshKeyring(userRepo user.Repository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := loadKeyring(userRepo)
+		if err != nil {
+			log.Error(errors.Wrap(err, "error refreshing signing keys"))
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Package mailer sends transactional emails through a configurable backend.
+package mailer
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"os"
+	"strings"
+)
+
+// Address is an email address with an optional display name
+type Address struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// Attachment is a file attached to an email
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Content     []byte `json:"-"`
+}
+
+// Message is a single email
+type Message struct {
+	From        Address      `json:"from"`
+	To          []Address    `json:"to"`
+	Subject     string       `json:"subject"`
+	HTML        string       `json:"html"`
+	Attachments []Attachment `json:"attachments"`
+}
+
+// Mailer sends emails
+type Mailer interface {
+	Send(ctx context.Context, m *Message) error
+}
+
+// DefaultFrom returns the sender address of outgoing emails.
+// It is read from the MAIL_FROM_ADDRESS and MAIL_FROM_NAME environment variables.
+func DefaultFrom() Address {
+	from := Address{
+		Name:  os.Getenv("MAIL_FROM_NAME"),
+		Email: os.Getenv("MAIL_FROM_ADDRESS"),
+	}
+	if from.Name == "" {
+		from.Name = "Tasarruf"
+	}
+	if from.Email == "" {
+		from.Email = "noreply@tasarruf.com"
+	}
+	return from
+}
+
+// CreateMailer returns the mailer selected by the MAIL_PROVIDER environment variable.
+//
+// Supported providers are "sendgrid" (the default), "smtp" and "outbox" which writes
+// emails to the MAIL_OUTBOX_DIR directory instead of sending them and is meant for development.
+func CreateMailer() (Mailer, error) {
+	provider := strings.ToLower(os.Getenv("MAIL_PROVIDER"))
+	switch provider {
+	case "", "sendgrid":
+		return CreateSendGridMailer(os.Getenv("SENDGRID_API_KEY")), nil
+	case "smtp":
+		return CreateSMTPMailerFromEnv()
+	case "outbox":
+		outbox, err := CreateOutboxMailer(os.Getenv("MAIL_OUTBOX_DIR"))
+		if err != nil {
+			return nil, err
+		}
+		return outbox, nil
+	default:
+		return nil, errors.Errorf("unknown mail provider %q", provider)
+	}
+}
+
+// SendTemplate renders the template with the given name and sends it to the given address
+func SendTemplate(ctx context.Context, mailer Mailer, to Address, name string, data Data, attachments ...Attachment) error {
+	if to.Email == "" {
+		return errors.New("recipient has no email address")
+	}
+	subject, html, err := Render(name, data)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(ctx, &Message{
+		From:        DefaultFrom(),
+		To:          []Address{to},
+		Subject:     subject,
+		HTML:        html,
+		Attachments: attachments,
+	})
+}
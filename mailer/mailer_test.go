@@ -0,0 +1,173 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ahmedaabouzied/tasarruf/entities"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRender(t *testing.T) {
+	t.Run("Receipt", func(t *testing.T) {
+		subject, html, err := Render(TemplateReceipt, Data{
+			"Name":       "Ahmed <b>",
+			"Plan":       entities.Plan{EnglishName: "Gold", TurkishName: "Altın"},
+			"Amount":     49.9,
+			"PaymentID":  "12345",
+			"ExpireDate": time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if subject != "TASARRUF ödeme makbuzunuz / Your Tasarruf receipt" {
+			t.Error(subject)
+		}
+		for _, want := range []string{"Gold", "Altın", "49.90 TL", "1 Mar 2021", "Ahmed &lt;b&gt;"} {
+			if !strings.Contains(html, want) {
+				t.Errorf("expected %q in %s", want, html)
+			}
+		}
+	})
+	t.Run("Cancellation", func(t *testing.T) {
+		data := Data{
+			"Name":   "Ahmed",
+			"Plan":   entities.Plan{EnglishName: "Gold", TurkishName: "Altın"},
+			"Refund": 30.0,
+		}
+		_, html, err := Render(TemplateCancellation, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(html, "30.00 TL") {
+			t.Errorf("expected the refund in %s", html)
+		}
+		data["Refund"] = 0.0
+		_, html, err = Render(TemplateCancellation, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(html, "TL") {
+			t.Errorf("expected no refund in %s", html)
+		}
+	})
+	t.Run("MissingData", func(t *testing.T) {
+		_, _, err := Render(TemplateVerification, Data{"Name": "Ahmed"})
+		if err == nil {
+			t.Fail()
+		}
+	})
+	t.Run("UnknownTemplate", func(t *testing.T) {
+		_, _, err := Render("unknown", Data{})
+		if err == nil {
+			t.Fail()
+		}
+	})
+}
+
+func TestMessageBytes(t *testing.T) {
+	m := &Message{
+		From:    Address{Name: "Tasarruf", Email: "noreply@tasarruf.com"},
+		To:      []Address{{Name: "Ahmed", Email: "ahmed@example.com"}},
+		Subject: "Özet / Summary",
+		HTML:    "<p>merhaba</p>",
+		Attachments: []Attachment{
+			{Filename: "summary.csv", ContentType: "text/csv", Content: []byte("a,b\n1,2\n")},
+		},
+	}
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := mail.ReadMessage(strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil || subject != m.Subject {
+		t.Error(subject, err)
+	}
+	_, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := multipart.NewReader(parsed.Body, params["boundary"])
+	var parts []string
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		content, _ := ioutil.ReadAll(part)
+		if part.FileName() == "summary.csv" {
+			if !strings.Contains(string(content), "YSxiCjEsMgo=") {
+				t.Error(string(content))
+			}
+		}
+		parts = append(parts, part.Header.Get("Content-Type"))
+	}
+	if len(parts) != 2 {
+		t.Error(parts)
+	}
+}
+
+func TestOutboxMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outbox, err := CreateOutboxMailer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SendTemplate(context.Background(), outbox, Address{Email: "ahmed@example.com"}, TemplateWelcome, Data{"Name": "Ahmed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := outbox.Messages()
+	if len(messages) != 1 || messages[0].To[0].Email != "ahmed@example.com" {
+		t.Fatal(messages)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatal(files, err)
+	}
+	err = SendTemplate(context.Background(), outbox, Address{}, TemplateWelcome, Data{"Name": "Ahmed"})
+	if err == nil {
+		t.Error("expected an error for a recipient without an email")
+	}
+}
+
+func TestSendGridMailer(t *testing.T) {
+	var body map[string]interface{}
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	mailer := CreateSendGridMailer("key").(*sendGridMailer)
+	mailer.host = server.URL
+	err := mailer.Send(context.Background(), &Message{
+		From:    DefaultFrom(),
+		To:      []Address{{Email: "ahmed@example.com"}},
+		Subject: "subject",
+		HTML:    "<p>body</p>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer key" || body["subject"] != "subject" {
+		t.Error(auth, body)
+	}
+}
@@ -0,0 +1,76 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Bytes encodes the message as a MIME email ready to be handed to an SMTP server
+func (m *Message) Bytes() ([]byte, error) {
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	to := make([]string, len(m.To))
+	for i, address := range m.To {
+		to[i] = address.String()
+	}
+	fmt.Fprintf(&b, "From: %s\r\n", m.From.String())
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", w.Boundary())
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return nil, errors.Wrap(err, "error writing email body")
+	}
+	qp := quotedprintable.NewWriter(part)
+	_, err = qp.Write([]byte(m.HTML))
+	if err != nil {
+		return nil, errors.Wrap(err, "error writing email body")
+	}
+	err = qp.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "error writing email body")
+	}
+
+	for _, attachment := range m.Attachments {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", attachment.ContentType)
+		header.Set("Content-Transfer-Encoding", "base64")
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return nil, errors.Wrap(err, "error writing email attachment")
+		}
+		encoded := base64.StdEncoding.EncodeToString(attachment.Content)
+		for len(encoded) > 76 {
+			fmt.Fprintf(part, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", encoded)
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "error closing email")
+	}
+	return b.Bytes(), nil
+}
+
+// String formats the address for use in an email header
+func (a Address) String() string {
+	address := mail.Address{Name: a.Name, Address: a.Email}
+	return address.String()
+}
@@ -0,0 +1,64 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// OutboxMailer keeps the emails it is asked to send instead of sending them.
+// Emails are logged, and written to a directory as .eml files when a directory is given.
+type OutboxMailer struct {
+	dir      string
+	mu       sync.Mutex
+	count    int
+	messages []Message
+}
+
+// CreateOutboxMailer returns an outbox mailer writing to the given directory
+func CreateOutboxMailer(dir string) (*OutboxMailer, error) {
+	if dir != "" {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating mail outbox directory")
+		}
+	}
+	return &OutboxMailer{dir: dir}, nil
+}
+
+// Send keeps the message in the outbox
+func (o *OutboxMailer) Send(ctx context.Context, m *Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.count++
+	o.messages = append(o.messages, *m)
+	log.WithField("to", m.To).Info("email : ", m.Subject)
+	if o.dir == "" {
+		return nil
+	}
+	body, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%04d.eml", time.Now().Format("20060102-150405"), o.count)
+	err = ioutil.WriteFile(filepath.Join(o.dir, name), body, 0644)
+	if err != nil {
+		return errors.Wrap(err, "error writing email to outbox")
+	}
+	return nil
+}
+
+// Messages returns the messages kept in the outbox
+func (o *OutboxMailer) Messages() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	messages := make([]Message, len(o.messages))
+	copy(messages, o.messages)
+	return messages
+}
@@ -0,0 +1,56 @@
+package mailer
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"github.com/sendgrid/sendgrid-go"
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+const sendGridHost = "https://api.sendgrid.com"
+
+type sendGridMailer struct {
+	apiKey string
+	host   string
+}
+
+// CreateSendGridMailer returns a mailer that sends emails through the SendGrid API
+func CreateSendGridMailer(apiKey string) Mailer {
+	return &sendGridMailer{
+		apiKey: apiKey,
+		host:   sendGridHost,
+	}
+}
+
+// Send sends the message through the SendGrid API
+func (s *sendGridMailer) Send(ctx context.Context, m *Message) error {
+	message := mail.NewV3Mail()
+	message.SetFrom(mail.NewEmail(m.From.Name, m.From.Email))
+	message.Subject = m.Subject
+	message.AddContent(mail.NewContent("text/html", m.HTML))
+	personalization := mail.NewPersonalization()
+	for _, to := range m.To {
+		personalization.AddTos(mail.NewEmail(to.Name, to.Email))
+	}
+	message.AddPersonalizations(personalization)
+	for _, attachment := range m.Attachments {
+		file := mail.NewAttachment()
+		file.SetContent(base64.StdEncoding.EncodeToString(attachment.Content))
+		file.SetType(attachment.ContentType)
+		file.SetFilename(attachment.Filename)
+		file.SetDisposition("attachment")
+		message.AddAttachment(file)
+	}
+	request := sendgrid.GetRequest(s.apiKey, "/v3/mail/send", s.host)
+	request.Method = "POST"
+	request.Body = mail.GetRequestBody(message)
+	response, err := sendgrid.API(request)
+	if err != nil {
+		return errors.Wrap(err, "error making request to sendgrid API")
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.Errorf("sendgrid API responded with %d: %s", response.StatusCode, response.Body)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package mailer
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"net/smtp"
+	"os"
+)
+
+// SMTPMailer sends emails through an SMTP server
+type SMTPMailer struct {
+	Addr string
+	Auth smtp.Auth
+}
+
+// CreateSMTPMailer returns a mailer that sends emails through the SMTP server at the given host and port.
+// Authentication is skipped when no username is given.
+func CreateSMTPMailer(host string, port string, username string, password string) Mailer {
+	m := SMTPMailer{
+		Addr: net.JoinHostPort(host, port),
+	}
+	if username != "" {
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &m
+}
+
+// CreateSMTPMailerFromEnv returns an SMTP mailer configured by the SMTP_HOST, SMTP_PORT,
+// SMTP_USERNAME and SMTP_PASSWORD environment variables
+func CreateSMTPMailerFromEnv() (Mailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, errors.New("SMTP_HOST is not set")
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	return CreateSMTPMailer(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD")), nil
+}
+
+// Send sends the message through the SMTP server
+func (s *SMTPMailer) Send(ctx context.Context, m *Message) error {
+	body, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	to := make([]string, len(m.To))
+	for i, address := range m.To {
+		to[i] = address.Email
+	}
+	err = smtp.SendMail(s.Addr, s.Auth, m.From.Email, to, body)
+	if err != nil {
+		return errors.Wrap(err, "error sending email through smtp")
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"html/template"
+	"time"
+)
+
+// Template names
+const (
+	TemplateWelcome       = "welcome"
+	TemplateVerification  = "verification"
+	TemplateReceipt       = "receipt"
+	TemplateExpiry        = "expiry"
+	TemplateCancellation  = "cancellation"
+	TemplateOffersSummary = "offersSummary"
+	TemplateEmailChanged  = "emailChanged"
+)
+
+// Data holds the values a template is rendered with
+type Data map[string]interface{}
+
+// bilingual holds the english and turkish text of an email.
+// Both are sent in the same email because users have no language preference.
+type bilingual struct {
+	EN string
+	TR string
+}
+
+type source struct {
+	Subject bilingual
+	Body    bilingual
+}
+
+const layout = `<!DOCTYPE html>
+<html>
+<body style="font-family: Arial, Helvetica, sans-serif; color: #333333;">
+<div lang="tr">{{template "tr" .}}</div>
+<hr>
+<div lang="en">{{template "en" .}}</div>
+</body>
+</html>
+`
+
+var sources = map[string]source{
+	TemplateWelcome: {
+		Subject: bilingual{EN: "Welcome to Tasarruf", TR: "TASARRUF'a hoş geldiniz"},
+		Body: bilingual{
+			EN: `<h1>Welcome {{.Name}}</h1><p>Your Tasarruf account has been created. You can now log in to the mobile application.</p>`,
+			TR: `<h1>Hoş geldiniz {{.Name}}</h1><p>TASARRUF hesabınız oluşturuldu. Artık mobil uygulamaya giriş yapabilirsiniz.</p>`,
+		},
+	},
+	TemplateVerification: {
+		Subject: bilingual{EN: "Verify your email address", TR: "E-posta adresinizi doğrulayın"},
+		Body: bilingual{
+			EN: `<p>Hello {{.Name}},</p><p>Your Tasarruf verification code is <strong>{{.Code}}</strong>.</p><p>If you did not request this code you can ignore this email.</p>`,
+			TR: `<p>Merhaba {{.Name}},</p><p>TASARRUF doğrulama kodunuz <strong>{{.Code}}</strong>.</p><p>Bu kodu siz istemediyseniz bu e-postayı dikkate almayınız.</p>`,
+		},
+	},
+	TemplateEmailChanged: {
+		Subject: bilingual{EN: "Your email address was changed", TR: "E-posta adresiniz değiştirildi"},
+		Body: bilingual{
+			EN: `<p>Hello {{.Name}},</p><p>The email address of your Tasarruf account was changed to <strong>{{.NewEmail}}</strong>. You will no longer receive emails at this address.</p><p>If you did not make this change, please contact support immediately.</p>`,
+			TR: `<p>Merhaba {{.Name}},</p><p>TASARRUF hesabınızın e-posta adresi <strong>{{.NewEmail}}</strong> olarak değiştirildi. Bu adrese artık e-posta gönderilmeyecektir.</p><p>Bu değişikliği siz yapmadıysanız lütfen hemen destek ekibiyle iletişime geçiniz.</p>`,
+		},
+	},
+	TemplateReceipt: {
+		Subject: bilingual{EN: "Your Tasarruf receipt", TR: "TASARRUF ödeme makbuzunuz"},
+		Body: bilingual{
+			EN: `<p>Hello {{.Name}},</p><p>Thank you for your payment.</p>
+<table>
+<tr><td>Plan</td><td>{{.Plan.EnglishName}}</td></tr>
+<tr><td>Amount</td><td>{{money .Amount}} TL</td></tr>
+<tr><td>Payment ID</td><td>{{.PaymentID}}</td></tr>
+<tr><td>Valid until</td><td>{{date .ExpireDate}}</td></tr>
+</table>`,
+			TR: `<p>Merhaba {{.Name}},</p><p>Ödemeniz için teşekkür ederiz.</p>
+<table>
+<tr><td>Paket</td><td>{{.Plan.TurkishName}}</td></tr>
+<tr><td>Tutar</td><td>{{money .Amount}} TL</td></tr>
+<tr><td>Ödeme numarası</td><td>{{.PaymentID}}</td></tr>
+<tr><td>Geçerlilik tarihi</td><td>{{date .ExpireDate}}</td></tr>
+</table>`,
+		},
+	},
+	TemplateExpiry: {
+		Subject: bilingual{EN: "Your Tasarruf subscription has expired", TR: "TASARRUF aboneliğinizin süresi doldu"},
+		Body: bilingual{
+			EN: `<p>Hello {{.Name}},</p><p>Your {{.Plan.EnglishName}} subscription expired on {{date .ExpireDate}}. Renew or upgrade your subscription to keep getting discounts.</p>`,
+			TR: `<p>Merhaba {{.Name}},</p><p>{{.Plan.TurkishName}} aboneliğinizin süresi {{date .ExpireDate}} tarihinde doldu. İndirimlerden yararlanmaya devam etmek için aboneliğinizi yenileyebilir veya yükseltebilirsiniz.</p>`,
+		},
+	},
+	TemplateCancellation: {
+		Subject: bilingual{EN: "Your Tasarruf subscription was cancelled", TR: "TASARRUF aboneliğiniz iptal edildi"},
+		Body: bilingual{
+			EN: `<p>Hello {{.Name}},</p><p>Your {{.Plan.EnglishName}} subscription was cancelled.</p>{{if .Refund}}<p>{{money .Refund}} TL will be refunded to your card.</p>{{end}}`,
+			TR: `<p>Merhaba {{.Name}},</p><p>{{.Plan.TurkishName}} aboneliğiniz iptal edildi.</p>{{if .Refund}}<p>{{money .Refund}} TL kartınıza iade edilecektir.</p>{{end}}`,
+		},
+	},
+	TemplateOffersSummary: {
+		Subject: bilingual{EN: "Tasarruf Summary", TR: "TASARRUF Özeti"},
+		Body: bilingual{
+			EN: `<h1>Offers Summary</h1><p>This is the summary of your offers on Tasarruf mobile application in the period from {{date .StartDate}} to {{date .EndDate}}.</p>`,
+			TR: `<h1>İndirim Özeti</h1><p>{{date .StartDate}} - {{date .EndDate}} tarihleri arasında TASARRUF mobil uygulamasındaki indirimlerinizin özeti ektedir.</p>`,
+		},
+	},
+}
+
+var funcs = template.FuncMap{
+	"date": func(t time.Time) string {
+		return t.Format("2 Jan 2006")
+	},
+	"money": func(amount float64) string {
+		return fmt.Sprintf("%.2f", amount)
+	},
+}
+
+var templates = parseTemplates()
+
+func parseTemplates() map[string]*template.Template {
+	parsed := make(map[string]*template.Template, len(sources))
+	for name, source := range sources {
+		t := template.Must(template.New(name).Option("missingkey=error").Funcs(funcs).Parse(layout))
+		template.Must(t.New("en").Parse(source.Body.EN))
+		template.Must(t.New("tr").Parse(source.Body.TR))
+		parsed[name] = t
+	}
+	return parsed
+}
+
+// Render renders the email template with the given name. It returns the subject and the html body.
+func Render(name string, data Data) (string, string, error) {
+	t, ok := templates[name]
+	if !ok {
+		return "", "", errors.Errorf("unknown email template %q", name)
+	}
+	var b bytes.Buffer
+	err := t.ExecuteTemplate(&b, name, data)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "error rendering email template %q", name)
+	}
+	subject := sources[name].Subject
+	return subject.TR + " / " + subject.EN, b.String(), nil
+}
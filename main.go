@@ -4,9 +4,11 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/ahmedaabouzied/tasarruf/entities"
+	_userrepo "github.com/ahmedaabouzied/tasarruf/user/repository"
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
@@ -14,16 +16,19 @@ import (
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 // Server configuration
 type Server struct {
-	Port    string        // Port number
-	Env     string        // Server environment dev, staging, prod , win
-	Timeout time.Duration // Server timeout
-	Router  *gin.Engine   // Router
-	DB      *gorm.DB      // Gorm DB Connection
+	Port     string             // Port number
+	Env      string             // Server environment dev, staging, prod , win
+	Timeout  time.Duration      // Server timeout
+	Router   *gin.Engine        // Router
+	DB       *gorm.DB           // Gorm DB Connection
+	DBConfig *entities.DBConfig // DB credentials
 }
 
 // ParseENV loads environment variables
@@ -72,7 +77,8 @@ func CreateDBConfig(env string) (*entities.DBConfig, error) {
 	return dbC, nil
 }
 
-// StartServer starts the server or fails with an error
+// StartServer starts the server or fails with an error.
+// On SIGINT or SIGTERM, the WS clients are disconnected and the server shuts down once the pending requests are handled.
 func StartServer(s *Server, debug bool) error {
 	srv := &http.Server{
 		Handler:      s.Router,
@@ -81,31 +87,60 @@ func StartServer(s *Server, debug bool) error {
 		ReadTimeout:  s.Timeout,
 	}
 
-	InitializeRoutes(s.DB, s.Router)
+	hub := InitializeRoutes(s.DB, s.DBConfig, s.Router)
 	if debug {
-		log.Info("=== Starting server on port " ,s.Port)
+		log.Info("=== Starting server on port ", s.Port)
 	}
-
-	return srv.ListenAndServe()
+	shutdown := make(chan error, 1)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		log.Info("=== Shutting down server")
+		hub.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+	err := srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return <-shutdown
 }
 
 func main() {
 	env := flag.String("env", "dev", "sets the running environment to either dev, staging or prod")
+	rotateJWTKey := flag.Bool("rotate-jwt-key", false, "adds a new access token signing key that replaces the current one and exits")
+	jwtAlgorithm := flag.String("jwt-algorithm", "", "sets the algorithm of the new signing key to either HS256, RS256 or EdDSA")
 	flag.Parse()
-	r := gin.Default() // default gin router
+	r := gin.New()
+	r.Use(requestLogger(), gin.Recovery())
 	ParseENV()
 	dbConfig, err := CreateDBConfig(*env)
 	db, err := entities.ConnectToDB(dbConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *rotateJWTKey {
+		key, err := rotateSigningKey(_userrepo.CreateUserRepository(db), *jwtAlgorithm)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("=== Added %s signing key %s, active from %s", key.Algorithm, key.KID, key.ActivatesAt.Format(time.RFC3339))
+		return
+	}
 	s := Server{
-		Port:    os.Getenv("PORT"),
-		Timeout: 15 * time.Second,
-		Router:  r,
-		Env:     "debug",
-		DB:      db,
+		Port:     os.Getenv("PORT"),
+		Timeout:  15 * time.Second,
+		Router:   r,
+		Env:      "debug",
+		DB:       db,
+		DBConfig: dbConfig,
 	}
 	debug := s.Env == "debug"
-	log.Fatal(StartServer(&s, debug))
+	err = StartServer(&s, debug)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -2,14 +2,35 @@ package offer
 
 import (
 	"github.com/ahmedaabouzied/tasarruf/entities"
+	"github.com/ahmedaabouzied/tasarruf/offer/protocol"
 	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
 )
 
+// ErrUserNotConnected is returned when sending a message to a user who has no connection to the hub.
+// The message stays in their inbox and is sent when they connect.
+var ErrUserNotConnected = errors.New("user is not connected")
+
+// ErrMessagePublished is returned when a message is handed to the instances of the server the user may be connected to
+// instead of being written to a connection. The instance that writes it to a connection of the user marks it as delivered.
+var ErrMessagePublished = errors.New("message has been published to the other instances")
+
+// Stream is a connection of a user that reads the messages sent to them from the hub instead of having them written to a web socket,
+// e.g. a server-sent events response. Messages are envelopes of the current version of the protocol.
+type Stream interface {
+	Messages() <-chan []byte
+	Done() <-chan struct{}
+}
+
 // Hub interface represents an interface for a hub of WS clients
 type Hub interface {
-	AddUser(user *entities.User, conn *websocket.Conn)
-	RemoveUser(ID uint)
+	AddUser(user *entities.User, conn *websocket.Conn, version int)
+	RemoveConnection(ID uint, conn *websocket.Conn)
+	AddStream(user *entities.User) Stream
+	RemoveStream(ID uint, stream Stream)
 	GetUser(ID uint) (*entities.User, error)
 	HasUser(ID uint) bool
-	SendOfferToUser(ID uint, offer *entities.Offer) error
+	SendMessageToUser(ID uint, m *entities.InboxMessage) error
+	SendToConnection(ID uint, conn *websocket.Conn, e *protocol.Envelope) error
+	Close()
 }
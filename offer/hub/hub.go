@@ -1,156 +1,345 @@
 package hub
 
 import (
+	"encoding/json"
 	"github.com/ahmedaabouzied/tasarruf/entities"
+	"github.com/ahmedaabouzied/tasarruf/offer"
+	"github.com/ahmedaabouzied/tasarruf/offer/protocol"
 	"github.com/gorilla/websocket"
+	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
-// Hub interface represents an interface for a hub of WS clients
-type Hub interface {
-	AddUser(user *entities.User, conn *websocket.Conn)
-	RemoveUser(ID uint)
-	GetUser(ID uint) (*entities.User, error)
-	HasUser(ID uint) bool
-	SendOfferToUser(ID uint, offer *entities.Offer) error
-}
+// Both hubs implement the hub interface of the offer package
+var (
+	_ offer.Hub = (*usersHub)(nil)
+	_ offer.Hub = (*postgresHub)(nil)
+)
+
+// sendQueueSize is how many messages can wait to be written to a connection before it's dropped as too slow
+const sendQueueSize = 64
 
-// usersHub is an implementation of the Hub interface
+// errHubClosed is returned when sending a message after the hub is closed
+var errHubClosed = errors.New("hub is closed")
+
+// usersHub is an implementation of the offer.Hub interface.
+// Users can have several connections, e.g. one for each of their devices.
+// Each connection has its own queue of messages written by its own goroutine, so a slow connection doesn't hold up the others.
 type usersHub struct {
-	lock        *sync.Mutex
-	addUser     chan *userClient
-	removeUser  chan uint
-	users       map[uint]*userClient
-	sendMessage chan *message
+	lock      sync.RWMutex
+	users     map[uint]map[*userClient]bool
+	closed    bool
+	writeWait time.Duration
 }
 
+// message is an inbox message as it's written to the connections of the user that speak version 0 of the protocol
 type message struct {
-	Client  *userClient     `json:"client,omitempty"`
-	Offer   *entities.Offer `json:"offer,omitempty"`
-	Message string          `json:"message,omitempty"`
+	MessageID uint            `json:"messageID,omitempty"`
+	Offer     json.RawMessage `json:"offer,omitempty"`
+	Message   string          `json:"message,omitempty"`
 }
 
-// userClient is a wrapper arrount a user object
+// userClient is a connection of a user. Clients without a web socket are streams read by their own goroutine.
 type userClient struct {
-	user *entities.User
-	conn *websocket.Conn
+	user      *entities.User
+	conn      *websocket.Conn
+	version   int
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-// CreateUserHub returns a new instance of the Hub interface
-func CreateUserHub() Hub {
-	h := usersHub{
-		lock:        &sync.Mutex{},
-		addUser:     make(chan *userClient),
-		removeUser:  make(chan uint),
-		users:       make(map[uint]*userClient),
-		sendMessage: make(chan *message),
+// CreateUserHub returns a new instance of the offer.Hub interface that keeps the connections in memory.
+// It's meant for running a single instance of the server, as users only get the messages sent from the instance they are connected to.
+func CreateUserHub() offer.Hub {
+	return newUsersHub()
+}
+
+// CreateHub returns the hub selected by the HUB_BACKEND environment variable.
+//
+// Supported backends are "memory" (the default) for a single instance of the server
+// and "postgres" for several instances sharing the DB with the given connection string.
+func CreateHub(db *gorm.DB, connectionString string) (offer.Hub, error) {
+	backend := strings.ToLower(os.Getenv("HUB_BACKEND"))
+	switch backend {
+	case "", "memory":
+		return CreateUserHub(), nil
+	case "postgres":
+		return CreatePostgresHub(db, connectionString)
+	default:
+		return nil, errors.Errorf("unknown hub backend %q", backend)
 	}
-	go h.Run()
-	return &h
 }
 
-func (h *usersHub) Run() {
-	ticker := time.NewTicker(pingPeriod)
-	defer func() {
-		ticker.Stop()
-	}()
-	for {
-		select {
-		case addRequest := <-h.addUser:
-			h.handleAddRequest(addRequest)
-		case removeRequest := <-h.removeUser:
-			h.handleRemoveRequest(removeRequest)
-		case sendMessageRequest := <-h.sendMessage:
-			h.handleSendMessage(sendMessageRequest)
-		case <-ticker.C:
-			h.handleTicker()
-		}
+func newUsersHub() *usersHub {
+	return &usersHub{
+		users:     make(map[uint]map[*userClient]bool),
+		writeWait: writeWait,
 	}
 }
 
-func (h *usersHub) handleAddRequest(client *userClient) {
-	_, alreadyAdded := h.users[client.user.ID]
-	if !alreadyAdded {
-		h.lock.Lock()
-		h.users[client.user.ID] = client
+// AddUser adds the given connection of the user to the hub and starts writing the messages sent to the user to it
+// in the given version of the protocol. The connection is closed when it's removed from the hub.
+func (h *usersHub) AddUser(user *entities.User, conn *websocket.Conn, version int) {
+	client := &userClient{
+		user:    user,
+		conn:    conn,
+		version: version,
+		send:    make(chan []byte, sendQueueSize),
+		done:    make(chan struct{}),
+	}
+	h.lock.Lock()
+	if h.closed {
 		h.lock.Unlock()
-		log.Info("Added user with ID :", client.user.ID, " to Hub")
+		conn.Close()
+		return
 	}
+	if h.users[user.ID] == nil {
+		h.users[user.ID] = make(map[*userClient]bool)
+	}
+	h.users[user.ID][client] = true
+	h.lock.Unlock()
+	log.Info("Added user with ID :", user.ID, " to Hub")
+	go h.writeMessages(client)
 }
 
-func (h *usersHub) handleRemoveRequest(ID uint) {
-	_, alreadyAdded := h.users[ID]
-	if alreadyAdded {
-		h.lock.Lock()
-		delete(h.users, ID)
-		h.lock.Unlock()
-		log.Error("disconnected user : ", ID)
+// RemoveConnection removes the given connection of the user with the given ID from the hub and closes it.
+// The other connections of the user are kept.
+func (h *usersHub) RemoveConnection(ID uint, conn *websocket.Conn) {
+	h.lock.Lock()
+	var removed *userClient
+	for client := range h.users[ID] {
+		if client.conn != nil && client.conn == conn {
+			removed = client
+			h.removeClient(client)
+		}
+	}
+	h.lock.Unlock()
+	if removed != nil {
+		log.Info("disconnected user : ", ID)
 	}
 }
 
-func (h *usersHub) handleTicker() {
-	for _, client := range h.users {
-		err := client.conn.WriteMessage(websocket.PingMessage, []byte{})
-		if err != nil {
-			h.lock.Lock()
-			delete(h.users, client.user.ID)
-			h.lock.Unlock()
+// AddStream adds a stream of the messages sent to the user to the hub.
+// The stream is done when it's removed from the hub, or when it's too slow to keep up with its messages.
+func (h *usersHub) AddStream(user *entities.User) offer.Stream {
+	client := &userClient{
+		user:    user,
+		version: protocol.Version,
+		send:    make(chan []byte, sendQueueSize),
+		done:    make(chan struct{}),
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		close(client.done)
+		return client
+	}
+	if h.users[user.ID] == nil {
+		h.users[user.ID] = make(map[*userClient]bool)
+	}
+	h.users[user.ID][client] = true
+	log.Info("Added stream of user with ID :", user.ID, " to Hub")
+	return client
+}
+
+// RemoveStream removes the given stream of the user with the given ID from the hub
+func (h *usersHub) RemoveStream(ID uint, stream offer.Stream) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for client := range h.users[ID] {
+		if client == stream {
+			h.removeClient(client)
 		}
 	}
 }
 
-func (h *usersHub) handleSendMessage(m *message) {
-	_, userConnected := h.users[m.Client.user.ID]
-	if userConnected {
-		err := m.Client.conn.WriteJSON(m)
-		if err != nil {
-			log.Error("error sending message to user : ", m.Client.user.ID, " : ", err)
+// GetUser returns the user with the given ID if they are connected
+func (h *usersHub) GetUser(ID uint) (*entities.User, error) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for client := range h.users[ID] {
+		return client.user, nil
+	}
+	log.Error(ID, " : ", offer.ErrUserNotConnected)
+	return nil, offer.ErrUserNotConnected
+}
+
+// HasUser returns true if the user with the given ID has a connection
+func (h *usersHub) HasUser(ID uint) bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return len(h.users[ID]) > 0
+}
+
+// SendMessageToUser queues the given inbox message to be written to every connection of the user with the given ID.
+// Connections with a full queue are too slow to keep up, so they are closed and the user gets the message when they connect again.
+// It returns offer.ErrUserNotConnected if the user isn't connected.
+func (h *usersHub) SendMessageToUser(ID uint, m *entities.InboxMessage) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return errHubClosed
+	}
+	if len(h.users[ID]) == 0 {
+		return offer.ErrUserNotConnected
+	}
+	// Connections speaking the same version of the protocol share the encoded message
+	encoded := make(map[int][]byte)
+	var queued bool
+	for client := range h.users[ID] {
+		data, ok := encoded[client.version]
+		if !ok {
+			var err error
+			data, err = encodeMessage(m, client.version)
+			if err != nil {
+				return err
+			}
+			encoded[client.version] = data
+		}
+		if h.queue(client, data) {
+			queued = true
 		}
 	}
+	if !queued {
+		return offer.ErrUserNotConnected
+	}
+	return nil
 }
 
-func (h *usersHub) AddUser(user *entities.User, conn *websocket.Conn) {
-	client := userClient{
-		user: user,
-		conn: conn,
+// SendToConnection queues the given envelope to be written to the given connection of the user with the given ID,
+// e.g. to reply to a message received on it.
+// It returns offer.ErrUserNotConnected if the connection isn't in the hub.
+func (h *usersHub) SendToConnection(ID uint, conn *websocket.Conn, e *protocol.Envelope) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "error encoding envelope")
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return errHubClosed
 	}
-	h.addUser <- &client
+	for client := range h.users[ID] {
+		if client.conn == conn && h.queue(client, data) {
+			return nil
+		}
+	}
+	return offer.ErrUserNotConnected
 }
 
-func (h *usersHub) RemoveUser(ID uint) {
-	h.removeUser <- ID
+// Messages returns the queue of the messages of a stream
+func (client *userClient) Messages() <-chan []byte {
+	return client.send
 }
 
-func (h *usersHub) GetUser(ID uint) (*entities.User, error) {
-	client, ok := h.users[ID]
-	if !ok {
-		err := errors.New("client not found")
-		log.Error(ID, " : ", err)
-		return nil, err
+// Done returns a channel that's closed when the client is removed from the hub
+func (client *userClient) Done() <-chan struct{} {
+	return client.done
+}
+
+// Close removes every connection from the hub and closes them. Connections added afterwards are closed right away.
+func (h *usersHub) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.closed = true
+	for _, clients := range h.users {
+		for client := range clients {
+			h.removeClient(client)
+		}
 	}
-	return client.user, nil
 }
 
-func (h *usersHub) HasUser(ID uint) bool {
-	_, ok := h.users[ID]
-	return ok
+// queue queues the given data to be written to the connection of the given client.
+// If the queue of the client is full, the client is removed and false is returned.
+// It must be called with the lock held.
+func (h *usersHub) queue(client *userClient, data []byte) bool {
+	select {
+	case client.send <- data:
+		return true
+	default:
+		log.Error("dropping slow connection of user : ", client.user.ID)
+		h.removeClient(client)
+		return false
+	}
 }
 
-func (h *usersHub) SendOfferToUser(ID uint, offer *entities.Offer) error {
-	client, ok := h.users[ID]
-	if !ok {
-		err := errors.New("client not found")
-		log.Error(ID, " : ", err)
-		return err
+// removeClient removes the given client from the hub and stops its writer, which closes its connection.
+// It must be called with the lock held.
+func (h *usersHub) removeClient(client *userClient) {
+	clients := h.users[client.user.ID]
+	delete(clients, client)
+	if len(clients) == 0 {
+		delete(h.users, client.user.ID)
 	}
-	message := message{
-		Client: client,
-		Offer:  offer,
+	client.closeOnce.Do(func() {
+		close(client.done)
+	})
+}
+
+// writeMessages writes the queued messages and pings to the connection of the given client until it's removed.
+// It's the only goroutine writing to the connection once it's added to the hub.
+func (h *usersHub) writeMessages(client *userClient) {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		client.conn.Close()
+	}()
+	for {
+		select {
+		case data := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(h.writeWait))
+			err := client.conn.WriteMessage(websocket.TextMessage, data)
+			if err != nil {
+				log.Error("error sending message to user : ", client.user.ID, " : ", err)
+				h.RemoveConnection(client.user.ID, client.conn)
+				return
+			}
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(h.writeWait))
+			err := client.conn.WriteMessage(websocket.PingMessage, []byte{})
+			if err != nil {
+				h.RemoveConnection(client.user.ID, client.conn)
+				return
+			}
+		case <-client.done:
+			client.conn.SetWriteDeadline(time.Now().Add(h.writeWait))
+			client.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
 	}
-	log.Info(message)
-	h.sendMessage <- &message
-	return nil
+}
+
+// encodeMessage encodes the given inbox message in the given version of the protocol
+func encodeMessage(m *entities.InboxMessage, version int) ([]byte, error) {
+	if version == 0 {
+		message := message{
+			MessageID: m.ID,
+		}
+		switch m.Kind {
+		case entities.InboxOffer, entities.InboxOfferPrompt:
+			message.Offer = json.RawMessage(m.Payload)
+		default:
+			message.Message = m.Payload
+		}
+		data, err := json.Marshal(message)
+		if err != nil {
+			return nil, errors.Wrap(err, "error encoding message")
+		}
+		return data, nil
+	}
+	e, err := protocol.NewMessage(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding message")
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding message")
+	}
+	return data, nil
 }
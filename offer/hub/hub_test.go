@@ -0,0 +1,380 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ahmedaabouzied/tasarruf/entities"
+	"github.com/ahmedaabouzied/tasarruf/offer"
+	"github.com/ahmedaabouzied/tasarruf/offer/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// testServer adds the WS connections it accepts to the hub as the user with the ID in the "user" query parameter,
+// speaking the version of the protocol in the "v" query parameter.
+// The server side of each connection is sent to the channel of the "conn" query parameter.
+type testServer struct {
+	hub   offer.Hub
+	lock  sync.Mutex
+	next  int
+	conns map[string]chan *websocket.Conn
+	*httptest.Server
+}
+
+func newTestServer(t *testing.T, h offer.Hub) *testServer {
+	s := &testServer{
+		hub:   h,
+		conns: make(map[string]chan *websocket.Conn),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := wsupgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var userID uint
+		var version int
+		fmt.Sscan(r.URL.Query().Get("user"), &userID)
+		fmt.Sscan(r.URL.Query().Get("v"), &version)
+		user := &entities.User{}
+		user.ID = userID
+		s.hub.AddUser(user, conn, version)
+		s.lock.Lock()
+		conns := s.conns[r.URL.Query().Get("conn")]
+		s.lock.Unlock()
+		conns <- conn
+	}))
+	return s
+}
+
+// connect connects to the hub as the user with the given ID, speaking the current version of the protocol.
+// It returns the client side of the connection and the server side added to the hub.
+func (s *testServer) connect(t *testing.T, userID uint) (*websocket.Conn, *websocket.Conn) {
+	return s.connectWithVersion(t, userID, protocol.Version)
+}
+
+// connectWithVersion connects to the hub as the user with the given ID, speaking the given version of the protocol
+func (s *testServer) connectWithVersion(t *testing.T, userID uint, version int) (*websocket.Conn, *websocket.Conn) {
+	s.lock.Lock()
+	s.next++
+	token := fmt.Sprint(s.next)
+	conns := make(chan *websocket.Conn, 1)
+	s.conns[token] = conns
+	s.lock.Unlock()
+	url := fmt.Sprintf("ws%s?user=%d&v=%d&conn=%s", strings.TrimPrefix(s.URL, "http"), userID, version, token)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, <-conns
+}
+
+func offerMessage(ID uint) *entities.InboxMessage {
+	m := &entities.InboxMessage{Kind: entities.InboxOffer, Payload: `{"ID":7,"status":"consumed"}`}
+	m.ID = ID
+	return m
+}
+
+func readMessage(t *testing.T, conn *websocket.Conn) protocol.Envelope {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var e protocol.Envelope
+	err := conn.ReadJSON(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func readLegacyMessage(t *testing.T, conn *websocket.Conn) message {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var m message
+	err := conn.ReadJSON(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSendMessageToEveryConnection(t *testing.T) {
+	h := CreateUserHub()
+	defer h.Close()
+	s := newTestServer(t, h)
+	defer s.Close()
+	phone, phoneServerConn := s.connect(t, 1)
+	defer phone.Close()
+	tablet, _ := s.connect(t, 1)
+	defer tablet.Close()
+	other, _ := s.connect(t, 2)
+	defer other.Close()
+	err := h.SendMessageToUser(1, offerMessage(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range []*websocket.Conn{phone, tablet} {
+		e := readMessage(t, conn)
+		if e.ID != 10 || e.Type != protocol.TypeOfferReceipt || string(e.Payload) != `{"offer":{"ID":7,"status":"consumed"}}` {
+			t.Errorf("unexpected message %+v", e)
+		}
+	}
+	h.RemoveConnection(1, phoneServerConn)
+	if !h.HasUser(1) {
+		t.Error("expected the user to be connected from their other device")
+	}
+	phone.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = phone.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("expected the removed connection to be closed, got %v", err)
+	}
+	err = h.SendMessageToUser(1, offerMessage(11))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := readMessage(t, tablet); e.ID != 11 {
+		t.Errorf("unexpected message %+v", e)
+	}
+}
+
+func TestSendMessageToDisconnectedUser(t *testing.T) {
+	h := CreateUserHub()
+	defer h.Close()
+	if h.HasUser(1) {
+		t.Error("expected the user not to be connected")
+	}
+	if _, err := h.GetUser(1); err == nil {
+		t.Error("expected an error getting a user who isn't connected")
+	}
+	if err := h.SendMessageToUser(1, offerMessage(10)); err != offer.ErrUserNotConnected {
+		t.Errorf("expected offer.ErrUserNotConnected, got %v", err)
+	}
+}
+
+func TestSlowConnectionIsDropped(t *testing.T) {
+	defaultWriteWait := writeWait
+	writeWait = 100 * time.Millisecond
+	defer func() {
+		writeWait = defaultWriteWait
+	}()
+	h := CreateUserHub()
+	defer h.Close()
+	s := newTestServer(t, h)
+	defer s.Close()
+	// The slow client never reads, so writes to it block once the socket buffers are full
+	slow, _ := s.connect(t, 1)
+	defer slow.Close()
+	fast, _ := s.connect(t, 2)
+	defer fast.Close()
+	large := &entities.InboxMessage{Payload: strings.Repeat("a", 64*1024)}
+	start := time.Now()
+	for i := 0; i < 1000 && h.HasUser(1); i++ {
+		h.SendMessageToUser(1, large)
+	}
+	if h.HasUser(1) {
+		t.Fatal("expected the slow connection to be dropped")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected sending to a slow connection not to block, took %s", elapsed)
+	}
+	err := h.SendMessageToUser(2, offerMessage(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := readMessage(t, fast); e.ID != 10 {
+		t.Errorf("unexpected message %+v", e)
+	}
+}
+
+func TestClose(t *testing.T) {
+	h := CreateUserHub()
+	s := newTestServer(t, h)
+	defer s.Close()
+	conn, _ := s.connect(t, 1)
+	defer conn.Close()
+	h.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+	if h.HasUser(1) {
+		t.Error("expected no users after closing the hub")
+	}
+	if err := h.SendMessageToUser(1, offerMessage(10)); err != errHubClosed {
+		t.Errorf("expected errHubClosed, got %v", err)
+	}
+	late, _ := s.connect(t, 1)
+	defer late.Close()
+	late.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := late.ReadMessage(); err == nil {
+		t.Error("expected connections added after closing the hub to be closed")
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	h := CreateUserHub()
+	defer h.Close()
+	s := newTestServer(t, h)
+	defer s.Close()
+	const users = 5
+	const connections = 4
+	var wg sync.WaitGroup
+	for userID := uint(1); userID <= users; userID++ {
+		for i := 0; i < connections; i++ {
+			wg.Add(1)
+			go func(userID uint) {
+				defer wg.Done()
+				conn, serverConn := s.connect(t, userID)
+				defer conn.Close()
+				go func() {
+					for {
+						if _, _, err := conn.ReadMessage(); err != nil {
+							return
+						}
+					}
+				}()
+				for j := 0; j < 20; j++ {
+					h.SendMessageToUser(userID, offerMessage(uint(j+1)))
+					h.HasUser(userID)
+					h.GetUser(userID)
+				}
+				h.RemoveConnection(userID, serverConn)
+			}(userID)
+		}
+	}
+	wg.Wait()
+	for userID := uint(1); userID <= users; userID++ {
+		if h.HasUser(userID) {
+			t.Errorf("expected every connection of user %d to be removed", userID)
+		}
+	}
+}
+
+func TestSendMessageInEachVersion(t *testing.T) {
+	h := CreateUserHub()
+	defer h.Close()
+	s := newTestServer(t, h)
+	defer s.Close()
+	current, _ := s.connect(t, 1)
+	defer current.Close()
+	legacy, _ := s.connectWithVersion(t, 1, 0)
+	defer legacy.Close()
+	err := h.SendMessageToUser(1, offerMessage(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := readMessage(t, current); e.Version != protocol.Version || e.ID != 10 || e.Type != protocol.TypeOfferReceipt {
+		t.Errorf("unexpected message %+v", e)
+	}
+	if m := readLegacyMessage(t, legacy); m.MessageID != 10 || string(m.Offer) != `{"ID":7,"status":"consumed"}` {
+		t.Errorf("unexpected message %+v", m)
+	}
+}
+
+func TestSendToConnection(t *testing.T) {
+	h := CreateUserHub()
+	defer h.Close()
+	s := newTestServer(t, h)
+	defer s.Close()
+	phone, phoneServerConn := s.connect(t, 1)
+	defer phone.Close()
+	tablet, _ := s.connect(t, 1)
+	defer tablet.Close()
+	pong, _ := protocol.NewEnvelope(protocol.TypePong, nil)
+	pong.Ack = 5
+	err := h.SendToConnection(1, phoneServerConn, pong)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := readMessage(t, phone); e.Type != protocol.TypePong || e.Ack != 5 {
+		t.Errorf("unexpected reply %+v", e)
+	}
+	err = h.SendMessageToUser(1, offerMessage(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := readMessage(t, tablet); e.ID != 10 {
+		t.Errorf("expected the reply to be sent to the other connection only, got %+v", e)
+	}
+	h.RemoveConnection(1, phoneServerConn)
+	if err := h.SendToConnection(1, phoneServerConn, pong); err != offer.ErrUserNotConnected {
+		t.Errorf("expected offer.ErrUserNotConnected, got %v", err)
+	}
+}
+
+func TestEncodeMessage(t *testing.T) {
+	prompt := &entities.InboxMessage{Kind: entities.InboxOfferPrompt, Payload: `{"ID":7,"status":"pending"}`}
+	prompt.ID = 3
+	notification := entities.NewNotificationMessage(1, "Your subscription expires tomorrow")
+	notification.ID = 4
+	tests := []struct {
+		message *entities.InboxMessage
+		version int
+		want    string
+	}{
+		{prompt, protocol.Version, `{"v":1,"type":"offer.prompt","id":3,"payload":{"offer":{"ID":7,"status":"pending"}}}`},
+		{prompt, 0, `{"messageID":3,"offer":{"ID":7,"status":"pending"}}`},
+		{notification, protocol.Version, `{"v":1,"type":"notification","id":4,"payload":{"message":"Your subscription expires tomorrow"}}`},
+		{notification, 0, `{"messageID":4,"message":"Your subscription expires tomorrow"}`},
+	}
+	for _, test := range tests {
+		data, err := encodeMessage(test.message, test.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.want {
+			t.Errorf("expected %s, got %s", test.want, data)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	h := CreateUserHub()
+	user := &entities.User{}
+	user.ID = 1
+	stream := h.AddStream(user)
+	if !h.HasUser(1) {
+		t.Error("expected the user to be connected through their stream")
+	}
+	err := h.SendMessageToUser(1, offerMessage(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-stream.Messages():
+		var e protocol.Envelope
+		err := json.Unmarshal(data, &e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.ID != 10 || e.Type != protocol.TypeOfferReceipt {
+			t.Errorf("unexpected message %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the message to be sent to the stream")
+	}
+	h.RemoveConnection(1, nil)
+	if !h.HasUser(1) {
+		t.Error("expected the stream not to be removed as a web socket connection")
+	}
+	h.RemoveStream(1, stream)
+	if h.HasUser(1) {
+		t.Error("expected the stream to be removed")
+	}
+	select {
+	case <-stream.Done():
+	default:
+		t.Error("expected the removed stream to be done")
+	}
+	h.Close()
+	late := h.AddStream(user)
+	select {
+	case <-late.Done():
+	default:
+		t.Error("expected streams added after closing the hub to be done")
+	}
+}
@@ -0,0 +1,194 @@
+package hub
+
+import (
+	"encoding/json"
+	"github.com/ahmedaabouzied/tasarruf/entities"
+	"github.com/ahmedaabouzied/tasarruf/offer"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// hubChannel is the Postgres channel the messages sent to users are published on
+const hubChannel = "hub_messages"
+
+// Reconnection intervals of the listener after losing the connection to the DB
+const (
+	minReconnectInterval = 5 * time.Second
+	maxReconnectInterval = time.Minute
+)
+
+// listenerPingPeriod is how often the connection of the listener is checked when there are no messages
+const listenerPingPeriod = time.Minute
+
+// notification is published on hubChannel when a message is sent to a user.
+// Only the IDs are published, as NOTIFY payloads are limited to 8000 bytes, and the message is loaded from the inbox
+// by the instances the user is connected to.
+type notification struct {
+	UserID    uint `json:"userID"`
+	MessageID uint `json:"messageID"`
+}
+
+// postgresHub is an implementation of the offer.Hub interface for running several instances of the server.
+// Messages are published through Postgres LISTEN/NOTIFY, so every instance can deliver them to the connections of the user it has.
+// GetUser and HasUser only know about the connections to this instance.
+type postgresHub struct {
+	*usersHub
+	db        *gorm.DB
+	listener  *pq.Listener
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// CreatePostgresHub returns a new instance of the offer.Hub interface that publishes messages through the DB with the given connection string
+func CreatePostgresHub(db *gorm.DB, connectionString string) (offer.Hub, error) {
+	listener := pq.NewListener(connectionString, minReconnectInterval, maxReconnectInterval, logListenerEvent)
+	err := listener.Listen(hubChannel)
+	if err != nil {
+		listener.Close()
+		return nil, errors.Wrap(err, "error listening to hub messages")
+	}
+	h := &postgresHub{
+		usersHub: newUsersHub(),
+		db:       db,
+		listener: listener,
+		done:     make(chan struct{}),
+	}
+	go h.listen()
+	return h, nil
+}
+
+// SendMessageToUser publishes the given inbox message to every instance, which write it to the connections of the user they have.
+// The message must be saved in the inbox first. It's sent to the user when they connect if they aren't connected to any instance.
+// It returns offer.ErrMessagePublished once the message is published, since only the instances the user is connected to
+// know whether it was delivered.
+func (h *postgresHub) SendMessageToUser(ID uint, m *entities.InboxMessage) error {
+	select {
+	case <-h.done:
+		return errHubClosed
+	default:
+	}
+	payload, err := json.Marshal(notification{UserID: ID, MessageID: m.ID})
+	if err != nil {
+		return errors.Wrap(err, "error encoding hub notification")
+	}
+	dbt := h.db.Exec("SELECT pg_notify(?, ?)", hubChannel, string(payload))
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error publishing hub message")
+	}
+	return offer.ErrMessagePublished
+}
+
+// Close stops listening to the messages of the other instances, then closes the connections to this instance
+func (h *postgresHub) Close() {
+	h.closeOnce.Do(func() {
+		close(h.done)
+		h.listener.Close()
+		h.usersHub.Close()
+	})
+}
+
+// listen writes the published messages to the connections of the users until the hub is closed
+func (h *postgresHub) listen() {
+	ticker := time.NewTicker(listenerPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case n, ok := <-h.listener.Notify:
+			if !ok {
+				return
+			}
+			if n == nil {
+				// The listener reconnected to the DB, so the messages published meanwhile were missed
+				h.redeliver()
+				continue
+			}
+			var published notification
+			err := json.Unmarshal([]byte(n.Extra), &published)
+			if err != nil {
+				log.Error(errors.Wrap(err, "error decoding hub notification"))
+				continue
+			}
+			h.deliver(published.UserID, published.MessageID)
+		case <-ticker.C:
+			go h.listener.Ping()
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// deliver writes the inbox message with the given ID to the connections of the user to this instance, if they have any
+func (h *postgresHub) deliver(userID uint, messageID uint) {
+	if !h.HasUser(userID) {
+		return
+	}
+	m := &entities.InboxMessage{}
+	dbt := h.db.Where("id = ? AND user_id = ?", messageID, userID).First(m)
+	if dbt.Error != nil {
+		log.Error(errors.Wrap(dbt.Error, "error getting hub message"))
+		return
+	}
+	err := h.usersHub.SendMessageToUser(userID, m)
+	if err != nil {
+		if err != offer.ErrUserNotConnected {
+			log.Error(errors.Wrap(err, "error sending hub message"))
+		}
+		return
+	}
+	h.markDelivered(m)
+}
+
+// markDelivered records that the given inbox message was written to a connection to this instance, unless it was delivered before
+func (h *postgresHub) markDelivered(m *entities.InboxMessage) {
+	dbt := h.db.Model(&entities.InboxMessage{}).Where("id = ? AND delivered_at IS NULL", m.ID).Update("delivered_at", time.Now())
+	if dbt.Error != nil {
+		log.Error(errors.Wrap(dbt.Error, "error marking hub message as delivered"))
+	}
+}
+
+// redeliver writes the unacknowledged inbox messages of the users connected to this instance to their connections again.
+// Clients ignore the messages they already handled.
+func (h *postgresHub) redeliver() {
+	for _, userID := range h.connectedUserIDs() {
+		var messages []entities.InboxMessage
+		dbt := h.db.Where("user_id = ? AND acknowledged_at IS NULL", userID).Order("id").Find(&messages)
+		if dbt.Error != nil {
+			log.Error(errors.Wrap(dbt.Error, "error getting hub messages"))
+			continue
+		}
+		for i := range messages {
+			err := h.usersHub.SendMessageToUser(userID, &messages[i])
+			if err != nil {
+				break
+			}
+			h.markDelivered(&messages[i])
+		}
+	}
+}
+
+// connectedUserIDs returns the IDs of the users connected to this instance
+func (h *postgresHub) connectedUserIDs() []uint {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	IDs := make([]uint, 0, len(h.users))
+	for ID := range h.users {
+		IDs = append(IDs, ID)
+	}
+	return IDs
+}
+
+// logListenerEvent logs the changes to the connection of the listener to the DB
+func logListenerEvent(event pq.ListenerEventType, err error) {
+	switch event {
+	case pq.ListenerEventDisconnected:
+		log.Error(errors.Wrap(err, "hub lost its connection to the DB"))
+	case pq.ListenerEventReconnected:
+		log.Info("hub reconnected to the DB")
+	case pq.ListenerEventConnectionAttemptFailed:
+		log.Error(errors.Wrap(err, "hub failed to reconnect to the DB"))
+	}
+}
@@ -0,0 +1,92 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ahmedaabouzied/tasarruf/entities"
+	"github.com/ahmedaabouzied/tasarruf/offer"
+	"github.com/jinzhu/gorm"
+)
+
+var testDBConfig = entities.DBConfig{
+	Port:     5432,
+	Host:     "localhost",
+	User:     "tasarruf",
+	Password: "password",
+	DBName:   "tasarruftestdb",
+}
+
+func connectToDB(t *testing.T) *gorm.DB {
+	db, err := entities.ConnectToDB(&testDBConfig)
+	if err != nil {
+		t.Skip("test database isn't available : ", err)
+	}
+	db.DropTable(entities.InboxMessage{})
+	db.AutoMigrate(entities.InboxMessage{})
+	return db
+}
+
+// createPostgresHub creates a hub as if it was running on another instance of the server
+func createPostgresHub(t *testing.T, db *gorm.DB) offer.Hub {
+	h, err := CreatePostgresHub(db, testDBConfig.ConnectionString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestSendMessageToOtherInstance(t *testing.T) {
+	db := connectToDB(t)
+	defer db.Close()
+	sender := createPostgresHub(t, db)
+	defer sender.Close()
+	receiver := createPostgresHub(t, db)
+	defer receiver.Close()
+	s := newTestServer(t, receiver)
+	defer s.Close()
+	conn, _ := s.connect(t, 1)
+	defer conn.Close()
+	if sender.HasUser(1) {
+		t.Error("expected the user to be connected to the other instance only")
+	}
+	m, err := entities.NewOfferMessage(1, &entities.Offer{Status: entities.OfferConsumed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbt := db.Create(m)
+	if dbt.Error != nil {
+		t.Fatal(dbt.Error)
+	}
+	err = sender.SendMessageToUser(1, m)
+	if err != offer.ErrMessagePublished {
+		t.Fatalf("expected ErrMessagePublished, got %v", err)
+	}
+	if received := readMessage(t, conn); received.ID != m.ID {
+		t.Errorf("expected message %d, got %+v", m.ID, received)
+	}
+	delivered := waitForDelivery(t, db, m.ID)
+	if delivered.DeliveredAt == nil {
+		t.Error("expected the receiving instance to mark the message as delivered")
+	}
+	sender.Close()
+	if err := sender.SendMessageToUser(1, m); err != errHubClosed {
+		t.Errorf("expected errHubClosed, got %v", err)
+	}
+}
+
+// waitForDelivery returns the inbox message with the given ID once it's marked as delivered, or after a second
+func waitForDelivery(t *testing.T, db *gorm.DB, ID uint) *entities.InboxMessage {
+	m := &entities.InboxMessage{}
+	for i := 0; i < 20; i++ {
+		dbt := db.First(m, ID)
+		if dbt.Error != nil {
+			t.Fatal(dbt.Error)
+		}
+		if m.DeliveredAt != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return m
+}
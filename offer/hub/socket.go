@@ -13,6 +13,9 @@ var pongWait = 60 * time.Second
 // pingPeriod is the interval for sending a ping message
 var pingPeriod = (pongWait * 9) / 10
 
+// writeWait is the time allowed to write a message to a connection
+var writeWait = 10 * time.Second
+
 // wsupgrader upgrades HTTP/HTTPS connection to WS connection
 var wsupgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
@@ -2,6 +2,9 @@ package offerapi
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"time"
@@ -9,6 +12,7 @@ import (
 	"github.com/ahmedaabouzied/tasarruf/branch"
 	"github.com/ahmedaabouzied/tasarruf/entities"
 	"github.com/ahmedaabouzied/tasarruf/offer"
+	"github.com/ahmedaabouzied/tasarruf/offer/protocol"
 	"github.com/ahmedaabouzied/tasarruf/user"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -25,9 +29,17 @@ type Handler struct {
 }
 
 type consumeOfferRequest struct {
-	Amount     float64 `json:"amount"`
-	CustomerID uint    `json:"customerID"`
-	PartnerID  uint    `json:"partnerID"`
+	Amount          float64 `json:"amount"`
+	RedemptionToken string  `json:"redemptionToken"`
+	PartnerID       uint    `json:"partnerID"`
+}
+
+type answerOfferRequest struct {
+	Accepted *bool `json:"accepted"`
+}
+
+type voidOfferRequest struct {
+	Reason string `json:"reason"`
 }
 
 type dateFilters struct {
@@ -46,6 +58,12 @@ func CreateOfferHandler(o offer.Usecase, h offer.Hub, b branch.Usecase, u user.U
 	return &handler
 }
 
+// eventsStreamDuration is how long an event stream is kept open. It must be shorter than the write timeout of the server.
+var eventsStreamDuration = 10 * time.Second
+
+// eventsRetry is how long clients wait before resuming an event stream after it ends
+var eventsRetry = time.Second
+
 // pongwait is the time the server awaits for a pong message
 var pongWait = 60 * time.Second
 
@@ -58,11 +76,21 @@ var wsupgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
-// AuthMessage the first message expected from the client upon connection
+// AuthMessage the first message expected from the client upon connection.
+// It's an envelope for clients speaking the current version of the protocol, and only has the token for clients speaking version 0.
 type AuthMessage struct {
+	protocol.Envelope
 	Token string `json:"token"`
 }
 
+// ClientMessage is sent by users speaking version 0 of the protocol after connection to acknowledge a message they received,
+// or by customers to accept or reject a pending offer
+type ClientMessage struct {
+	Ack      uint  `json:"ack"`
+	OfferID  uint  `json:"offerID"`
+	Accepted *bool `json:"accepted"`
+}
+
 // Connect handles WS connection on connect endpoint
 func (h *Handler) Connect(c *gin.Context) {
 	log.Info("conncting")
@@ -74,14 +102,22 @@ func (h *Handler) ConsumeOffer(c *gin.Context) {
 	ctx := context.Background()
 	userID := c.MustGet("userID").(uint)
 	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	if apiKeyID, ok := c.Get("apiKeyID"); ok {
+		ctx = context.WithValue(ctx, entities.APIKeyIDKey, apiKeyID)
+	}
+	ctx = context.WithValue(ctx, entities.IdempotencyKeyKey, c.GetHeader("Idempotency-Key"))
 	var req consumeOfferRequest
 	err := c.BindJSON(&req)
 	if err != nil {
 		entities.SendParsingError(c, "There has been an error while processing your request , please try again", err)
 		return
 	}
-	offer, err := h.offersUsecase.ConsumeOffer(ctx, req.CustomerID, req.PartnerID, req.Amount)
+	offer, err := h.offersUsecase.ConsumeOffer(ctx, req.RedemptionToken, req.PartnerID, req.Amount)
 	if err != nil {
+		if errors.Cause(err) == entities.ErrIdempotencyKeyReused {
+			entities.SendConflictError(c, errors.Cause(err).Error(), err)
+			return
+		}
 		entities.SendValidationError(c, errors.Cause(err).Error(), err)
 		return
 	}
@@ -90,6 +126,100 @@ func (h *Handler) ConsumeOffer(c *gin.Context) {
 	})
 }
 
+// CreatePendingOffer handles POST request to offer/pending endpoint
+func (h *Handler) CreatePendingOffer(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	if apiKeyID, ok := c.Get("apiKeyID"); ok {
+		ctx = context.WithValue(ctx, entities.APIKeyIDKey, apiKeyID)
+	}
+	ctx = context.WithValue(ctx, entities.IdempotencyKeyKey, c.GetHeader("Idempotency-Key"))
+	var req consumeOfferRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while processing your request , please try again", err)
+		return
+	}
+	offer, err := h.offersUsecase.CreatePendingOffer(ctx, req.RedemptionToken, req.PartnerID, req.Amount)
+	if err != nil {
+		if errors.Cause(err) == entities.ErrIdempotencyKeyReused {
+			entities.SendConflictError(c, errors.Cause(err).Error(), err)
+			return
+		}
+		entities.SendValidationError(c, errors.Cause(err).Error(), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"offer": offer,
+	})
+}
+
+// AnswerOffer handles POST request to offer/answer/:id endpoint
+func (h *Handler) AnswerOffer(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	offerID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	var req answerOfferRequest
+	err = c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while processing your request , please try again", err)
+		return
+	}
+	if req.Accepted == nil {
+		err := errors.New("accepted is required")
+		entities.SendValidationError(c, err.Error(), err)
+		return
+	}
+	offer, err := h.offersUsecase.AnswerOffer(ctx, uint(offerID), *req.Accepted)
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "You are not authorized to answer this offer", err)
+			return
+		}
+		entities.SendValidationError(c, errors.Cause(err).Error(), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"offer": offer,
+	})
+}
+
+// VoidOffer handles POST request to offer/void/:id endpoint
+func (h *Handler) VoidOffer(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	offerID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	var req voidOfferRequest
+	err = c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while processing your request , please try again", err)
+		return
+	}
+	offer, err := h.offersUsecase.VoidOffer(ctx, uint(offerID), req.Reason)
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "You are not authorized to void this offer", err)
+			return
+		}
+		entities.SendValidationError(c, errors.Cause(err).Error(), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"offer": offer,
+	})
+}
+
 // GetMyOffersHistory handles GET request to offers endpoint
 func (h *Handler) GetMyOffersHistory(c *gin.Context) {
 	ctx := context.Background()
@@ -198,6 +328,10 @@ func (h *Handler) GetOffer(c *gin.Context) {
 	}
 	offer, err := h.offersUsecase.GetOffer(ctx, uint(offerID))
 	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "You are not authorized to view this offer", err)
+			return
+		}
 		entities.SendValidationError(c, "There has been an error while getting information from the server, please try again", err)
 		return
 	}
@@ -206,7 +340,9 @@ func (h *Handler) GetOffer(c *gin.Context) {
 	})
 }
 
-// ConnectWebSocket connects the user into the web socket hub
+// ConnectWebSocket connects the user into the web socket hub.
+// The first message of the client authenticates the user. It's an auth envelope for clients speaking the current version of the protocol,
+// and the token alone for clients speaking version 0.
 func (h *Handler) ConnectWebSocket(w http.ResponseWriter, r *http.Request) {
 	log.Info("connecting WS")
 	wsupgrader.CheckOrigin = func(r *http.Request) bool {
@@ -225,41 +361,318 @@ func (h *Handler) ConnectWebSocket(w http.ResponseWriter, r *http.Request) {
 		conn.Close()
 		return
 	}
-	if authMessage.Token == "" {
-		log.Error(authMessage)
-		conn.WriteMessage(websocket.CloseMessage, []byte("empty token"))
+	if authMessage.Type == "" {
+		h.serveLegacyWebSocket(conn, authMessage.Token)
+		return
+	}
+	h.serveWebSocket(conn, &authMessage.Envelope)
+}
+
+// serveWebSocket authenticates the user with the given auth envelope, then handles the envelopes they send until they disconnect
+func (h *Handler) serveWebSocket(conn *websocket.Conn, auth *protocol.Envelope) {
+	if auth.Type != protocol.TypeAuth {
+		closeWebSocket(conn, protocol.NewError(auth.ID, protocol.ErrCodeInvalidMessage, "the first message must be an auth message"))
+		return
+	}
+	if auth.Version != protocol.Version {
+		closeWebSocket(conn, protocol.NewError(auth.ID, protocol.ErrCodeUnsupportedVersion, fmt.Sprintf("only version %d of the protocol is supported", protocol.Version)))
+		return
+	}
+	var payload protocol.AuthPayload
+	err := auth.DecodePayload(&payload)
+	if err != nil || payload.Token == "" {
+		closeWebSocket(conn, protocol.NewError(auth.ID, protocol.ErrCodeInvalidToken, "empty token"))
+		return
+	}
+	user, err := h.authenticateToken(payload.Token)
+	if err != nil {
+		log.Error(err)
+		closeWebSocket(conn, protocol.NewError(auth.ID, protocol.ErrCodeInvalidToken, "invalid token"))
+		return
+	}
+	authenticated, err := protocol.NewEnvelope(protocol.TypeAuthenticated, protocol.AuthenticatedPayload{UserID: user.ID})
+	if err != nil {
+		log.Error(err)
 		conn.Close()
 		return
 	}
-	ID, err := entities.ParseToken(authMessage.Token)
+	authenticated.Ack = auth.ID
+	conn.WriteJSON(authenticated)
+	h.hub.AddUser(user, conn, protocol.Version)
+	ctx := context.WithValue(context.Background(), entities.UserIDKey, user.ID)
+	// Send the messages the user missed while they weren't connected
+	err = h.offersUsecase.DeliverInbox(ctx)
 	if err != nil {
-		conn.WriteMessage(websocket.CloseMessage, []byte("invalid token"))
-		log.Error(err.Error())
+		log.Error(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error { conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			log.Error(err)
+			h.hub.RemoveConnection(user.ID, conn)
+			return
+		}
+		var reply *protocol.Envelope
+		var e protocol.Envelope
+		err = json.Unmarshal(data, &e)
+		if err != nil {
+			reply = protocol.NewError(0, protocol.ErrCodeInvalidMessage, "messages must be JSON envelopes")
+		} else {
+			reply = h.handleEnvelope(ctx, &e)
+		}
+		if reply == nil {
+			continue
+		}
+		err = h.hub.SendToConnection(user.ID, conn, reply)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// handleEnvelope handles an envelope sent by the current user and returns the reply to send them, if any
+func (h *Handler) handleEnvelope(ctx context.Context, e *protocol.Envelope) *protocol.Envelope {
+	switch e.Type {
+	case protocol.TypeAck:
+		if e.Ack == 0 {
+			return protocol.NewError(e.ID, protocol.ErrCodeInvalidMessage, "ack messages must have the ID of the acknowledged message")
+		}
+		err := h.offersUsecase.AcknowledgeMessage(ctx, e.Ack)
+		if err != nil {
+			return protocol.NewError(e.ID, protocol.ErrCodeRequestFailed, errors.Cause(err).Error())
+		}
+		return nil
+	case protocol.TypeAnswer:
+		var answer protocol.AnswerPayload
+		err := e.DecodePayload(&answer)
+		if err != nil || answer.OfferID == 0 {
+			return protocol.NewError(e.ID, protocol.ErrCodeInvalidMessage, "answer messages must have the ID of the offer")
+		}
+		// The answered offer is sent back over the hub
+		_, err = h.offersUsecase.AnswerOffer(ctx, answer.OfferID, answer.Accepted)
+		if err != nil {
+			return protocol.NewError(e.ID, protocol.ErrCodeRequestFailed, errors.Cause(err).Error())
+		}
+		ok, _ := protocol.NewEnvelope(protocol.TypeOK, nil)
+		ok.Ack = e.ID
+		return ok
+	case protocol.TypePing:
+		pong, _ := protocol.NewEnvelope(protocol.TypePong, nil)
+		pong.Ack = e.ID
+		return pong
+	default:
+		return protocol.NewError(e.ID, protocol.ErrCodeUnknownType, fmt.Sprintf("unknown message type %q", e.Type))
+	}
+}
+
+// serveLegacyWebSocket authenticates the user with the given token, then handles the messages of version 0 of the protocol they send until they disconnect
+func (h *Handler) serveLegacyWebSocket(conn *websocket.Conn, token string) {
+	if token == "" {
+		conn.WriteMessage(websocket.CloseMessage, []byte("empty token"))
 		conn.Close()
 		return
 	}
-	user, err := h.userUsecase.GetUser(context.Background(), ID)
+	user, err := h.authenticateToken(token)
 	if err != nil {
 		conn.WriteMessage(websocket.CloseMessage, []byte("invalid token"))
 		log.Error(err.Error())
 		conn.Close()
 		return
 	}
-	h.hub.AddUser(user, conn)
 	conn.WriteMessage(websocket.TextMessage, []byte("success: authenticated successfully"))
+	h.hub.AddUser(user, conn, 0)
+	ctx := context.WithValue(context.Background(), entities.UserIDKey, user.ID)
+	// Send the messages the user missed while they weren't connected
+	err = h.offersUsecase.DeliverInbox(ctx)
+	if err != nil {
+		log.Error(err)
+	}
 	conn.SetReadDeadline(time.Now().Add(pongWait))
 	conn.SetPongHandler(func(string) error { conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
-		var msg AuthMessage
+		var msg ClientMessage
 		err := conn.ReadJSON(&msg)
 		if err != nil {
 			log.Error(err)
-			h.hub.RemoveUser(user.ID)
+			h.hub.RemoveConnection(user.ID, conn)
+			return
+		}
+		if msg.Ack != 0 {
+			err = h.offersUsecase.AcknowledgeMessage(ctx, msg.Ack)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+		if msg.OfferID != 0 && msg.Accepted != nil {
+			// The answered offer is sent back over the hub
+			_, err = h.offersUsecase.AnswerOffer(ctx, msg.OfferID, *msg.Accepted)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// authenticateToken returns the user with the given token
+func (h *Handler) authenticateToken(token string) (*entities.User, error) {
+	claims, err := h.userUsecase.Authenticate(context.Background(), token)
+	if err != nil {
+		return nil, err
+	}
+	return h.userUsecase.GetUser(context.Background(), claims.ID)
+}
+
+// authenticateTicket returns the user the given stream ticket was issued to
+func (h *Handler) authenticateTicket(ticket string) (*entities.User, error) {
+	userID, err := h.offersUsecase.UseStreamTicket(context.Background(), ticket)
+	if err != nil {
+		return nil, err
+	}
+	return h.userUsecase.GetUser(context.Background(), userID)
+}
+
+// closeWebSocket sends the given error to the client and closes the connection
+func closeWebSocket(conn *websocket.Conn, e *protocol.Envelope) {
+	conn.WriteJSON(e)
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""))
+	conn.Close()
+}
+
+// CreateStreamTicket handles POST request to events/ticket endpoint
+func (h *Handler) CreateStreamTicket(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	ticket, record, err := h.offersUsecase.CreateStreamTicket(ctx)
+	if err != nil {
+		entities.SendValidationError(c, "There has been an error while processing your request, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"ticket":    ticket,
+		"expiresAt": record.ExpiresAt,
+	})
+}
+
+// Events handles GET request to events endpoint.
+// It streams the messages sent to the user as server-sent events, for clients that can't connect to the web socket.
+// The stream ends before the write timeout of the server, and clients resume it by sending the ID of the last event they received.
+func (h *Handler) Events(c *gin.Context) {
+	// EventSource can't send headers, so browsers send a single use stream ticket as a query parameter instead of the token
+	var user *entities.User
+	var err error
+	if ticket := c.Query("ticket"); ticket != "" {
+		user, err = h.authenticateTicket(ticket)
+	} else {
+		user, err = h.authenticateToken(c.GetHeader("Token"))
+	}
+	if err != nil {
+		entities.SendAuthError(c, "You are not authorized to access this page, please login first", err)
+		return
+	}
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+	var afterID uint64
+	if lastEventID != "" {
+		afterID, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+			return
+		}
+	}
+	ctx := context.WithValue(context.Background(), entities.UserIDKey, user.ID)
+	// The stream is added before reading the inbox, so the messages sent meanwhile aren't missed
+	stream := h.hub.AddStream(user)
+	defer h.hub.RemoveStream(user.ID, stream)
+	inbox, err := h.offersUsecase.GetInbox(ctx, uint(afterID))
+	if err != nil {
+		entities.SendValidationError(c, "There has been an error while getting information from the server, please try again", err)
+		return
+	}
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", eventsRetry.Milliseconds())
+	lastSentID := uint(afterID)
+	for i := range inbox {
+		e, err := protocol.NewMessage(&inbox[i])
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		writeEvent(c.Writer, e)
+		lastSentID = e.ID
+	}
+	c.Writer.Flush()
+	timeout := time.NewTimer(eventsStreamDuration)
+	defer timeout.Stop()
+	for {
+		select {
+		case data := <-stream.Messages():
+			var e protocol.Envelope
+			err := json.Unmarshal(data, &e)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			// Messages sent while the inbox was read are already sent
+			if e.ID != 0 && e.ID <= lastSentID {
+				continue
+			}
+			writeEvent(c.Writer, &e)
+			c.Writer.Flush()
+			if e.ID != 0 {
+				lastSentID = e.ID
+			}
+		case <-stream.Done():
+			return
+		case <-timeout.C:
+			return
+		case <-c.Request.Context().Done():
 			return
 		}
 	}
 }
 
+// AcknowledgeMessage handles POST request to inbox/ack/:id endpoint.
+// It's used by clients receiving their messages as server-sent events, which can't send messages back on the stream.
+func (h *Handler) AcknowledgeMessage(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	messageID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	err = h.offersUsecase.AcknowledgeMessage(ctx, uint(messageID))
+	if err != nil {
+		entities.SendValidationError(c, errors.Cause(err).Error(), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": "message acknowledged successfully",
+	})
+}
+
+// writeEvent writes the given envelope as a server-sent event, with the ID of the envelope if it has one
+func writeEvent(w io.Writer, e *protocol.Envelope) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if e.ID != 0 {
+		fmt.Fprintf(w, "id: %d\n", e.ID)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+}
+
 // GetOffersCount handles GET /admin/count/offers
 func (h *Handler) GetOffersCount(c *gin.Context) {
 	ctx := context.Background()
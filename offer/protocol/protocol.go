@@ -0,0 +1,143 @@
+// Package protocol defines the messages exchanged over the web socket of the connect endpoint.
+//
+// Every message is an Envelope with a type and a payload that depends on the type. Clients authenticate
+// with an auth envelope as their first message, and the server answers with an authenticated or an error envelope.
+// Envelopes sent by clients can have an ID, which the server sends back in the ack field of its reply.
+// Envelopes sent by the server with an ID are kept in the inbox of the user until the client acknowledges them with an ack envelope.
+package protocol
+
+import (
+	"encoding/json"
+
+	"github.com/ahmedaabouzied/tasarruf/entities"
+	"github.com/pkg/errors"
+)
+
+// Version is the version of the protocol spoken by the server.
+// Clients that connected before the protocol was versioned speak version 0, where messages aren't wrapped in envelopes.
+const Version = 1
+
+// Types of the envelopes sent by clients
+const (
+	TypeAuth   = "auth"
+	TypeAck    = "ack"
+	TypeAnswer = "answer"
+	TypePing   = "ping"
+)
+
+// Types of the envelopes sent by the server
+const (
+	TypeAuthenticated = "authenticated"
+	TypeOfferReceipt  = "offer.receipt"
+	TypeOfferPrompt   = "offer.prompt"
+	TypeNotification  = "notification"
+	TypeOK            = "ok"
+	TypePong          = "pong"
+	TypeError         = "error"
+)
+
+// Codes of the errors sent by the server
+const (
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeInvalidToken       = "invalid_token"
+	ErrCodeInvalidMessage     = "invalid_message"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeRequestFailed      = "request_failed"
+)
+
+// Envelope is a message sent over the web socket
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      uint            `json:"id,omitempty"`
+	Ack     uint            `json:"ack,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// AuthPayload is the payload of auth envelopes
+type AuthPayload struct {
+	Token string `json:"token"`
+}
+
+// AuthenticatedPayload is the payload of authenticated envelopes
+type AuthenticatedPayload struct {
+	UserID uint `json:"userID"`
+}
+
+// AnswerPayload is the payload of answer envelopes, sent by customers to accept or reject a pending offer
+type AnswerPayload struct {
+	OfferID  uint `json:"offerID"`
+	Accepted bool `json:"accepted"`
+}
+
+// OfferPayload is the payload of offer receipts and prompts
+type OfferPayload struct {
+	Offer json.RawMessage `json:"offer"`
+}
+
+// NotificationPayload is the payload of notification envelopes
+type NotificationPayload struct {
+	Message string `json:"message"`
+}
+
+// ErrorPayload is the payload of error envelopes
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewEnvelope returns an envelope of the current version with the given type and payload.
+// The payload is omitted if it's nil.
+func NewEnvelope(kind string, payload interface{}) (*Envelope, error) {
+	e := &Envelope{
+		Version: Version,
+		Type:    kind,
+	}
+	if payload == nil {
+		return e, nil
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding envelope payload")
+	}
+	e.Payload = data
+	return e, nil
+}
+
+// NewMessage returns the envelope sending the given inbox message
+func NewMessage(m *entities.InboxMessage) (*Envelope, error) {
+	var e *Envelope
+	var err error
+	switch m.Kind {
+	case entities.InboxOffer:
+		e, err = NewEnvelope(TypeOfferReceipt, OfferPayload{Offer: json.RawMessage(m.Payload)})
+	case entities.InboxOfferPrompt:
+		e, err = NewEnvelope(TypeOfferPrompt, OfferPayload{Offer: json.RawMessage(m.Payload)})
+	default:
+		e, err = NewEnvelope(TypeNotification, NotificationPayload{Message: m.Payload})
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.ID = m.ID
+	return e, nil
+}
+
+// NewError returns an error envelope replying to the envelope with the given ID
+func NewError(ack uint, code string, message string) *Envelope {
+	e, _ := NewEnvelope(TypeError, ErrorPayload{Code: code, Message: message})
+	e.Ack = ack
+	return e
+}
+
+// DecodePayload decodes the payload of the envelope into v
+func (e *Envelope) DecodePayload(v interface{}) error {
+	if len(e.Payload) == 0 {
+		return errors.New("envelope has no payload")
+	}
+	err := json.Unmarshal(e.Payload, v)
+	if err != nil {
+		return errors.Wrap(err, "error decoding envelope payload")
+	}
+	return nil
+}
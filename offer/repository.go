@@ -14,7 +14,22 @@ type Repository interface {
 	GetByID(ctx context.Context, ID uint) (*entities.Offer, error)
 	GetByUser(ctx context.Context, userID uint) ([]entities.Offer, error)
 	GetByPartner(ctx context.Context, partnerID uint, startDate time.Time, endDate time.Time) ([]entities.Offer, error)
+	GetByBranch(ctx context.Context, partnerID uint, branchID uint, startDate time.Time, endDate time.Time) ([]entities.Offer, error)
+	GetByCashier(ctx context.Context, partnerID uint, cashierID uint, startDate time.Time, endDate time.Time) ([]entities.Offer, error)
 	GetCountByPartnerAndCustomer(ctx context.Context, partnerID uint, customerID uint, startDate time.Time, endDate time.Time) (int, error)
+	GetIdempotencyKey(ctx context.Context, partnerID uint, key string, now time.Time) (*entities.UsedIdempotencyKey, error)
 	GetOffersCount(ctx context.Context) (int, error)
 	GetAllOffers(ctx context.Context) ([]entities.Offer, error)
+	IsRedemptionTokenUsed(ctx context.Context, nonce string) (bool, error)
+	ConsumeOffer(ctx context.Context, o *entities.Offer, token *entities.UsedRedemptionToken, key *entities.UsedIdempotencyKey, notify []uint) (*entities.Offer, error)
+	VoidOffer(ctx context.Context, o *entities.Offer, notify []uint) error
+	CreatePendingOffer(ctx context.Context, o *entities.Offer, token *entities.UsedRedemptionToken, key *entities.UsedIdempotencyKey, notify []uint) (*entities.Offer, error)
+	ConfirmOffer(ctx context.Context, o *entities.Offer, notify []uint) error
+	ClosePendingOffer(ctx context.Context, o *entities.Offer, notify []uint) error
+	GetExpiredPendingOffers(ctx context.Context, now time.Time) ([]entities.Offer, error)
+	GetUnacknowledgedMessages(ctx context.Context, userID uint) ([]entities.InboxMessage, error)
+	MarkMessageDelivered(ctx context.Context, messageID uint, at time.Time) error
+	AcknowledgeMessage(ctx context.Context, userID uint, messageID uint, at time.Time) error
+	CreateStreamTicket(ctx context.Context, ticket *entities.StreamTicket) error
+	UseStreamTicket(ctx context.Context, hash string, now time.Time) (*entities.StreamTicket, error)
 }
@@ -6,6 +6,7 @@ import (
 	"github.com/ahmedaabouzied/tasarruf/offer"
 	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"time"
 )
 
@@ -70,6 +71,32 @@ func (r *OfferRepository) GetByPartner(ctx context.Context, partnerID uint, star
 	return offers, nil
 }
 
+// GetByBranch returns the offers given at the branch with the given ID of the partner with the given ID
+func (r *OfferRepository) GetByBranch(ctx context.Context, partnerID uint, branchID uint, startDate time.Time, endDate time.Time) ([]entities.Offer, error) {
+	var offers []entities.Offer
+	dbt := r.DB.Where("partner_id = ? AND branch_id = ? AND created_at > ? AND created_at < ?", partnerID, branchID, startDate, endDate).Find(&offers)
+	if dbt.Error != nil {
+		if dbt.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, errors.Wrap(dbt.Error, "error getting offers for the given branch")
+	}
+	return offers, nil
+}
+
+// GetByCashier returns the offers scanned by the cashier with the given ID of the partner with the given ID
+func (r *OfferRepository) GetByCashier(ctx context.Context, partnerID uint, cashierID uint, startDate time.Time, endDate time.Time) ([]entities.Offer, error) {
+	var offers []entities.Offer
+	dbt := r.DB.Where("partner_id = ? AND cashier_id = ? AND created_at > ? AND created_at < ?", partnerID, cashierID, startDate, endDate).Find(&offers)
+	if dbt.Error != nil {
+		if dbt.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, errors.Wrap(dbt.Error, "error getting offers for the given cashier")
+	}
+	return offers, nil
+}
+
 // GetCountByPartnerAndCustomer returns the count of offers consumed by this partner to this customer for the given time range
 func (r *OfferRepository) GetCountByPartnerAndCustomer(ctx context.Context, partnerID uint, customerID uint, startDate time.Time, endDate time.Time) (int, error) {
 	var offers []entities.Offer
@@ -83,11 +110,24 @@ func (r *OfferRepository) GetCountByPartnerAndCustomer(ctx context.Context, part
 	return len(offers), nil
 }
 
-// GetOffersCount returns the count of offers
+// GetIdempotencyKey returns the record of the request the given partner consumed an offer with under the given idempotency key.
+// It returns nil if the partner hasn't used the key or it has expired by the given time.
+func (r *OfferRepository) GetIdempotencyKey(ctx context.Context, partnerID uint, key string, now time.Time) (*entities.UsedIdempotencyKey, error) {
+	var k entities.UsedIdempotencyKey
+	dbt := r.DB.Where("partner_id = ? AND key = ? AND expires_at > ?", partnerID, key, now).First(&k)
+	if dbt.Error != nil {
+		if dbt.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, errors.Wrap(dbt.Error, "error getting idempotency key")
+	}
+	return &k, nil
+}
+
+// GetOffersCount returns the count of consumed offers
 func (r *OfferRepository) GetOffersCount(ctx context.Context) (int, error) {
-	var offers []entities.Offer
 	var count int
-	dbt := r.DB.Find(&offers).Count(&count)
+	dbt := r.DB.Model(&entities.Offer{}).Where("status = ?", entities.OfferConsumed).Count(&count)
 	if dbt.Error != nil {
 		return 0, errors.Wrap(dbt.Error, "error getting offers count")
 	}
@@ -103,3 +143,383 @@ func (r *OfferRepository) GetAllOffers(ctx context.Context) ([]entities.Offer, e
 	}
 	return offers, nil
 }
+
+// IsRedemptionTokenUsed returns true if the redemption token with the given nonce has been used
+func (r *OfferRepository) IsRedemptionTokenUsed(ctx context.Context, nonce string) (bool, error) {
+	var count int
+	dbt := r.DB.Model(&entities.UsedRedemptionToken{}).Where("nonce = ?", nonce).Count(&count)
+	if dbt.Error != nil {
+		return false, errors.Wrap(dbt.Error, "error checking redemption token")
+	}
+	return count > 0, nil
+}
+
+// ConsumeOffer saves the given offer in one transaction with using the given redemption token and idempotency key,
+// debiting it from the offers ledger of the subscription of the customer and sending it to the inbox of the users to notify.
+//
+// The subscription is locked until the transaction ends, so concurrent scans of the same customer
+// can't consume the same remaining offer.
+// It returns entities.ErrNoRemainingOffers if there are none left, entities.ErrRedemptionTokenUsed if the token has been used before,
+// and entities.ErrIdempotencyKeyUsed if the partner has already saved an offer with the idempotency key.
+// The idempotency key is optional.
+func (r *OfferRepository) ConsumeOffer(ctx context.Context, o *entities.Offer, token *entities.UsedRedemptionToken, key *entities.UsedIdempotencyKey, notify []uint) (*entities.Offer, error) {
+	tx := r.DB.Begin()
+	if tx.Error != nil {
+		return nil, errors.Wrap(tx.Error, "error starting transaction")
+	}
+	err := r.useRedemptionToken(ctx, tx, token)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = lockRemainingOffers(tx, o)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	dbt := tx.Create(o)
+	if dbt.Error != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(dbt.Error, "error creating offer")
+	}
+	err = r.useIdempotencyKey(ctx, tx, o, key)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	dbt = tx.Create(entities.NewConsumption(o))
+	if dbt.Error != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(dbt.Error, "error debiting offer")
+	}
+	err = sendOfferMessages(tx, o, notify)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	dbt = tx.Commit()
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error committing offer")
+	}
+	r.deleteExpiredRedemptionTokens()
+	r.deleteExpiredIdempotencyKeys()
+	return o, nil
+}
+
+// CreatePendingOffer saves the given pending offer in one transaction with using the given redemption token
+// and idempotency key, and sending it to the inbox of the users to notify. Nothing is debited until the customer confirms the offer.
+func (r *OfferRepository) CreatePendingOffer(ctx context.Context, o *entities.Offer, token *entities.UsedRedemptionToken, key *entities.UsedIdempotencyKey, notify []uint) (*entities.Offer, error) {
+	tx := r.DB.Begin()
+	if tx.Error != nil {
+		return nil, errors.Wrap(tx.Error, "error starting transaction")
+	}
+	err := r.useRedemptionToken(ctx, tx, token)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	dbt := tx.Create(o)
+	if dbt.Error != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(dbt.Error, "error creating offer")
+	}
+	err = r.useIdempotencyKey(ctx, tx, o, key)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = sendOfferMessages(tx, o, notify)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	dbt = tx.Commit()
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error committing offer")
+	}
+	r.deleteExpiredRedemptionTokens()
+	r.deleteExpiredIdempotencyKeys()
+	return o, nil
+}
+
+// ConfirmOffer saves the given pending offer accepted by the customer in one transaction with debiting it from the offers ledger
+// and sending it to the inbox of the users to notify.
+// It returns entities.ErrOfferNotPending if the offer has been answered or expired by another request,
+// and entities.ErrNoRemainingOffers if the customer has no offers left.
+func (r *OfferRepository) ConfirmOffer(ctx context.Context, o *entities.Offer, notify []uint) error {
+	tx := r.DB.Begin()
+	if tx.Error != nil {
+		return errors.Wrap(tx.Error, "error starting transaction")
+	}
+	err := lockRemainingOffers(tx, o)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	dbt := tx.Model(&entities.Offer{}).Where("id = ? AND status = ?", o.ID, entities.OfferPending).Update("status", o.Status)
+	if dbt.Error != nil {
+		tx.Rollback()
+		return errors.Wrap(dbt.Error, "error confirming offer")
+	}
+	if dbt.RowsAffected == 0 {
+		tx.Rollback()
+		return entities.ErrOfferNotPending
+	}
+	dbt = tx.Create(entities.NewConsumption(o))
+	if dbt.Error != nil {
+		tx.Rollback()
+		return errors.Wrap(dbt.Error, "error debiting offer")
+	}
+	err = sendOfferMessages(tx, o, notify)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	dbt = tx.Commit()
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error committing offer")
+	}
+	return nil
+}
+
+// ClosePendingOffer saves the given pending offer rejected by the customer or expired in one transaction with
+// sending it to the inbox of the users to notify.
+// It returns entities.ErrOfferNotPending if the offer has been answered or expired by another request.
+func (r *OfferRepository) ClosePendingOffer(ctx context.Context, o *entities.Offer, notify []uint) error {
+	tx := r.DB.Begin()
+	if tx.Error != nil {
+		return errors.Wrap(tx.Error, "error starting transaction")
+	}
+	dbt := tx.Model(&entities.Offer{}).Where("id = ? AND status = ?", o.ID, entities.OfferPending).Update("status", o.Status)
+	if dbt.Error != nil {
+		tx.Rollback()
+		return errors.Wrap(dbt.Error, "error closing pending offer")
+	}
+	if dbt.RowsAffected == 0 {
+		tx.Rollback()
+		return entities.ErrOfferNotPending
+	}
+	err := sendOfferMessages(tx, o, notify)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	dbt = tx.Commit()
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error committing pending offer")
+	}
+	return nil
+}
+
+// GetExpiredPendingOffers returns the pending offers that weren't answered before the given time
+func (r *OfferRepository) GetExpiredPendingOffers(ctx context.Context, now time.Time) ([]entities.Offer, error) {
+	var offers []entities.Offer
+	dbt := r.DB.Where("status = ? AND confirm_by < ?", entities.OfferPending, now).Find(&offers)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting expired pending offers")
+	}
+	return offers, nil
+}
+
+// VoidOffer saves the given voided offer in one transaction with crediting it back to the offers ledger of the subscription of the customer
+// and sending it to the inbox of the users to notify.
+// It returns entities.ErrOfferVoided if the offer has been voided by another request.
+func (r *OfferRepository) VoidOffer(ctx context.Context, o *entities.Offer, notify []uint) error {
+	tx := r.DB.Begin()
+	if tx.Error != nil {
+		return errors.Wrap(tx.Error, "error starting transaction")
+	}
+	dbt := tx.Model(&entities.Offer{}).Where("id = ? AND status = ?", o.ID, entities.OfferConsumed).Updates(map[string]interface{}{
+		"status":       o.Status,
+		"voided_at":    o.VoidedAt,
+		"void_reason":  o.VoidReason,
+		"voided_by_id": o.VoidedByID,
+	})
+	if dbt.Error != nil {
+		tx.Rollback()
+		return errors.Wrap(dbt.Error, "error voiding offer")
+	}
+	if dbt.RowsAffected == 0 {
+		tx.Rollback()
+		return entities.ErrOfferVoided
+	}
+	dbt = tx.Create(entities.NewVoid(o, o.VoidedByID, o.VoidReason))
+	if dbt.Error != nil {
+		tx.Rollback()
+		return errors.Wrap(dbt.Error, "error crediting voided offer")
+	}
+	err := sendOfferMessages(tx, o, notify)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	dbt = tx.Commit()
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error committing voided offer")
+	}
+	return nil
+}
+
+// GetUnacknowledgedMessages returns the messages in the inbox of the given user that they haven't acknowledged, oldest first
+func (r *OfferRepository) GetUnacknowledgedMessages(ctx context.Context, userID uint) ([]entities.InboxMessage, error) {
+	var messages []entities.InboxMessage
+	dbt := r.DB.Where("user_id = ? AND acknowledged_at IS NULL", userID).Order("id").Find(&messages)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting inbox messages")
+	}
+	return messages, nil
+}
+
+// MarkMessageDelivered records that the message with the given ID has been sent to its user
+func (r *OfferRepository) MarkMessageDelivered(ctx context.Context, messageID uint, at time.Time) error {
+	dbt := r.DB.Model(&entities.InboxMessage{}).Where("id = ?", messageID).Update("delivered_at", at)
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error marking inbox message as delivered")
+	}
+	return nil
+}
+
+// AcknowledgeMessage records that the given user received the message with the given ID, so it's not sent again.
+// Acknowledging a message more than once has no effect.
+// It returns entities.ErrInboxMessageNotFound if the message isn't in the inbox of the user.
+func (r *OfferRepository) AcknowledgeMessage(ctx context.Context, userID uint, messageID uint, at time.Time) error {
+	var count int
+	dbt := r.DB.Model(&entities.InboxMessage{}).Where("id = ? AND user_id = ?", messageID, userID).Count(&count)
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error getting inbox message")
+	}
+	if count == 0 {
+		return entities.ErrInboxMessageNotFound
+	}
+	dbt = r.DB.Model(&entities.InboxMessage{}).Where("id = ? AND acknowledged_at IS NULL", messageID).Update("acknowledged_at", at)
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error acknowledging inbox message")
+	}
+	return nil
+}
+
+// useRedemptionToken records the given redemption token as used within the given transaction.
+// It returns entities.ErrRedemptionTokenUsed if the token has been used before.
+func (r *OfferRepository) useRedemptionToken(ctx context.Context, tx *gorm.DB, token *entities.UsedRedemptionToken) error {
+	dbt := tx.Create(token)
+	if dbt.Error != nil {
+		used, err := r.IsRedemptionTokenUsed(ctx, token.Nonce)
+		if err == nil && used {
+			return entities.ErrRedemptionTokenUsed
+		}
+		return errors.Wrap(dbt.Error, "error using redemption token")
+	}
+	return nil
+}
+
+// useIdempotencyKey records the given idempotency key as used for the given offer within the given transaction.
+// An expired record of the key is replaced. It returns entities.ErrIdempotencyKeyUsed if another request of the partner used the key.
+func (r *OfferRepository) useIdempotencyKey(ctx context.Context, tx *gorm.DB, o *entities.Offer, key *entities.UsedIdempotencyKey) error {
+	if key == nil {
+		return nil
+	}
+	dbt := tx.Unscoped().Where("partner_id = ? AND key = ? AND expires_at <= ?", key.PartnerID, key.Key, time.Now()).Delete(&entities.UsedIdempotencyKey{})
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error deleting expired idempotency key")
+	}
+	key.OfferID = o.ID
+	dbt = tx.Create(key)
+	if dbt.Error != nil {
+		var count int
+		r.DB.Model(&entities.UsedIdempotencyKey{}).Where("partner_id = ? AND key = ?", key.PartnerID, key.Key).Count(&count)
+		if count > 0 {
+			return entities.ErrIdempotencyKeyUsed
+		}
+		return errors.Wrap(dbt.Error, "error using idempotency key")
+	}
+	return nil
+}
+
+// deleteExpiredRedemptionTokens deletes the records of expired tokens since they can't be replayed anymore.
+// It's called after the offer using a token is saved, so failing to do so is only logged.
+func (r *OfferRepository) deleteExpiredRedemptionTokens() {
+	dbt := r.DB.Unscoped().Where("expires_at < ?", time.Now()).Delete(&entities.UsedRedemptionToken{})
+	if dbt.Error != nil {
+		log.Error(errors.Wrap(dbt.Error, "error deleting expired redemption tokens"))
+	}
+}
+
+// deleteExpiredIdempotencyKeys deletes the records of expired idempotency keys since retries with them aren't recognized anymore.
+// It's called after the offer using a key is saved, so failing to do so is only logged.
+func (r *OfferRepository) deleteExpiredIdempotencyKeys() {
+	dbt := r.DB.Unscoped().Where("expires_at < ?", time.Now()).Delete(&entities.UsedIdempotencyKey{})
+	if dbt.Error != nil {
+		log.Error(errors.Wrap(dbt.Error, "error deleting expired idempotency keys"))
+	}
+}
+
+// lockRemainingOffers locks the subscription of the given offer until the transaction ends, so concurrent scans of the same customer
+// can't consume the same remaining offer. It returns entities.ErrSubscriptionEnded if the subscription expired or was cancelled meanwhile,
+// and entities.ErrNoRemainingOffers if there are none left with the partner of the offer.
+func lockRemainingOffers(tx *gorm.DB, o *entities.Offer) error {
+	var subscription entities.Subscription
+	dbt := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", o.SubsriptionID).First(&subscription)
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error locking subscription")
+	}
+	if subscription.HasExpirPassed() || subscription.IsExpired() {
+		return entities.ErrSubscriptionEnded
+	}
+	balance, err := entities.RemainingOffersWithPartner(tx, o.SubsriptionID, o.PartnerID)
+	if err != nil {
+		return err
+	}
+	if balance <= 0 {
+		return entities.ErrNoRemainingOffers
+	}
+	return nil
+}
+
+// sendOfferMessages saves the given offer in the inbox of each of the given users within the given transaction
+func sendOfferMessages(tx *gorm.DB, o *entities.Offer, userIDs []uint) error {
+	for _, userID := range userIDs {
+		message, err := entities.NewOfferMessage(userID, o)
+		if err != nil {
+			return err
+		}
+		dbt := tx.Create(message)
+		if dbt.Error != nil {
+			return errors.Wrap(dbt.Error, "error saving inbox message")
+		}
+	}
+	return nil
+}
+
+// CreateStreamTicket saves the given stream ticket
+func (r *OfferRepository) CreateStreamTicket(ctx context.Context, ticket *entities.StreamTicket) error {
+	dbt := r.DB.Create(ticket)
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error creating stream ticket")
+	}
+	return nil
+}
+
+// UseStreamTicket deletes the stream ticket with the given hash and returns it, so it can only be used once.
+// It returns entities.ErrInvalidStreamTicket if there's no such ticket, it expired by the given time or another request used it.
+func (r *OfferRepository) UseStreamTicket(ctx context.Context, hash string, now time.Time) (*entities.StreamTicket, error) {
+	var ticket entities.StreamTicket
+	dbt := r.DB.Where("token_hash = ? AND expires_at > ?", hash, now).First(&ticket)
+	if dbt.Error != nil {
+		if dbt.RecordNotFound() {
+			return nil, entities.ErrInvalidStreamTicket
+		}
+		return nil, errors.Wrap(dbt.Error, "error getting stream ticket")
+	}
+	dbt = r.DB.Unscoped().Where("id = ?", ticket.ID).Delete(&entities.StreamTicket{})
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error using stream ticket")
+	}
+	if dbt.RowsAffected != 1 {
+		return nil, entities.ErrInvalidStreamTicket
+	}
+	dbt = r.DB.Unscoped().Where("expires_at < ?", now).Delete(&entities.StreamTicket{})
+	if dbt.Error != nil {
+		log.Error(errors.Wrap(dbt.Error, "error deleting expired stream tickets"))
+	}
+	return &ticket, nil
+}
@@ -0,0 +1,494 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ahmedaabouzied/tasarruf/entities"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+func connectToDB() (*gorm.DB, error) {
+	conf := entities.DBConfig{
+		Port:     5432,
+		Host:     "localhost",
+		User:     "tasarruf",
+		Password: "password",
+		DBName:   "tasarruftestdb",
+	}
+	db, err := entities.ConnectToDB(&conf)
+	if err != nil {
+		return nil, err
+	}
+	db.DropTable(entities.Offer{})
+	db.DropTable(entities.UsedRedemptionToken{})
+	db.DropTable(entities.UsedIdempotencyKey{})
+	db.DropTable(entities.Subscription{})
+	db.DropTable(entities.OfferLedgerEntry{})
+	db.DropTable(entities.InboxMessage{})
+	db.DropTable(entities.StreamTicket{})
+	db.AutoMigrate(entities.Offer{})
+	db.AutoMigrate(entities.UsedRedemptionToken{})
+	db.AutoMigrate(entities.UsedIdempotencyKey{})
+	db.AutoMigrate(entities.Subscription{})
+	db.AutoMigrate(entities.OfferLedgerEntry{})
+	db.AutoMigrate(entities.InboxMessage{})
+	db.AutoMigrate(entities.StreamTicket{})
+	err = entities.MigrateIdempotencyKeys(db)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// createSubscription creates a subscription of customer 1 with the given offers with every partner
+func createSubscription(t *testing.T, db *gorm.DB, offers uint) *entities.Subscription {
+	subscription := &entities.Subscription{
+		UserID:          1,
+		RemainingOffers: offers,
+		ExpireDate:      time.Now().AddDate(1, 0, 0),
+	}
+	dbt := db.Create(subscription)
+	if dbt.Error != nil {
+		t.Fatal(dbt.Error)
+	}
+	dbt = db.Create(entities.NewPlanGrant(subscription, &entities.Plan{CountOfOffers: offers}))
+	if dbt.Error != nil {
+		t.Fatal(dbt.Error)
+	}
+	return subscription
+}
+
+func newOffer(subscription *entities.Subscription) *entities.Offer {
+	return &entities.Offer{CustomerID: 1, PartnerID: 2, SubsriptionID: subscription.ID, Amount: 100}
+}
+
+func remainingOffers(t *testing.T, db *gorm.DB, subscription *entities.Subscription) int {
+	balance, err := entities.RemainingOffersWithPartner(db, subscription.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+func usedToken(nonce string) *entities.UsedRedemptionToken {
+	return &entities.UsedRedemptionToken{
+		Nonce:      nonce,
+		CustomerID: 1,
+		ExpiresAt:  time.Now().Add(entities.RedemptionTokenLifetime),
+	}
+}
+
+// usedKey returns the "retried" idempotency key of partner 2 used with the given token until the given time
+func usedKey(token *entities.UsedRedemptionToken, expiresAt time.Time) *entities.UsedIdempotencyKey {
+	claims := &entities.RedemptionClaims{CustomerID: token.CustomerID, Nonce: token.Nonce}
+	return entities.NewUsedIdempotencyKey(2, "retried", claims, 100, expiresAt)
+}
+
+// notify sends the offers to the inbox of customer 1
+var notify = []uint{1}
+
+func TestConsumeOfferConcurrently(t *testing.T) {
+	db, err := connectToDB()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	repo := CreateOfferRepository(db)
+	const remaining = 5
+	const scans = 50
+	subscription := createSubscription(t, db, remaining)
+	var wg sync.WaitGroup
+	results := make(chan error, scans)
+	for i := 0; i < scans; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			offer := newOffer(subscription)
+			_, err := repo.ConsumeOffer(context.Background(), offer, usedToken(fmt.Sprintf("nonce-%d", i)), nil, notify)
+			results <- err
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+	var consumed int
+	for err := range results {
+		switch errors.Cause(err) {
+		case nil:
+			consumed++
+		case entities.ErrNoRemainingOffers:
+		default:
+			t.Error(err)
+		}
+	}
+	if consumed != remaining {
+		t.Errorf("expected %d offers to be consumed, got %d", remaining, consumed)
+	}
+	var count int
+	db.Model(&entities.Offer{}).Where("customer_id = ?", 1).Count(&count)
+	if count != remaining {
+		t.Errorf("expected %d offers to be saved, got %d", remaining, count)
+	}
+	if balance := remainingOffers(t, db, subscription); balance != 0 {
+		t.Errorf("expected no remaining offers, got %d", balance)
+	}
+}
+
+func TestConsumeOfferWithSameTokenConcurrently(t *testing.T) {
+	db, err := connectToDB()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	repo := CreateOfferRepository(db)
+	const scans = 20
+	subscription := createSubscription(t, db, scans)
+	var wg sync.WaitGroup
+	results := make(chan error, scans)
+	for i := 0; i < scans; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			offer := newOffer(subscription)
+			_, err := repo.ConsumeOffer(context.Background(), offer, usedToken("replayed"), nil, notify)
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+	var consumed int
+	for err := range results {
+		switch errors.Cause(err) {
+		case nil:
+			consumed++
+		case entities.ErrRedemptionTokenUsed:
+		default:
+			t.Error(err)
+		}
+	}
+	if consumed != 1 {
+		t.Errorf("expected the token to be used once, got %d", consumed)
+	}
+	if balance := remainingOffers(t, db, subscription); balance != scans-1 {
+		t.Errorf("expected %d remaining offers, got %d", scans-1, balance)
+	}
+}
+
+func TestConsumeOfferWithSameIdempotencyKeyConcurrently(t *testing.T) {
+	db, err := connectToDB()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	repo := CreateOfferRepository(db)
+	const scans = 10
+	subscription := createSubscription(t, db, scans)
+	var wg sync.WaitGroup
+	results := make(chan error, scans)
+	for i := 0; i < scans; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token := usedToken(fmt.Sprintf("key-%d", i))
+			_, err := repo.ConsumeOffer(context.Background(), newOffer(subscription), token, usedKey(token, time.Now().Add(time.Hour)), notify)
+			results <- err
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+	var consumed int
+	for err := range results {
+		switch errors.Cause(err) {
+		case nil:
+			consumed++
+		case entities.ErrIdempotencyKeyUsed:
+		default:
+			t.Error(err)
+		}
+	}
+	if consumed != 1 {
+		t.Errorf("expected the idempotency key to be used once, got %d", consumed)
+	}
+	key, err := repo.GetIdempotencyKey(context.Background(), 2, "retried", time.Now())
+	if err != nil || key == nil {
+		t.Fatalf("expected the used idempotency key, got %+v and %v", key, err)
+	}
+	key, err = repo.GetIdempotencyKey(context.Background(), 2, "retried", time.Now().Add(2*time.Hour))
+	if err != nil || key != nil {
+		t.Errorf("expected the idempotency key to expire, got %+v and %v", key, err)
+	}
+}
+
+func TestConsumeOfferWithExpiredIdempotencyKey(t *testing.T) {
+	db, err := connectToDB()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	repo := CreateOfferRepository(db)
+	subscription := createSubscription(t, db, 2)
+	token := usedToken("expired-key")
+	offer := newOffer(subscription)
+	offer.IdempotencyKey = "retried"
+	first, err := repo.ConsumeOffer(context.Background(), offer, token, usedKey(token, time.Now().Add(-time.Minute)), notify)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token = usedToken("reused-key")
+	second, err := repo.ConsumeOffer(context.Background(), newOffer(subscription), token, usedKey(token, time.Now().Add(time.Hour)), notify)
+	if err != nil {
+		t.Fatalf("expected an expired idempotency key to be used again, got %v", err)
+	}
+	key, err := repo.GetIdempotencyKey(context.Background(), 2, "retried", time.Now())
+	if err != nil || key == nil || key.OfferID != second.ID {
+		t.Errorf("expected the key to be used for offer %d, got %+v and %v", second.ID, key, err)
+	}
+	var saved entities.Offer
+	db.First(&saved, first.ID)
+	if saved.IdempotencyKey != "retried" {
+		t.Error("expected the first offer to keep its idempotency key")
+	}
+}
+
+func TestConsumeOfferRollsBack(t *testing.T) {
+	db, err := connectToDB()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	repo := CreateOfferRepository(db)
+	subscription := createSubscription(t, db, 0)
+	offer := newOffer(subscription)
+	_, err = repo.ConsumeOffer(context.Background(), offer, usedToken("undebited"), nil, notify)
+	if errors.Cause(err) != entities.ErrNoRemainingOffers {
+		t.Errorf("expected ErrNoRemainingOffers, got %v", err)
+	}
+	var count int
+	db.Model(&entities.Offer{}).Count(&count)
+	if count != 0 {
+		t.Error("expected the offer not to be saved")
+	}
+	messages, err := repo.GetUnacknowledgedMessages(context.Background(), 1)
+	if err != nil || len(messages) != 0 {
+		t.Errorf("expected no receipt to be saved, got %+v", messages)
+	}
+	used, err := repo.IsRedemptionTokenUsed(context.Background(), "undebited")
+	if err != nil || used {
+		t.Error("expected the redemption token not to be used")
+	}
+}
+
+func TestInbox(t *testing.T) {
+	db, err := connectToDB()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	repo := CreateOfferRepository(db)
+	subscription := createSubscription(t, db, 2)
+	for _, nonce := range []string{"first", "second"} {
+		_, err := repo.ConsumeOffer(context.Background(), newOffer(subscription), usedToken(nonce), nil, notify)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages, err := repo.GetUnacknowledgedMessages(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].ID > messages[1].ID || messages[0].Kind != entities.InboxOffer {
+		t.Fatalf("expected a receipt for each offer in order, got %+v", messages)
+	}
+	if err := repo.MarkMessageDelivered(context.Background(), messages[0].ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AcknowledgeMessage(context.Background(), 2, messages[0].ID, time.Now()); err != entities.ErrInboxMessageNotFound {
+		t.Errorf("expected ErrInboxMessageNotFound for another user, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := repo.AcknowledgeMessage(context.Background(), 1, messages[0].ID, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages, err = repo.GetUnacknowledgedMessages(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].IsDelivered() {
+		t.Errorf("expected the undelivered receipt to be left, got %+v", messages)
+	}
+}
+
+func TestVoidOfferConcurrently(t *testing.T) {
+	db, err := connectToDB()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	repo := CreateOfferRepository(db)
+	subscription := createSubscription(t, db, 1)
+	offer, err := repo.ConsumeOffer(context.Background(), newOffer(subscription), usedToken("voided"), nil, notify)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const voids = 10
+	var wg sync.WaitGroup
+	results := make(chan error, voids)
+	for i := 0; i < voids; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			voided := *offer
+			err := voided.Void(&entities.User{AccountType: "admin", Role: entities.RoleSuperAdmin}, "Wrong amount", time.Now(), entities.DefaultVoidWindow)
+			if err == nil {
+				err = repo.VoidOffer(context.Background(), &voided, notify)
+			}
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+	var voided int
+	for err := range results {
+		switch errors.Cause(err) {
+		case nil:
+			voided++
+		case entities.ErrOfferVoided:
+		default:
+			t.Error(err)
+		}
+	}
+	if voided != 1 {
+		t.Errorf("expected the offer to be voided once, got %d", voided)
+	}
+	if balance := remainingOffers(t, db, subscription); balance != 1 {
+		t.Errorf("expected the offer to be credited back once, got %d remaining offers", balance)
+	}
+	saved, err := repo.GetByID(context.Background(), offer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.IsVoided() || saved.VoidReason != "Wrong amount" {
+		t.Errorf("expected the offer to be saved as voided, got %+v", saved)
+	}
+}
+
+func TestConfirmOffer(t *testing.T) {
+	db, err := connectToDB()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	repo := CreateOfferRepository(db)
+	subscription := createSubscription(t, db, 1)
+	customer := &entities.User{AccountType: "user", Role: entities.RoleCustomer}
+	customer.ID = 1
+	createPending := func(nonce string) *entities.Offer {
+		offer := newOffer(subscription)
+		offer.RequireConfirmation(time.Now(), entities.DefaultConfirmationWindow)
+		offer, err := repo.CreatePendingOffer(context.Background(), offer, usedToken(nonce), nil, notify)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return offer
+	}
+	pending := createPending("pending")
+	if remainingOffers(t, db, subscription) != 1 {
+		t.Error("expected the pending offer not to be debited")
+	}
+	accepted := *pending
+	if err := accepted.Answer(customer, true, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	rejected := *pending
+	if err := rejected.Answer(customer, false, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ConfirmOffer(context.Background(), &accepted, notify); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ClosePendingOffer(context.Background(), &rejected, notify); err != entities.ErrOfferNotPending {
+		t.Errorf("expected ErrOfferNotPending, got %v", err)
+	}
+	if remainingOffers(t, db, subscription) != 0 {
+		t.Error("expected the confirmed offer to be debited")
+	}
+	another := createPending("another")
+	if err := another.Answer(customer, true, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ConfirmOffer(context.Background(), another, notify); errors.Cause(err) != entities.ErrNoRemainingOffers {
+		t.Errorf("expected ErrNoRemainingOffers, got %v", err)
+	}
+	expired, err := repo.GetExpiredPendingOffers(context.Background(), time.Now().Add(entities.DefaultConfirmationWindow+time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].ID != another.ID {
+		t.Errorf("expected the unconfirmed offer to expire, got %+v", expired)
+	}
+}
+
+func TestConsumeOfferWithCancelledSubscription(t *testing.T) {
+	db, err := connectToDB()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	repo := CreateOfferRepository(db)
+	subscription := createSubscription(t, db, 1)
+	cancelledAt := time.Now()
+	dbt := db.Model(subscription).Update("cancelled_at", &cancelledAt)
+	if dbt.Error != nil {
+		t.Fatal(dbt.Error)
+	}
+	_, err = repo.ConsumeOffer(context.Background(), newOffer(subscription), usedToken("cancelled"), nil, notify)
+	if errors.Cause(err) != entities.ErrSubscriptionEnded {
+		t.Errorf("expected ErrSubscriptionEnded, got %v", err)
+	}
+	if balance := remainingOffers(t, db, subscription); balance != 1 {
+		t.Errorf("expected the offer not to be debited, got %d remaining offers", balance)
+	}
+}
+
+func TestUseStreamTicketOnce(t *testing.T) {
+	db, err := connectToDB()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	repo := CreateOfferRepository(db)
+	now := time.Now()
+	ticket, record, err := entities.NewStreamTicket(1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.CreateStreamTicket(context.Background(), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used, err := repo.UseStreamTicket(context.Background(), entities.HashRefreshToken(ticket), now)
+	if err != nil || used.UserID != 1 {
+		t.Fatalf("expected the ticket of user 1, got %+v and %v", used, err)
+	}
+	_, err = repo.UseStreamTicket(context.Background(), entities.HashRefreshToken(ticket), now)
+	if err != entities.ErrInvalidStreamTicket {
+		t.Errorf("expected a used ticket to be rejected, got %v", err)
+	}
+	ticket, record, err = entities.NewStreamTicket(1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.CreateStreamTicket(context.Background(), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.UseStreamTicket(context.Background(), entities.HashRefreshToken(ticket), now.Add(entities.StreamTicketLifetime))
+	if err != entities.ErrInvalidStreamTicket {
+		t.Errorf("expected an expired ticket to be rejected, got %v", err)
+	}
+}
@@ -8,11 +8,20 @@ import (
 
 // Usecase reporesents offer usecase contract
 type Usecase interface {
-	ConsumeOffer(ctx context.Context, customerID uint, partnerID uint, amount float64) (*entities.Offer, error)
+	ConsumeOffer(ctx context.Context, redemptionToken string, partnerID uint, amount float64) (*entities.Offer, error)
 	GetMyOffersHistory(ctx context.Context, startDate time.Time, endDate time.Time) ([]entities.Offer, error)
 	SendOffersStaticMail(ctx context.Context, startDate time.Time, endDate time.Time) error
 	GetOffer(ctx context.Context, offerID uint) (*entities.Offer, error)
 	GetOffersCount(ctx context.Context) (int, error)
 	GetAllOffers(ctx context.Context) ([]entities.Offer, error)
 	GetByCustomer(ctx context.Context, customerID uint) ([]entities.Offer, error)
+	VoidOffer(ctx context.Context, offerID uint, reason string) (*entities.Offer, error)
+	CreatePendingOffer(ctx context.Context, redemptionToken string, partnerID uint, amount float64) (*entities.Offer, error)
+	AnswerOffer(ctx context.Context, offerID uint, accepted bool) (*entities.Offer, error)
+	ExpirePendingOffers(ctx context.Context) error
+	DeliverInbox(ctx context.Context) error
+	GetInbox(ctx context.Context, afterID uint) ([]entities.InboxMessage, error)
+	AcknowledgeMessage(ctx context.Context, messageID uint) error
+	CreateStreamTicket(ctx context.Context) (string, *entities.StreamTicket, error)
+	UseStreamTicket(ctx context.Context, ticket string) (uint, error)
 }
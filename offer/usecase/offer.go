@@ -3,20 +3,17 @@ package usecase
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/csv"
 	"fmt"
-	"os"
 	"time"
 
 	"github.com/ahmedaabouzied/tasarruf/branch"
 	"github.com/ahmedaabouzied/tasarruf/entities"
+	"github.com/ahmedaabouzied/tasarruf/mailer"
 	"github.com/ahmedaabouzied/tasarruf/offer"
 	"github.com/ahmedaabouzied/tasarruf/subscription"
 	"github.com/ahmedaabouzied/tasarruf/user"
 	"github.com/pkg/errors"
-	"github.com/sendgrid/sendgrid-go"
-	"github.com/sendgrid/sendgrid-go/helpers/mail"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -27,76 +24,143 @@ type OfferUsecase struct {
 	userRepo         user.Repository
 	branchRepo       branch.Repository
 	subscriptionRepo subscription.Repository
+	mailer           mailer.Mailer
 }
 
 // CreateOfferUsecase returns an implementation of offer usecase interface
-func CreateOfferUsecase(o offer.Repository, h offer.Hub, u user.Repository, b branch.Repository, s subscription.Repository) offer.Usecase {
+func CreateOfferUsecase(o offer.Repository, h offer.Hub, u user.Repository, b branch.Repository, s subscription.Repository, m mailer.Mailer) offer.Usecase {
 	usecase := OfferUsecase{
 		offerRepo:        o,
 		hub:              h,
 		userRepo:         u,
 		branchRepo:       b,
 		subscriptionRepo: s,
+		mailer:           m,
 	}
 	return &usecase
 }
 
-// ConsumeOffer represents a scan action
-func (u *OfferUsecase) ConsumeOffer(ctx context.Context, customerID uint, partnerID uint, amount float64) (*entities.Offer, error) {
+// ConsumeOffer represents a scan action.
+// The customer is identified by the redemption token shown as a QR code by the customer app, which can only be used once,
+// so the customer doesn't have to be connected.
+// Using the token, saving the offer, debiting it from the offers ledger and saving the receipt in the inbox of the customer
+// happen in one transaction, so either all of them succeed or none does. The receipt is sent to the customer if they are connected,
+// or else when they connect again.
+// If the request has an idempotency key that the partner used within the idempotency window,
+// the offer consumed by the original request is returned instead of consuming another one.
+func (u *OfferUsecase) ConsumeOffer(ctx context.Context, redemptionToken string, partnerID uint, amount float64) (*entities.Offer, error) {
+	return u.consumeOffer(ctx, redemptionToken, partnerID, amount, false)
+}
+
+// CreatePendingOffer represents a scan action that the customer has to confirm.
+// It's the same as ConsumeOffer, except that the offer is sent to the customer as pending and nothing is debited
+// until they accept it with AnswerOffer. Offers that aren't answered within the confirmation window expire.
+func (u *OfferUsecase) CreatePendingOffer(ctx context.Context, redemptionToken string, partnerID uint, amount float64) (*entities.Offer, error) {
+	return u.consumeOffer(ctx, redemptionToken, partnerID, amount, true)
+}
+
+func (u *OfferUsecase) consumeOffer(ctx context.Context, redemptionToken string, partnerID uint, amount float64, requireConfirmation bool) (*entities.Offer, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	// Get current partner
+	// Get current partner, or the partner of the current cashier
 	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := u.getPartnerByID(ctx, currentUserID)
+	scanner, err := u.userRepo.GetByID(ctx, currentUserID)
 	if err != nil {
 		err := errors.Wrap(err, "repository error while getting user")
 		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
-	if currentUser.ID != partnerID {
+	if scanningPartnerID := scanner.ScanningPartnerID(); scanningPartnerID == 0 || scanningPartnerID != partnerID {
 		err := errors.New("partner ID and current user ID do not match")
 		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
-	// Get CustomerUser
-	customer, err := u.getCustomerByID(ctx, customerID)
+	currentUser, err := u.getPartnerByID(ctx, partnerID)
 	if err != nil {
 		err := errors.Wrap(err, "repository error while getting user")
 		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
-	if customer.Subscription == nil {
-		err := errors.New("customer is not subscribed to any plan")
+	// Verify the redemption token. It's used when the offer is saved.
+	secret, err := entities.RedemptionSecret()
+	if err != nil {
 		log.Error(err)
 		cancelFunc()
 		return nil, err
-
 	}
-	if customer.Subscription.HasExpirPassed() || customer.Subscription.IsExpired() {
-		err := errors.New("subscription has expired, please renew or upgrade your subscription")
+	claims, err := entities.ParseRedemptionToken(redemptionToken, secret, time.Now())
+	if err != nil {
 		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
-	partner, err := u.getPartnerByID(ctx, partnerID)
+	// Return the original receipt of a retried request.
+	// This has to happen before checking if the redemption token is used since the original request used it.
+	var idempotencyKey *entities.UsedIdempotencyKey
+	if key, _ := ctx.Value(entities.IdempotencyKeyKey).(string); key != "" {
+		idempotencyKey, err = u.newIdempotencyKey(currentUser, key, claims, amount)
+		if err != nil {
+			log.Error(err)
+			cancelFunc()
+			return nil, err
+		}
+		offer, err := u.getIdempotentOffer(ctx, currentUser, idempotencyKey)
+		if err != nil {
+			log.Error(err)
+			cancelFunc()
+			return nil, err
+		}
+		if offer != nil {
+			cancelFunc()
+			return offer, nil
+		}
+	}
+	used, err := u.offerRepo.IsRedemptionTokenUsed(ctx, claims.Nonce)
 	if err != nil {
+		err := errors.Wrap(err, "repository error while checking redemption token")
+		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
-	currentRemainingOffers, err := u.subscriptionRepo.GetCountOfOffersWithPartner(ctx, partner, customer.Subscription)
+	if used {
+		offer, err := u.getConcurrentOffer(ctx, currentUser, idempotencyKey, entities.ErrRedemptionTokenUsed)
+		if err != nil {
+			log.Error(err)
+			cancelFunc()
+			return nil, err
+		}
+		cancelFunc()
+		return offer, nil
+	}
+	// Get CustomerUser
+	customer, err := u.getCustomerByID(ctx, claims.CustomerID)
 	if err != nil {
+		err := errors.Wrap(err, "repository error while getting user")
+		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
-	customer.Subscription.RemainingOffers = currentRemainingOffers.CountOfOffers
-	if !u.hub.HasUser(customer.ID) {
-		err := errors.New("customer is not connected")
+	if customer.Subscription == nil {
+		err := errors.New("customer is not subscribed to any plan")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+
+	}
+	if customer.Subscription.HasExpirPassed() || customer.Subscription.IsExpired() {
+		err := entities.ErrSubscriptionEnded
 		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
+	remainingOffers, err := u.subscriptionRepo.GetRemainingOffersWithPartner(ctx, customer.Subscription, partnerID)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	customer.Subscription.RemainingOffers = remainingOffers
 	net := amount - (currentUser.PartnerProfile.DiscountValue * amount / 100)
 	offer := &entities.Offer{
 		CustomerID:    customer.ID,
@@ -105,9 +169,17 @@ func (u *OfferUsecase) ConsumeOffer(ctx context.Context, customerID uint, partne
 		Amount:        amount,
 		Discount:      currentUser.PartnerProfile.DiscountValue,
 		Total:         net,
+		Status:        entities.OfferConsumed,
 		Customer:      customer,
 		Partner:       currentUser,
 	}
+	offer.SetScanner(scanner)
+	if apiKeyID, ok := ctx.Value(entities.APIKeyIDKey).(uint); ok {
+		offer.APIKeyID = apiKeyID
+	}
+	if idempotencyKey != nil {
+		offer.IdempotencyKey = idempotencyKey.Key
+	}
 	err = currentUser.ConsumeOffer(customer, offer)
 	if err != nil {
 		err := errors.Wrap(err, "error consuming offer")
@@ -116,36 +188,49 @@ func (u *OfferUsecase) ConsumeOffer(ctx context.Context, customerID uint, partne
 		cancelFunc()
 		return nil, err
 	}
-	// Save offer to DB
-	offer, err = u.offerRepo.Create(ctx, offer)
-	if err != nil {
-		err := errors.Wrap(err, "repository error while creating offer")
-		log.Error(err)
-		cancelFunc()
-		return nil, err
+	// Save offer to DB with its receipt, or the offer to confirm, in the inbox of the customer
+	notify := []uint{customer.ID}
+	if requireConfirmation {
+		window, err := entities.ConfirmationWindow()
+		if err != nil {
+			log.Error(err)
+			cancelFunc()
+			return nil, err
+		}
+		offer.RequireConfirmation(time.Now(), window)
+		offer, err = u.offerRepo.CreatePendingOffer(ctx, offer, claims.Use(), idempotencyKey, notify)
+	} else {
+		offer, err = u.offerRepo.ConsumeOffer(ctx, offer, claims.Use(), idempotencyKey, notify)
 	}
-	// set new remaining offers count
-	err = u.subscriptionRepo.SetCountOfOffersWithPartner(ctx, partner, customer.Subscription, currentRemainingOffers.CountOfOffers-1)
-	if err != nil {
-		err := errors.Wrap(err, "repository error while decrementing remaining offers")
-		log.Error(err)
+	if err == entities.ErrRedemptionTokenUsed || err == entities.ErrIdempotencyKeyUsed {
+		offer, err := u.getConcurrentOffer(ctx, currentUser, idempotencyKey, err)
+		if err != nil {
+			log.Error(err)
+			cancelFunc()
+			return nil, err
+		}
 		cancelFunc()
-		return nil, err
+		return offer, nil
 	}
-	// Send offer receipt to user
-	err = u.hub.SendOfferToUser(customer.ID, offer)
 	if err != nil {
-		err := errors.Wrap(err, "WS error while sending notification to the customer")
+		err := errors.Wrap(err, "repository error while consuming offer")
 		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
+	u.deliverMessages(ctx, notify...)
 	cancelFunc()
 	return offer, nil
 }
 
 func (u *OfferUsecase) GetByCustomer(ctx context.Context, customerID uint) ([]entities.Offer, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
+	_, err := user.Authorize(ctx, u.userRepo, entities.PermissionViewOffers)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
 	customer, err := u.getCustomerByID(ctx, customerID)
 	if err != nil {
 		err := errors.Wrap(err, "repository error while getting offers history")
@@ -216,30 +301,38 @@ func (u *OfferUsecase) GetMyOffersHistory(ctx context.Context, startDate time.Ti
 		cancelFunc()
 		return offers, nil
 	case "partner":
-		partner, err := u.getPartnerByID(ctx, currentUserID)
+		offers, err := u.offerRepo.GetByPartner(ctx, currentUserID, startDate, endDate)
 		if err != nil {
 			err := errors.Wrap(err, "repository error while getting offers history")
 			log.Error(err)
 			cancelFunc()
 			return nil, err
 		}
-		offers, err := u.offerRepo.GetByPartner(ctx, currentUserID, startDate, endDate)
+		offers, err = u.withPartnerOfferDetails(ctx, currentUserID, offers)
+		if err != nil {
+			cancelFunc()
+			return nil, err
+		}
+		cancelFunc()
+		return offers, nil
+	case entities.AccountTypeCashier:
+		// Cashiers of a branch see the offers given at their branch, the others only see the offers they scanned
+		var offers []entities.Offer
+		if currentUser.BranchID != 0 {
+			offers, err = u.offerRepo.GetByBranch(ctx, currentUser.PartnerID, currentUser.BranchID, startDate, endDate)
+		} else {
+			offers, err = u.offerRepo.GetByCashier(ctx, currentUser.PartnerID, currentUser.ID, startDate, endDate)
+		}
 		if err != nil {
 			err := errors.Wrap(err, "repository error while getting offers history")
 			log.Error(err)
 			cancelFunc()
 			return nil, err
 		}
-		for i, offer := range offers {
-			customer, err := u.getCustomerByID(ctx, offer.CustomerID)
-			if err != nil {
-				err := errors.Wrap(err, "repository error while getting offer partner")
-				log.Error(err)
-				cancelFunc()
-				return nil, err
-			}
-			offers[i].Customer = customer
-			offers[i].Partner = partner
+		offers, err = u.withPartnerOfferDetails(ctx, currentUser.PartnerID, offers)
+		if err != nil {
+			cancelFunc()
+			return nil, err
 		}
 		cancelFunc()
 		return offers, nil
@@ -251,6 +344,39 @@ func (u *OfferUsecase) GetMyOffersHistory(ctx context.Context, startDate time.Ti
 	}
 }
 
+// withPartnerOfferDetails sets the partner, customer and cashier of the given offers of the partner with the given ID
+func (u *OfferUsecase) withPartnerOfferDetails(ctx context.Context, partnerID uint, offers []entities.Offer) ([]entities.Offer, error) {
+	partner, err := u.getPartnerByID(ctx, partnerID)
+	if err != nil {
+		err := errors.Wrap(err, "repository error while getting offers history")
+		log.Error(err)
+		return nil, err
+	}
+	cashiers := make(map[uint]*entities.User)
+	for i, offer := range offers {
+		customer, err := u.getCustomerByID(ctx, offer.CustomerID)
+		if err != nil {
+			err := errors.Wrap(err, "repository error while getting offer partner")
+			log.Error(err)
+			return nil, err
+		}
+		offers[i].Customer = customer
+		offers[i].Partner = partner
+		if offer.CashierID != 0 {
+			if _, ok := cashiers[offer.CashierID]; !ok {
+				cashiers[offer.CashierID], err = u.userRepo.GetByIDIncludingDeleted(ctx, offer.CashierID)
+				if err != nil {
+					err := errors.Wrap(err, "repository error while getting offer cashier")
+					log.Error(err)
+					return nil, err
+				}
+			}
+			offers[i].Cashier = cashiers[offer.CashierID]
+		}
+	}
+	return offers, nil
+}
+
 // SendOffersStaticMail sends a static mail with the offers given by the provided date range
 func (u *OfferUsecase) SendOffersStaticMail(ctx context.Context, startDate time.Time, endDate time.Time) error {
 	offers, err := u.GetMyOffersHistory(ctx, startDate, endDate)
@@ -263,9 +389,13 @@ func (u *OfferUsecase) SendOffersStaticMail(ctx context.Context, startDate time.
 		return errors.Wrap(err, "error getting current user")
 	}
 	var records [][]string
-	records = append(records, []string{"Date", "Customer Name", "Partner Name", "Amount", "Discount", "Total"})
+	records = append(records, []string{"Date", "Customer Name", "Partner Name", "Amount", "Discount", "Total", "Cashier", "Status"})
 	for _, offer := range offers {
-		records = append(records, []string{offer.CreatedAt.Format("2 Jan 2006 15:04"), fmt.Sprintf("%s %s", offer.Customer.FirstName, offer.Customer.LastName), offer.Partner.PartnerProfile.BrandName, fmt.Sprintf("%.2f", offer.Amount), fmt.Sprintf("%.0f %%", offer.Discount), fmt.Sprintf("%.2f", offer.Total)})
+		var cashier string
+		if offer.Cashier != nil {
+			cashier = offer.Cashier.GetFullName()
+		}
+		records = append(records, []string{offer.CreatedAt.Format("2 Jan 2006 15:04"), fmt.Sprintf("%s %s", offer.Customer.FirstName, offer.Customer.LastName), offer.Partner.PartnerProfile.BrandName, fmt.Sprintf("%.2f", offer.Amount), fmt.Sprintf("%.0f %%", offer.Discount), fmt.Sprintf("%.2f", offer.Total), cashier, offer.Status})
 	}
 	buff := new(bytes.Buffer)
 	w := csv.NewWriter(buff)
@@ -273,46 +403,31 @@ func (u *OfferUsecase) SendOffersStaticMail(ctx context.Context, startDate time.
 	if err != nil {
 		return errors.Wrap(err, "failed to make csv file")
 	}
-	// create new *SGMailV3
-	m := mail.NewV3Mail()
-	from := mail.NewEmail("Tasarruf", "noreply@tasarruf.com")
-	content := mail.NewContent("text/html", fmt.Sprintf("<h1>Offers Summary</h1> </br> <p> This is the summary of your offers on Tasarruf mobile application in the period from %s to %s\n", startDate.Format("2 Jan 2006"), endDate.Format("2 Jan 2006")))
-	to := mail.NewEmail(fmt.Sprintf("%s %s", user.FirstName, user.LastName), user.Email)
-	m.SetFrom(from)
-	m.AddContent(content)
-	// create new *Personalization
-	personalization := mail.NewPersonalization()
-	personalization.AddTos(to)
-	personalization.Subject = "Tasarruf Summary"
-
-	// add `personalization` to `m`
-	m.AddPersonalizations(personalization)
-
-	file := mail.NewAttachment()
-	encoded := base64.StdEncoding.EncodeToString(buff.Bytes())
-	file.SetContent(encoded)
-	file.SetType("text/csv")
-	file.SetFilename("summary.csv")
-	file.SetDisposition("attachment")
-	file.SetContentID("summary")
-	m.AddAttachment(file)
-	request := sendgrid.GetRequest(os.Getenv("SENDGRID_API_KEY"), "/v3/mail/send", "https://api.sendgrid.com")
-	request.Method = "POST"
-	request.Body = mail.GetRequestBody(m)
-	response, err := sendgrid.API(request)
-	if err != nil {
-		log.Println(err)
-	} else {
-		fmt.Println(response.StatusCode)
-		fmt.Println(response.Body)
-		fmt.Println(response.Headers)
+	err = mailer.SendTemplate(ctx, u.mailer, mailer.Address{Name: user.GetFullName(), Email: user.Email}, mailer.TemplateOffersSummary, mailer.Data{
+		"StartDate": startDate,
+		"EndDate":   endDate,
+	}, mailer.Attachment{
+		Filename:    "summary.csv",
+		ContentType: "text/csv",
+		Content:     buff.Bytes(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "error sending offers summary email")
 	}
 	return nil
 }
 
-// GetOffer returns the offer with the given ID
+// GetOffer returns the offer with the given ID if the current user can view it
 func (u *OfferUsecase) GetOffer(ctx context.Context, offerID uint) (*entities.Offer, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	currentUser, err := u.userRepo.GetByID(ctx, currentUserID)
+	if err != nil {
+		err := errors.Wrap(err, "repository error while getting user")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
 	offer, err := u.offerRepo.GetByID(ctx, offerID)
 	if err != nil {
 		err := errors.Wrap(err, "repository error while getting offers history")
@@ -320,6 +435,18 @@ func (u *OfferUsecase) GetOffer(ctx context.Context, offerID uint) (*entities.Of
 		cancelFunc()
 		return nil, err
 	}
+	if offer == nil {
+		err := errors.New("offer not found")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	if !offer.CanView(currentUser) {
+		err := errors.Wrap(entities.ErrForbidden, "offer belongs to another partner")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
 	customer, err := u.getCustomerByID(ctx, offer.CustomerID)
 	if err != nil {
 		err := errors.Wrap(err, "repository error while getting offer customer")
@@ -344,14 +471,9 @@ func (u *OfferUsecase) GetOffer(ctx context.Context, offerID uint) (*entities.Of
 // GetOffersCount returns the count of offers consumed
 func (u *OfferUsecase) GetOffersCount(ctx context.Context) (int, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := u.userRepo.GetByID(ctx, currentUserID)
+	_, err := user.Authorize(ctx, u.userRepo, entities.PermissionViewOffers)
 	if err != nil {
-		cancelFunc()
-		return 0, errors.Wrap(err, "error getting user")
-	}
-	if !currentUser.IsAdmin() {
-		err := errors.New("only admins are authorized to perform this task")
+		log.Error(err)
 		cancelFunc()
 		return 0, err
 	}
@@ -366,25 +488,376 @@ func (u *OfferUsecase) GetOffersCount(ctx context.Context) (int, error) {
 
 // GetAllOffers returns the count of offers consumed
 func (u *OfferUsecase) GetAllOffers(ctx context.Context) ([]entities.Offer, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	_, err := user.Authorize(ctx, u.userRepo, entities.PermissionViewOffers)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	offers, err := u.offerRepo.GetAllOffers(ctx)
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "error getting count of customers")
+	}
+	cancelFunc()
+	return offers, nil
+}
+
+// VoidOffer cancels the offer with the given ID for the given reason and credits it back to the customer.
+// The voided offer is sent to the inbox of the customer, and it stays in their history with its status.
+func (u *OfferUsecase) VoidOffer(ctx context.Context, offerID uint, reason string) (*entities.Offer, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
 	currentUserID := ctx.Value(entities.UserIDKey).(uint)
 	currentUser, err := u.userRepo.GetByID(ctx, currentUserID)
 	if err != nil {
+		err := errors.Wrap(err, "repository error while getting user")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	offer, err := u.offerRepo.GetByID(ctx, offerID)
+	if err != nil {
+		err := errors.Wrap(err, "repository error while getting offer")
+		log.Error(err)
 		cancelFunc()
-		return nil, errors.Wrap(err, "error getting user")
+		return nil, err
 	}
-	if !currentUser.IsAdmin() {
-		err := errors.New("only admins are authorized to perform this task")
+	if offer == nil {
+		err := errors.New("offer not found")
+		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
-	offers, err := u.offerRepo.GetAllOffers(ctx)
+	window, err := entities.VoidWindow()
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	err = offer.Void(currentUser, reason, time.Now(), window)
 	if err != nil {
+		log.Error(err)
 		cancelFunc()
-		return nil, errors.Wrap(err, "error getting count of customers")
+		return nil, err
+	}
+	err = u.loadOffer(ctx, offer)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	notify := []uint{offer.CustomerID}
+	err = u.offerRepo.VoidOffer(ctx, offer, notify)
+	if err != nil {
+		err := errors.Wrap(err, "repository error while voiding offer")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
 	}
+	u.deliverMessages(ctx, notify...)
 	cancelFunc()
-	return offers, nil
+	return offer, nil
+}
+
+// AnswerOffer accepts or rejects the pending offer with the given ID for the current customer.
+// An accepted offer is debited from the offers ledger. The answered offer is sent to the inboxes of the customer and the scanner of the offer.
+func (u *OfferUsecase) AnswerOffer(ctx context.Context, offerID uint, accepted bool) (*entities.Offer, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	currentUser, err := u.userRepo.GetByID(ctx, currentUserID)
+	if err != nil {
+		err := errors.Wrap(err, "repository error while getting user")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	offer, err := u.offerRepo.GetByID(ctx, offerID)
+	if err != nil {
+		err := errors.Wrap(err, "repository error while getting offer")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	if offer == nil {
+		err := errors.New("offer not found")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	err = offer.Answer(currentUser, accepted, time.Now())
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	err = u.loadOffer(ctx, offer)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	notify := []uint{offer.CustomerID, offer.ScannerID()}
+	if accepted {
+		err = u.offerRepo.ConfirmOffer(ctx, offer, notify)
+	} else {
+		err = u.offerRepo.ClosePendingOffer(ctx, offer, notify)
+	}
+	if err != nil {
+		err := errors.Wrap(err, "repository error while answering offer")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	u.deliverMessages(ctx, notify...)
+	cancelFunc()
+	return offer, nil
+}
+
+// ExpirePendingOffers closes the pending offers that weren't answered within the confirmation window.
+// The expired offer is sent to the inboxes of the customer and the scanner of each offer.
+func (u *OfferUsecase) ExpirePendingOffers(ctx context.Context) error {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	now := time.Now()
+	offers, err := u.offerRepo.GetExpiredPendingOffers(ctx, now)
+	if err != nil {
+		cancelFunc()
+		return errors.Wrap(err, "repository error while getting expired pending offers")
+	}
+	for i := range offers {
+		offer := &offers[i]
+		err := offer.Expire(now)
+		if err != nil {
+			continue
+		}
+		err = u.loadOffer(ctx, offer)
+		if err != nil {
+			cancelFunc()
+			return err
+		}
+		notify := []uint{offer.CustomerID, offer.ScannerID()}
+		err = u.offerRepo.ClosePendingOffer(ctx, offer, notify)
+		if errors.Cause(err) == entities.ErrOfferNotPending {
+			// The customer answered it in the meantime
+			continue
+		}
+		if err != nil {
+			cancelFunc()
+			return errors.Wrap(err, "repository error while expiring pending offer")
+		}
+		u.deliverMessages(ctx, notify...)
+	}
+	cancelFunc()
+	return nil
+}
+
+// loadOffer sets the customer and the partner of the given offer
+func (u *OfferUsecase) loadOffer(ctx context.Context, offer *entities.Offer) error {
+	customer, err := u.getCustomerByID(ctx, offer.CustomerID)
+	if err != nil {
+		return errors.Wrap(err, "repository error while getting offer customer")
+	}
+	offer.Customer = customer
+	partner, err := u.getPartnerByID(ctx, offer.PartnerID)
+	if err != nil {
+		return errors.Wrap(err, "repository error while getting offer partner")
+	}
+	offer.Partner = partner
+	return nil
+}
+
+// DeliverInbox sends the current user all the messages in their inbox that they haven't acknowledged.
+// It's called when the user connects, so the messages sent while they weren't connected are delivered.
+func (u *OfferUsecase) DeliverInbox(ctx context.Context) error {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	err := u.deliverInbox(ctx, currentUserID, true)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return err
+	}
+	cancelFunc()
+	return nil
+}
+
+// GetInbox returns the messages in the inbox of the current user that they haven't acknowledged, after the message with the given ID.
+// The messages are marked as delivered, as they are returned to be sent to the user.
+func (u *OfferUsecase) GetInbox(ctx context.Context, afterID uint) ([]entities.InboxMessage, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	messages, err := u.offerRepo.GetUnacknowledgedMessages(ctx, currentUserID)
+	if err != nil {
+		err := errors.Wrap(err, "repository error while getting inbox messages")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	inbox := []entities.InboxMessage{}
+	for _, message := range messages {
+		if message.ID <= afterID {
+			continue
+		}
+		err = u.offerRepo.MarkMessageDelivered(ctx, message.ID, time.Now())
+		if err != nil {
+			err := errors.Wrap(err, "repository error while marking inbox message as delivered")
+			log.Error(err)
+			cancelFunc()
+			return nil, err
+		}
+		inbox = append(inbox, message)
+	}
+	cancelFunc()
+	return inbox, nil
+}
+
+// AcknowledgeMessage records that the current user received the message with the given ID, so it's not sent again
+func (u *OfferUsecase) AcknowledgeMessage(ctx context.Context, messageID uint) error {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	err := u.offerRepo.AcknowledgeMessage(ctx, currentUserID, messageID, time.Now())
+	if err != nil {
+		err := errors.Wrap(err, "repository error while acknowledging message")
+		log.Error(err)
+		cancelFunc()
+		return err
+	}
+	cancelFunc()
+	return nil
+}
+
+// CreateStreamTicket returns a new ticket the current user can open the event stream with once
+func (u *OfferUsecase) CreateStreamTicket(ctx context.Context) (string, *entities.StreamTicket, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	ticket, record, err := entities.NewStreamTicket(currentUserID, time.Now())
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return "", nil, err
+	}
+	err = u.offerRepo.CreateStreamTicket(ctx, record)
+	if err != nil {
+		err := errors.Wrap(err, "repository error while creating stream ticket")
+		log.Error(err)
+		cancelFunc()
+		return "", nil, err
+	}
+	cancelFunc()
+	return ticket, record, nil
+}
+
+// UseStreamTicket returns the ID of the user the given stream ticket was issued to, and makes sure it can't be used again
+func (u *OfferUsecase) UseStreamTicket(ctx context.Context, ticket string) (uint, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	record, err := u.offerRepo.UseStreamTicket(ctx, entities.HashRefreshToken(ticket), time.Now())
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return 0, err
+	}
+	cancelFunc()
+	return record.UserID, nil
+}
+
+// deliverMessages sends the new messages in the inboxes of the users with the given IDs who are connected.
+// It's called after the messages are saved, so failing to send them is only logged, and they are sent when the users connect again.
+func (u *OfferUsecase) deliverMessages(ctx context.Context, userIDs ...uint) {
+	for _, userID := range userIDs {
+		err := u.deliverInbox(ctx, userID, false)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// deliverInbox sends the messages the given user hasn't acknowledged if they are connected.
+// Messages that have already been sent are only sent again if redeliver is true.
+// It stops at the first message that can't be sent, so the user receives the messages in order.
+func (u *OfferUsecase) deliverInbox(ctx context.Context, userID uint, redeliver bool) error {
+	messages, err := u.offerRepo.GetUnacknowledgedMessages(ctx, userID)
+	if err != nil {
+		return errors.Wrap(err, "repository error while getting inbox messages")
+	}
+	for i := range messages {
+		message := &messages[i]
+		if message.IsDelivered() && !redeliver {
+			continue
+		}
+		err := u.hub.SendMessageToUser(userID, message)
+		if err == offer.ErrUserNotConnected {
+			return nil
+		}
+		if err == offer.ErrMessagePublished {
+			// The instance the user is connected to marks it as delivered
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "WS error while sending inbox message")
+		}
+		err = u.offerRepo.MarkMessageDelivered(ctx, message.ID, time.Now())
+		if err != nil {
+			return errors.Wrap(err, "repository error while marking inbox message as delivered")
+		}
+	}
+	return nil
+}
+
+// newIdempotencyKey returns the record of the request consuming an offer of the given partner under the given idempotency key
+func (u *OfferUsecase) newIdempotencyKey(partner *entities.Partner, key string, claims *entities.RedemptionClaims, amount float64) (*entities.UsedIdempotencyKey, error) {
+	err := entities.ValidateIdempotencyKey(key)
+	if err != nil {
+		return nil, err
+	}
+	window, err := entities.IdempotencyWindow()
+	if err != nil {
+		return nil, err
+	}
+	return entities.NewUsedIdempotencyKey(partner.ID, key, claims, amount, time.Now().Add(window)), nil
+}
+
+// getIdempotentOffer returns the offer the partner consumed with the given idempotency key before it expired.
+// It returns nil if the key hasn't been used, and entities.ErrIdempotencyKeyReused if it was used by a different request.
+func (u *OfferUsecase) getIdempotentOffer(ctx context.Context, partner *entities.Partner, request *entities.UsedIdempotencyKey) (*entities.Offer, error) {
+	key, err := u.offerRepo.GetIdempotencyKey(ctx, partner.ID, request.Key, time.Now())
+	if err != nil {
+		return nil, errors.Wrap(err, "repository error while getting idempotency key")
+	}
+	if key == nil {
+		return nil, nil
+	}
+	err = key.IsRetryOf(request)
+	if err != nil {
+		return nil, err
+	}
+	offer, err := u.offerRepo.GetByID(ctx, key.OfferID)
+	if err != nil {
+		return nil, errors.Wrap(err, "repository error while getting offer by idempotency key")
+	}
+	customer, err := u.getCustomerByID(ctx, offer.CustomerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "repository error while getting offer customer")
+	}
+	offer.Customer = customer
+	offer.Partner = partner
+	return offer, nil
+}
+
+// getConcurrentOffer returns the offer saved by the original request when a retry with the given idempotency key
+// failed with the given error because the original request was still in flight when it was checked.
+// It returns the given error if there's no idempotency key or no such offer.
+func (u *OfferUsecase) getConcurrentOffer(ctx context.Context, partner *entities.Partner, idempotencyKey *entities.UsedIdempotencyKey, err error) (*entities.Offer, error) {
+	if idempotencyKey == nil {
+		return nil, err
+	}
+	offer, retryErr := u.getIdempotentOffer(ctx, partner, idempotencyKey)
+	if retryErr != nil {
+		return nil, retryErr
+	}
+	if offer == nil {
+		return nil, err
+	}
+	return offer, nil
 }
 
 func (u *OfferUsecase) getCustomerByID(ctx context.Context, ID uint) (*entities.Customer, error) {
@@ -0,0 +1,247 @@
+// Package wsclient is a client of the web socket of the connect endpoint, speaking the current version of the protocol.
+// It's meant for integration tests and tools talking to the server like the apps do.
+package wsclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ahmedaabouzied/tasarruf/offer/protocol"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// ErrClosed is returned when using a client after its connection is closed
+var ErrClosed = errors.New("connection is closed")
+
+// Error is an error envelope sent by the server
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Client is a connection of an authenticated user to the web socket.
+// Replies to the requests of the client are returned by the request methods, and the other envelopes sent by the server
+// are received from Messages, which should be drained as replies aren't read while its buffer is full. It's safe for concurrent use.
+type Client struct {
+	UserID   uint
+	conn     *websocket.Conn
+	lock     sync.Mutex
+	nextID   uint
+	replies  map[uint]chan *protocol.Envelope
+	messages chan *protocol.Envelope
+	done     chan struct{}
+	err      error
+}
+
+// Dial connects to the web socket at the given URL, e.g. ws://localhost:8080/api/v1/connect, and authenticates with the given token.
+// It returns an *Error if the server rejects the token.
+func Dial(ctx context.Context, url string, token string) (*Client, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, http.Header{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error connecting to the web socket")
+	}
+	c := &Client{
+		conn:     conn,
+		replies:  make(map[uint]chan *protocol.Envelope),
+		messages: make(chan *protocol.Envelope, 64),
+		done:     make(chan struct{}),
+	}
+	auth, err := c.envelope(protocol.TypeAuth, protocol.AuthPayload{Token: token})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	err = conn.WriteJSON(auth)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "error sending auth message")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	var reply protocol.Envelope
+	err = conn.ReadJSON(&reply)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "error reading auth reply")
+	}
+	conn.SetReadDeadline(time.Time{})
+	err = replyError(&reply)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var authenticated protocol.AuthenticatedPayload
+	err = reply.DecodePayload(&authenticated)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.UserID = authenticated.UserID
+	go c.read()
+	return c, nil
+}
+
+// Messages returns the channel of the envelopes sent by the server that aren't replies, e.g. offer receipts and prompts.
+// It's closed when the connection is closed.
+func (c *Client) Messages() <-chan *protocol.Envelope {
+	return c.messages
+}
+
+// Next returns the next envelope sent by the server that isn't a reply
+func (c *Client) Next(ctx context.Context) (*protocol.Envelope, error) {
+	select {
+	case e, ok := <-c.messages:
+		if !ok {
+			return nil, c.Err()
+		}
+		return e, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Ack acknowledges the message with the given ID, so the server doesn't send it again
+func (c *Client) Ack(messageID uint) error {
+	e, err := c.envelope(protocol.TypeAck, nil)
+	if err != nil {
+		return err
+	}
+	e.Ack = messageID
+	return c.write(e)
+}
+
+// AnswerOffer accepts or rejects the pending offer with the given ID and waits for the server to handle the answer
+func (c *Client) AnswerOffer(ctx context.Context, offerID uint, accepted bool) error {
+	_, err := c.request(ctx, protocol.TypeAnswer, protocol.AnswerPayload{OfferID: offerID, Accepted: accepted})
+	return err
+}
+
+// Ping waits for the server to reply to a ping
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.request(ctx, protocol.TypePing, nil)
+	return err
+}
+
+// Err returns the error that closed the connection, if any
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	c.lock.Lock()
+	c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.lock.Unlock()
+	return c.conn.Close()
+}
+
+// request sends an envelope with the given type and payload and waits for its reply.
+// It returns an *Error if the reply is an error envelope.
+func (c *Client) request(ctx context.Context, kind string, payload interface{}) (*protocol.Envelope, error) {
+	e, err := c.envelope(kind, payload)
+	if err != nil {
+		return nil, err
+	}
+	replies := make(chan *protocol.Envelope, 1)
+	c.lock.Lock()
+	c.replies[e.ID] = replies
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.replies, e.ID)
+		c.lock.Unlock()
+	}()
+	err = c.write(e)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-replies:
+		return reply, replyError(reply)
+	case <-c.done:
+		return nil, c.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// envelope returns an envelope with the given type and payload and a new ID
+func (c *Client) envelope(kind string, payload interface{}) (*protocol.Envelope, error) {
+	e, err := protocol.NewEnvelope(kind, payload)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.nextID++
+	e.ID = c.nextID
+	c.lock.Unlock()
+	return e, nil
+}
+
+// write sends the given envelope to the server
+func (c *Client) write(e *protocol.Envelope) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	err := c.conn.WriteJSON(e)
+	if err != nil {
+		return errors.Wrap(err, "error sending message")
+	}
+	return nil
+}
+
+// read reads the envelopes sent by the server until the connection is closed.
+// Replies are sent to the requests waiting for them, and the other envelopes to the messages channel.
+func (c *Client) read() {
+	defer close(c.messages)
+	for {
+		var e protocol.Envelope
+		err := c.conn.ReadJSON(&e)
+		if err != nil {
+			c.lock.Lock()
+			c.err = ErrClosed
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				c.err = errors.Wrap(err, "error reading message")
+			}
+			c.lock.Unlock()
+			close(c.done)
+			return
+		}
+		if e.Ack != 0 && e.Type != protocol.TypeAck {
+			c.lock.Lock()
+			replies, ok := c.replies[e.Ack]
+			c.lock.Unlock()
+			if ok {
+				replies <- &e
+				continue
+			}
+		}
+		c.messages <- &e
+	}
+}
+
+// replyError returns an *Error if the given reply is an error envelope
+func replyError(reply *protocol.Envelope) error {
+	if reply.Type != protocol.TypeError {
+		return nil
+	}
+	var payload protocol.ErrorPayload
+	err := reply.DecodePayload(&payload)
+	if err != nil {
+		return err
+	}
+	return &Error{Code: payload.Code, Message: payload.Message}
+}
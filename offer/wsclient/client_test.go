@@ -0,0 +1,142 @@
+package wsclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahmedaabouzied/tasarruf/offer/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer returns a server speaking the protocol for the user with ID 1 and the token "valid".
+// It sends the user an offer receipt with ID 10 once they are authenticated, accepts answers to the offer with ID 7
+// and sends the IDs of the messages the user acknowledges to the given channel.
+func newTestServer(t *testing.T, acks chan<- uint) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		var auth protocol.Envelope
+		err = conn.ReadJSON(&auth)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var payload protocol.AuthPayload
+		auth.DecodePayload(&payload)
+		if auth.Type != protocol.TypeAuth || payload.Token != "valid" {
+			conn.WriteJSON(protocol.NewError(auth.ID, protocol.ErrCodeInvalidToken, "invalid token"))
+			return
+		}
+		authenticated, _ := protocol.NewEnvelope(protocol.TypeAuthenticated, protocol.AuthenticatedPayload{UserID: 1})
+		authenticated.Ack = auth.ID
+		conn.WriteJSON(authenticated)
+		receipt, _ := protocol.NewEnvelope(protocol.TypeOfferReceipt, protocol.OfferPayload{Offer: json.RawMessage(`{"ID":7}`)})
+		receipt.ID = 10
+		conn.WriteJSON(receipt)
+		for {
+			var e protocol.Envelope
+			err := conn.ReadJSON(&e)
+			if err != nil {
+				return
+			}
+			var reply *protocol.Envelope
+			switch e.Type {
+			case protocol.TypeAck:
+				acks <- e.Ack
+			case protocol.TypeAnswer:
+				var answer protocol.AnswerPayload
+				e.DecodePayload(&answer)
+				if answer.OfferID != 7 {
+					reply = protocol.NewError(e.ID, protocol.ErrCodeRequestFailed, "offer not found")
+				} else {
+					reply, _ = protocol.NewEnvelope(protocol.TypeOK, nil)
+				}
+			case protocol.TypePing:
+				reply, _ = protocol.NewEnvelope(protocol.TypePong, nil)
+			}
+			if reply != nil {
+				reply.Ack = e.ID
+				conn.WriteJSON(reply)
+			}
+		}
+	}))
+}
+
+func dial(t *testing.T, s *httptest.Server, token string) (*Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http"), token)
+}
+
+func TestDialWithInvalidToken(t *testing.T) {
+	s := newTestServer(t, make(chan uint, 1))
+	defer s.Close()
+	_, err := dial(t, s, "invalid")
+	if e, ok := err.(*Error); !ok || e.Code != protocol.ErrCodeInvalidToken {
+		t.Errorf("expected an %s error, got %v", protocol.ErrCodeInvalidToken, err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	acks := make(chan uint, 1)
+	s := newTestServer(t, acks)
+	defer s.Close()
+	c, err := dial(t, s, "valid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.UserID != 1 {
+		t.Errorf("expected to be authenticated as user 1, got %d", c.UserID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	receipt, err := c.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offer protocol.OfferPayload
+	err = receipt.DecodePayload(&offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Type != protocol.TypeOfferReceipt || receipt.ID != 10 || string(offer.Offer) != `{"ID":7}` {
+		t.Errorf("unexpected receipt %+v", receipt)
+	}
+	err = c.Ack(receipt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack := <-acks; ack != 10 {
+		t.Errorf("expected message 10 to be acknowledged, got %d", ack)
+	}
+	err = c.AnswerOffer(ctx, 7, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.AnswerOffer(ctx, 8, true)
+	if e, ok := err.(*Error); !ok || e.Code != protocol.ErrCodeRequestFailed {
+		t.Errorf("expected a %s error, got %v", protocol.ErrCodeRequestFailed, err)
+	}
+	err = c.Ping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err := c.Next(ctx); err == nil || err == context.DeadlineExceeded {
+		t.Error("expected an error after the connection is closed")
+	}
+	if err := c.Ping(ctx); err == nil || err == context.DeadlineExceeded {
+		t.Error("expected an error pinging after the connection is closed")
+	}
+}
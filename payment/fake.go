@@ -0,0 +1,178 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ahmedaabouzied/tasarruf/entities"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+)
+
+// Test card numbers of the fake provider. Payments with any other card are declined.
+const (
+	TestCardApproved          = "4242424242424242"
+	TestCardDeclined          = "4000000000000002"
+	TestCardInsufficientFunds = "4000000000009995"
+)
+
+// Errors of the payments declined by the fake provider
+var (
+	ErrCardDeclined      = errors.New("card declined")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+)
+
+// Charge is a payment approved by the fake provider
+type Charge struct {
+	ID             string  `json:"id"`
+	ConversationID string  `json:"conversationID"`
+	UserID         uint    `json:"userID"`
+	PlanID         uint    `json:"planID"`
+	Amount         float64 `json:"amount"`
+	Refunded       float64 `json:"refunded"`
+	Cancelled      bool    `json:"cancelled"`
+	refunds        int
+}
+
+// FakeProvider approves or declines payments based on test card numbers without charging anything.
+// It keeps the payments it approves, which get deterministic IDs in the order they are submitted.
+type FakeProvider struct {
+	mu      sync.Mutex
+	charges []Charge
+}
+
+// CreateFakeProvider returns a fake provider with no charges
+func CreateFakeProvider() *FakeProvider {
+	return &FakeProvider{}
+}
+
+// Name returns the name payments made through the fake provider are recorded with
+func (p *FakeProvider) Name() string {
+	return "fake"
+}
+
+// CreateTransaction returns a new fake transaction
+func (p *FakeProvider) CreateTransaction(details *entities.PaymentDetails) Payment {
+	return &fakeTransaction{
+		provider: p,
+		details:  details,
+	}
+}
+
+// GetTransaction returns the fake transaction of the given recorded payment
+func (p *FakeProvider) GetTransaction(payment *entities.Payment) Payment {
+	return &fakeTransaction{
+		provider: p,
+		chargeID: payment.ProviderPaymentID,
+	}
+}
+
+// Charges returns the payments approved so far
+func (p *FakeProvider) Charges() []Charge {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	charges := make([]Charge, len(p.charges))
+	copy(charges, p.charges)
+	return charges
+}
+
+// Retrieve returns the charge with the given conversation ID. Declined payments aren't kept, so they aren't found.
+func (p *FakeProvider) Retrieve(ctx context.Context, conversationID string) (*Receipt, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, charge := range p.charges {
+		if charge.ConversationID == conversationID {
+			return charge.receipt(), nil
+		}
+	}
+	return nil, ErrPaymentNotFound
+}
+
+// receipt returns the receipt of the charge, with the charge as the raw response
+func (c Charge) receipt() *Receipt {
+	raw, _ := json.Marshal(c)
+	return &Receipt{
+		PaymentID:   c.ID,
+		Status:      entities.PaymentSucceeded,
+		Amount:      c.Amount,
+		RawResponse: string(raw),
+	}
+}
+
+// declined returns the receipt of a payment declined with the given error
+func declined(err error) *Receipt {
+	raw, _ := json.Marshal(map[string]string{"errorMessage": err.Error()})
+	return &Receipt{
+		Status:      entities.PaymentFailed,
+		RawResponse: string(raw),
+	}
+}
+
+type fakeTransaction struct {
+	provider *FakeProvider
+	details  *entities.PaymentDetails
+	chargeID string
+}
+
+// Submit approves the payment if it's made with the approved test card, and returns the receipt of the charge
+func (t *fakeTransaction) Submit(ctx context.Context) (*Receipt, error) {
+	if t.details.Card == nil {
+		err := errors.New("payment card is required")
+		return declined(err), err
+	}
+	switch strings.Replace(t.details.Card.CardNumber, " ", "", -1) {
+	case TestCardApproved:
+	case TestCardInsufficientFunds:
+		return declined(ErrInsufficientFunds), ErrInsufficientFunds
+	default:
+		return declined(ErrCardDeclined), ErrCardDeclined
+	}
+	p := t.provider
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t.chargeID = fmt.Sprintf("fake-%d", len(p.charges)+1)
+	charge := Charge{
+		ID:             t.chargeID,
+		ConversationID: t.details.ConversationID,
+		UserID:         t.details.User.ID,
+		PlanID:         t.details.Plan.ID,
+		Amount:         t.details.Plan.Price,
+	}
+	p.charges = append(p.charges, charge)
+	log.Infof("Charged %f to user %d for plan %d : %s", t.details.Plan.Price, t.details.User.ID, t.details.Plan.ID, t.chargeID)
+	return charge.receipt(), nil
+}
+
+// Cancel refunds the given amount of the charge of the payment. The charge is cancelled once all of it is refunded.
+func (t *fakeTransaction) Cancel(ctx context.Context, amount float64) (*Receipt, error) {
+	if t.chargeID == "" {
+		return nil, errors.New("payment hasn't been charged")
+	}
+	p := t.provider
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.charges {
+		charge := &p.charges[i]
+		if charge.ID != t.chargeID {
+			continue
+		}
+		if amount <= 0 || amount > charge.Amount-charge.Refunded+0.005 {
+			err := errors.Errorf("can't refund %.2f of the %.2f left of the charge", amount, charge.Amount-charge.Refunded)
+			return declined(err), err
+		}
+		charge.Refunded += amount
+		charge.Cancelled = charge.Refunded >= charge.Amount-0.005
+		charge.refunds++
+		raw, _ := json.Marshal(charge)
+		log.Infof("Refunded %f of charge %s", amount, charge.ID)
+		return &Receipt{
+			PaymentID:   fmt.Sprintf("%s-refund-%d", charge.ID, charge.refunds),
+			Status:      entities.PaymentRefunded,
+			Amount:      amount,
+			RawResponse: string(raw),
+		}, nil
+	}
+	return nil, ErrPaymentNotFound
+}
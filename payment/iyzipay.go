@@ -7,37 +7,126 @@ import (
 	"github.com/ahmedaabouzied/iyzipay-go/iyzipay"
 	"github.com/ahmedaabouzied/tasarruf/entities"
 	"github.com/pkg/errors"
-	"os"
 )
 
 type transaction struct {
-	user        *entities.User
-	plan        *entities.Plan
-	card        *iyzipay.PaymentCard
-	idNumber    string
-	iyzipayRoot iyzipay.Options
+	user           *entities.User
+	plan           *entities.Plan
+	card           *iyzipay.PaymentCard
+	idNumber       string
+	conversationID string
+	transactionID  string
+	iyzipayRoot    iyzipay.Options
 }
 
-// CreateTransaction returns a new iyzipay transaction.
-// An iyzipay transaction implements the payment interface.
-func CreateTransaction(details *entities.PaymentDetails) Payment {
-	apiKey := os.Getenv("PAYMENT_API_KEY")
-	secretKey := os.Getenv("PAYMENT_API_SECRET")
-	baseURL := os.Getenv("PAYMENT_BASE_URL")
+// iyzipayResponse holds the fields of the iyzipay responses about payments
+type iyzipayResponse struct {
+	Status               string  `json:"status"`
+	ErrorCode            string  `json:"errorCode"`
+	ErrorMessage         string  `json:"errorMessage"`
+	PaymentID            string  `json:"paymentId"`
+	PaymentStatus        string  `json:"paymentStatus"`
+	PaidPrice            float64 `json:"paidPrice"`
+	Price                float64 `json:"price"`
+	PaymentTransactionID string  `json:"paymentTransactionId"`
+	ItemTransactions     []struct {
+		PaymentTransactionID string `json:"paymentTransactionId"`
+	} `json:"itemTransactions"`
+}
+
+// iyzipayPaymentNotFound is the error code iyzipay answers with when it has no payment with the requested conversation ID
+const iyzipayPaymentNotFound = "5115"
+
+// retrieveError returns the error of a failed payment retrieval. Only a missing payment is ErrPaymentNotFound,
+// since iyzipay also fails requests when it's unavailable or the credentials are wrong.
+func (r *iyzipayResponse) retrieveError() error {
+	if r.ErrorCode == iyzipayPaymentNotFound {
+		return errors.Wrap(ErrPaymentNotFound, r.ErrorMessage)
+	}
+	return errors.Errorf("error retrieving payment from Iyzipay : %s %s", r.ErrorCode, r.ErrorMessage)
+}
+
+// itemTransactionID returns the ID of the transaction of the plan in the payment, which refunds are made against
+func (r *iyzipayResponse) itemTransactionID() string {
+	if len(r.ItemTransactions) == 0 {
+		return ""
+	}
+	return r.ItemTransactions[0].PaymentTransactionID
+}
+
+// iyzipayProvider charges customers through iyzipay
+type iyzipayProvider struct {
+	options iyzipay.Options
+}
 
+// CreateIyzipayProvider returns a provider charging customers through iyzipay with the given credentials
+func CreateIyzipayProvider(apiKey string, secretKey string, baseURL string) Provider {
 	options := iyzipay.Options{}
 	options.New(apiKey, secretKey, baseURL)
+	return &iyzipayProvider{options: options}
+}
+
+// Name returns the name payments made through iyzipay are recorded with
+func (p *iyzipayProvider) Name() string {
+	return "iyzipay"
+}
+
+// CreateTransaction returns a new iyzipay transaction.
+// An iyzipay transaction implements the payment interface.
+func (p *iyzipayProvider) CreateTransaction(details *entities.PaymentDetails) Payment {
 	transaction := transaction{
-		iyzipayRoot: options,
-		user:        details.User,
-		plan:        details.Plan,
-		idNumber:    details.IDNumber,
-		card:        details.Card,
+		iyzipayRoot:    p.options,
+		user:           details.User,
+		plan:           details.Plan,
+		idNumber:       details.IDNumber,
+		card:           details.Card,
+		conversationID: details.ConversationID,
 	}
 	return &transaction
 }
 
-func (t *transaction) Submit(ctx context.Context) (string, error) {
+// GetTransaction returns the iyzipay transaction of the given recorded payment.
+// The transaction of the plan is read from the response iyzipay answered the payment with.
+func (p *iyzipayProvider) GetTransaction(payment *entities.Payment) Payment {
+	var resp iyzipayResponse
+	json.Unmarshal([]byte(payment.RawResponse), &resp)
+	return &transaction{
+		iyzipayRoot:    p.options,
+		conversationID: payment.ConversationID,
+		transactionID:  resp.itemTransactionID(),
+	}
+}
+
+// Retrieve returns the payment with the given conversation ID from iyzipay.
+// It returns ErrPaymentNotFound if iyzipay has no such payment, and other errors if the payment couldn't be retrieved.
+func (p *iyzipayProvider) Retrieve(ctx context.Context, conversationID string) (*Receipt, error) {
+	request := iyzipay.RetrievePaymentRequest{
+		Locale:                "en",
+		ConversationId:        conversationID,
+		PaymentConversationId: conversationID,
+	}
+	rawResponse := iyzipay.Payment{}.Retrieve(request, p.options)
+	var resp iyzipayResponse
+	err := json.Unmarshal([]byte(rawResponse), &resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "error processing response from Iyzipay")
+	}
+	if resp.Status != "success" {
+		return nil, resp.retrieveError()
+	}
+	receipt := &Receipt{
+		PaymentID:   resp.PaymentID,
+		Status:      entities.PaymentFailed,
+		Amount:      resp.PaidPrice,
+		RawResponse: rawResponse,
+	}
+	if resp.PaymentStatus == "SUCCESS" {
+		receipt.Status = entities.PaymentSucceeded
+	}
+	return receipt, nil
+}
+
+func (t *transaction) Submit(ctx context.Context) (*Receipt, error) {
 
 	paymentCard := iyzipay.PaymentCard{
 		CardHolderName: t.user.FirstName,
@@ -80,13 +169,13 @@ func (t *transaction) Submit(ctx context.Context) (string, error) {
 
 	request := iyzipay.CreatePaymentRequest{
 		Locale:          "en",
-		ConversationId:  "123456789",
+		ConversationId:  t.conversationID,
 		Price:           fmt.Sprintf("%f", t.plan.Price),
 		PaidPrice:       fmt.Sprintf("%f", t.plan.Price),
 		BasketId:        fmt.Sprintf("%d", t.plan.ID),
 		PaymentGroup:    "LISTING",
 		PaymentCard:     paymentCard,
-		Currency:        "TRY",
+		Currency:        entities.PaymentCurrency,
 		Buyer:           buyer,
 		ShippingAddress: address,
 		BillingAddress:  address,
@@ -94,22 +183,56 @@ func (t *transaction) Submit(ctx context.Context) (string, error) {
 	}
 
 	paymentResponse := iyzipay.Payment{}.Create(request, t.iyzipayRoot)
-	var resp map[string]interface{}
+	receipt := &Receipt{
+		Status:      entities.PaymentFailed,
+		RawResponse: paymentResponse,
+	}
+	var resp iyzipayResponse
 	err := json.Unmarshal([]byte(paymentResponse), &resp)
 	if err != nil {
-		return "", errors.Wrap(err, "error processing payment: error processing response from Iyzipay")
+		return receipt, errors.Wrap(err, "error processing payment: error processing response from Iyzipay")
 	}
-	if status, ok := resp["status"]; ok {
-		if status.(string) == "success" {
-			return "success", nil
-		}
-		if status.(string) == "failure" {
-			return resp["errorMessage"].(string), errors.New(resp["errorMessage"].(string))
-		}
+	switch resp.Status {
+	case "success":
+		t.transactionID = resp.itemTransactionID()
+		receipt.PaymentID = resp.PaymentID
+		receipt.Status = entities.PaymentSucceeded
+		receipt.Amount = resp.PaidPrice
+		return receipt, nil
+	case "failure":
+		return receipt, errors.New(resp.ErrorMessage)
 	}
-	return "error processing payment", errors.New("error processing payment")
+	return receipt, errors.New("error processing payment")
 }
 
-func (t *transaction) Cancel(ctx context.Context) (string, error) {
-	return "", nil
+// Cancel refunds the given amount of the payment.
+// iyzipay only cancels payments on the day they are made, so they are refunded instead, which also allows refunding part of them.
+func (t *transaction) Cancel(ctx context.Context, amount float64) (*Receipt, error) {
+	if t.transactionID == "" {
+		return nil, errors.New("payment hasn't been charged")
+	}
+	request := iyzipay.CreateRefundRequest{
+		Locale:               "en",
+		ConversationId:       t.conversationID,
+		PaymentTransactionId: t.transactionID,
+		Price:                fmt.Sprintf("%f", amount),
+		Currency:             entities.PaymentCurrency,
+	}
+	refundResponse := iyzipay.Refund{}.Create(request, t.iyzipayRoot)
+	receipt := &Receipt{
+		Status:      entities.PaymentFailed,
+		RawResponse: refundResponse,
+	}
+	var resp iyzipayResponse
+	err := json.Unmarshal([]byte(refundResponse), &resp)
+	if err != nil {
+		return receipt, errors.Wrap(err, "error processing refund: error processing response from Iyzipay")
+	}
+	if resp.Status != "success" {
+		return receipt, errors.New(resp.ErrorMessage)
+	}
+	receipt.PaymentID = resp.PaymentTransactionID
+	receipt.Status = entities.PaymentRefunded
+	receipt.Amount = resp.Price
+	return receipt, nil
 }
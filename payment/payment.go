@@ -1,11 +1,55 @@
+// Package payment charges customers for subscription plans through a configurable provider.
 package payment
 
 import (
 	"context"
+	"github.com/ahmedaabouzied/tasarruf/entities"
+	"github.com/pkg/errors"
+	"os"
+	"strings"
 )
 
+// ErrPaymentNotFound is returned when the provider has no payment with the given conversation ID
+var ErrPaymentNotFound = errors.New("payment not found")
+
+// Receipt is what the provider answers about a payment, or a refund in which case the payment ID is the ID of the refund
+type Receipt struct {
+	PaymentID   string
+	Status      string
+	Amount      float64
+	RawResponse string
+}
+
 // Payment represents a transaction.
 type Payment interface {
-	Submit(ctx context.Context) (string, error)
-	Cancel(ctx context.Context) (string, error)
+	// Submit charges the payment and returns the answer of the provider. Declined payments return a failed receipt with the error.
+	Submit(ctx context.Context) (*Receipt, error)
+	// Cancel refunds the given amount of the charged payment and returns the receipt of the refund
+	Cancel(ctx context.Context, amount float64) (*Receipt, error)
+}
+
+// Provider creates the transactions charging customers for plans
+type Provider interface {
+	Name() string
+	CreateTransaction(details *entities.PaymentDetails) Payment
+	// GetTransaction returns the transaction of the given recorded payment, so it can be cancelled
+	GetTransaction(payment *entities.Payment) Payment
+	// Retrieve returns the payment sent with the given conversation ID as the provider has it
+	Retrieve(ctx context.Context, conversationID string) (*Receipt, error)
+}
+
+// CreateProvider returns the provider selected by the PAYMENT_PROVIDER environment variable.
+//
+// Supported providers are "iyzipay" (the default) and "fake" which approves or declines payments
+// based on test card numbers without charging anything and is meant for development and tests.
+func CreateProvider() (Provider, error) {
+	provider := strings.ToLower(os.Getenv("PAYMENT_PROVIDER"))
+	switch provider {
+	case "", "iyzipay":
+		return CreateIyzipayProvider(os.Getenv("PAYMENT_API_KEY"), os.Getenv("PAYMENT_API_SECRET"), os.Getenv("PAYMENT_BASE_URL")), nil
+	case "fake":
+		return CreateFakeProvider(), nil
+	default:
+		return nil, errors.Errorf("unknown payment provider %q", provider)
+	}
 }
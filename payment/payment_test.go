@@ -0,0 +1,133 @@
+package payment
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/ahmedaabouzied/iyzipay-go/iyzipay"
+	"github.com/ahmedaabouzied/tasarruf/entities"
+	"github.com/pkg/errors"
+)
+
+func paymentDetails(cardNumber string) *entities.PaymentDetails {
+	user := &entities.User{}
+	user.ID = 4
+	plan := &entities.Plan{Price: 120}
+	plan.ID = 2
+	return &entities.PaymentDetails{
+		User:           user,
+		Plan:           plan,
+		Card:           &iyzipay.PaymentCard{CardNumber: cardNumber},
+		ConversationID: "conversation-" + cardNumber,
+	}
+}
+
+func TestFakeProvider(t *testing.T) {
+	p := CreateFakeProvider()
+	tests := []struct {
+		card   string
+		id     string
+		status string
+		err    error
+	}{
+		{TestCardApproved, "fake-1", entities.PaymentSucceeded, nil},
+		{"4242 4242 4242 4242", "fake-2", entities.PaymentSucceeded, nil},
+		{TestCardDeclined, "", entities.PaymentFailed, ErrCardDeclined},
+		{TestCardInsufficientFunds, "", entities.PaymentFailed, ErrInsufficientFunds},
+		{"5528790000000008", "", entities.PaymentFailed, ErrCardDeclined},
+	}
+	for _, test := range tests {
+		receipt, err := p.CreateTransaction(paymentDetails(test.card)).Submit(context.Background())
+		if receipt.PaymentID != test.id || receipt.Status != test.status || receipt.RawResponse == "" || err != test.err {
+			t.Errorf("expected %q %s and %v paying with %s, got %+v and %v", test.id, test.status, test.err, test.card, receipt, err)
+		}
+	}
+	charges := p.Charges()
+	if len(charges) != 2 {
+		t.Fatalf("expected the approved payments to be charged, got %+v", charges)
+	}
+	if charges[0].UserID != 4 || charges[0].PlanID != 2 || charges[0].Amount != 120 {
+		t.Errorf("unexpected charge %+v", charges[0])
+	}
+}
+
+func TestFakeProviderRetrieve(t *testing.T) {
+	p := CreateFakeProvider()
+	details := paymentDetails(TestCardApproved)
+	receipt, err := p.CreateTransaction(details).Submit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	retrieved, err := p.Retrieve(context.Background(), details.ConversationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *retrieved != *receipt {
+		t.Errorf("expected %+v, got %+v", receipt, retrieved)
+	}
+	declined := paymentDetails(TestCardDeclined)
+	p.CreateTransaction(declined).Submit(context.Background())
+	if _, err := p.Retrieve(context.Background(), declined.ConversationID); err != ErrPaymentNotFound {
+		t.Errorf("expected ErrPaymentNotFound for a declined payment, got %v", err)
+	}
+}
+
+func TestFakeProviderCancel(t *testing.T) {
+	p := CreateFakeProvider()
+	declined := p.CreateTransaction(paymentDetails(TestCardDeclined))
+	declined.Submit(context.Background())
+	if _, err := declined.Cancel(context.Background(), 120); err == nil {
+		t.Error("expected an error cancelling a declined payment")
+	}
+	approved := p.CreateTransaction(paymentDetails(TestCardApproved))
+	receipt, err := approved.Submit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	refund, err := approved.Cancel(context.Background(), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refund.PaymentID != "fake-1-refund-1" || refund.Status != entities.PaymentRefunded || refund.Amount != 20 || p.Charges()[0].Cancelled {
+		t.Errorf("expected 20 of charge %s to be refunded, got %+v and %+v", receipt.PaymentID, refund, p.Charges())
+	}
+	if _, err := approved.Cancel(context.Background(), 110); err == nil {
+		t.Error("expected an error refunding more than was charged")
+	}
+	record := &entities.Payment{ProviderPaymentID: receipt.PaymentID}
+	_, err = p.GetTransaction(record).Cancel(context.Background(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if charge := p.Charges()[0]; !charge.Cancelled || charge.Refunded != 120 {
+		t.Errorf("expected charge %s to be cancelled, got %+v", receipt.PaymentID, charge)
+	}
+}
+
+func TestIyzipayRetrieveError(t *testing.T) {
+	notFound := &iyzipayResponse{Status: "failure", ErrorCode: iyzipayPaymentNotFound, ErrorMessage: "payment not found"}
+	if err := notFound.retrieveError(); errors.Cause(err) != ErrPaymentNotFound {
+		t.Errorf("expected ErrPaymentNotFound, got %v", err)
+	}
+	unavailable := &iyzipayResponse{Status: "failure", ErrorCode: "1", ErrorMessage: "system error"}
+	if err := unavailable.retrieveError(); err == nil || errors.Cause(err) == ErrPaymentNotFound {
+		t.Errorf("expected a retrieval error, got %v", err)
+	}
+}
+
+func TestCreateProvider(t *testing.T) {
+	defer os.Unsetenv("PAYMENT_PROVIDER")
+	os.Setenv("PAYMENT_PROVIDER", "fake")
+	p, err := CreateProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.(*FakeProvider); !ok {
+		t.Errorf("expected the fake provider, got %T", p)
+	}
+	os.Setenv("PAYMENT_PROVIDER", "unknown")
+	if _, err := CreateProvider(); err == nil {
+		t.Error("expected an error for an unknown provider")
+	}
+}
@@ -1,23 +1,32 @@
 package main
 
 import (
+	"context"
+	"time"
+
 	branchapi "github.com/ahmedaabouzied/tasarruf/branch/branchapi"
 	_branchrepo "github.com/ahmedaabouzied/tasarruf/branch/repository"
 	_branchusecase "github.com/ahmedaabouzied/tasarruf/branch/usecase"
 	"github.com/ahmedaabouzied/tasarruf/entities"
+	"github.com/ahmedaabouzied/tasarruf/mailer"
+	"github.com/ahmedaabouzied/tasarruf/offer"
 	"github.com/ahmedaabouzied/tasarruf/offer/hub"
 	offerapi "github.com/ahmedaabouzied/tasarruf/offer/offerapi"
 	_offerrepo "github.com/ahmedaabouzied/tasarruf/offer/repository"
 	_offerusecase "github.com/ahmedaabouzied/tasarruf/offer/usecase"
+	"github.com/ahmedaabouzied/tasarruf/payment"
 	_reviewrepo "github.com/ahmedaabouzied/tasarruf/review/repository"
 	reviewapi "github.com/ahmedaabouzied/tasarruf/review/reviewapi"
 	_reviewusecase "github.com/ahmedaabouzied/tasarruf/review/usecase"
+	"github.com/ahmedaabouzied/tasarruf/sms"
+	"github.com/ahmedaabouzied/tasarruf/subscription"
 	_subscriptionrepo "github.com/ahmedaabouzied/tasarruf/subscription/repository"
 	subscriptionapi "github.com/ahmedaabouzied/tasarruf/subscription/subscriptionapi"
 	_subscriptionusecase "github.com/ahmedaabouzied/tasarruf/subscription/usecase"
 	_supportrepo "github.com/ahmedaabouzied/tasarruf/support/repository"
 	supportapi "github.com/ahmedaabouzied/tasarruf/support/supportapi"
 	_supportusecase "github.com/ahmedaabouzied/tasarruf/support/usecase"
+	"github.com/ahmedaabouzied/tasarruf/user"
 	_userrepo "github.com/ahmedaabouzied/tasarruf/user/repository"
 	_userusecase "github.com/ahmedaabouzied/tasarruf/user/usecase"
 	userapi "github.com/ahmedaabouzied/tasarruf/user/userapi"
@@ -25,21 +34,43 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 )
 
-// InitializeRoutes defines server routes
-func InitializeRoutes(db *gorm.DB, router *gin.Engine) {
-	hub := hub.CreateUserHub()
+// InitializeRoutes defines server routes.
+// It returns the hub of WS clients, which has to be closed when the server shuts down.
+func InitializeRoutes(db *gorm.DB, dbConfig *entities.DBConfig, router *gin.Engine) offer.Hub {
+	hub, err := hub.CreateHub(db, dbConfig.ConnectionString())
+	if err != nil {
+		log.Fatal(err)
+	}
 	userRepo := _userrepo.CreateUserRepository(db)
 	branchRepo := _branchrepo.CreateBranchRepository(db)
 	subscriptionRepo := _subscriptionrepo.CreateSubscriptionRepository(db)
 	offerRepo := _offerrepo.CreateOfferRepository(db)
 	reviewRepo := _reviewrepo.CreateReviewRepository(db)
 	supportRepo := _supportrepo.CreateSupportRepository(db)
-	userUsecase := _userusecase.CreateUserUsecase(userRepo, subscriptionRepo, reviewRepo, branchRepo, offerRepo)
+	err = loadKeyring(userRepo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go refreshKeyring(userRepo, time.Minute)
+	smsSender, err := sms.CreateSender()
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := mailer.CreateMailer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	paymentProvider, err := payment.CreateProvider()
+	if err != nil {
+		log.Fatal(err)
+	}
+	userUsecase := _userusecase.CreateUserUsecase(userRepo, subscriptionRepo, reviewRepo, branchRepo, offerRepo, smsSender, m)
 	branchUsecase := _branchusecase.CreateBranchUsecase(branchRepo, userRepo, subscriptionRepo)
-	subscriptionUsecase := _subscriptionusecase.CreateSubscriptionUsecase(subscriptionRepo, userRepo, branchRepo, offerRepo)
-	offerUsecase := _offerusecase.CreateOfferUsecase(offerRepo, hub, userRepo, branchRepo, subscriptionRepo)
+	subscriptionUsecase := _subscriptionusecase.CreateSubscriptionUsecase(subscriptionRepo, userRepo, branchRepo, offerRepo, m, paymentProvider)
+	offerUsecase := _offerusecase.CreateOfferUsecase(offerRepo, hub, userRepo, branchRepo, subscriptionRepo, m)
 	reviewUsecase := _reviewusecase.CreateReviewUsecase(reviewRepo, userRepo, branchRepo)
 	supportUsecase := _supportusecase.CreateSupportUsecase(supportRepo, userRepo)
 	userHandler := userapi.CreateUserAPI(userUsecase)
@@ -48,10 +79,14 @@ func InitializeRoutes(db *gorm.DB, router *gin.Engine) {
 	offerHandler := offerapi.CreateOfferHandler(offerUsecase, hub, branchUsecase, userUsecase)
 	reviewHandler := reviewapi.CreateReviewAPI(reviewUsecase)
 	supportHandler := supportapi.CreateSupportAPI(supportUsecase)
+	// The jobs run on one instance at a time when several instances share the DB
+	go notifyExpiredSubscriptions(db, subscriptionUsecase, time.Hour)
+	go reconcilePayments(db, subscriptionUsecase, time.Hour)
+	go expirePendingOffers(db, offerUsecase, 15*time.Second)
 	config := cors.DefaultConfig()
 	config.AllowOrigins = []string{"*"}
 	config.AllowWebSockets = true
-	config.AllowHeaders = []string{"Token", "Content-Type"}
+	config.AllowHeaders = []string{"Token", "X-API-Key", "Idempotency-Key", "Content-Type", "Device-Name", "Device-Platform"}
 	config.AllowCredentials = true
 	config.AllowBrowserExtensions = true
 	router.Use(cors.New(config))
@@ -60,6 +95,8 @@ func InitializeRoutes(db *gorm.DB, router *gin.Engine) {
 		publicRoutes.POST("/user", userHandler.CreateUser)
 		publicRoutes.POST("/email-login", userHandler.EmailLogin)
 		publicRoutes.POST("/phone-login", userHandler.PhoneLogin)
+		publicRoutes.POST("/login/2fa", userHandler.VerifyLoginChallenge)
+		publicRoutes.POST("/refresh", userHandler.RefreshToken)
 		publicRoutes.GET("/is-email-registered", userHandler.IsPhoneRegistered)
 		publicRoutes.GET("/is-phone-registered", userHandler.IsEmailRegistered)
 		publicRoutes.POST("/forget-password", userHandler.ForgetPassword)
@@ -68,8 +105,17 @@ func InitializeRoutes(db *gorm.DB, router *gin.Engine) {
 		publicRoutes.GET("support-info", supportHandler.GetSupportInfo)
 	}
 	router.GET("/api/v1/connect", offerHandler.Connect)
+	router.GET("/api/v1/events", offerHandler.Events)
+	router.GET("/.well-known/jwks.json", userHandler.GetJWKS)
+	posRoutes := router.Group("/api/v1/pos")
+	posRoutes.Use(authAPIKey(userUsecase))
+	{
+		posRoutes.POST("/offer", offerHandler.ConsumeOffer)
+		posRoutes.GET("/validate-offer", userHandler.ValidateCustomer)
+		posRoutes.POST("/offer/history", offerHandler.GetMyOffersHistory)
+	}
 	authorizedRoutes := router.Group("/api/v1")
-	authorizedRoutes.Use(authUser())
+	authorizedRoutes.Use(authUser(userUsecase), restrictCashiers(userUsecase))
 	{
 		authorizedRoutes.GET("my-branches", branchHandler.GetMyBranches)
 		authorizedRoutes.GET("branches-by-owner/:id", branchHandler.GetBranchesOfOwner)
@@ -86,9 +132,30 @@ func InitializeRoutes(db *gorm.DB, router *gin.Engine) {
 			userRoutes.DELETE("/partner-photo/:photoID", userHandler.DeletePartnerPhoto)
 			userRoutes.POST("/verify", userHandler.VerifyUser)
 			userRoutes.POST("/resend-verification-code", userHandler.ResendVerificationCode)
+			userRoutes.POST("/email/verification", userHandler.RequestEmailVerification)
+			userRoutes.PUT("/email", userHandler.ChangeEmail)
+			userRoutes.POST("/email/confirm", userHandler.ConfirmEmail)
+			userRoutes.PUT("/mobile", userHandler.ChangeMobile)
+			userRoutes.POST("/mobile/confirm", userHandler.ConfirmMobile)
+			userRoutes.POST("/2fa/enroll", userHandler.StartTwoFactorEnrollment)
+			userRoutes.POST("/2fa/enable", userHandler.EnableTwoFactor)
+			userRoutes.POST("/2fa/disable", userHandler.DisableTwoFactor)
+			userRoutes.POST("/2fa/recovery-codes", userHandler.RegenerateRecoveryCodes)
 			userRoutes.PUT("main-branch", userHandler.UpdatePartnerProfile)
 			userRoutes.POST("/update-pass", userHandler.UpdatePassword)
+			userRoutes.POST("/logout", userHandler.Logout)
+			userRoutes.GET("/sessions", userHandler.GetMySessions)
+			userRoutes.DELETE("/sessions", userHandler.RevokeMySessions)
+			userRoutes.DELETE("/sessions/:id", userHandler.RevokeMySession)
 			userRoutes.GET("/validate-offer", userHandler.ValidateCustomer)
+			userRoutes.POST("/redemption-token", userHandler.CreateRedemptionToken)
+			userRoutes.POST("/cashiers", userHandler.CreateCashier)
+			userRoutes.GET("/cashiers", userHandler.GetCashiers)
+			userRoutes.PUT("/cashiers/:id", userHandler.UpdateCashier)
+			userRoutes.DELETE("/cashiers/:id", userHandler.DeleteCashier)
+			userRoutes.POST("/api-keys", userHandler.CreateAPIKey)
+			userRoutes.GET("/api-keys", userHandler.GetAPIKeys)
+			userRoutes.DELETE("/api-keys/:id", userHandler.RevokeAPIKey)
 			userRoutes.POST("/share", userHandler.Share)
 		}
 		branchRoutes := authorizedRoutes.Group("/branch")
@@ -114,6 +181,7 @@ func InitializeRoutes(db *gorm.DB, router *gin.Engine) {
 			subscriptionRoutes.POST("/subscribe/:id", subscriptionHandler.SubscribeToPlan)
 			subscriptionRoutes.POST("/renew", subscriptionHandler.RenewPlan)
 			subscriptionRoutes.POST("/upgrade/:id", subscriptionHandler.UpgradePlan)
+			subscriptionRoutes.POST("/cancel", subscriptionHandler.CancelMySubscription)
 		}
 		offersRoutes := authorizedRoutes.Group("/offer")
 		{
@@ -121,6 +189,14 @@ func InitializeRoutes(db *gorm.DB, router *gin.Engine) {
 			offersRoutes.POST("/history", offerHandler.GetMyOffersHistory)
 			offersRoutes.POST("/history/mail", offerHandler.SendOffersStaticMail)
 			offersRoutes.GET("/:id", offerHandler.GetOffer)
+			offersRoutes.POST("/pending", offerHandler.CreatePendingOffer)
+			offersRoutes.POST("/answer/:id", offerHandler.AnswerOffer)
+			offersRoutes.POST("/void/:id", offerHandler.VoidOffer)
+			offersRoutes.POST("/events/ticket", offerHandler.CreateStreamTicket)
+		}
+		inboxRoutes := authorizedRoutes.Group("/inbox")
+		{
+			inboxRoutes.POST("/ack/:id", offerHandler.AcknowledgeMessage)
 		}
 		reviewRoutes := authorizedRoutes.Group("/review")
 		{
@@ -149,6 +225,7 @@ func InitializeRoutes(db *gorm.DB, router *gin.Engine) {
 			cityRoutes.PUT("/:id", branchHandler.UpdateCity)
 		}
 		supportRoutes := authorizedRoutes.Group("/support")
+		supportRoutes.Use(requirePermission(userUsecase, entities.PermissionManageSupport))
 		{
 			supportRoutes.POST("", supportHandler.CreateSupportRecord)
 			supportRoutes.PUT("", supportHandler.UpdateSupportRecord)
@@ -160,6 +237,7 @@ func InitializeRoutes(db *gorm.DB, router *gin.Engine) {
 			exclusiveRoutes.DELETE("/:id", userHandler.RemovePartnerAsExclusive)
 		}
 		adminRoutes := authorizedRoutes.Group("/admin")
+		adminRoutes.Use(requirePermission(userUsecase, entities.PermissionAccessAdmin))
 		{
 			adminRoutes.GET("/count/customers", userHandler.GetCustomersCount)
 			adminRoutes.GET("/count/partners", userHandler.GetPartnersCount)
@@ -171,9 +249,21 @@ func InitializeRoutes(db *gorm.DB, router *gin.Engine) {
 			adminRoutes.GET("/partner/:id", userHandler.GetPartnerByID)
 			adminRoutes.GET("/offers", offerHandler.GetAllOffers)
 			adminRoutes.GET("/offers/customer/:id", offerHandler.GetOffersOfCustomer)
+			adminRoutes.GET("/customer/:id/offers-ledger", subscriptionHandler.GetOffersLedger)
+			adminRoutes.POST("/customer/:id/offers-ledger", subscriptionHandler.AdjustOffers)
+			adminRoutes.POST("/customer/:id/cancel-subscription", subscriptionHandler.AdminCancelSubscription)
+			adminRoutes.GET("/payments", subscriptionHandler.GetPayments)
+			adminRoutes.GET("/payment/:id", subscriptionHandler.GetPaymentByID)
 			adminRoutes.GET("/partners/not-approved", userHandler.GetNotApproved)
 			adminRoutes.POST("/approve/:id", userHandler.ApprovePartner)
 			adminRoutes.DELETE("/user/:userID", userHandler.AdminDeleteUser)
+			adminRoutes.GET("/user/:userID/sessions", userHandler.GetUserSessions)
+			adminRoutes.DELETE("/user/:userID/sessions", userHandler.RevokeUserSessions)
+			adminRoutes.DELETE("/user/:userID/sessions/:id", userHandler.RevokeUserSession)
+			adminRoutes.POST("/user/:userID/role", userHandler.SetUserRole)
+			adminRoutes.POST("/user/:userID/unlock", userHandler.UnlockUser)
+			adminRoutes.GET("/user/:userID/audit", userHandler.GetAuditEntries)
+			adminRoutes.DELETE("/user/:userID/2fa", userHandler.AdminDisableTwoFactor)
 			adminRoutes.POST("/is-sharable/:id", userHandler.ToggleIsSharable)
 			adminRoutes.POST("/upgrade-plan", subscriptionHandler.AdminUpgradeUserPlan)
 			adminRoutes.POST("/associate-plan-category", subscriptionHandler.CreatePlanCategoryAssociation)
@@ -185,8 +275,52 @@ func InitializeRoutes(db *gorm.DB, router *gin.Engine) {
 	router.NoRoute(func(c *gin.Context) {
 		c.JSON(404, gin.H{"code": "PAGE_NOT_FOUND", "message": "Page not found"})
 	})
+	return hub
+}
+
+// notifyExpiredSubscriptions periodically emails the users whose subscriptions expired
+func notifyExpiredSubscriptions(db *gorm.DB, subscriptionUsecase subscription.Usecase, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		_, err := entities.RunExclusively(db, "notify-expired-subscriptions", func() error {
+			return subscriptionUsecase.NotifyExpiredSubscriptions(context.Background())
+		})
+		if err != nil {
+			log.Error(errors.Wrap(err, "error notifying expired subscriptions"))
+		}
+	}
 }
-func authUser() gin.HandlerFunc {
+
+// reconcilePayments periodically compares the recorded payments with the records of the payment provider
+func reconcilePayments(db *gorm.DB, subscriptionUsecase subscription.Usecase, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		_, err := entities.RunExclusively(db, "reconcile-payments", func() error {
+			return subscriptionUsecase.ReconcilePayments(context.Background())
+		})
+		if err != nil {
+			log.Error(errors.Wrap(err, "error reconciling payments"))
+		}
+	}
+}
+
+// expirePendingOffers periodically closes the pending offers that customers didn't answer in time
+func expirePendingOffers(db *gorm.DB, offerUsecase offer.Usecase, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		_, err := entities.RunExclusively(db, "expire-pending-offers", func() error {
+			return offerUsecase.ExpirePendingOffers(context.Background())
+		})
+		if err != nil {
+			log.Error(errors.Wrap(err, "error expiring pending offers"))
+		}
+	}
+}
+
+func authUser(userUsecase user.Usecase) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token := c.GetHeader("Token")
 		if len(token) == 0 {
@@ -194,12 +328,94 @@ func authUser() gin.HandlerFunc {
 			entities.SendAuthError(c, "you are not authorized to access this page, please login first", err)
 			return
 		}
-		id, err := entities.ParseToken(token)
+		ctx := context.WithValue(context.Background(), entities.ClientInfoKey, entities.GetClientInfo(c))
+		claims, err := userUsecase.Authenticate(ctx, token)
 		if err != nil {
 			entities.SendAuthError(c, "You are not authorized to access this page, please login first", err)
 			return
 		}
-		c.Set("userID", id)
+		c.Set("userID", claims.ID)
+		c.Set("sessionID", claims.SessionID)
+		c.Next()
+	}
+}
+
+// authAPIKey authenticates the requests of the point of sale systems of partners with the X-API-Key header.
+// The requests are handled as if they were sent by the partner of the key.
+func authAPIKey(userUsecase user.Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("X-API-Key")
+		if key == "" {
+			err := errors.New("empty API key")
+			entities.SendAuthError(c, "You are not authorized to access this page, please send your API key", err)
+			return
+		}
+		ctx := context.WithValue(context.Background(), entities.ClientInfoKey, entities.GetClientInfo(c))
+		apiKey, err := userUsecase.AuthenticateAPIKey(ctx, key)
+		if err != nil {
+			entities.SendAuthError(c, "You are not authorized to access this page, please check your API key", err)
+			return
+		}
+		c.Set("userID", apiKey.PartnerID)
+		c.Set("apiKeyID", apiKey.ID)
+		c.Next()
+	}
+}
+
+// cashierRoutes are the only routes cashier accounts can use
+var cashierRoutes = map[string]bool{
+	"GET /api/v1/user":                     true,
+	"POST /api/v1/user/update-pass":        true,
+	"POST /api/v1/user/logout":             true,
+	"GET /api/v1/user/sessions":            true,
+	"DELETE /api/v1/user/sessions":         true,
+	"DELETE /api/v1/user/sessions/:id":     true,
+	"POST /api/v1/user/2fa/enroll":         true,
+	"POST /api/v1/user/2fa/enable":         true,
+	"POST /api/v1/user/2fa/disable":        true,
+	"POST /api/v1/user/2fa/recovery-codes": true,
+	"GET /api/v1/user/validate-offer":      true,
+	"POST /api/v1/offer":                   true,
+	"POST /api/v1/offer/pending":           true,
+	"POST /api/v1/offer/history":           true,
+	"POST /api/v1/offer/void/:id":          true,
+	"POST /api/v1/inbox/ack/:id":           true,
+	"POST /api/v1/offer/events/ticket":     true,
+}
+
+// restrictCashiers aborts the request if it is sent by a cashier to a route outside cashierRoutes.
+// It must be used after authUser.
+func restrictCashiers(userUsecase user.Usecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cashierRoutes[c.Request.Method+" "+c.FullPath()] {
+			c.Next()
+			return
+		}
+		userID := c.MustGet("userID").(uint)
+		role, err := userUsecase.GetRole(context.Background(), userID)
+		if err != nil {
+			entities.SendAuthError(c, "You are not authorized to access this page, please login first", err)
+			return
+		}
+		if role == entities.RoleCashier {
+			entities.SendAuthError(c, "Cashier accounts can only scan offers", entities.ErrForbidden)
+			return
+		}
+		c.Next()
+	}
+}
+
+// requirePermission aborts the request unless the role of the current user grants the given permission.
+// It must be used after authUser.
+func requirePermission(userUsecase user.Usecase, permission entities.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+		ctx := context.WithValue(context.Background(), entities.UserIDKey, userID)
+		_, err := userUsecase.Authorize(ctx, permission)
+		if err != nil {
+			entities.SendAuthError(c, "You are not authorized to access this page", err)
+			return
+		}
 		c.Next()
 	}
 }
@@ -0,0 +1,54 @@
+package sms
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sync"
+)
+
+// FakeSender keeps the messages it is asked to send instead of sending them.
+// Messages are logged, and appended to a file as JSON lines when a path is given.
+type FakeSender struct {
+	mu       sync.Mutex
+	path     string
+	messages []Message
+}
+
+// CreateFakeSender returns a fake sender writing to the file at path, path may be empty
+func CreateFakeSender(path string) *FakeSender {
+	return &FakeSender{path: path}
+}
+
+// Send records the message
+func (s *FakeSender) Send(ctx context.Context, to string, body string) error {
+	msg := Message{To: to, Body: body}
+	log.Infof("SMS to %s : %s", to, body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+	if s.path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "error opening sms outbox")
+	}
+	defer f.Close()
+	err = json.NewEncoder(f).Encode(msg)
+	if err != nil {
+		return errors.Wrap(err, "error writing to sms outbox")
+	}
+	return nil
+}
+
+// Messages returns the messages sent so far
+func (s *FakeSender) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages := make([]Message, len(s.messages))
+	copy(messages, s.messages)
+	return messages
+}
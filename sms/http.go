@@ -0,0 +1,140 @@
+package sms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// HTTPConfig configures a generic HTTP gateway.
+//
+// URL and Body are templates rendered with the fields To and Message,
+// e.g. a GET gateway can be configured with
+// "https://gateway.example.com/send?to={{urlquery .To}}&text={{urlquery .Message}}"
+// and a JSON gateway with the body `{"to": {{json .To}}, "text": {{json .Message}}}`.
+type HTTPConfig struct {
+	Method      string
+	URL         string
+	Body        string
+	ContentType string
+	Username    string
+	Password    string
+	Headers     map[string]string
+}
+
+type httpSender struct {
+	config HTTPConfig
+	url    *template.Template
+	body   *template.Template
+	client *http.Client
+}
+
+type httpTemplateData struct {
+	To      string
+	Message string
+}
+
+var httpTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// CreateHTTPSender returns a sender for a gateway described by the given config
+func CreateHTTPSender(config HTTPConfig) (Sender, error) {
+	if config.URL == "" {
+		return nil, errors.New("sms gateway url is empty")
+	}
+	if config.Method == "" {
+		config.Method = http.MethodPost
+	}
+	urlTemplate, err := template.New("url").Funcs(httpTemplateFuncs).Parse(config.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing sms gateway url template")
+	}
+	bodyTemplate, err := template.New("body").Funcs(httpTemplateFuncs).Parse(config.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing sms gateway body template")
+	}
+	return &httpSender{
+		config: config,
+		url:    urlTemplate,
+		body:   bodyTemplate,
+		client: &http.Client{},
+	}, nil
+}
+
+// CreateHTTPSenderFromEnv returns an HTTP gateway sender configured by the SMS_HTTP_* environment variables.
+// Extra headers are given in SMS_HTTP_HEADERS as "Name: value" pairs separated by ";".
+func CreateHTTPSenderFromEnv() (Sender, error) {
+	config := HTTPConfig{
+		Method:      os.Getenv("SMS_HTTP_METHOD"),
+		URL:         os.Getenv("SMS_HTTP_URL"),
+		Body:        os.Getenv("SMS_HTTP_BODY"),
+		ContentType: os.Getenv("SMS_HTTP_CONTENT_TYPE"),
+		Username:    os.Getenv("SMS_HTTP_USERNAME"),
+		Password:    os.Getenv("SMS_HTTP_PASSWORD"),
+		Headers:     map[string]string{},
+	}
+	for _, header := range strings.Split(os.Getenv("SMS_HTTP_HEADERS"), ";") {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		config.Headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return CreateHTTPSender(config)
+}
+
+func (s *httpSender) Send(ctx context.Context, to string, body string) error {
+	data := httpTemplateData{To: to, Message: body}
+	var urlStr bytes.Buffer
+	err := s.url.Execute(&urlStr, data)
+	if err != nil {
+		return errors.Wrap(err, "error rendering sms gateway url")
+	}
+	var reqBody io.Reader
+	if s.config.Body != "" {
+		var b bytes.Buffer
+		err = s.body.Execute(&b, data)
+		if err != nil {
+			return errors.Wrap(err, "error rendering sms gateway body")
+		}
+		reqBody = &b
+	}
+	req, err := http.NewRequest(s.config.Method, urlStr.String(), reqBody)
+	if err != nil {
+		return errors.Wrap(err, "error creating sms gateway request")
+	}
+	req = req.WithContext(ctx)
+	if s.config.ContentType != "" {
+		req.Header.Set("Content-Type", s.config.ContentType)
+	}
+	if s.config.Username != "" {
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+	for name, value := range s.config.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error making request to sms gateway")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "error reading sms gateway response %s", resp.Status)
+	}
+	return errors.Errorf("sms gateway responded with %s: %s", resp.Status, b)
+}
@@ -0,0 +1,47 @@
+// Package sms sends text messages to users through a configurable gateway.
+package sms
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"os"
+	"strings"
+)
+
+// Sender sends a text message to a mobile number
+type Sender interface {
+	Send(ctx context.Context, to string, body string) error
+}
+
+// Message is a single text message
+type Message struct {
+	To   string `json:"to"`
+	Body string `json:"body"`
+}
+
+// CreateSender returns the sender selected by the SMS_PROVIDER environment variable.
+//
+// Supported providers are "twilio" (the default), "http" for a generic HTTP gateway
+// and "log" which only logs messages and is meant for development.
+func CreateSender() (Sender, error) {
+	provider := strings.ToLower(os.Getenv("SMS_PROVIDER"))
+	switch provider {
+	case "", "twilio":
+		return CreateTwilioSender(os.Getenv("TWILLIO_SID"), os.Getenv("TWILLIO_AUTH_TOKEN"), os.Getenv("TWILLIO_NUMBER")), nil
+	case "http":
+		return CreateHTTPSenderFromEnv()
+	case "log", "fake":
+		return CreateFakeSender(os.Getenv("SMS_OUTBOX_FILE")), nil
+	default:
+		return nil, errors.Errorf("unknown sms provider %q", provider)
+	}
+}
+
+// SendTemplate renders the template with the given name and sends it
+func SendTemplate(ctx context.Context, sender Sender, to string, name string, data Data) error {
+	body, err := Render(name, data)
+	if err != nil {
+		return err
+	}
+	return sender.Send(ctx, to, body)
+}
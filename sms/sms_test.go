@@ -0,0 +1,131 @@
+package sms
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	t.Run("Bilingual", func(t *testing.T) {
+		body, err := Render(TemplateVerification, Data{"Code": "1234"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(body, "verification code : 1234") || !strings.Contains(body, "doğrulama kodunuz: 1234") {
+			t.Error(body)
+		}
+	})
+	t.Run("MissingData", func(t *testing.T) {
+		_, err := Render(TemplateOTP, Data{})
+		if err == nil {
+			t.Fail()
+		}
+	})
+	t.Run("UnknownTemplate", func(t *testing.T) {
+		_, err := Render("unknown", Data{})
+		if err == nil {
+			t.Fail()
+		}
+	})
+}
+
+func TestFakeSender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "outbox.jsonl")
+	sender := CreateFakeSender(path)
+	err = SendTemplate(context.Background(), sender, "+905551112233", TemplateVerified, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := sender.Messages()
+	if len(messages) != 1 || messages[0].To != "+905551112233" {
+		t.Fatal(messages)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "+905551112233") {
+		t.Error(string(b))
+	}
+}
+
+func TestTwilioSender(t *testing.T) {
+	var gotPath, gotBody, gotUser string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotUser, _, _ = r.BasicAuth()
+		r.ParseForm()
+		gotBody = r.PostForm.Get("Body")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	sender := CreateTwilioSender("sid", "token", "+100").(*twilioSender)
+	sender.baseURL = server.URL
+	err := sender.Send(context.Background(), "+905551112233", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotPath != "/Accounts/sid/Messages.json" || gotUser != "sid" || gotBody != "hello" {
+		t.Error(gotPath, gotUser, gotBody)
+	}
+}
+
+func TestHTTPSender(t *testing.T) {
+	t.Run("QueryGateway", func(t *testing.T) {
+		var gotTo, gotText string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotTo = r.URL.Query().Get("to")
+			gotText = r.URL.Query().Get("text")
+		}))
+		defer server.Close()
+		sender, err := CreateHTTPSender(HTTPConfig{
+			Method: http.MethodGet,
+			URL:    server.URL + "/send?to={{urlquery .To}}&text={{urlquery .Message}}",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sender.Send(context.Background(), "+905551112233", "kod: 1234 & ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotTo != "+905551112233" || gotText != "kod: 1234 & ok" {
+			t.Error(gotTo, gotText)
+		}
+	})
+	t.Run("JSONGatewayFailure", func(t *testing.T) {
+		var gotBody string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			gotBody = string(b)
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer server.Close()
+		sender, err := CreateHTTPSender(HTTPConfig{
+			URL:         server.URL,
+			Body:        `{"to": {{json .To}}, "text": {{json .Message}}}`,
+			ContentType: "application/json",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sender.Send(context.Background(), "+905551112233", "line \"one\"\nline two")
+		if err == nil {
+			t.Error("expected an error for a 400 response")
+		}
+		if gotBody != `{"to": "+905551112233", "text": "line \"one\"\nline two"}` {
+			t.Error(gotBody)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package sms
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"text/template"
+)
+
+// Template names
+const (
+	TemplateOTP           = "otp"
+	TemplateVerification  = "verification"
+	TemplateVerified      = "verified"
+	TemplateMobileChanged = "mobileChanged"
+)
+
+// Data holds the values a template is rendered with
+type Data map[string]interface{}
+
+// bilingual holds the english and turkish text of a message.
+// Both are sent in the same message because users have no language preference.
+type bilingual struct {
+	EN string
+	TR string
+}
+
+var sources = map[string]bilingual{
+	TemplateOTP: {
+		EN: "Use this password to login to your account: {{.Code}}",
+		TR: "TASARRUF hesabınıza giriş yapmak için bu şifreyi kullanabilirsiniz: {{.Code}}",
+	},
+	TemplateVerification: {
+		EN: "Your Tasarruf verification code : {{.Code}}.",
+		TR: "TASARRUF üyelik doğrulama kodunuz: {{.Code}}.",
+	},
+	TemplateMobileChanged: {
+		EN: "The mobile number of your Tasarruf account was changed to {{.Mobile}}. If you did not make this change, please contact support.",
+		TR: "TASARRUF hesabınızın cep telefonu numarası {{.Mobile}} olarak değiştirildi. Bu değişikliği siz yapmadıysanız lütfen destek ekibiyle iletişime geçiniz.",
+	},
+	TemplateVerified: {
+		EN: "Your tasarruf account got verified.",
+		TR: "TASARRUF hesabınız doğrulandı.",
+	},
+}
+
+var templates = parseTemplates()
+
+func parseTemplates() map[string]*template.Template {
+	parsed := make(map[string]*template.Template, len(sources))
+	for name, source := range sources {
+		text := source.EN + "\n" + source.TR
+		parsed[name] = template.Must(template.New(name).Option("missingkey=error").Parse(text))
+	}
+	return parsed
+}
+
+// Render renders the message template with the given name
+func Render(name string, data Data) (string, error) {
+	t, ok := templates[name]
+	if !ok {
+		return "", errors.Errorf("unknown sms template %q", name)
+	}
+	var b bytes.Buffer
+	err := t.Execute(&b, data)
+	if err != nil {
+		return "", errors.Wrapf(err, "error rendering sms template %q", name)
+	}
+	return b.String(), nil
+}
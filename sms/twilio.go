@@ -0,0 +1,60 @@
+package sms
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const twilioBaseURL = "https://api.twilio.com/2010-04-01"
+
+type twilioSender struct {
+	baseURL    string
+	accountSid string
+	authToken  string
+	from       string
+	client     *http.Client
+}
+
+// CreateTwilioSender returns a sender that sends messages through the Twilio API
+func CreateTwilioSender(accountSid string, authToken string, from string) Sender {
+	return &twilioSender{
+		baseURL:    twilioBaseURL,
+		accountSid: accountSid,
+		authToken:  authToken,
+		from:       from,
+		client:     &http.Client{},
+	}
+}
+
+func (s *twilioSender) Send(ctx context.Context, to string, body string) error {
+	urlStr := s.baseURL + "/Accounts/" + s.accountSid + "/Messages.json"
+	msgData := url.Values{}
+	msgData.Set("To", to)
+	msgData.Set("From", s.from)
+	msgData.Set("Body", body)
+	req, err := http.NewRequest("POST", urlStr, strings.NewReader(msgData.Encode()))
+	if err != nil {
+		return errors.Wrap(err, "error creating twilio request")
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(s.accountSid, s.authToken)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error making request to twilio API")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated {
+		return nil
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "error reading twilio response %s", resp.Status)
+	}
+	return errors.Errorf("twilio responded with %s: %s", resp.Status, b)
+}
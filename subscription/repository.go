@@ -2,6 +2,7 @@ package subscription
 
 import (
 	"context"
+	"time"
 
 	"github.com/ahmedaabouzied/tasarruf/entities"
 )
@@ -19,12 +20,22 @@ type Repository interface {
 	GetSubscriptionByID(ctx context.Context, ID uint) (*entities.Subscription, error)
 	GetSubscriptionByUser(ctx context.Context, userID uint) (*entities.Subscription, error)
 	ExpireSubscription(ctx context.Context, s *entities.Subscription) (*entities.Subscription, error)
+	StartSubscription(ctx context.Context, s *entities.Subscription, plan *entities.Plan, replaced *entities.Subscription) (*entities.Subscription, error)
+	GetSubscriptionsToNotifyOfExpiry(ctx context.Context, since time.Time) ([]entities.Subscription, error)
 	RankPlanUp(ctx context.Context, toUpdatePlan *entities.Plan) ([]entities.Plan, error)
 	CreatePlanCategoryAssociation(ctx context.Context, planID uint, CategoryID uint) error
 	GetCategoriesByPlanID(ctx context.Context, planID uint) ([]entities.Category, error)
 	RemovePlanCategoryAssociation(ctx context.Context, planID uint, CategoryID uint) error
 	GetDefaultPlan(ctx context.Context) (*entities.Plan, error)
-	GetCountOfOffersWithPartner(ctx context.Context, partner *entities.Partner, subscription *entities.Subscription) (*entities.CustomerPartnerOffersCount, error)
-	SetCountOfOffersWithPartner(ctx context.Context, partner *entities.Partner, subscription *entities.Subscription, newCount uint) error
-	GetCountOfOffersOfCustomer(ctx context.Context, subscription *entities.Subscription) ([]entities.CustomerPartnerOffersCount, error)
+	CreateLedgerEntries(ctx context.Context, entries []entities.OfferLedgerEntry) error
+	GetLedgerEntries(ctx context.Context, subscriptionID uint) ([]entities.OfferLedgerEntry, error)
+	GetRemainingOffersWithPartner(ctx context.Context, subscription *entities.Subscription, partnerID uint) (uint, error)
+	CreatePayment(ctx context.Context, p *entities.Payment) (*entities.Payment, error)
+	UpdatePayment(ctx context.Context, p *entities.Payment) (*entities.Payment, error)
+	GetPaymentByID(ctx context.Context, ID uint) (*entities.Payment, error)
+	GetPayments(ctx context.Context, filter *entities.PaymentFilter) ([]entities.Payment, error)
+	GetPaymentsToReconcile(ctx context.Context, provider string, before time.Time) ([]entities.Payment, error)
+	ClaimCancellation(ctx context.Context, subscriptionID uint, at time.Time) (bool, error)
+	ReleaseCancellation(ctx context.Context, subscriptionID uint) error
+	CancelSubscription(ctx context.Context, s *entities.Subscription, entries []entities.OfferLedgerEntry) error
 }
@@ -192,6 +192,10 @@ func (r *SubscriptionRepository) GetSubscriptionByUser(ctx context.Context, user
 			if err != nil {
 				return nil, err
 			}
+			err = r.CreateLedgerEntries(ctx, []entities.OfferLedgerEntry{*entities.NewPlanGrant(newSubscription, defaultPlan)})
+			if err != nil {
+				return nil, err
+			}
 			return newSubscription, nil
 		}
 		return nil, errors.Wrap(dbt.Error, "error getting subscription of the given user")
@@ -216,6 +220,123 @@ func (r *SubscriptionRepository) ExpireSubscription(ctx context.Context, s *enti
 	return s, nil
 }
 
+// ClaimCancellation marks the subscription with the given ID as being cancelled at the given time,
+// unless it's already being cancelled or has expired. It returns false if it couldn't be claimed,
+// so only one of concurrent cancellations goes on to refund the subscription.
+func (r *SubscriptionRepository) ClaimCancellation(ctx context.Context, subscriptionID uint, at time.Time) (bool, error) {
+	dbt := r.DB.Model(&entities.Subscription{}).Where("id = ? AND cancelled_at IS NULL AND expired = ?", subscriptionID, false).Update("cancelled_at", at)
+	if dbt.Error != nil {
+		return false, errors.Wrap(dbt.Error, "error claiming subscription cancellation")
+	}
+	return dbt.RowsAffected == 1, nil
+}
+
+// ReleaseCancellation clears the claim on the cancellation of the subscription with the given ID if it hasn't expired,
+// e.g. when the refund failed, so it can be cancelled again
+func (r *SubscriptionRepository) ReleaseCancellation(ctx context.Context, subscriptionID uint) error {
+	dbt := r.DB.Model(&entities.Subscription{}).Where("id = ? AND expired = ?", subscriptionID, false).Update("cancelled_at", gorm.Expr("NULL"))
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error releasing subscription cancellation")
+	}
+	return nil
+}
+
+// CancelSubscription saves the given cancelled subscription in one transaction with the given entries removing its offers from the ledger
+func (r *SubscriptionRepository) CancelSubscription(ctx context.Context, s *entities.Subscription, entries []entities.OfferLedgerEntry) error {
+	tx := r.DB.Begin()
+	dbt := tx.Save(s)
+	if dbt.Error != nil {
+		tx.Rollback()
+		return errors.Wrap(dbt.Error, "error saving cancelled subscription")
+	}
+	for i := range entries {
+		dbt := tx.Create(&entries[i])
+		if dbt.Error != nil {
+			tx.Rollback()
+			return errors.Wrap(dbt.Error, "error creating offer ledger entry")
+		}
+	}
+	dbt = tx.Commit()
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error committing subscription cancellation")
+	}
+	return nil
+}
+
+// StartSubscription saves the given new subscription of the given plan in one transaction with expiring the subscription it replaces if any,
+// and crediting the offers of the plan and the remaining offers of the replaced subscription to the offers ledger of the new one.
+// The replaced subscription is locked until the transaction ends, so offers can't be consumed with it while they're carried over.
+// It returns entities.ErrSubscriptionEnded if the replaced subscription has been replaced or cancelled meanwhile.
+func (r *SubscriptionRepository) StartSubscription(ctx context.Context, s *entities.Subscription, plan *entities.Plan, replaced *entities.Subscription) (*entities.Subscription, error) {
+	tx := r.DB.Begin()
+	if tx.Error != nil {
+		return nil, errors.Wrap(tx.Error, "error starting transaction")
+	}
+	var carriedOver []entities.OfferLedgerEntry
+	if replaced != nil {
+		var locked entities.Subscription
+		dbt := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", replaced.ID).First(&locked)
+		if dbt.Error != nil {
+			tx.Rollback()
+			return nil, errors.Wrap(dbt.Error, "error locking replaced subscription")
+		}
+		if locked.IsExpired() {
+			tx.Rollback()
+			return nil, entities.ErrSubscriptionEnded
+		}
+		dbt = tx.Model(&entities.Subscription{}).Where("id = ?", replaced.ID).Updates(map[string]interface{}{
+			"expired":         true,
+			"expiry_notified": true,
+		})
+		if dbt.Error != nil {
+			tx.Rollback()
+			return nil, errors.Wrap(dbt.Error, "error expiring replaced subscription")
+		}
+		dbt = tx.Where("subscription_id = ?", replaced.ID).Order("id ASC").Find(&carriedOver)
+		if dbt.Error != nil {
+			tx.Rollback()
+			return nil, errors.Wrap(dbt.Error, "error getting offer ledger entries")
+		}
+	}
+	dbt := tx.Create(s)
+	if dbt.Error != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(dbt.Error, "error creating subscription record")
+	}
+	entries := []entities.OfferLedgerEntry{*entities.NewPlanGrant(s, plan)}
+	if replaced != nil {
+		entries = append(entries, entities.NewCarryOvers(replaced, carriedOver, s)...)
+	}
+	for i := range entries {
+		dbt := tx.Create(&entries[i])
+		if dbt.Error != nil {
+			tx.Rollback()
+			return nil, errors.Wrap(dbt.Error, "error creating offer ledger entry")
+		}
+	}
+	dbt = tx.Commit()
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error committing subscription")
+	}
+	if replaced != nil {
+		replaced.Replace()
+	}
+	return s, nil
+}
+
+// GetSubscriptionsToNotifyOfExpiry returns the paid subscriptions that expired after the given time and whose users were not notified yet
+func (r *SubscriptionRepository) GetSubscriptionsToNotifyOfExpiry(ctx context.Context, since time.Time) ([]entities.Subscription, error) {
+	var subscriptions []entities.Subscription
+	dbt := r.DB.Joins("JOIN plans ON plans.id = subscriptions.plan_id").
+		Where("subscriptions.expire_date < ? AND subscriptions.expire_date > ?", time.Now(), since).
+		Where("subscriptions.expiry_notified = ? AND plans.is_default = ?", false, false).
+		Find(&subscriptions)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting expired subscriptions")
+	}
+	return subscriptions, nil
+}
+
 // CreatePlanCategoryAssociation creates a plan-category association
 func (r *SubscriptionRepository) CreatePlanCategoryAssociation(ctx context.Context, planID uint, CategoryID uint) error {
 	pc := entities.PlanCategory{
@@ -252,61 +373,114 @@ func (r *SubscriptionRepository) RemovePlanCategoryAssociation(ctx context.Conte
 	return nil
 }
 
-func (r *SubscriptionRepository) SetCountOfOffersWithPartner(ctx context.Context, partner *entities.Partner, subscription *entities.Subscription, newCount uint) error {
-	cpoc, err := r.GetCountOfOffersWithPartner(ctx, partner, subscription)
-	if err != nil {
-		return err
+// CreateLedgerEntries saves the given offer ledger entries in one transaction
+func (r *SubscriptionRepository) CreateLedgerEntries(ctx context.Context, entries []entities.OfferLedgerEntry) error {
+	tx := r.DB.Begin()
+	for i := range entries {
+		dbt := tx.Create(&entries[i])
+		if dbt.Error != nil {
+			tx.Rollback()
+			return errors.Wrap(dbt.Error, "error creating offer ledger entry")
+		}
 	}
-	cpoc.CountOfOffers = newCount
-	dbt := r.DB.Save(cpoc)
+	dbt := tx.Commit()
 	if dbt.Error != nil {
-		return dbt.Error
+		return errors.Wrap(dbt.Error, "error saving offer ledger entries")
 	}
 	return nil
 }
 
-func (r *SubscriptionRepository) GetCountOfOffersWithPartner(ctx context.Context, partner *entities.Partner, subscription *entities.Subscription) (*entities.CustomerPartnerOffersCount, error) {
-	var customerPartnerOffersRecord entities.CustomerPartnerOffersCount
-	dbt := r.DB.Where("customer_id = ? AND partner_id = ? AND subscription_id = ?", subscription.UserID, partner.ID, subscription.ID).Find(&customerPartnerOffersRecord)
-	if dbt.RecordNotFound() {
-		cpoc := &entities.CustomerPartnerOffersCount{
-			CustomerID:     subscription.UserID,
-			PartnerID:      partner.ID,
-			SubscriptionID: subscription.ID,
-		}
-		if partner.PartnerProfile.IsSharable {
-			var s entities.Share
-			dbt := r.DB.Where("customer_id = ?", subscription.UserID).First(&s)
-			if dbt.RecordNotFound() {
-				cpoc.CountOfOffers = subscription.RemainingOffers
-			} else {
-				if s.ID > 0 {
-					cpoc.CountOfOffers = subscription.RemainingOffers + 1
-				} else {
-					cpoc.CountOfOffers = subscription.RemainingOffers
-				}
-			}
-		} else {
-			cpoc.CountOfOffers = subscription.RemainingOffers
-		}
-		dbt := r.DB.Create(cpoc)
-		if dbt.Error != nil {
-			return cpoc, dbt.Error
+// GetLedgerEntries returns the offer ledger entries of the given subscription in the order they were made
+func (r *SubscriptionRepository) GetLedgerEntries(ctx context.Context, subscriptionID uint) ([]entities.OfferLedgerEntry, error) {
+	var entries []entities.OfferLedgerEntry
+	dbt := r.DB.Where("subscription_id = ?", subscriptionID).Order("id ASC").Find(&entries)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting offer ledger entries")
+	}
+	return entries, nil
+}
+
+// GetRemainingOffersWithPartner returns the offers the customer of the given subscription has left with the given partner
+func (r *SubscriptionRepository) GetRemainingOffersWithPartner(ctx context.Context, subscription *entities.Subscription, partnerID uint) (uint, error) {
+	balance, err := entities.RemainingOffersWithPartner(r.DB, subscription.ID, partnerID)
+	if err != nil {
+		return 0, err
+	}
+	if balance < 0 {
+		return 0, nil
+	}
+	return uint(balance), nil
+}
+
+// CreatePayment creates a new payment record
+func (r *SubscriptionRepository) CreatePayment(ctx context.Context, p *entities.Payment) (*entities.Payment, error) {
+	dbt := r.DB.Create(p)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error creating payment")
+	}
+	return p, nil
+}
+
+// UpdatePayment saves the changes of the given payment record
+func (r *SubscriptionRepository) UpdatePayment(ctx context.Context, p *entities.Payment) (*entities.Payment, error) {
+	dbt := r.DB.Save(p)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error updating payment")
+	}
+	return p, nil
+}
+
+// GetPaymentByID returns the payment record with the given ID
+func (r *SubscriptionRepository) GetPaymentByID(ctx context.Context, ID uint) (*entities.Payment, error) {
+	var p entities.Payment
+	dbt := r.DB.Where("id = ?", ID).First(&p)
+	if dbt.Error != nil {
+		if gorm.IsRecordNotFoundError(dbt.Error) {
+			return nil, errors.New("payment not found")
 		}
-		return cpoc, nil
+		return nil, errors.Wrap(dbt.Error, "error getting payment")
 	}
-	return &customerPartnerOffersRecord, nil
+	return &p, nil
 }
 
-// GetCountOfOffersOfCustomer returns a list of couts of offers of the given customer
-func (r *SubscriptionRepository) GetCountOfOffersOfCustomer(ctx context.Context, subscription *entities.Subscription) ([]entities.CustomerPartnerOffersCount, error) {
-	var customerPartnerOffersRecords []entities.CustomerPartnerOffersCount
-	dbt := r.DB.Where("customer_id = ? AND subscription_id = ?", subscription.UserID, subscription.ID).Find(&customerPartnerOffersRecords)
-	if dbt.RecordNotFound() {
-		return nil, nil
+// GetPayments returns the payment records matching the given filter, newest first
+func (r *SubscriptionRepository) GetPayments(ctx context.Context, filter *entities.PaymentFilter) ([]entities.Payment, error) {
+	var payments []entities.Payment
+	query := r.DB.Order("created_at desc").Limit(500)
+	if filter.UserID != 0 {
+		query = query.Where("user_id = ?", filter.UserID)
+	}
+	if filter.SubscriptionID != 0 {
+		query = query.Where("subscription_id = ?", filter.SubscriptionID)
+	}
+	if filter.Provider != "" {
+		query = query.Where("provider = ?", filter.Provider)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("created_at >= ?", filter.From)
 	}
+	if !filter.To.IsZero() {
+		query = query.Where("created_at < ?", filter.To)
+	}
+	if filter.Discrepancies {
+		query = query.Where("discrepancy <> ''")
+	}
+	dbt := query.Find(&payments)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting payments")
+	}
+	return payments, nil
+}
+
+// GetPaymentsToReconcile returns the payment records made through the given provider before the given time that were never reconciled
+func (r *SubscriptionRepository) GetPaymentsToReconcile(ctx context.Context, provider string, before time.Time) ([]entities.Payment, error) {
+	var payments []entities.Payment
+	dbt := r.DB.Where("provider = ? AND reconciled_at IS NULL AND created_at < ?", provider, before).Order("id ASC").Limit(100).Find(&payments)
 	if dbt.Error != nil {
-		return nil, dbt.Error
+		return nil, errors.Wrap(dbt.Error, "error getting payments to reconcile")
 	}
-	return customerPartnerOffersRecords, nil
+	return payments, nil
 }
@@ -21,8 +21,10 @@ func connectToDB() (*gorm.DB, error) {
 	}
 	db.DropTable(entities.Subscription{})
 	db.DropTable(entities.Plan{})
+	db.DropTable(entities.OfferLedgerEntry{})
 	db.AutoMigrate(entities.Subscription{})
 	db.AutoMigrate(entities.Plan{})
+	db.AutoMigrate(entities.OfferLedgerEntry{})
 	return db, nil
 }
 
@@ -291,6 +293,63 @@ func TestExpireSubscription(t *testing.T) {
 	}
 }
 
+func TestStartSubscription(t *testing.T) {
+	db, err := connectToDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+	repo := CreateSubscriptionRepository(db)
+	ctx := context.Background()
+	plan, err := repo.CreatePlan(ctx, &entities.Plan{CountOfOffers: 5})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	replaced, err := repo.StartSubscription(ctx, &entities.Subscription{UserID: 1, PlanID: plan.ID, RemainingOffers: 5}, plan, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = repo.CreateLedgerEntries(ctx, []entities.OfferLedgerEntry{{CustomerID: 1, SubscriptionID: replaced.ID, PartnerID: 2, Kind: entities.LedgerConsumption, Amount: -1}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	subscription, err := repo.StartSubscription(ctx, &entities.Subscription{UserID: 1, PlanID: plan.ID, RemainingOffers: 9}, plan, replaced)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expired, err := repo.GetSubscriptionByID(ctx, replaced.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !expired.IsExpired() || !expired.ExpiryNotified {
+		t.Errorf("expected the replaced subscription to be expired without a notice")
+		return
+	}
+	entries, err := repo.GetLedgerEntries(ctx, subscription.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	balance := 0
+	for _, entry := range entries {
+		balance += entry.Amount
+	}
+	if balance != 9 {
+		t.Errorf("expected a balance of 9 offers, got %d", balance)
+		return
+	}
+	_, err = repo.StartSubscription(ctx, &entities.Subscription{UserID: 1, PlanID: plan.ID}, plan, replaced)
+	if err != entities.ErrSubscriptionEnded {
+		t.Errorf("expected %v starting a subscription replacing an expired one, got %v", entities.ErrSubscriptionEnded, err)
+		return
+	}
+}
+
 func TestRankPlanUp(t *testing.T) {
 	db, err := connectToDB()
 	if err != nil {
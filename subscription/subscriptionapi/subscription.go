@@ -8,8 +8,10 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/go-ozzo/ozzo-validation/v3"
 	"github.com/go-ozzo/ozzo-validation/v3/is"
+	"github.com/pkg/errors"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 // SubscriptionAPI defines the API handlers for subscription routes
@@ -37,6 +39,16 @@ type paymentRequest struct {
 	CardHolderName string `json:"cardHolderName"`
 }
 
+type adjustOffersRequest struct {
+	PartnerID uint   `json:"partnerID"`
+	Amount    int    `json:"amount"`
+	Reason    string `json:"reason"`
+}
+
+type cancelSubscriptionRequest struct {
+	Reason string `json:"reason"`
+}
+
 // CreateSubscriptionAPI returns a new API instance
 func CreateSubscriptionAPI(u subscription.Usecase) SubscriptionAPI {
 	api := SubscriptionAPI{
@@ -58,6 +70,21 @@ func (req *newPlanRequest) Validate() error {
 	)
 }
 
+// Validate method for the adjustOffersRequest body
+func (req *adjustOffersRequest) Validate() error {
+	return validation.ValidateStruct(req,
+		validation.Field(&req.Amount, validation.Required),
+		validation.Field(&req.Reason, validation.Required, validation.Length(1, 255)),
+	)
+}
+
+// Validate method for the cancelSubscriptionRequest body
+func (req *cancelSubscriptionRequest) Validate() error {
+	return validation.ValidateStruct(req,
+		validation.Field(&req.Reason, validation.Length(0, 255)),
+	)
+}
+
 // Validate method for the paymentRequest body
 func (req *paymentRequest) Validate() error {
 	return validation.ValidateStruct(req,
@@ -134,8 +161,8 @@ func (h *SubscriptionAPI) RankPlanUp(c *gin.Context) {
 	}
 	err = h.SubscriptionUsecase.RankPlanUp(ctx, uint(planID))
 	if err != nil {
-		if err.Error() == "only admin users can delete subscription plans" {
-			entities.SendAuthError(c, "only admin users can delete plans", err)
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "only admin users can rank plans", err)
 			return
 		}
 		entities.SendNotFoundError(c, "there has been an error while deleting plan, please try again", err)
@@ -159,7 +186,7 @@ func (h *SubscriptionAPI) DeletePlan(c *gin.Context) {
 	}
 	deletedPlan, err := h.SubscriptionUsecase.DeletePlan(ctx, uint(planID))
 	if err != nil {
-		if err.Error() == "only admin users can delete subscription plans" {
+		if errors.Cause(err) == entities.ErrForbidden {
 			entities.SendAuthError(c, "only admin users can delete plans", err)
 			return
 		}
@@ -337,6 +364,36 @@ func (h *SubscriptionAPI) RenewPlan(c *gin.Context) {
 	})
 }
 
+// CancelMySubscription handles POST /subscription/cancel
+func (h *SubscriptionAPI) CancelMySubscription(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	var req cancelSubscriptionRequest
+	if c.Request.ContentLength != 0 {
+		err := c.BindJSON(&req)
+		if err != nil {
+			entities.SendParsingError(c, "there has been an error while parsing your request", err)
+			return
+		}
+	}
+	err := req.Validate()
+	if err != nil {
+		entities.SendValidationError(c, err.Error(), err)
+		return
+	}
+	subscription, refund, err := h.SubscriptionUsecase.CancelMySubscription(ctx, req.Reason)
+	if err != nil {
+		entities.SendValidationError(c, errors.Cause(err).Error(), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":      "cancelled successfully",
+		"subscription": subscription,
+		"refund":       refund,
+	})
+}
+
 // GetMySubscription handles GET requests to the subscription endpoint
 func (h *SubscriptionAPI) GetMySubscription(c *gin.Context) {
 	ctx := context.Background()
@@ -476,3 +533,198 @@ func (h *SubscriptionAPI) GetCategoriesOfPlan(c *gin.Context) {
 		"categories": categories,
 	})
 }
+
+// GetOffersLedger handles GET /admin/customer/:id/offers-ledger
+func (h *SubscriptionAPI) GetOffersLedger(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	customerID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "there has been an error parsing your request", err)
+		return
+	}
+	var partnerID int64
+	if c.Query("partnerID") != "" {
+		partnerID, err = strconv.ParseInt(c.Query("partnerID"), 10, 64)
+		if err != nil {
+			entities.SendParsingError(c, "there has been an error parsing your request", err)
+			return
+		}
+	}
+	entries, err := h.SubscriptionUsecase.GetOffersLedger(ctx, uint(customerID), uint(partnerID))
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "You are not authorized to view offers", err)
+			return
+		}
+		entities.SendValidationError(c, "There has been an error while getting the offers ledger, please try again", err)
+		return
+	}
+	response := gin.H{
+		"entries": entries,
+	}
+	if partnerID != 0 {
+		response["remainingOffers"] = entities.RemainingOffers(entries, uint(partnerID))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// AdjustOffers handles POST /admin/customer/:id/offers-ledger
+func (h *SubscriptionAPI) AdjustOffers(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	customerID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "there has been an error parsing your request", err)
+		return
+	}
+	var req adjustOffersRequest
+	err = c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "there has been an error while parsing your request", err)
+		return
+	}
+	err = req.Validate()
+	if err != nil {
+		entities.SendValidationError(c, err.Error(), err)
+		return
+	}
+	entry, err := h.SubscriptionUsecase.AdjustOffers(ctx, uint(customerID), req.PartnerID, req.Amount, req.Reason)
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "You are not authorized to adjust offers", err)
+			return
+		}
+		entities.SendValidationError(c, errors.Cause(err).Error(), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"entry": entry,
+	})
+}
+
+// AdminCancelSubscription handles POST /admin/customer/:id/cancel-subscription
+func (h *SubscriptionAPI) AdminCancelSubscription(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	customerID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "there has been an error parsing your request", err)
+		return
+	}
+	var req cancelSubscriptionRequest
+	err = c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "there has been an error while parsing your request", err)
+		return
+	}
+	err = req.Validate()
+	if err != nil {
+		entities.SendValidationError(c, err.Error(), err)
+		return
+	}
+	subscription, refund, err := h.SubscriptionUsecase.AdminCancelSubscription(ctx, uint(customerID), req.Reason)
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "You are not authorized to cancel subscriptions", err)
+			return
+		}
+		entities.SendValidationError(c, errors.Cause(err).Error(), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":      "cancelled successfully",
+		"subscription": subscription,
+		"refund":       refund,
+	})
+}
+
+// GetPayments handles GET /admin/payments
+func (h *SubscriptionAPI) GetPayments(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	filter, err := parsePaymentFilter(c)
+	if err != nil {
+		entities.SendValidationError(c, err.Error(), err)
+		return
+	}
+	payments, err := h.SubscriptionUsecase.GetPayments(ctx, filter)
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "You are not authorized to view payments", err)
+			return
+		}
+		entities.SendValidationError(c, "There has been an error while getting payments, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"payments": payments,
+	})
+}
+
+// GetPaymentByID handles GET /admin/payment/:id
+func (h *SubscriptionAPI) GetPaymentByID(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	paymentID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "there has been an error parsing your request", err)
+		return
+	}
+	payment, err := h.SubscriptionUsecase.GetPaymentByID(ctx, uint(paymentID))
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "You are not authorized to view payments", err)
+			return
+		}
+		entities.SendNotFoundError(c, "payment not found", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"payment": payment,
+	})
+}
+
+// parsePaymentFilter reads the filter of the payments to list from the query of the request.
+// Dates are in RFC3339 format.
+func parsePaymentFilter(c *gin.Context) (*entities.PaymentFilter, error) {
+	filter := &entities.PaymentFilter{
+		Provider:      c.Query("provider"),
+		Status:        c.Query("status"),
+		Discrepancies: c.Query("discrepancies") == "true",
+	}
+	if c.Query("userID") != "" {
+		userID, err := strconv.ParseInt(c.Query("userID"), 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid user id")
+		}
+		filter.UserID = uint(userID)
+	}
+	if c.Query("subscriptionID") != "" {
+		subscriptionID, err := strconv.ParseInt(c.Query("subscriptionID"), 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid subscription id")
+		}
+		filter.SubscriptionID = uint(subscriptionID)
+	}
+	if c.Query("from") != "" {
+		from, err := time.Parse(time.RFC3339, c.Query("from"))
+		if err != nil {
+			return nil, errors.New("Please select a valid start date")
+		}
+		filter.From = from
+	}
+	if c.Query("to") != "" {
+		to, err := time.Parse(time.RFC3339, c.Query("to"))
+		if err != nil {
+			return nil, errors.New("Please select a valid end date")
+		}
+		filter.To = to
+	}
+	return filter, nil
+}
@@ -23,4 +23,12 @@ type Usecase interface {
 	RemovePlanCategoryAssociation(ctx context.Context, planID uint, categoryID uint) error
 	GetCategoriesOfPlan(ctx context.Context, planID uint) ([]entities.Category, error)
 	SubscribeToFreePlan(ctx context.Context, planID uint) (*entities.Subscription, error)
+	NotifyExpiredSubscriptions(ctx context.Context) error
+	GetOffersLedger(ctx context.Context, customerID uint, partnerID uint) ([]entities.OfferLedgerEntry, error)
+	AdjustOffers(ctx context.Context, customerID uint, partnerID uint, amount int, reason string) (*entities.OfferLedgerEntry, error)
+	GetPayments(ctx context.Context, filter *entities.PaymentFilter) ([]entities.Payment, error)
+	GetPaymentByID(ctx context.Context, paymentID uint) (*entities.Payment, error)
+	ReconcilePayments(ctx context.Context) error
+	CancelMySubscription(ctx context.Context, reason string) (*entities.Subscription, float64, error)
+	AdminCancelSubscription(ctx context.Context, customerID uint, reason string) (*entities.Subscription, float64, error)
 }
@@ -6,6 +6,7 @@ import (
 
 	"github.com/ahmedaabouzied/tasarruf/branch"
 	"github.com/ahmedaabouzied/tasarruf/entities"
+	"github.com/ahmedaabouzied/tasarruf/mailer"
 	"github.com/ahmedaabouzied/tasarruf/offer"
 	"github.com/ahmedaabouzied/tasarruf/payment"
 	"github.com/ahmedaabouzied/tasarruf/subscription"
@@ -20,15 +21,19 @@ type SubscriptionUsecase struct {
 	UserRepo         user.Repository
 	BranchRepo       branch.Repository
 	OfferRepo        offer.Repository
+	Mailer           mailer.Mailer
+	PaymentProvider  payment.Provider
 }
 
 // CreateSubscriptionUsecase returns an implementation of the subscription usecase interface
-func CreateSubscriptionUsecase(subscriptionRepo subscription.Repository, userRepo user.Repository, branchRepo branch.Repository, offerRepo offer.Repository) subscription.Usecase {
+func CreateSubscriptionUsecase(subscriptionRepo subscription.Repository, userRepo user.Repository, branchRepo branch.Repository, offerRepo offer.Repository, m mailer.Mailer, p payment.Provider) subscription.Usecase {
 	u := SubscriptionUsecase{
 		SubscriptionRepo: subscriptionRepo,
 		UserRepo:         userRepo,
 		BranchRepo:       branchRepo,
 		OfferRepo:        offerRepo,
+		Mailer:           m,
+		PaymentProvider:  p,
 	}
 	return &u
 }
@@ -36,16 +41,8 @@ func CreateSubscriptionUsecase(subscriptionRepo subscription.Repository, userRep
 // CreatePlan creates a new subscription plan
 func (u *SubscriptionUsecase) CreatePlan(ctx context.Context, p *entities.Plan) (*entities.Plan, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := u.UserRepo.GetByID(ctx, currentUserID)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionManagePlans)
 	if err != nil {
-		err = errors.Wrap(err, "repository error while getting user")
-		log.Error(err, "current user id = ", currentUserID)
-		cancelFunc()
-		return nil, err
-	}
-	if currentUser.AccountType != "admin" {
-		err := errors.New("only admin users can create subscription plans")
 		log.Error(err)
 		cancelFunc()
 		return nil, err
@@ -82,16 +79,8 @@ func (u *SubscriptionUsecase) CreatePlan(ctx context.Context, p *entities.Plan)
 // DeletePlan deletes the plan with the given ID
 func (u *SubscriptionUsecase) DeletePlan(ctx context.Context, planID uint) (*entities.Plan, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := u.UserRepo.GetByID(ctx, currentUserID)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionManagePlans)
 	if err != nil {
-		err = errors.Wrap(err, "repository error while getting user")
-		log.Error(err, "current user id = ", currentUserID)
-		cancelFunc()
-		return nil, err
-	}
-	if currentUser.AccountType != "admin" {
-		err := errors.New("only admin users can delete subscription plans")
 		log.Error(err)
 		cancelFunc()
 		return nil, err
@@ -123,16 +112,8 @@ func (u *SubscriptionUsecase) DeletePlan(ctx context.Context, planID uint) (*ent
 // UpdatePlan updates the plan with the given ID
 func (u *SubscriptionUsecase) UpdatePlan(ctx context.Context, planID uint, plan *entities.Plan) (*entities.Plan, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := u.UserRepo.GetByID(ctx, currentUserID)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionManagePlans)
 	if err != nil {
-		err = errors.Wrap(err, "repository error while getting user")
-		log.Error(err, "current user id = ", currentUserID)
-		cancelFunc()
-		return nil, err
-	}
-	if currentUser.AccountType != "admin" {
-		err := errors.New("only admin users can delete subscription plans")
 		log.Error(err)
 		cancelFunc()
 		return nil, err
@@ -186,6 +167,12 @@ func (u *SubscriptionUsecase) UpdatePlan(ctx context.Context, planID uint, plan
 // RankPlanUp ranks the plan with the given ID up
 func (u *SubscriptionUsecase) RankPlanUp(ctx context.Context, planID uint) error {
 	ctx, cancelFunc := context.WithCancel(ctx)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionManagePlans)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return err
+	}
 	plan, err := u.SubscriptionRepo.GetPlanByID(ctx, planID)
 	if err != nil {
 		cancelFunc()
@@ -281,14 +268,12 @@ func (u *SubscriptionUsecase) SubscribeToPlan(ctx context.Context, planID uint,
 	}
 	paymentDetails.User = user
 	paymentDetails.Plan = plan
-	p := payment.CreateTransaction(paymentDetails)
-	id, err := p.Submit(ctx)
+	payment, err := u.charge(ctx, paymentDetails)
 	if err != nil {
 		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
-	log.Info("payment id = ", id)
 	subscription := &entities.Subscription{
 		UserID:              user.ID,
 		PlanID:              plan.ID,
@@ -296,15 +281,19 @@ func (u *SubscriptionUsecase) SubscribeToPlan(ctx context.Context, planID uint,
 		Expired:             false,
 		ExpireDate:          time.Now().AddDate(1, 0, 0),
 		DelegationStartDate: time.Now(),
+		PaymentID:           payment.ProviderPaymentID,
 	}
-	subscription, err = u.SubscriptionRepo.CreateSubscription(ctx, subscription)
+	subscription, err = u.SubscriptionRepo.StartSubscription(ctx, subscription, plan, nil)
 	if err != nil {
-		err = errors.Wrap(err, "repository error while getting plan")
+		err = errors.Wrap(err, "repository error while starting subscription")
 		log.Error(err)
+		u.refundCharge(ctx, payment)
 		cancelFunc()
 		return nil, err
 	}
 	subscription.Plan = *plan
+	u.linkPayment(ctx, payment, subscription)
+	u.sendReceipt(ctx, user, subscription, payment.ProviderPaymentID)
 	cancelFunc()
 	return subscription, nil
 }
@@ -341,27 +330,12 @@ func (u *SubscriptionUsecase) UpgradePlan(ctx context.Context, planID uint, paym
 	}
 	paymentDetails.User = &customer.User
 	paymentDetails.Plan = newPlan
-	p := payment.CreateTransaction(paymentDetails)
-	id, err := p.Submit(ctx)
-	if err != nil {
-		log.Error(err)
-		cancelFunc()
-		return nil, err
-	}
-	if id == "" {
-		err = errors.Wrap(err, "error processing payment")
-		log.Error(err)
-		cancelFunc()
-		return nil, err
-	}
-	oldSubscription := customer.Subscription
-	oldCountsOfOffers, err := u.SubscriptionRepo.GetCountOfOffersOfCustomer(ctx, oldSubscription)
+	payment, err := u.charge(ctx, paymentDetails)
 	if err != nil {
 		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
-
 	subscription := &entities.Subscription{
 		UserID:              customer.ID,
 		PlanID:              newPlan.ID,
@@ -369,34 +343,19 @@ func (u *SubscriptionUsecase) UpgradePlan(ctx context.Context, planID uint, paym
 		Expired:             false,
 		ExpireDate:          time.Now().AddDate(1, 0, 0),
 		DelegationStartDate: customer.Subscription.DelegationStartDate,
+		PaymentID:           payment.ProviderPaymentID,
 	}
-	subscription, err = u.SubscriptionRepo.CreateSubscription(ctx, subscription)
+	subscription, err = u.SubscriptionRepo.StartSubscription(ctx, subscription, newPlan, customer.Subscription)
 	if err != nil {
-		err = errors.Wrap(err, "repository error while getting plan")
+		err = errors.Wrap(err, "repository error while starting subscription")
 		log.Error(err)
+		u.refundCharge(ctx, payment)
 		cancelFunc()
 		return nil, err
 	}
 	subscription.Plan = *newPlan
-	_, err = u.SubscriptionRepo.ExpireSubscription(ctx, customer.Subscription)
-	if err != nil {
-		err = errors.Wrap(err, "repository error while upgrading subscription")
-		log.Error(err)
-		cancelFunc()
-		return nil, err
-	}
-	for _, countOfOffer := range oldCountsOfOffers {
-		partner, err := u.getPartnerByID(ctx, countOfOffer.PartnerID)
-		if err != nil {
-			log.Error(err)
-			cancelFunc()
-		}
-		// set new counts of offers
-		err = u.SubscriptionRepo.SetCountOfOffersWithPartner(ctx, partner, subscription, countOfOffer.CountOfOffers+newPlan.CountOfOffers)
-		if err != nil {
-			log.Error(err)
-		}
-	}
+	u.linkPayment(ctx, payment, subscription)
+	u.sendReceipt(ctx, &customer.User, subscription, payment.ProviderPaymentID)
 	cancelFunc()
 	return subscription, nil
 }
@@ -435,13 +394,6 @@ func (u *SubscriptionUsecase) RenewPlan(ctx context.Context, paymentDetails *ent
 		cancelFunc()
 		return nil, err
 	}
-	oldSubscription := userCurrentSubscription
-	oldCountsOfOffers, err := u.SubscriptionRepo.GetCountOfOffersOfCustomer(ctx, oldSubscription)
-	if err != nil {
-		log.Error(err)
-		cancelFunc()
-		return nil, err
-	}
 	if userCurrentSubscription == nil {
 		err = errors.New("user is not subscribed to any plan")
 		log.Error(err)
@@ -457,8 +409,7 @@ func (u *SubscriptionUsecase) RenewPlan(ctx context.Context, paymentDetails *ent
 	}
 	paymentDetails.User = user
 	paymentDetails.Plan = plan
-	p := payment.CreateTransaction(paymentDetails)
-	_, err = p.Submit(ctx)
+	payment, err := u.charge(ctx, paymentDetails)
 	if err != nil {
 		log.Error(err)
 		cancelFunc()
@@ -471,34 +422,19 @@ func (u *SubscriptionUsecase) RenewPlan(ctx context.Context, paymentDetails *ent
 		Expired:             false,
 		ExpireDate:          time.Now().AddDate(1, 0, 0),
 		DelegationStartDate: userCurrentSubscription.DelegationStartDate,
+		PaymentID:           payment.ProviderPaymentID,
 	}
-	subscription, err = u.SubscriptionRepo.CreateSubscription(ctx, subscription)
+	subscription, err = u.SubscriptionRepo.StartSubscription(ctx, subscription, plan, userCurrentSubscription)
 	if err != nil {
-		err = errors.Wrap(err, "repository error while getting plan")
+		err = errors.Wrap(err, "repository error while starting subscription")
 		log.Error(err)
+		u.refundCharge(ctx, payment)
 		cancelFunc()
 		return nil, err
 	}
 	subscription.Plan = *plan
-	_, err = u.SubscriptionRepo.ExpireSubscription(ctx, userCurrentSubscription)
-	if err != nil {
-		err = errors.Wrap(err, "repository error while upgrading subscription")
-		log.Error(err)
-		cancelFunc()
-		return nil, err
-	}
-	for _, countOfOffer := range oldCountsOfOffers {
-		partner, err := u.getPartnerByID(ctx, countOfOffer.PartnerID)
-		if err != nil {
-			log.Error(err)
-			cancelFunc()
-		}
-		// set new counts of offers
-		err = u.SubscriptionRepo.SetCountOfOffersWithPartner(ctx, partner, subscription, countOfOffer.CountOfOffers+plan.CountOfOffers)
-		if err != nil {
-			log.Error(err)
-		}
-	}
+	u.linkPayment(ctx, payment, subscription)
+	u.sendReceipt(ctx, user, subscription, payment.ProviderPaymentID)
 	cancelFunc()
 	return subscription, nil
 }
@@ -549,15 +485,11 @@ func (u *SubscriptionUsecase) GetMySubscription(ctx context.Context) (*entities.
 // AdminUpgradeUserPlan upgared user plan by admin
 func (u *SubscriptionUsecase) AdminUpgradeUserPlan(ctx context.Context, userID uint, planID uint) (*entities.Subscription, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := u.UserRepo.GetByID(ctx, currentUserID)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionManageSubscriptions)
 	if err != nil {
+		log.Error(err)
 		cancelFunc()
-		return nil, errors.Wrap(err, "error getting current user")
-	}
-	if !currentUser.IsAdmin() {
-		cancelFunc()
-		return nil, errors.New("not authorized to change user's plan")
+		return nil, err
 	}
 	customer, err := u.getCustomerByID(ctx, userID)
 	if err != nil {
@@ -580,13 +512,6 @@ func (u *SubscriptionUsecase) AdminUpgradeUserPlan(ctx context.Context, userID u
 			return nil, err
 		}
 	}
-	oldSubscription := customer.Subscription
-	oldCountsOfOffers, err := u.SubscriptionRepo.GetCountOfOffersOfCustomer(ctx, oldSubscription)
-	if err != nil {
-		log.Error(err)
-		cancelFunc()
-		return nil, err
-	}
 	newPlan, err := u.SubscriptionRepo.GetPlanByID(ctx, planID)
 	if err != nil {
 		err = errors.Wrap(err, "repository error while getting plan")
@@ -607,35 +532,14 @@ func (u *SubscriptionUsecase) AdminUpgradeUserPlan(ctx context.Context, userID u
 		subscription.RemainingOffers = newPlan.CountOfOffers
 		subscription.DelegationStartDate = time.Now()
 	}
-	subscription, err = u.SubscriptionRepo.CreateSubscription(ctx, subscription)
+	subscription, err = u.SubscriptionRepo.StartSubscription(ctx, subscription, newPlan, customer.Subscription)
 	if err != nil {
-		err = errors.Wrap(err, "repository error while getting plan")
+		err = errors.Wrap(err, "repository error while starting subscription")
 		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
 	subscription.Plan = *newPlan
-	if customer.Subscription != nil {
-		_, err = u.SubscriptionRepo.ExpireSubscription(ctx, customer.Subscription)
-		if err != nil {
-			err = errors.Wrap(err, "repository error while upgrading subscription")
-			log.Error(err)
-			cancelFunc()
-			return nil, err
-		}
-	}
-	for _, countOfOffer := range oldCountsOfOffers {
-		partner, err := u.getPartnerByID(ctx, countOfOffer.PartnerID)
-		if err != nil {
-			log.Error(err)
-			cancelFunc()
-		}
-		// set new counts of offers
-		err = u.SubscriptionRepo.SetCountOfOffersWithPartner(ctx, partner, subscription, countOfOffer.CountOfOffers+newPlan.CountOfOffers)
-		if err != nil {
-			log.Error(err)
-		}
-	}
 	cancelFunc()
 	return subscription, nil
 }
@@ -689,23 +593,14 @@ func (u *SubscriptionUsecase) SubscribeToFreePlan(ctx context.Context, planID ui
 		subscription.RemainingOffers = newPlan.CountOfOffers
 		subscription.DelegationStartDate = time.Now()
 	}
-	subscription, err = u.SubscriptionRepo.CreateSubscription(ctx, subscription)
+	subscription, err = u.SubscriptionRepo.StartSubscription(ctx, subscription, newPlan, customer.Subscription)
 	if err != nil {
-		err = errors.Wrap(err, "repository error while getting plan")
+		err = errors.Wrap(err, "repository error while starting subscription")
 		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
 	subscription.Plan = *newPlan
-	if customer.Subscription != nil {
-		_, err = u.SubscriptionRepo.ExpireSubscription(ctx, customer.Subscription)
-		if err != nil {
-			err = errors.Wrap(err, "repository error while upgrading subscription")
-			log.Error(err)
-			cancelFunc()
-			return nil, err
-		}
-	}
 	cancelFunc()
 	return subscription, nil
 }
@@ -748,19 +643,19 @@ func (u *SubscriptionUsecase) GetMySubscriptionWithPartner(ctx context.Context,
 		return nil, err
 	}
 	userCurrentSubscription.Plan = *plan
-	partner, err := u.getPartnerByID(ctx, partnerID)
+	_, err = u.getPartnerByID(ctx, partnerID)
 	if err != nil {
 		cancelFunc()
 		return nil, err
 	}
-	cof, err := u.SubscriptionRepo.GetCountOfOffersWithPartner(ctx, partner, userCurrentSubscription)
+	remainingOffers, err := u.SubscriptionRepo.GetRemainingOffersWithPartner(ctx, userCurrentSubscription, partnerID)
 	if err != nil {
-		err = errors.New("error getting user remaining offers")
+		err = errors.Wrap(err, "error getting user remaining offers")
 		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
-	userCurrentSubscription.RemainingOffers = cof.CountOfOffers
+	userCurrentSubscription.RemainingOffers = remainingOffers
 	userCurrentSubscription.Plan = *plan
 	cancelFunc()
 	return userCurrentSubscription, nil
@@ -770,15 +665,11 @@ func (u *SubscriptionUsecase) GetMySubscriptionWithPartner(ctx context.Context,
 // CreatePlanCategoryAssociation creates a plan-category association
 func (u *SubscriptionUsecase) CreatePlanCategoryAssociation(ctx context.Context, planID uint, categoryID uint) error {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := u.UserRepo.GetByID(ctx, currentUserID)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionManagePlans)
 	if err != nil {
+		log.Error(err)
 		cancelFunc()
-		return errors.Wrap(err, "error getting user")
-	}
-	if !currentUser.IsAdmin() {
-		cancelFunc()
-		return errors.New("not authorized")
+		return err
 	}
 	err = u.SubscriptionRepo.CreatePlanCategoryAssociation(ctx, planID, categoryID)
 	if err != nil {
@@ -792,15 +683,11 @@ func (u *SubscriptionUsecase) CreatePlanCategoryAssociation(ctx context.Context,
 // RemovePlanCategoryAssociation removes the plan-category association
 func (u *SubscriptionUsecase) RemovePlanCategoryAssociation(ctx context.Context, planID uint, categoryID uint) error {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := u.UserRepo.GetByID(ctx, currentUserID)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionManagePlans)
 	if err != nil {
+		log.Error(err)
 		cancelFunc()
-		return errors.Wrap(err, "error getting user")
-	}
-	if !currentUser.IsAdmin() {
-		cancelFunc()
-		return errors.New("not authorized")
+		return err
 	}
 	err = u.SubscriptionRepo.RemovePlanCategoryAssociation(ctx, planID, categoryID)
 	if err != nil {
@@ -836,6 +723,445 @@ func (u *SubscriptionUsecase) GetPlanByID(ctx context.Context, planID uint) (*en
 
 }
 
+// NotifyExpiredSubscriptions sends an expiry email to the users whose paid subscriptions expired in the last week.
+// Each subscription is notified once.
+func (u *SubscriptionUsecase) NotifyExpiredSubscriptions(ctx context.Context) error {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	subscriptions, err := u.SubscriptionRepo.GetSubscriptionsToNotifyOfExpiry(ctx, time.Now().AddDate(0, 0, -7))
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return err
+	}
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		user, err := u.UserRepo.GetByID(ctx, subscription.UserID)
+		if err != nil {
+			log.Error(errors.Wrap(err, "repository error while getting user"))
+			continue
+		}
+		plan, err := u.SubscriptionRepo.GetPlanByID(ctx, subscription.PlanID)
+		if err != nil {
+			log.Error(errors.Wrap(err, "repository error while getting plan"))
+			continue
+		}
+		if user.Email != "" {
+			err = mailer.SendTemplate(ctx, u.Mailer, mailer.Address{Name: user.GetFullName(), Email: user.Email}, mailer.TemplateExpiry, mailer.Data{
+				"Name":       user.FirstName,
+				"Plan":       *plan,
+				"ExpireDate": subscription.ExpireDate,
+			})
+			if err != nil {
+				log.Error(errors.Wrap(err, "error sending expiry email"))
+				continue
+			}
+		}
+		subscription.ExpiryNotified = true
+		_, err = u.SubscriptionRepo.ExpireSubscription(ctx, subscription)
+		if err != nil {
+			log.Error(errors.Wrap(err, "repository error while saving expired subscription"))
+		}
+	}
+	cancelFunc()
+	return nil
+}
+
+// sendReceipt emails the user a receipt of the payment made for the subscription.
+// Failing to send it is logged and doesn't fail the payment.
+func (u *SubscriptionUsecase) sendReceipt(ctx context.Context, user *entities.User, subscription *entities.Subscription, paymentID string) {
+	if user.Email == "" {
+		return
+	}
+	err := mailer.SendTemplate(ctx, u.Mailer, mailer.Address{Name: user.GetFullName(), Email: user.Email}, mailer.TemplateReceipt, mailer.Data{
+		"Name":       user.FirstName,
+		"Plan":       subscription.Plan,
+		"Amount":     subscription.Plan.Price,
+		"PaymentID":  paymentID,
+		"ExpireDate": subscription.ExpireDate,
+	})
+	if err != nil {
+		log.Error(errors.Wrap(err, "error sending receipt email"))
+	}
+}
+
+// charge records a pending payment of the given details, charges it through the payment provider and records its result.
+// Failing to record the result is only logged, since reconciling the payment later sets it from the provider.
+func (u *SubscriptionUsecase) charge(ctx context.Context, details *entities.PaymentDetails) (*entities.Payment, error) {
+	payment, err := entities.NewPayment(u.PaymentProvider.Name(), details)
+	if err != nil {
+		return nil, err
+	}
+	payment, err = u.SubscriptionRepo.CreatePayment(ctx, payment)
+	if err != nil {
+		return nil, errors.Wrap(err, "repository error while creating payment")
+	}
+	details.ConversationID = payment.ConversationID
+	receipt, err := u.PaymentProvider.CreateTransaction(details).Submit(ctx)
+	var rawResponse string
+	if receipt != nil {
+		rawResponse = receipt.RawResponse
+	}
+	if err != nil {
+		payment.Fail(rawResponse)
+		u.savePayment(ctx, payment)
+		return nil, err
+	}
+	payment.Succeed(receipt.PaymentID, rawResponse)
+	u.savePayment(ctx, payment)
+	return payment, nil
+}
+
+// linkPayment records the subscription the given payment was made for
+func (u *SubscriptionUsecase) linkPayment(ctx context.Context, payment *entities.Payment, subscription *entities.Subscription) {
+	payment.SubscriptionID = subscription.ID
+	u.savePayment(ctx, payment)
+}
+
+// savePayment saves the changes of the given payment and logs the error if it fails
+func (u *SubscriptionUsecase) savePayment(ctx context.Context, payment *entities.Payment) {
+	_, err := u.SubscriptionRepo.UpdatePayment(ctx, payment)
+	if err != nil {
+		log.Error(errors.Wrap(err, "repository error while saving payment"))
+	}
+}
+
+// GetPayments returns the payments matching the given filter
+func (u *SubscriptionUsecase) GetPayments(ctx context.Context, filter *entities.PaymentFilter) ([]entities.Payment, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionViewPayments)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	payments, err := u.SubscriptionRepo.GetPayments(ctx, filter)
+	if err != nil {
+		err = errors.Wrap(err, "repository error while getting payments")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	cancelFunc()
+	return payments, nil
+}
+
+// GetPaymentByID returns the payment with the given ID
+func (u *SubscriptionUsecase) GetPaymentByID(ctx context.Context, paymentID uint) (*entities.Payment, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionViewPayments)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	payment, err := u.SubscriptionRepo.GetPaymentByID(ctx, paymentID)
+	if err != nil {
+		err = errors.Wrap(err, "repository error while getting payment")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	cancelFunc()
+	return payment, nil
+}
+
+// ReconcilePayments compares the payments made through the payment provider that were never reconciled with its records.
+// Payments made in the last minutes are left out since they may still be processed.
+// Payments that don't match are kept with their discrepancy for admins to resolve.
+func (u *SubscriptionUsecase) ReconcilePayments(ctx context.Context) error {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	payments, err := u.SubscriptionRepo.GetPaymentsToReconcile(ctx, u.PaymentProvider.Name(), time.Now().Add(-10*time.Minute))
+	if err != nil {
+		err = errors.Wrap(err, "repository error while getting payments to reconcile")
+		log.Error(err)
+		cancelFunc()
+		return err
+	}
+	for i := range payments {
+		record := &payments[i]
+		receipt, err := u.PaymentProvider.Retrieve(ctx, record.ConversationID)
+		if err != nil && errors.Cause(err) != payment.ErrPaymentNotFound {
+			log.Error(errors.Wrapf(err, "error retrieving payment %d from the provider", record.ID))
+			continue
+		}
+		var matches bool
+		if receipt != nil {
+			if record.ProviderPaymentID == "" {
+				record.ProviderPaymentID = receipt.PaymentID
+			}
+			matches = record.Reconcile(true, receipt.Status, receipt.Amount, time.Now())
+		} else {
+			matches = record.Reconcile(false, "", 0, time.Now())
+		}
+		if !matches {
+			log.Warnf("payment %d doesn't match the provider: %s", record.ID, record.Discrepancy)
+		}
+		_, err = u.SubscriptionRepo.UpdatePayment(ctx, record)
+		if err != nil {
+			log.Error(errors.Wrap(err, "repository error while saving reconciled payment"))
+		}
+	}
+	cancelFunc()
+	return nil
+}
+
+// GetOffersLedger returns the offer ledger entries of the current subscription of the given customer.
+// If a partner ID is given, only the entries applying to that partner are returned.
+func (u *SubscriptionUsecase) GetOffersLedger(ctx context.Context, customerID uint, partnerID uint) ([]entities.OfferLedgerEntry, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionViewOffers)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	subscription, err := u.SubscriptionRepo.GetSubscriptionByUser(ctx, customerID)
+	if err != nil {
+		err = errors.Wrap(err, "repository error while getting customer subscription")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	entries, err := u.SubscriptionRepo.GetLedgerEntries(ctx, subscription.ID)
+	if err != nil {
+		err = errors.Wrap(err, "repository error while getting offers ledger")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	if partnerID != 0 {
+		var partnerEntries []entities.OfferLedgerEntry
+		for _, entry := range entries {
+			if entry.PartnerID == 0 || entry.PartnerID == partnerID {
+				partnerEntries = append(partnerEntries, entry)
+			}
+		}
+		entries = partnerEntries
+	}
+	cancelFunc()
+	return entries, nil
+}
+
+// AdjustOffers corrects the remaining offers of the given customer with the given partner, or with every partner if it's zero
+func (u *SubscriptionUsecase) AdjustOffers(ctx context.Context, customerID uint, partnerID uint, amount int, reason string) (*entities.OfferLedgerEntry, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUser, err := user.Authorize(ctx, u.UserRepo, entities.PermissionManageSubscriptions)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	if partnerID != 0 {
+		_, err = u.getPartnerByID(ctx, partnerID)
+		if err != nil {
+			err = errors.Wrap(err, "repository error while getting partner")
+			log.Error(err)
+			cancelFunc()
+			return nil, err
+		}
+	}
+	subscription, err := u.SubscriptionRepo.GetSubscriptionByUser(ctx, customerID)
+	if err != nil {
+		err = errors.Wrap(err, "repository error while getting customer subscription")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	entry, err := entities.NewAdjustment(currentUser, subscription, partnerID, amount, reason)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	entries := []entities.OfferLedgerEntry{*entry}
+	err = u.SubscriptionRepo.CreateLedgerEntries(ctx, entries)
+	if err != nil {
+		err = errors.Wrap(err, "repository error while adjusting offers")
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	cancelFunc()
+	return &entries[0], nil
+}
+
+// CancelMySubscription cancels the current subscription of the current user, and returns it with the amount refunded for it
+func (u *SubscriptionUsecase) CancelMySubscription(ctx context.Context, reason string) (*entities.Subscription, float64, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	userID := ctx.Value(entities.UserIDKey).(uint)
+	user, err := u.UserRepo.GetByID(ctx, userID)
+	if err != nil {
+		err = errors.Wrap(err, "repository error while getting user")
+		log.Error(err)
+		cancelFunc()
+		return nil, 0, err
+	}
+	if user.AccountType == "partner" {
+		err = errors.New("partner users don't have subscriptions")
+		log.Error(err)
+		cancelFunc()
+		return nil, 0, err
+	}
+	if reason == "" {
+		reason = "Cancelled by the customer"
+	}
+	subscription, refund, err := u.cancelSubscription(ctx, user.ID, user, reason)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, 0, err
+	}
+	cancelFunc()
+	return subscription, refund, nil
+}
+
+// AdminCancelSubscription cancels the current subscription of the given customer for the given reason,
+// and returns it with the amount refunded for it
+func (u *SubscriptionUsecase) AdminCancelSubscription(ctx context.Context, customerID uint, reason string) (*entities.Subscription, float64, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUser, err := user.Authorize(ctx, u.UserRepo, entities.PermissionManageSubscriptions)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, 0, err
+	}
+	if reason == "" {
+		err = errors.New("reason is required")
+		log.Error(err)
+		cancelFunc()
+		return nil, 0, err
+	}
+	customer, err := u.UserRepo.GetByID(ctx, customerID)
+	if err != nil {
+		err = errors.Wrap(err, "repository error while getting customer")
+		log.Error(err)
+		cancelFunc()
+		return nil, 0, err
+	}
+	subscription, refund, err := u.cancelSubscription(ctx, currentUser.ID, customer, reason)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, 0, err
+	}
+	cancelFunc()
+	return subscription, refund, nil
+}
+
+// cancelSubscription expires the current subscription of the given customer, refunds the payment made for it
+// and removes its remaining offers from the ledger.
+//
+// The subscription is claimed before it's refunded, so concurrent cancellations can't both refund it, and it can't be used
+// while it's being cancelled. The claim is released if the refund fails, so the subscription stays active and can be cancelled again.
+func (u *SubscriptionUsecase) cancelSubscription(ctx context.Context, actorID uint, customer *entities.User, reason string) (*entities.Subscription, float64, error) {
+	subscription, err := u.SubscriptionRepo.GetSubscriptionByUser(ctx, customer.ID)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "repository error while getting customer subscription")
+	}
+	if subscription == nil {
+		return nil, 0, errors.New("user is not subscribed to any plan")
+	}
+	plan, err := u.SubscriptionRepo.GetPlanByID(ctx, subscription.PlanID)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "repository error while getting plan")
+	}
+	subscription.Plan = *plan
+	window, err := entities.RefundWindow()
+	if err != nil {
+		return nil, 0, err
+	}
+	now := time.Now()
+	err = subscription.Cancel(now)
+	if err != nil {
+		return nil, 0, err
+	}
+	claimed, err := u.SubscriptionRepo.ClaimCancellation(ctx, subscription.ID, now)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "repository error while claiming subscription cancellation")
+	}
+	if !claimed {
+		return nil, 0, entities.ErrSubscriptionCancelled
+	}
+	// The offers used and the payment are read once the subscription is claimed, so they can't change before it's refunded
+	entries, err := u.SubscriptionRepo.GetLedgerEntries(ctx, subscription.ID)
+	if err != nil {
+		u.releaseCancellation(ctx, subscription)
+		return nil, 0, errors.Wrap(err, "repository error while getting offers ledger")
+	}
+	payments, err := u.SubscriptionRepo.GetPayments(ctx, &entities.PaymentFilter{SubscriptionID: subscription.ID, Status: entities.PaymentSucceeded})
+	if err != nil {
+		u.releaseCancellation(ctx, subscription)
+		return nil, 0, errors.Wrap(err, "repository error while getting subscription payment")
+	}
+	var payment *entities.Payment
+	if len(payments) > 0 {
+		payment = &payments[0]
+	}
+	refund := subscription.RefundAmount(payment, entities.OffersUsed(entries), now, window)
+	if refund > 0 {
+		err = u.refund(ctx, payment, refund, now)
+		if err != nil {
+			u.releaseCancellation(ctx, subscription)
+			return nil, 0, err
+		}
+	}
+	err = u.SubscriptionRepo.CancelSubscription(ctx, subscription, entities.NewCancellations(subscription, entries, actorID, reason))
+	if err != nil {
+		// The claim is kept, since the customer was refunded, so the subscription can't be used until it's expired
+		return nil, 0, errors.Wrapf(err, "repository error while cancelling subscription %d refunded %.2f", subscription.ID, refund)
+	}
+	u.sendCancellation(ctx, customer, subscription, refund)
+	return subscription, refund, nil
+}
+
+// releaseCancellation releases the claim on the cancellation of the given subscription after it failed.
+// Failing to do so is logged, and leaves the subscription unusable until it's released.
+func (u *SubscriptionUsecase) releaseCancellation(ctx context.Context, subscription *entities.Subscription) {
+	err := u.SubscriptionRepo.ReleaseCancellation(ctx, subscription.ID)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "repository error while releasing cancellation of subscription %d", subscription.ID))
+	}
+}
+
+// refund refunds the given amount of the payment through the provider it was made with, and records the refund
+func (u *SubscriptionUsecase) refund(ctx context.Context, payment *entities.Payment, amount float64, now time.Time) error {
+	if payment.Provider != u.PaymentProvider.Name() {
+		return errors.Errorf("payment was made through %s and can't be refunded through %s", payment.Provider, u.PaymentProvider.Name())
+	}
+	receipt, err := u.PaymentProvider.GetTransaction(payment).Cancel(ctx, amount)
+	if err != nil {
+		return errors.Wrap(err, "error refunding payment")
+	}
+	payment.Refund(receipt.PaymentID, amount, receipt.RawResponse, now)
+	u.savePayment(ctx, payment)
+	return nil
+}
+
+// sendCancellation emails the user that their subscription was cancelled with the amount refunded.
+// Failing to send it is logged and doesn't fail the cancellation.
+func (u *SubscriptionUsecase) sendCancellation(ctx context.Context, user *entities.User, subscription *entities.Subscription, refund float64) {
+	if user.Email == "" {
+		return
+	}
+	err := mailer.SendTemplate(ctx, u.Mailer, mailer.Address{Name: user.GetFullName(), Email: user.Email}, mailer.TemplateCancellation, mailer.Data{
+		"Name":   user.FirstName,
+		"Plan":   subscription.Plan,
+		"Refund": refund,
+	})
+	if err != nil {
+		log.Error(errors.Wrap(err, "error sending cancellation email"))
+	}
+}
+
+// refundCharge refunds the whole payment made for a subscription that couldn't be started.
+// Failing to refund it is logged with the payment so it can be refunded by hand.
+func (u *SubscriptionUsecase) refundCharge(ctx context.Context, payment *entities.Payment) {
+	err := u.refund(ctx, payment, payment.Amount, time.Now())
+	if err != nil {
+		log.Error(errors.Wrapf(err, "error refunding payment %d of a subscription that couldn't be started", payment.ID))
+	}
+}
+
 func (u *SubscriptionUsecase) getCustomerByID(ctx context.Context, ID uint) (*entities.Customer, error) {
 	user, err := u.UserRepo.GetByID(ctx, ID)
 	if err != nil {
@@ -2,19 +2,33 @@ package usecase
 
 import (
 	"context"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/ahmedaabouzied/iyzipay-go/iyzipay"
+	branchrepo "github.com/ahmedaabouzied/tasarruf/branch/repository"
 	"github.com/ahmedaabouzied/tasarruf/entities"
+	"github.com/ahmedaabouzied/tasarruf/mailer"
+	offerrepo "github.com/ahmedaabouzied/tasarruf/offer/repository"
+	"github.com/ahmedaabouzied/tasarruf/payment"
 	"github.com/ahmedaabouzied/tasarruf/subscription"
 	subscriptionrepo "github.com/ahmedaabouzied/tasarruf/subscription/repository"
 	"github.com/ahmedaabouzied/tasarruf/user"
 	userrepo "github.com/ahmedaabouzied/tasarruf/user/repository"
 	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
 )
 
 var subscriptionUsecase subscription.Usecase
 var userRepo user.Repository
 var subscriptionRepo subscription.Repository
+var paymentProvider *payment.FakeProvider
+
+// testCityID is the ID of the city of the customers buying plans, which is seeded by setupTest
+var testCityID uint
 
 func connectToDB() (*gorm.DB, error) {
 	conf := entities.DBConfig{
@@ -32,10 +46,18 @@ func connectToDB() (*gorm.DB, error) {
 	db.DropTable(entities.User{})
 	db.DropTable(entities.Subscription{})
 	db.DropTable(entities.Plan{})
+	db.DropTable(entities.Payment{})
+	db.DropTable(entities.OfferLedgerEntry{})
+	db.DropTable(entities.City{})
+	db.DropTable(entities.OTP{})
 	db.AutoMigrate(entities.Branch{})
 	db.AutoMigrate(entities.User{})
 	db.AutoMigrate(entities.Subscription{})
 	db.AutoMigrate(entities.Plan{})
+	db.AutoMigrate(entities.Payment{})
+	db.AutoMigrate(entities.OfferLedgerEntry{})
+	db.AutoMigrate(entities.City{})
+	db.AutoMigrate(entities.OTP{})
 	return db, nil
 }
 
@@ -45,15 +67,44 @@ func CreateRepos(db *gorm.DB) (user.Repository, subscription.Repository) {
 	return userRepo, subscriptionRepo
 }
 
-func setupTest() {
-	db, _ := connectToDB()
+func setupTest(t *testing.T) {
+	db, err := connectToDB()
+	if err != nil {
+		t.Skip("test database isn't available : ", err)
+	}
 	userRepo, subscriptionRepo := CreateRepos(db)
-	subscriptionUsecase = CreateSubscriptionUsecase(subscriptionRepo, userRepo)
+	outbox, err := mailer.CreateOutboxMailer(filepath.Join(os.TempDir(), "tasarruf-test-outbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	city := &entities.City{EnglishName: "Istanbul"}
+	if err := db.Create(city).Error; err != nil {
+		t.Fatal(err)
+	}
+	testCityID = city.ID
+	paymentProvider = payment.CreateFakeProvider()
+	subscriptionUsecase = CreateSubscriptionUsecase(subscriptionRepo, userRepo, branchrepo.CreateBranchRepository(db), offerrepo.CreateOfferRepository(db), outbox, paymentProvider)
+}
+
+// createDefaultPlan creates the plan customers are subscribed to until they buy one
+func createDefaultPlan(t *testing.T) *entities.Plan {
+	plan, err := subscriptionRepo.CreatePlan(context.Background(), &entities.Plan{IsDefault: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+// cardPayment returns the details of a payment made with the given test card of the fake payment provider
+func cardPayment(cardNumber string) *entities.PaymentDetails {
+	return &entities.PaymentDetails{
+		Card: &iyzipay.PaymentCard{CardNumber: cardNumber},
+	}
 }
 
 func TestCreatePlan(t *testing.T) {
 	t.Run("TestCreatePlanByAdminUser", func(t *testing.T) {
-		setupTest()
+		setupTest(t)
 		testUser := &entities.User{
 			AccountType: "admin",
 		}
@@ -76,7 +127,7 @@ func TestCreatePlan(t *testing.T) {
 	})
 
 	t.Run("TestCreatePlanByNotAdminUser", func(t *testing.T) {
-		setupTest()
+		setupTest(t)
 		testUser := &entities.User{
 			AccountType: "user",
 		}
@@ -101,7 +152,7 @@ func TestCreatePlan(t *testing.T) {
 
 func TestDeletePlan(t *testing.T) {
 	t.Run("TestDeletePlanByAdminUser", func(t *testing.T) {
-		setupTest()
+		setupTest(t)
 		testUser := &entities.User{
 			AccountType: "admin",
 		}
@@ -133,7 +184,7 @@ func TestDeletePlan(t *testing.T) {
 	})
 
 	t.Run("TestDeletePlanByNonAdminUser", func(t *testing.T) {
-		setupTest()
+		setupTest(t)
 		testAdminUser := &entities.User{
 			Email:       "testadminuser@test.com",
 			AccountType: "admin",
@@ -179,7 +230,7 @@ func TestDeletePlan(t *testing.T) {
 }
 
 func TestGetAllPlans(t *testing.T) {
-	setupTest()
+	setupTest(t)
 	testUser := &entities.User{
 		AccountType: "admin",
 	}
@@ -215,9 +266,11 @@ func TestGetAllPlans(t *testing.T) {
 }
 
 func TestSubscribeToPlan(t *testing.T) {
-	setupTest()
+	setupTest(t)
+	createDefaultPlan(t)
 	testUser := &entities.User{
 		AccountType: "admin",
+		CityID:      testCityID,
 	}
 	createdUser, err := userRepo.CreateCustomer(context.Background(), testUser)
 	if err != nil {
@@ -231,21 +284,309 @@ func TestSubscribeToPlan(t *testing.T) {
 		return
 	}
 	ctx := context.WithValue(context.Background(), entities.UserIDKey, createdUser.ID)
-	subscription, err := subscriptionUsecase.SubscribeToPlan(ctx, plan.ID)
-	if err != nil {
-		t.Error(err)
+	// Customers are subscribed to the default plan until they buy one, which they do by upgrading it
+	subscription, err := subscriptionUsecase.SubscribeToPlan(ctx, plan.ID, cardPayment(payment.TestCardApproved))
+	if err == nil {
+		t.Errorf("expected an error subscribing while subscribed to the default plan, got %+v", subscription)
 		return
 	}
-	if subscription == nil {
-		t.Fail()
-		return
+	if charges := paymentProvider.Charges(); len(charges) != 0 {
+		t.Errorf("expected no charges, got %+v", charges)
+	}
+}
+
+func TestBuyPlan(t *testing.T) {
+	setupTest(t)
+	defaultPlan := createDefaultPlan(t)
+	createdUser, err := userRepo.CreateCustomer(context.Background(), &entities.User{AccountType: "user", CityID: testCityID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := subscriptionRepo.CreatePlan(context.Background(), &entities.Plan{CountOfOffers: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), entities.UserIDKey, createdUser.ID)
+	subscription, err := subscriptionUsecase.UpgradePlan(ctx, plan.ID, cardPayment(payment.TestCardApproved))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subscription.PlanID != plan.ID {
+		t.Errorf("expected a subscription to plan %d, got %+v", plan.ID, subscription)
+	}
+	charges := paymentProvider.Charges()
+	if len(charges) != 1 || charges[0].UserID != createdUser.ID || charges[0].PlanID != plan.ID {
+		t.Fatalf("expected the customer to be charged for the plan, got %+v", charges)
+	}
+	if subscription.PaymentID != charges[0].ID {
+		t.Errorf("expected the subscription to have the payment id %s, got %q", charges[0].ID, subscription.PaymentID)
+	}
+	payments, err := subscriptionRepo.GetPayments(context.Background(), &entities.PaymentFilter{UserID: createdUser.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 1 || payments[0].Status != entities.PaymentSucceeded || payments[0].SubscriptionID != subscription.ID ||
+		payments[0].ProviderPaymentID != charges[0].ID || payments[0].ConversationID != charges[0].ConversationID {
+		t.Errorf("expected the payment to be recorded, got %+v", payments)
+	}
+	entries, err := subscriptionRepo.GetLedgerEntries(context.Background(), subscription.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining := entities.RemainingOffers(entries, 1); remaining != plan.CountOfOffers+defaultPlan.CountOfOffers {
+		t.Errorf("expected %d remaining offers, got %d", plan.CountOfOffers+defaultPlan.CountOfOffers, remaining)
+	}
+}
+
+func TestBuyPlanWithDeclinedCard(t *testing.T) {
+	setupTest(t)
+	defaultPlan := createDefaultPlan(t)
+	testUser := &entities.User{
+		AccountType: "user",
+		CityID:      testCityID,
+	}
+	createdUser, err := userRepo.CreateCustomer(context.Background(), testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := subscriptionRepo.CreatePlan(context.Background(), &entities.Plan{CountOfOffers: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), entities.UserIDKey, createdUser.ID)
+	_, err = subscriptionUsecase.UpgradePlan(ctx, plan.ID, cardPayment(payment.TestCardDeclined))
+	if errors.Cause(err) != payment.ErrCardDeclined {
+		t.Errorf("expected the payment to be declined, got %v", err)
+	}
+	subscription, err := subscriptionRepo.GetSubscriptionByUser(context.Background(), createdUser.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subscription.PlanID != defaultPlan.ID {
+		t.Errorf("expected the customer to stay on the default plan after a declined payment, got %+v", subscription)
+	}
+	if charges := paymentProvider.Charges(); len(charges) != 0 {
+		t.Errorf("expected no charges, got %+v", charges)
+	}
+	payments, err := subscriptionRepo.GetPayments(context.Background(), &entities.PaymentFilter{UserID: createdUser.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 1 || payments[0].Status != entities.PaymentFailed || payments[0].RawResponse == "" {
+		t.Errorf("expected the failed payment to be recorded, got %+v", payments)
+	}
+}
+
+func TestCancelMySubscription(t *testing.T) {
+	subscribe := func(t *testing.T) (context.Context, *entities.Subscription) {
+		createDefaultPlan(t)
+		createdUser, err := userRepo.CreateCustomer(context.Background(), &entities.User{AccountType: "user", CityID: testCityID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan, err := subscriptionRepo.CreatePlan(context.Background(), &entities.Plan{Price: 120, CountOfOffers: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.WithValue(context.Background(), entities.UserIDKey, createdUser.ID)
+		subscription, err := subscriptionUsecase.UpgradePlan(ctx, plan.ID, cardPayment(payment.TestCardApproved))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ctx, subscription
+	}
+	t.Run("FullRefund", func(t *testing.T) {
+		setupTest(t)
+		ctx, subscription := subscribe(t)
+		cancelled, refund, err := subscriptionUsecase.CancelMySubscription(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refund != 120 || cancelled.ID != subscription.ID || !cancelled.Expired || cancelled.CancelledAt == nil {
+			t.Errorf("expected the subscription to be cancelled with a full refund, got %.2f and %+v", refund, cancelled)
+		}
+		if charge := paymentProvider.Charges()[0]; !charge.Cancelled {
+			t.Errorf("expected the charge to be refunded, got %+v", charge)
+		}
+		payments, err := subscriptionRepo.GetPayments(context.Background(), &entities.PaymentFilter{SubscriptionID: subscription.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(payments) != 1 || payments[0].Status != entities.PaymentRefunded || payments[0].RefundedAmount != 120 || payments[0].RefundID == "" {
+			t.Errorf("expected the refund to be recorded, got %+v", payments)
+		}
+		entries, err := subscriptionRepo.GetLedgerEntries(context.Background(), subscription.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remaining := entities.RemainingOffers(entries, 1); remaining != 0 {
+			t.Errorf("expected no remaining offers, got %d", remaining)
+		}
+		if _, _, err := subscriptionUsecase.CancelMySubscription(ctx, ""); err == nil {
+			t.Error("expected an error cancelling twice")
+		}
+	})
+	t.Run("OffersUsed", func(t *testing.T) {
+		setupTest(t)
+		ctx, subscription := subscribe(t)
+		offer := &entities.Offer{CustomerID: subscription.UserID, PartnerID: 2, SubsriptionID: subscription.ID}
+		err := subscriptionRepo.CreateLedgerEntries(context.Background(), []entities.OfferLedgerEntry{*entities.NewConsumption(offer)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cancelled, refund, err := subscriptionUsecase.CancelMySubscription(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refund != 0 || !cancelled.Expired {
+			t.Errorf("expected the subscription to be cancelled without a refund, got %.2f and %+v", refund, cancelled)
+		}
+		if charge := paymentProvider.Charges()[0]; charge.Refunded != 0 {
+			t.Errorf("expected nothing to be refunded, got %+v", charge)
+		}
+	})
+	t.Run("Concurrently", func(t *testing.T) {
+		setupTest(t)
+		ctx, _ := subscribe(t)
+		const cancellations = 5
+		var wg sync.WaitGroup
+		results := make(chan error, cancellations)
+		for i := 0; i < cancellations; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _, err := subscriptionUsecase.CancelMySubscription(ctx, "")
+				results <- err
+			}()
+		}
+		wg.Wait()
+		close(results)
+		var cancelled int
+		for err := range results {
+			if err == nil {
+				cancelled++
+			}
+		}
+		if cancelled != 1 {
+			t.Errorf("expected the subscription to be cancelled once, got %d", cancelled)
+		}
+		if charge := paymentProvider.Charges()[0]; charge.Refunded != 120 {
+			t.Errorf("expected the charge to be refunded once, got %+v", charge)
+		}
+	})
+	t.Run("RefundFails", func(t *testing.T) {
+		setupTest(t)
+		ctx, subscription := subscribe(t)
+		payments, err := subscriptionRepo.GetPayments(context.Background(), &entities.PaymentFilter{SubscriptionID: subscription.ID})
+		if err != nil || len(payments) != 1 {
+			t.Fatalf("expected the payment of the subscription, got %+v and %v", payments, err)
+		}
+		// Payments made through another provider can't be refunded
+		payments[0].Provider = "iyzipay"
+		_, err = subscriptionRepo.UpdatePayment(context.Background(), &payments[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := subscriptionUsecase.CancelMySubscription(ctx, ""); err == nil {
+			t.Fatal("expected an error when the refund fails")
+		}
+		current, err := subscriptionRepo.GetSubscriptionByUser(context.Background(), subscription.UserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current.ID != subscription.ID || current.IsExpired() {
+			t.Errorf("expected the subscription to stay active, got %+v", current)
+		}
+	})
+}
+
+func TestReconcilePayments(t *testing.T) {
+	setupTest(t)
+	customer := &entities.User{}
+	customer.ID = 4
+	plan := &entities.Plan{Price: 120}
+	plan.ID = 2
+	newPayment := func(status string, subscriptionID uint) *entities.Payment {
+		details := &entities.PaymentDetails{User: customer, Plan: plan}
+		p, err := entities.NewPayment(paymentProvider.Name(), details)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Status = status
+		p.SubscriptionID = subscriptionID
+		p.CreatedAt = time.Now().Add(-time.Hour)
+		return p
+	}
+	charge := func(p *entities.Payment) {
+		details := cardPayment(payment.TestCardApproved)
+		details.User = customer
+		details.Plan = plan
+		details.ConversationID = p.ConversationID
+		receipt, err := paymentProvider.CreateTransaction(details).Submit(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.ProviderPaymentID = receipt.PaymentID
+	}
+	succeeded := newPayment(entities.PaymentSucceeded, 1)
+	charge(succeeded)
+	pending := newPayment(entities.PaymentPending, 2)
+	charge(pending)
+	pending.ProviderPaymentID = ""
+	missing := newPayment(entities.PaymentSucceeded, 3)
+	recent := newPayment(entities.PaymentPending, 0)
+	recent.CreatedAt = time.Now()
+	otherProvider := newPayment(entities.PaymentPending, 0)
+	otherProvider.Provider = "iyzipay"
+	for _, p := range []*entities.Payment{succeeded, pending, missing, recent, otherProvider} {
+		_, err := subscriptionRepo.CreatePayment(context.Background(), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := subscriptionUsecase.ReconcilePayments(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		payment     *entities.Payment
+		status      string
+		discrepancy bool
+		reconciled  bool
+	}{
+		{succeeded, entities.PaymentSucceeded, false, true},
+		{pending, entities.PaymentSucceeded, false, true},
+		{missing, entities.PaymentSucceeded, true, true},
+		{recent, entities.PaymentPending, false, false},
+		{otherProvider, entities.PaymentPending, false, false},
+	} {
+		p, err := subscriptionRepo.GetPaymentByID(context.Background(), test.payment.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Status != test.status || (p.Discrepancy != "") != test.discrepancy || (p.ReconciledAt != nil) != test.reconciled {
+			t.Errorf("unexpected reconciled payment %+v", p)
+		}
+	}
+	reconciledPending, _ := subscriptionRepo.GetPaymentByID(context.Background(), pending.ID)
+	if reconciledPending.ProviderPaymentID == "" {
+		t.Error("expected the pending payment to get the id of the provider")
+	}
+	payments, err := subscriptionRepo.GetPayments(context.Background(), &entities.PaymentFilter{Discrepancies: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 1 || payments[0].ID != missing.ID {
+		t.Errorf("expected only the missing payment to have a discrepancy, got %+v", payments)
 	}
 }
 
 func TestUpgradePlan(t *testing.T) {
-	setupTest()
+	setupTest(t)
+	createDefaultPlan(t)
 	testUser := &entities.User{
 		AccountType: "admin",
+		CityID:      testCityID,
 	}
 	createdUser, err := userRepo.CreateCustomer(context.Background(), testUser)
 	if err != nil {
@@ -261,7 +602,7 @@ func TestUpgradePlan(t *testing.T) {
 		return
 	}
 	ctx := context.WithValue(context.Background(), entities.UserIDKey, createdUser.ID)
-	subscription, err := subscriptionUsecase.SubscribeToPlan(ctx, plan.ID)
+	subscription, err := subscriptionUsecase.UpgradePlan(ctx, plan.ID, cardPayment(payment.TestCardApproved))
 	if err != nil {
 		t.Error(err)
 		return
@@ -278,7 +619,7 @@ func TestUpgradePlan(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	subscription, err = subscriptionUsecase.UpgradePlan(ctx, plan2.ID)
+	subscription, err = subscriptionUsecase.UpgradePlan(ctx, plan2.ID, cardPayment(payment.TestCardApproved))
 	if err != nil {
 		t.Error(err)
 		return
@@ -294,11 +635,13 @@ func TestUpgradePlan(t *testing.T) {
 }
 
 func TestRenewPlan(t *testing.T) {
-	setupTest()
+	setupTest(t)
+	createDefaultPlan(t)
 	testUser := &entities.User{
 		AccountType: "admin",
+		CityID:      testCityID,
 	}
-	createdUser, err := userRepo.Create(context.Background(), testUser)
+	createdUser, err := userRepo.CreateCustomer(context.Background(), testUser)
 	if err != nil {
 		t.Error(err)
 		return
@@ -312,7 +655,7 @@ func TestRenewPlan(t *testing.T) {
 		return
 	}
 	ctx := context.WithValue(context.Background(), entities.UserIDKey, createdUser.ID)
-	subscription, err := subscriptionUsecase.SubscribeToPlan(ctx, plan.ID)
+	subscription, err := subscriptionUsecase.UpgradePlan(ctx, plan.ID, cardPayment(payment.TestCardApproved))
 	if err != nil {
 		t.Error(err)
 		return
@@ -321,7 +664,7 @@ func TestRenewPlan(t *testing.T) {
 		t.Fail()
 		return
 	}
-	subscription, err = subscriptionUsecase.RenewPlan(ctx)
+	subscription, err = subscriptionUsecase.RenewPlan(ctx, cardPayment(payment.TestCardApproved))
 	if err != nil {
 		t.Fail()
 		return
@@ -337,11 +680,13 @@ func TestRenewPlan(t *testing.T) {
 }
 
 func TestGetMySubscription(t *testing.T) {
-	setupTest()
+	setupTest(t)
+	createDefaultPlan(t)
 	testUser := &entities.User{
 		AccountType: "admin",
+		CityID:      testCityID,
 	}
-	createdUser, err := userRepo.Create(context.Background(), testUser)
+	createdUser, err := userRepo.CreateCustomer(context.Background(), testUser)
 	if err != nil {
 		t.Error(err)
 		return
@@ -355,7 +700,7 @@ func TestGetMySubscription(t *testing.T) {
 		return
 	}
 	ctx := context.WithValue(context.Background(), entities.UserIDKey, createdUser.ID)
-	subscription, err := subscriptionUsecase.SubscribeToPlan(ctx, plan.ID)
+	subscription, err := subscriptionUsecase.UpgradePlan(ctx, plan.ID, cardPayment(payment.TestCardApproved))
 	if err != nil {
 		t.Error(err)
 		return
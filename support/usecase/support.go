@@ -25,15 +25,10 @@ func CreateSupportUsecase(supportRepo support.Repository, userRepo user.Reposito
 // Create creates a new support infor record
 func (u *SupportUsecase) Create(ctx context.Context, info *entities.SupportInfo) (*entities.SupportInfo, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := u.UserRepo.GetByID(ctx, currentUserID)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionManageSupport)
 	if err != nil {
 		cancelFunc()
-		return nil, errors.Wrap(err, "error getting user")
-	}
-	if !currentUser.IsAdmin() {
-		cancelFunc()
-		return nil, errors.New("user is not authorized to create support record")
+		return nil, err
 	}
 	info, err = u.SupportRepo.Create(ctx, info)
 	if err != nil {
@@ -47,15 +42,10 @@ func (u *SupportUsecase) Create(ctx context.Context, info *entities.SupportInfo)
 // Update updates the support info record
 func (u *SupportUsecase) Update(ctx context.Context, info *entities.SupportInfo) (*entities.SupportInfo, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := u.UserRepo.GetByID(ctx, currentUserID)
+	_, err := user.Authorize(ctx, u.UserRepo, entities.PermissionManageSupport)
 	if err != nil {
 		cancelFunc()
-		return nil, errors.Wrap(err, "error getting user")
-	}
-	if !currentUser.IsAdmin() {
-		cancelFunc()
-		return nil, errors.New("user is not authorized to update support record")
+		return nil, err
 	}
 	toUpdateInfo, err := u.SupportRepo.GetSupportInfo(ctx)
 	if err != nil {
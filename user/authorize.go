@@ -0,0 +1,25 @@
+package user
+
+import (
+	"context"
+
+	"github.com/ahmedaabouzied/tasarruf/entities"
+	"github.com/pkg/errors"
+)
+
+// Authorize returns the current user of the context if their role grants the given permission.
+// Staff users are refused while they haven't enabled two-factor authentication and it is enforced.
+func Authorize(ctx context.Context, repo Repository, permission entities.Permission) (*entities.User, error) {
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	currentUser, err := repo.GetByID(ctx, currentUserID)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting current user")
+	}
+	if !currentUser.Can(permission) {
+		return nil, errors.Wrapf(entities.ErrForbidden, "missing permission %s", permission)
+	}
+	if currentUser.NeedsTwoFactorSetup() {
+		return nil, errors.Wrap(entities.ErrForbidden, "two-factor authentication has to be enabled to use staff permissions")
+	}
+	return currentUser, nil
+}
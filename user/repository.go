@@ -41,4 +41,36 @@ type Repository interface {
 	GetSharesByCustomer(ctx context.Context, customerID uint, startDate time.Time, endDate time.Time) (int, error)
 	SearchUsers(ctx context.Context, searchTerm string) ([]entities.User, error)
 	GetSharablePartners(ctx context.Context) ([]entities.User, error)
+	CreateSession(ctx context.Context, session *entities.Session) (*entities.Session, error)
+	UpdateSession(ctx context.Context, session *entities.Session) (*entities.Session, error)
+	GetSessionByID(ctx context.Context, ID uint) (*entities.Session, error)
+	GetActiveSessionsByUser(ctx context.Context, userID uint) ([]entities.Session, error)
+	GetSessionByRefreshTokenHash(ctx context.Context, hash string) (*entities.Session, error)
+	GetSessionByPreviousRefreshTokenHash(ctx context.Context, hash string) (*entities.Session, error)
+	RotateSession(ctx context.Context, session *entities.Session, previousHash string) (bool, error)
+	RevokeUserSessions(ctx context.Context, userID uint, exceptSessionID uint) error
+	GetLoginAttempt(ctx context.Context, key string) (*entities.LoginAttempt, error)
+	ReserveLoginAttempt(ctx context.Context, key string, policy entities.AttemptPolicy) (bool, error)
+	RecordLoginFailure(ctx context.Context, key string, policy entities.AttemptPolicy) (bool, error)
+	DeleteLoginAttempts(ctx context.Context, keys []string) error
+	CreateAuditEntry(ctx context.Context, entry *entities.AuditEntry) error
+	GetAuditEntriesByUser(ctx context.Context, userID uint) ([]entities.AuditEntry, error)
+	CreateContactChange(ctx context.Context, change *entities.ContactChange) (*entities.ContactChange, error)
+	UpdateContactChange(ctx context.Context, change *entities.ContactChange) (*entities.ContactChange, error)
+	GetPendingContactChange(ctx context.Context, userID uint, kind string) (*entities.ContactChange, error)
+	CreateLoginChallenge(ctx context.Context, challenge *entities.LoginChallenge) (*entities.LoginChallenge, error)
+	UpdateLoginChallenge(ctx context.Context, challenge *entities.LoginChallenge) (*entities.LoginChallenge, error)
+	GetLoginChallengeByTokenHash(ctx context.Context, hash string) (*entities.LoginChallenge, error)
+	ReplaceRecoveryCodes(ctx context.Context, userID uint, codes []entities.RecoveryCode) error
+	GetUnusedRecoveryCode(ctx context.Context, userID uint, hash string) (*entities.RecoveryCode, error)
+	UpdateRecoveryCode(ctx context.Context, code *entities.RecoveryCode) (*entities.RecoveryCode, error)
+	GetByIDIncludingDeleted(ctx context.Context, ID uint) (*entities.User, error)
+	GetCashiersByPartner(ctx context.Context, partnerID uint) ([]entities.User, error)
+	CreateAPIKey(ctx context.Context, apiKey *entities.APIKey) (*entities.APIKey, error)
+	UpdateAPIKey(ctx context.Context, apiKey *entities.APIKey) (*entities.APIKey, error)
+	GetAPIKeyByID(ctx context.Context, ID uint) (*entities.APIKey, error)
+	GetAPIKeyByHash(ctx context.Context, hash string) (*entities.APIKey, error)
+	GetAPIKeysByPartner(ctx context.Context, partnerID uint) ([]entities.APIKey, error)
+	GetSigningKeys(ctx context.Context) ([]entities.SigningKey, error)
+	RotateSigningKey(ctx context.Context, key *entities.SigningKey) error
 }
@@ -408,3 +408,392 @@ func (r UserRepository) GetSharablePartners(ctx context.Context) ([]entities.Use
 	}
 	return sharables, nil
 }
+
+// CreateSession creates a new session record
+func (r *UserRepository) CreateSession(ctx context.Context, session *entities.Session) (*entities.Session, error) {
+	dbt := r.DB.Create(session)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error creating session")
+	}
+	return session, nil
+}
+
+// UpdateSession saves the given session
+func (r *UserRepository) UpdateSession(ctx context.Context, session *entities.Session) (*entities.Session, error) {
+	dbt := r.DB.Save(session)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error updating session")
+	}
+	return session, nil
+}
+
+// RotateSession saves the new refresh token and client info of the given session, as long as its refresh token
+// is still the one with the given hash and it isn't revoked. It returns false if another refresh rotated the token first.
+func (r *UserRepository) RotateSession(ctx context.Context, session *entities.Session, previousHash string) (bool, error) {
+	dbt := r.DB.Model(&entities.Session{}).Where("id = ? AND refresh_token_hash = ? AND revoked_at IS NULL", session.ID, previousHash).Updates(map[string]interface{}{
+		"refresh_token_hash":          session.RefreshTokenHash,
+		"previous_refresh_token_hash": previousHash,
+		"expires_at":                  session.ExpiresAt,
+		"device_name":                 session.DeviceName,
+		"platform":                    session.Platform,
+		"ip_address":                  session.IPAddress,
+		"user_agent":                  session.UserAgent,
+		"last_seen_at":                session.LastSeenAt,
+	})
+	if dbt.Error != nil {
+		return false, errors.Wrap(dbt.Error, "error rotating session")
+	}
+	return dbt.RowsAffected == 1, nil
+}
+
+// GetSessionByID returns the session with the given ID
+func (r *UserRepository) GetSessionByID(ctx context.Context, ID uint) (*entities.Session, error) {
+	var session entities.Session
+	dbt := r.DB.Where("id = ?", ID).First(&session)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting session")
+	}
+	return &session, nil
+}
+
+// GetActiveSessionsByUser returns the sessions of the given user that are neither revoked nor expired
+func (r *UserRepository) GetActiveSessionsByUser(ctx context.Context, userID uint) ([]entities.Session, error) {
+	var sessions []entities.Session
+	dbt := r.DB.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).Order("last_seen_at desc").Find(&sessions)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting sessions")
+	}
+	return sessions, nil
+}
+
+// GetSessionByRefreshTokenHash returns the session holding the given refresh token hash
+func (r *UserRepository) GetSessionByRefreshTokenHash(ctx context.Context, hash string) (*entities.Session, error) {
+	var session entities.Session
+	dbt := r.DB.Where("refresh_token_hash = ?", hash).First(&session)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting session")
+	}
+	return &session, nil
+}
+
+// GetSessionByPreviousRefreshTokenHash returns the session whose refresh token was rotated away from the given hash
+func (r *UserRepository) GetSessionByPreviousRefreshTokenHash(ctx context.Context, hash string) (*entities.Session, error) {
+	var session entities.Session
+	dbt := r.DB.Where("previous_refresh_token_hash = ?", hash).First(&session)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting session")
+	}
+	return &session, nil
+}
+
+// RevokeUserSessions revokes all the active sessions of the given user except the session with exceptSessionID.
+// Pass 0 as exceptSessionID to revoke every session.
+func (r *UserRepository) RevokeUserSessions(ctx context.Context, userID uint, exceptSessionID uint) error {
+	dbt := r.DB.Model(&entities.Session{}).Where("user_id = ? AND revoked_at IS NULL AND id <> ?", userID, exceptSessionID).Update("revoked_at", time.Now())
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error revoking sessions")
+	}
+	return nil
+}
+
+// GetLoginAttempt returns the failed attempts record of the given key.
+// A new record is returned if the key has no failed attempts.
+func (r *UserRepository) GetLoginAttempt(ctx context.Context, key string) (*entities.LoginAttempt, error) {
+	var attempt entities.LoginAttempt
+	dbt := r.DB.Where("key = ?", key).First(&attempt)
+	if dbt.RecordNotFound() {
+		return &entities.LoginAttempt{Key: key}, nil
+	}
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting login attempt")
+	}
+	return &attempt, nil
+}
+
+// ReserveLoginAttempt counts an attempt against the given key before it's made.
+// The record is locked while it's checked and incremented, so concurrent attempts are counted one after the other.
+// It returns a TooManyAttemptsError if the key is throttled or locked, otherwise true if the attempt locked the key.
+func (r *UserRepository) ReserveLoginAttempt(ctx context.Context, key string, policy entities.AttemptPolicy) (bool, error) {
+	locked := false
+	err := r.updateLoginAttempt(key, func(attempt *entities.LoginAttempt) error {
+		var err error
+		locked, err = attempt.Reserve(policy, time.Now())
+		return err
+	})
+	return locked, err
+}
+
+// RecordLoginFailure counts a failed attempt against the given key. It returns true if the failure locked the key.
+func (r *UserRepository) RecordLoginFailure(ctx context.Context, key string, policy entities.AttemptPolicy) (bool, error) {
+	locked := false
+	err := r.updateLoginAttempt(key, func(attempt *entities.LoginAttempt) error {
+		locked = attempt.RecordFailure(policy, time.Now())
+		return nil
+	})
+	return locked, err
+}
+
+// updateLoginAttempt applies update to the attempts record of the given key while holding a row lock on it.
+// The record is created first if the key has no failed attempts, and it's only saved if update returns no error.
+func (r *UserRepository) updateLoginAttempt(key string, update func(*entities.LoginAttempt) error) error {
+	now := time.Now()
+	tx := r.DB.Begin()
+	dbt := tx.Exec("INSERT INTO login_attempts (key, failures, last_failure_at, created_at, updated_at) VALUES (?, 0, ?, ?, ?) ON CONFLICT (key) DO NOTHING", key, time.Time{}, now, now)
+	if dbt.Error != nil {
+		tx.Rollback()
+		return errors.Wrap(dbt.Error, "error creating login attempt")
+	}
+	var attempt entities.LoginAttempt
+	dbt = tx.Set("gorm:query_option", "FOR UPDATE").Where("key = ?", key).First(&attempt)
+	if dbt.Error != nil {
+		tx.Rollback()
+		return errors.Wrap(dbt.Error, "error locking login attempt")
+	}
+	err := update(&attempt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	dbt = tx.Save(&attempt)
+	if dbt.Error != nil {
+		tx.Rollback()
+		return errors.Wrap(dbt.Error, "error saving login attempt")
+	}
+	dbt = tx.Commit()
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error saving login attempt")
+	}
+	return nil
+}
+
+// DeleteLoginAttempts removes the attempts records of the given keys
+func (r *UserRepository) DeleteLoginAttempts(ctx context.Context, keys []string) error {
+	dbt := r.DB.Unscoped().Where("key IN (?)", keys).Delete(&entities.LoginAttempt{})
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error deleting login attempts")
+	}
+	return nil
+}
+
+// CreateAuditEntry creates a new audit entry
+func (r *UserRepository) CreateAuditEntry(ctx context.Context, entry *entities.AuditEntry) error {
+	dbt := r.DB.Create(entry)
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error creating audit entry")
+	}
+	return nil
+}
+
+// GetAuditEntriesByUser returns the audit entries of the given user, newest first
+func (r *UserRepository) GetAuditEntriesByUser(ctx context.Context, userID uint) ([]entities.AuditEntry, error) {
+	var entries []entities.AuditEntry
+	dbt := r.DB.Where("user_id = ?", userID).Order("created_at desc").Limit(200).Find(&entries)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting audit entries")
+	}
+	return entries, nil
+}
+
+// CreateContactChange creates a new pending contact change
+func (r *UserRepository) CreateContactChange(ctx context.Context, change *entities.ContactChange) (*entities.ContactChange, error) {
+	dbt := r.DB.Create(change)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error creating contact change")
+	}
+	return change, nil
+}
+
+// UpdateContactChange saves the changes of the given contact change
+func (r *UserRepository) UpdateContactChange(ctx context.Context, change *entities.ContactChange) (*entities.ContactChange, error) {
+	dbt := r.DB.Save(change)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error updating contact change")
+	}
+	return change, nil
+}
+
+// GetPendingContactChange returns the latest unconfirmed change of the given kind of contact of the user
+func (r *UserRepository) GetPendingContactChange(ctx context.Context, userID uint, kind string) (*entities.ContactChange, error) {
+	var change entities.ContactChange
+	dbt := r.DB.Where("user_id = ? AND kind = ? AND confirmed_at IS NULL", userID, kind).Order("created_at desc").First(&change)
+	if dbt.Error != nil {
+		if dbt.RecordNotFound() {
+			return nil, errors.New("no pending verification, please request a new code")
+		}
+		return nil, errors.Wrap(dbt.Error, "error getting contact change")
+	}
+	return &change, nil
+}
+
+// CreateLoginChallenge creates a new login challenge
+func (r *UserRepository) CreateLoginChallenge(ctx context.Context, challenge *entities.LoginChallenge) (*entities.LoginChallenge, error) {
+	dbt := r.DB.Create(challenge)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error creating login challenge")
+	}
+	return challenge, nil
+}
+
+// UpdateLoginChallenge saves the changes of the given login challenge
+func (r *UserRepository) UpdateLoginChallenge(ctx context.Context, challenge *entities.LoginChallenge) (*entities.LoginChallenge, error) {
+	dbt := r.DB.Save(challenge)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error updating login challenge")
+	}
+	return challenge, nil
+}
+
+// GetLoginChallengeByTokenHash returns the login challenge with the given token hash
+func (r *UserRepository) GetLoginChallengeByTokenHash(ctx context.Context, hash string) (*entities.LoginChallenge, error) {
+	var challenge entities.LoginChallenge
+	dbt := r.DB.Where("token_hash = ?", hash).First(&challenge)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting login challenge")
+	}
+	return &challenge, nil
+}
+
+// ReplaceRecoveryCodes deletes the recovery codes of the user and saves the given ones instead
+func (r *UserRepository) ReplaceRecoveryCodes(ctx context.Context, userID uint, codes []entities.RecoveryCode) error {
+	tx := r.DB.Begin()
+	dbt := tx.Unscoped().Where("user_id = ?", userID).Delete(&entities.RecoveryCode{})
+	if dbt.Error != nil {
+		tx.Rollback()
+		return errors.Wrap(dbt.Error, "error deleting recovery codes")
+	}
+	for i := range codes {
+		dbt = tx.Create(&codes[i])
+		if dbt.Error != nil {
+			tx.Rollback()
+			return errors.Wrap(dbt.Error, "error creating recovery code")
+		}
+	}
+	dbt = tx.Commit()
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error saving recovery codes")
+	}
+	return nil
+}
+
+// GetUnusedRecoveryCode returns the unused recovery code of the user with the given hash
+func (r *UserRepository) GetUnusedRecoveryCode(ctx context.Context, userID uint, hash string) (*entities.RecoveryCode, error) {
+	var code entities.RecoveryCode
+	dbt := r.DB.Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hash).First(&code)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting recovery code")
+	}
+	return &code, nil
+}
+
+// UpdateRecoveryCode saves the changes of the given recovery code
+func (r *UserRepository) UpdateRecoveryCode(ctx context.Context, code *entities.RecoveryCode) (*entities.RecoveryCode, error) {
+	dbt := r.DB.Save(code)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error updating recovery code")
+	}
+	return code, nil
+}
+
+// GetByIDIncludingDeleted returns the user with the given ID even if it was soft deleted
+func (r *UserRepository) GetByIDIncludingDeleted(ctx context.Context, ID uint) (*entities.User, error) {
+	var u entities.User
+	dbt := r.DB.Unscoped().Where("id = ?", ID).First(&u)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting user with the given ID")
+	}
+	return &u, nil
+}
+
+// GetCashiersByPartner returns the staff accounts of the given partner
+func (r *UserRepository) GetCashiersByPartner(ctx context.Context, partnerID uint) ([]entities.User, error) {
+	var cashiers []entities.User
+	dbt := r.DB.Where("account_type = ? AND partner_id = ?", entities.AccountTypeCashier, partnerID).Order("id").Find(&cashiers)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting cashiers")
+	}
+	return cashiers, nil
+}
+
+// CreateAPIKey creates a new API key record
+func (r *UserRepository) CreateAPIKey(ctx context.Context, apiKey *entities.APIKey) (*entities.APIKey, error) {
+	dbt := r.DB.Create(apiKey)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error creating API key")
+	}
+	return apiKey, nil
+}
+
+// UpdateAPIKey saves the given API key
+func (r *UserRepository) UpdateAPIKey(ctx context.Context, apiKey *entities.APIKey) (*entities.APIKey, error) {
+	dbt := r.DB.Save(apiKey)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error updating API key")
+	}
+	return apiKey, nil
+}
+
+// GetAPIKeyByID returns the API key with the given ID
+func (r *UserRepository) GetAPIKeyByID(ctx context.Context, ID uint) (*entities.APIKey, error) {
+	var apiKey entities.APIKey
+	dbt := r.DB.Where("id = ?", ID).First(&apiKey)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting API key")
+	}
+	return &apiKey, nil
+}
+
+// GetAPIKeyByHash returns the API key with the given hash
+func (r *UserRepository) GetAPIKeyByHash(ctx context.Context, hash string) (*entities.APIKey, error) {
+	var apiKey entities.APIKey
+	dbt := r.DB.Where("key_hash = ?", hash).First(&apiKey)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting API key")
+	}
+	return &apiKey, nil
+}
+
+// GetAPIKeysByPartner returns the API keys of the given partner, newest first
+func (r *UserRepository) GetAPIKeysByPartner(ctx context.Context, partnerID uint) ([]entities.APIKey, error) {
+	var apiKeys []entities.APIKey
+	dbt := r.DB.Where("partner_id = ?", partnerID).Order("created_at desc").Find(&apiKeys)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting API keys")
+	}
+	return apiKeys, nil
+}
+
+// GetSigningKeys returns all the signing keys of access tokens
+func (r *UserRepository) GetSigningKeys(ctx context.Context) ([]entities.SigningKey, error) {
+	var keys []entities.SigningKey
+	dbt := r.DB.Find(&keys)
+	if dbt.Error != nil {
+		return nil, errors.Wrap(dbt.Error, "error getting signing keys")
+	}
+	return keys, nil
+}
+
+// RotateSigningKey creates the given signing key and retires the current keys once it becomes active.
+// Keys that don't verify tokens anymore are deleted.
+func (r *UserRepository) RotateSigningKey(ctx context.Context, key *entities.SigningKey) error {
+	tx := r.DB.Begin()
+	dbt := tx.Model(&entities.SigningKey{}).Where("retires_at IS NULL OR retires_at > ?", key.ActivatesAt).Update("retires_at", key.ActivatesAt)
+	if dbt.Error != nil {
+		tx.Rollback()
+		return errors.Wrap(dbt.Error, "error retiring signing keys")
+	}
+	dbt = tx.Unscoped().Where("retires_at < ?", time.Now().Add(-entities.AccessTokenLifetime)).Delete(&entities.SigningKey{})
+	if dbt.Error != nil {
+		tx.Rollback()
+		return errors.Wrap(dbt.Error, "error deleting expired signing keys")
+	}
+	dbt = tx.Create(key)
+	if dbt.Error != nil {
+		tx.Rollback()
+		return errors.Wrap(dbt.Error, "error creating signing key")
+	}
+	dbt = tx.Commit()
+	if dbt.Error != nil {
+		return errors.Wrap(dbt.Error, "error saving signing key")
+	}
+	return nil
+}
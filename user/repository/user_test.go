@@ -220,3 +220,63 @@ func TestSearchUsers(t *testing.T) {
 		return
 	}
 }
+
+func TestRotateSession(t *testing.T) {
+	db, err := connectToDB()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	db.DropTable(&entities.Session{})
+	db.AutoMigrate(&entities.Session{})
+	repo := CreateUserRepository(db)
+	session, err := repo.CreateSession(context.Background(), &entities.Session{UserID: 1, RefreshTokenHash: "first", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.RefreshTokenHash = "second"
+	rotated, err := repo.RotateSession(context.Background(), session, "first")
+	if err != nil || !rotated {
+		t.Fatalf("expected the session to be rotated, got %t and %v", rotated, err)
+	}
+	session.RefreshTokenHash = "concurrent"
+	rotated, err = repo.RotateSession(context.Background(), session, "first")
+	if err != nil || rotated {
+		t.Errorf("expected a second rotation from the same token to fail, got %t and %v", rotated, err)
+	}
+	saved, err := repo.GetSessionByID(context.Background(), session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.RefreshTokenHash != "second" || saved.PreviousRefreshTokenHash != "first" {
+		t.Errorf("unexpected rotated session %+v", saved)
+	}
+}
+
+func TestReserveLoginAttemptConcurrently(t *testing.T) {
+	db, err := connectToDB()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	db.DropTable(&entities.LoginAttempt{})
+	db.AutoMigrate(&entities.LoginAttempt{})
+	repo := CreateUserRepository(db)
+	key := entities.AccountAttemptKey("verification", "1")
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := repo.ReserveLoginAttempt(context.Background(), key, entities.VerificationAttemptPolicy)
+			results <- err
+		}()
+	}
+	reserved := 0
+	for i := 0; i < 10; i++ {
+		if <-results == nil {
+			reserved++
+		}
+	}
+	if reserved != entities.VerificationAttemptPolicy.FreeAttempts {
+		t.Errorf("expected %d attempts to be reserved at once, got %d", entities.VerificationAttemptPolicy.FreeAttempts, reserved)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/ahmedaabouzied/tasarruf/entities"
 	"mime/multipart"
+	"time"
 )
 
 // Usecase represents the user business logic
@@ -12,8 +13,35 @@ type Usecase interface {
 	CreatePartner(ctx context.Context, u *entities.User, profile *entities.PartnerProfile, newPassword string) (*entities.User, error)
 	IsEmailRegistered(ctx context.Context, email string) (bool, error)
 	IsPhoneRegistered(ctx context.Context, phone string) (bool, error)
-	EmailLogin(ctx context.Context, email string, password string) (*entities.User, string, error)
-	PhoneLogin(ctx context.Context, phone string, password string) (*entities.User, string, error)
+	EmailLogin(ctx context.Context, email string, password string) (*entities.User, *entities.TokenPair, error)
+	PhoneLogin(ctx context.Context, phone string, password string) (*entities.User, *entities.TokenPair, error)
+	VerifyLoginChallenge(ctx context.Context, challengeToken string, code string) (*entities.User, *entities.TokenPair, error)
+	IssueTokens(ctx context.Context, userID uint) (*entities.TokenPair, error)
+	Authenticate(ctx context.Context, token string) (*entities.Claims, error)
+	RefreshToken(ctx context.Context, refreshToken string) (*entities.TokenPair, error)
+	Logout(ctx context.Context) error
+	GetSessions(ctx context.Context, userID uint) ([]entities.Session, error)
+	RevokeSession(ctx context.Context, userID uint, sessionID uint) error
+	RevokeAllSessions(ctx context.Context, userID uint) error
+	Authorize(ctx context.Context, permission entities.Permission) (*entities.User, error)
+	SetUserRole(ctx context.Context, userID uint, role entities.Role) (*entities.User, error)
+	UnlockUser(ctx context.Context, userID uint) error
+	GetAuditEntries(ctx context.Context, userID uint) ([]entities.AuditEntry, error)
+	StartTwoFactorEnrollment(ctx context.Context) (string, string, error)
+	EnableTwoFactor(ctx context.Context, code string) ([]string, error)
+	DisableTwoFactor(ctx context.Context, password string, code string) error
+	RegenerateRecoveryCodes(ctx context.Context, code string) ([]string, error)
+	AdminDisableTwoFactor(ctx context.Context, userID uint) error
+	CreateCashier(ctx context.Context, u *entities.User, branchID uint, password string) (*entities.User, error)
+	GetCashiers(ctx context.Context) ([]entities.User, error)
+	UpdateCashierBranch(ctx context.Context, cashierID uint, branchID uint) (*entities.User, error)
+	DeleteCashier(ctx context.Context, cashierID uint) error
+	GetRole(ctx context.Context, userID uint) (entities.Role, error)
+	CreateRedemptionToken(ctx context.Context) (string, time.Time, error)
+	CreateAPIKey(ctx context.Context, name string) (*entities.APIKey, string, error)
+	GetAPIKeys(ctx context.Context) ([]entities.APIKey, error)
+	RevokeAPIKey(ctx context.Context, apiKeyID uint) error
+	AuthenticateAPIKey(ctx context.Context, key string) (*entities.APIKey, error)
 	GetUser(ctx context.Context, ID uint) (*entities.User, error)
 	DeleteUser(ctx context.Context, ID uint) (*entities.User, error)
 	UpdateUser(ctx context.Context, user *entities.User) (*entities.User, error)
@@ -27,7 +55,10 @@ type Usecase interface {
 	UpdatePartnerProfile(ctx context.Context, profile *entities.PartnerProfile) (*entities.User, error)
 	VerifyUser(ctx context.Context, code string) (*entities.User, error)
 	ResendVerficationCode(ctx context.Context) error
-	ValidateCustomerPartnerIntegrity(ctx context.Context, customerID uint, partnerID uint) (*entities.User, *entities.Subscription, error)
+	RequestEmailVerification(ctx context.Context) (*entities.ContactChange, error)
+	RequestContactChange(ctx context.Context, kind string, newValue string) (*entities.ContactChange, error)
+	ConfirmContactChange(ctx context.Context, kind string, code string) (*entities.User, error)
+	ValidateCustomerPartnerIntegrity(ctx context.Context, redemptionToken string, partnerID uint) (*entities.User, *entities.Subscription, error)
 	GetCustomersCount(ctx context.Context) (int, error)
 	GetCustomerByID(ctx context.Context, ID uint) (*entities.Customer, error)
 	GetPartnersCount(ctx context.Context) (int, error)
@@ -2,21 +2,22 @@ package usecase
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"github.com/ahmedaabouzied/tasarruf/branch"
 	"github.com/ahmedaabouzied/tasarruf/entities"
 	"github.com/ahmedaabouzied/tasarruf/filestore"
+	"github.com/ahmedaabouzied/tasarruf/mailer"
 	"github.com/ahmedaabouzied/tasarruf/offer"
 	"github.com/ahmedaabouzied/tasarruf/review"
+	"github.com/ahmedaabouzied/tasarruf/sms"
 	"github.com/ahmedaabouzied/tasarruf/subscription"
 	"github.com/ahmedaabouzied/tasarruf/user"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
-	"math/rand"
+	"math/big"
 	"mime/multipart"
 	"net/http"
-	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -32,16 +33,20 @@ type UserUsecase struct {
 	ReviewRepository       review.Repository
 	BranchRepository       branch.Repository
 	OfferRepo              offer.Repository
+	SMSSender              sms.Sender
+	Mailer                 mailer.Mailer
 }
 
 // CreateUserUsecase returns an instance of the user usecase interface
-func CreateUserUsecase(uRepo user.Repository, sRepo subscription.Repository, reviewRepo review.Repository, branchRepo branch.Repository, offerRepo offer.Repository) user.Usecase {
+func CreateUserUsecase(uRepo user.Repository, sRepo subscription.Repository, reviewRepo review.Repository, branchRepo branch.Repository, offerRepo offer.Repository, smsSender sms.Sender, m mailer.Mailer) user.Usecase {
 	u := UserUsecase{
 		UserRepository:         uRepo,
 		SubscriptionRepository: sRepo,
 		ReviewRepository:       reviewRepo,
 		BranchRepository:       branchRepo,
 		OfferRepo:              offerRepo,
+		SMSSender:              smsSender,
+		Mailer:                 m,
 	}
 	return &u
 }
@@ -50,6 +55,7 @@ func CreateUserUsecase(uRepo user.Repository, sRepo subscription.Repository, rev
 func (c *UserUsecase) CreateCustomer(ctx context.Context, u *entities.User, newPassword string) (*entities.User, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
 	profileImageURL := os.Getenv("DEFAULT_PROFILE_IMAGE_URL")
+	u.Role = entities.DefaultRole(u.AccountType)
 	err := u.SetHashedPassword(newPassword, u)
 	if err != nil {
 		cancelFunc()
@@ -80,10 +86,17 @@ func (c *UserUsecase) CreateCustomer(ctx context.Context, u *entities.User, newP
 		cancelFunc()
 		return nil, err
 	}
-	err = sendVerfificationMessage(newUser.Mobile, code)
+	err = sms.SendTemplate(ctx, c.SMSSender, newUser.Mobile, sms.TemplateVerification, sms.Data{"Code": code})
 	if err != nil {
 		log.Error(err)
 	}
+	c.sendWelcomeEmail(ctx, newUser)
+	if newUser.Email != "" {
+		_, err = c.startContactChange(ctx, newUser, entities.ContactEmail, newUser.Email)
+		if err != nil {
+			log.Error(err)
+		}
+	}
 	newUser.City = *city
 	cancelFunc()
 	return newUser, nil
@@ -93,6 +106,7 @@ func (c *UserUsecase) CreateCustomer(ctx context.Context, u *entities.User, newP
 func (c *UserUsecase) CreatePartner(ctx context.Context, u *entities.User, profile *entities.PartnerProfile, newPassword string) (*entities.User, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
 	profileImageURL := os.Getenv("DEFAULT_PROFILE_IMAGE_URL")
+	u.Role = entities.DefaultRole(u.AccountType)
 	err := u.SetHashedPassword(newPassword, u)
 	if err != nil {
 		cancelFunc()
@@ -115,10 +129,17 @@ func (c *UserUsecase) CreatePartner(ctx context.Context, u *entities.User, profi
 		cancelFunc()
 		return nil, errors.Wrap(err, "repository error")
 	}
-	err = sendVerfificationMessage(newUser.Mobile, code)
+	err = sms.SendTemplate(ctx, c.SMSSender, newUser.Mobile, sms.TemplateVerification, sms.Data{"Code": code})
 	if err != nil {
 		log.Error(err)
 	}
+	c.sendWelcomeEmail(ctx, newUser)
+	if newUser.Email != "" {
+		_, err = c.startContactChange(ctx, newUser, entities.ContactEmail, newUser.Email)
+		if err != nil {
+			log.Error(err)
+		}
+	}
 	cancelFunc()
 	return newUser, nil
 }
@@ -149,46 +170,60 @@ func (c *UserUsecase) IsPhoneRegistered(ctx context.Context, phone string) (bool
 }
 
 // EmailLogin performs login with Email
-func (c *UserUsecase) EmailLogin(ctx context.Context, email string, password string) (*entities.User, string, error) {
+func (c *UserUsecase) EmailLogin(ctx context.Context, email string, password string) (*entities.User, *entities.TokenPair, error) {
 	ctx, cancelFunc := context.WithTimeout(ctx, 5*time.Second)
+	keys := attemptKeys(ctx, loginAttempts, email)
+	err := c.checkAttempts(ctx, keys)
+	if err != nil {
+		cancelFunc()
+		return nil, nil, err
+	}
 	user, err := c.UserRepository.GetByEmail(ctx, email)
 	if err != nil {
+		c.recordFailedAttempt(ctx, 0, loginAttempts, keys)
 		cancelFunc()
-		return nil, "", errors.New("not registered")
+		return nil, nil, errors.New("not registered")
 	}
 	if !user.Active {
 		cancelFunc()
-		return nil, "", errors.New("Your account has been deactivated please contact us")
+		return nil, nil, errors.New("Your account has been deactivated please contact us")
 	}
 	if !user.IsPartner() {
 		city, err := c.BranchRepository.GetCityByID(ctx, user.CityID)
 		if err != nil {
 			cancelFunc()
-			return nil, "", err
+			return nil, nil, err
 		}
 		user.City = *city
 	}
 	otp, err := c.UserRepository.GetOTPByUser(ctx, user.ID)
 	if err != nil {
 		cancelFunc()
-		return nil, "", errors.Wrap(err, "OTP error")
+		return nil, nil, errors.Wrap(err, "OTP error")
 	}
 	user.SetOTP(otp)
 	err = user.ValidatePassword(password)
 	if err != nil {
+		c.recordFailedAttempt(ctx, user.ID, loginAttempts, keys)
 		cancelFunc()
-		return nil, "", errors.Wrap(err, "Wrong Password")
+		return nil, nil, errors.Wrap(err, "Wrong Password")
 	}
-	token, err := entities.GenerateAuthToken(user.ID)
+	c.clearAttempts(ctx, keys[0])
+	if user.TOTPEnabled {
+		err = c.startLoginChallenge(ctx, user.ID)
+		cancelFunc()
+		return nil, nil, err
+	}
+	tokens, err := c.createSession(ctx, user.ID)
 	if err != nil {
 		cancelFunc()
-		return nil, "", errors.Wrap(err, "error generating auth token")
+		return nil, nil, err
 	}
 	if user.CityID != 0 {
 		city, err := c.BranchRepository.GetCityByID(ctx, user.CityID)
 		if err != nil {
 			cancelFunc()
-			return nil, "", err
+			return nil, nil, err
 		}
 		user.City = *city
 		if user.IsPartner() {
@@ -196,37 +231,55 @@ func (c *UserUsecase) EmailLogin(ctx context.Context, email string, password str
 		}
 	}
 	cancelFunc()
-	return user, token, nil
+	return user, tokens, nil
 }
 
 // PhoneLogin performs login with phone
-func (c *UserUsecase) PhoneLogin(ctx context.Context, phone string, password string) (*entities.User, string, error) {
+func (c *UserUsecase) PhoneLogin(ctx context.Context, phone string, password string) (*entities.User, *entities.TokenPair, error) {
 	ctx, cancelFunc := context.WithTimeout(ctx, 5*time.Second)
+	keys := attemptKeys(ctx, loginAttempts, phone)
+	err := c.checkAttempts(ctx, keys)
+	if err != nil {
+		cancelFunc()
+		return nil, nil, err
+	}
 	user, err := c.UserRepository.GetByPhone(ctx, phone)
 	if err != nil {
+		c.recordFailedAttempt(ctx, 0, loginAttempts, keys)
 		cancelFunc()
-		return nil, "", errors.New("not registered")
+		return nil, nil, errors.New("not registered")
+	}
+	if !user.Active {
+		cancelFunc()
+		return nil, nil, errors.New("Your account has been deactivated please contact us")
 	}
 	if !user.IsPartner() {
 		city, err := c.BranchRepository.GetCityByID(ctx, user.CityID)
 		if err != nil {
 			cancelFunc()
-			return nil, "", err
+			return nil, nil, err
 		}
 		user.City = *city
 	}
 	truePass := user.VerifyPassword(password)
 	if !truePass {
+		c.recordFailedAttempt(ctx, user.ID, loginAttempts, keys)
+		cancelFunc()
+		return nil, nil, errors.New("invalid password")
+	}
+	c.clearAttempts(ctx, keys[0])
+	if user.TOTPEnabled {
+		err = c.startLoginChallenge(ctx, user.ID)
 		cancelFunc()
-		return nil, "", errors.New("invalid password")
+		return nil, nil, err
 	}
-	token, err := entities.GenerateAuthToken(user.ID)
+	tokens, err := c.createSession(ctx, user.ID)
 	if err != nil {
 		cancelFunc()
-		return nil, "", errors.Wrap(err, "error generating auth token")
+		return nil, nil, err
 	}
 	cancelFunc()
-	return user, token, nil
+	return user, tokens, nil
 }
 
 // GetUser retruns the user with the given ID
@@ -275,6 +328,11 @@ func (c *UserUsecase) DeleteUser(ctx context.Context, ID uint) (*entities.User,
 		cancelFunc()
 		return nil, err
 	}
+	err = c.UserRepository.RevokeUserSessions(ctx, user.ID, 0)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
 	if !user.IsPartner() {
 		city, err := c.BranchRepository.GetCityByID(ctx, user.CityID)
 		if err != nil {
@@ -580,7 +638,7 @@ func (c *UserUsecase) AdminRecoverPassword(ctx context.Context, mobile string) e
 		cancelFunc()
 		return errors.Wrap(err, "error saving OTP")
 	}
-	err = sendOTPMessage(user.Mobile, password)
+	err = sms.SendTemplate(ctx, c.SMSSender, user.Mobile, sms.TemplateOTP, sms.Data{"Code": password})
 	if err != nil {
 		cancelFunc()
 		return errors.Wrap(err, "error sending recovery SMS")
@@ -611,7 +669,7 @@ func (c *UserUsecase) RecoverPassword(ctx context.Context, mobile string) error
 		cancelFunc()
 		return errors.Wrap(err, "error saving OTP")
 	}
-	err = sendOTPMessage(user.Mobile, password)
+	err = sms.SendTemplate(ctx, c.SMSSender, user.Mobile, sms.TemplateOTP, sms.Data{"Code": password})
 	if err != nil {
 		cancelFunc()
 		return errors.Wrap(err, "error sending recovery SMS")
@@ -649,7 +707,7 @@ func (c *UserUsecase) ResendVerficationCode(ctx context.Context) error {
 			return errors.Wrap(err, "error updating verification code hash value")
 		}
 	}
-	err = sendVerfificationMessage(user.Mobile, code)
+	err = sms.SendTemplate(ctx, c.SMSSender, user.Mobile, sms.TemplateVerification, sms.Data{"Code": code})
 	if err != nil {
 		cancelFunc()
 		return errors.Wrap(err, "error sending verification SMS")
@@ -662,6 +720,12 @@ func (c *UserUsecase) ResendVerficationCode(ctx context.Context) error {
 func (c *UserUsecase) VerifyUser(ctx context.Context, code string) (*entities.User, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
 	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	keys := attemptKeys(ctx, verificationAttempts, fmt.Sprint(currentUserID))
+	err := c.checkAttempts(ctx, keys)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
 	user, err := c.UserRepository.GetByID(ctx, currentUserID)
 	if err != nil {
 		err := errors.Wrap(err, "error getting current user")
@@ -670,10 +734,11 @@ func (c *UserUsecase) VerifyUser(ctx context.Context, code string) (*entities.Us
 	}
 	trueCode := user.CheckVerificationCode(code)
 	if !trueCode {
-		err := errors.Wrap(err, "validation code doesn't match")
+		c.recordFailedAttempt(ctx, user.ID, verificationAttempts, keys)
 		cancelFunc()
-		return nil, err
+		return nil, errors.New("validation code doesn't match")
 	}
+	c.clearAttempts(ctx, keys[0])
 	user.Verified = true
 	if user.AccountType == "partner" {
 		user, err = c.UserRepository.UpdatePartner(ctx, user, &user.PartnerProfile)
@@ -700,6 +765,141 @@ func (c *UserUsecase) VerifyUser(ctx context.Context, code string) (*entities.Us
 	return user, nil
 }
 
+// RequestEmailVerification sends a code to the current email of the user to verify it
+func (c *UserUsecase) RequestEmailVerification(ctx context.Context) (*entities.ContactChange, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	user, err := c.UserRepository.GetByID(ctx, currentUserID)
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "error getting current user")
+	}
+	if user.EmailVerified {
+		cancelFunc()
+		return nil, errors.New("email is already verified")
+	}
+	change, err := c.startContactChange(ctx, user, entities.ContactEmail, user.Email)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	cancelFunc()
+	return change, nil
+}
+
+// RequestContactChange sends a code to the new email or mobile of the user.
+// The contact details of the user don't change until the code is confirmed.
+func (c *UserUsecase) RequestContactChange(ctx context.Context, kind string, newValue string) (*entities.ContactChange, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	user, err := c.UserRepository.GetByID(ctx, currentUserID)
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "error getting current user")
+	}
+	var registered bool
+	switch kind {
+	case entities.ContactEmail:
+		if newValue == user.Email {
+			cancelFunc()
+			return nil, errors.New("new email is the same as the current email")
+		}
+		registered, err = c.IsEmailRegistered(ctx, newValue)
+	case entities.ContactMobile:
+		if newValue == user.Mobile {
+			cancelFunc()
+			return nil, errors.New("new mobile is the same as the current mobile")
+		}
+		registered, err = c.IsPhoneRegistered(ctx, newValue)
+	default:
+		cancelFunc()
+		return nil, errors.New("unknown contact kind")
+	}
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	if registered {
+		cancelFunc()
+		return nil, errors.Errorf("%s is already registered", kind)
+	}
+	change, err := c.startContactChange(ctx, user, kind, newValue)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	cancelFunc()
+	return change, nil
+}
+
+// ConfirmContactChange confirms the latest pending change of the given kind of contact with the code sent to it.
+// The old email or mobile is notified once it gets replaced.
+func (c *UserUsecase) ConfirmContactChange(ctx context.Context, kind string, code string) (*entities.User, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	keys := attemptKeys(ctx, verificationAttempts, fmt.Sprint(currentUserID))
+	err := c.checkAttempts(ctx, keys)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	user, err := c.UserRepository.GetByID(ctx, currentUserID)
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "error getting current user")
+	}
+	change, err := c.UserRepository.GetPendingContactChange(ctx, user.ID, kind)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	err = change.Confirm(user, code)
+	if err != nil {
+		if !change.Expired() {
+			c.recordFailedAttempt(ctx, user.ID, verificationAttempts, keys)
+		}
+		cancelFunc()
+		return nil, err
+	}
+	c.clearAttempts(ctx, keys[0])
+	user, err = c.saveUser(ctx, user)
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "error saving contact change")
+	}
+	_, err = c.UserRepository.UpdateContactChange(ctx, change)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	entry := &entities.AuditEntry{
+		UserID:    user.ID,
+		ActorID:   user.ID,
+		IPAddress: clientInfoFromContext(ctx).IPAddress,
+	}
+	switch {
+	case change.IsVerification():
+		entry.Action = entities.AuditEmailVerified
+	case change.Kind == entities.ContactEmail:
+		entry.Action = entities.AuditEmailChanged
+		entry.Detail = fmt.Sprintf("%s -> %s", change.OldValue, change.NewValue)
+		err = mailer.SendTemplate(ctx, c.Mailer, mailer.Address{Name: user.GetFullName(), Email: change.OldValue}, mailer.TemplateEmailChanged, mailer.Data{
+			"Name":     user.FirstName,
+			"NewEmail": change.NewValue,
+		})
+	case change.Kind == entities.ContactMobile:
+		entry.Action = entities.AuditMobileChanged
+		entry.Detail = fmt.Sprintf("%s -> %s", change.OldValue, change.NewValue)
+		err = sms.SendTemplate(ctx, c.SMSSender, change.OldValue, sms.TemplateMobileChanged, sms.Data{"Mobile": change.NewValue})
+	}
+	if err != nil {
+		log.Error(errors.Wrap(err, "error notifying the old contact"))
+	}
+	c.audit(ctx, entry)
+	cancelFunc()
+	return user, nil
+}
+
 // UpdatePartnerProfile updates the partner profile associated with a user provided in the ctx
 func (c *UserUsecase) UpdatePartnerProfile(ctx context.Context, profile *entities.PartnerProfile) (*entities.User, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
@@ -757,14 +957,9 @@ func (c *UserUsecase) UpdatePartnerProfile(ctx context.Context, profile *entitie
 
 func (c *UserUsecase) ToggleIsSharable(ctx context.Context, partnerID uint) error {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := c.UserRepository.GetByID(ctx, currentUserID)
+	_, err := c.Authorize(ctx, entities.PermissionManagePartners)
 	if err != nil {
-		cancelFunc()
-		return errors.Wrap(err, "error getting current user")
-	}
-	if !currentUser.IsAdmin() {
-		err := errors.New("not authorized to set is sharable")
+		log.Error(err)
 		cancelFunc()
 		return err
 	}
@@ -816,18 +1011,21 @@ func (c *UserUsecase) UpdatePassword(ctx context.Context, newPassword string) (*
 			return nil, err
 		}
 	}
+	currentSessionID, _ := ctx.Value(entities.SessionIDKey).(uint)
+	err = c.UserRepository.RevokeUserSessions(ctx, user.ID, currentSessionID)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
 	cancelFunc()
 	return updatedUser, nil
 }
 
 func generateOTP(userID uint) (*entities.OTP, string, error) {
-	letters := []rune("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-	b := make([]rune, 8)
-	rand.Seed(time.Now().UnixNano())
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+	pass, err := randomString("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ", 8)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error generating random string")
 	}
-	pass := string(b)
 	hpass, err := entities.EncryptPassword(pass)
 	if err != nil {
 		return nil, "", errors.Wrap(err, "error generating hash string")
@@ -842,13 +1040,10 @@ func generateOTP(userID uint) (*entities.OTP, string, error) {
 }
 
 func generateVerficationCode() ([]byte, string, error) {
-	letters := []rune("0123456789")
-	b := make([]rune, 4)
-	rand.Seed(time.Now().UnixNano())
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+	pass, err := randomString("0123456789", 4)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error generating random string")
 	}
-	pass := string(b)
 	hpass, err := entities.EncryptPassword(pass)
 	if err != nil {
 		return nil, "", errors.Wrap(err, "error generating hash string")
@@ -856,117 +1051,116 @@ func generateVerficationCode() ([]byte, string, error) {
 	return hpass, pass, nil
 }
 
-func sendOTPMessage(mobile string, otp string) error {
-	accountSid := os.Getenv("TWILLIO_SID")
-	authToken := os.Getenv("TWILLIO_AUTH_TOKEN")
-	twillioNumber := os.Getenv("TWILLIO_NUMBER")
-	urlStr := "https://api.twilio.com/2010-04-01/Accounts/" + accountSid + "/Messages.json"
-	msgData := url.Values{}
-	msgData.Set("To", mobile)
-	msgData.Set("From", twillioNumber)
-	msgData.Set("Body", fmt.Sprintf("Use this password to login to your account\n TASARRUF hesabınıza giriş yapmak için bu şifreyi kullanabilirsiniz\n %s", otp))
-	msgDataReader := *strings.NewReader(msgData.Encode())
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", urlStr, &msgDataReader)
-	req.SetBasicAuth(accountSid, authToken)
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := client.Do(req)
-	if err != nil {
-		return errors.Wrap(err, "error making request to twilio API")
-	}
-	switch resp.StatusCode {
-	case 201:
-		return nil
-	default:
-		return errors.New(resp.Status)
-	}
-}
-
-func sendVerfificationMessage(mobile string, code string) error {
-	log.Info("OPT : ", code)
-	accountSid := os.Getenv("TWILLIO_SID")
-	authToken := os.Getenv("TWILLIO_AUTH_TOKEN")
-	twillioNumber := os.Getenv("TWILLIO_NUMBER")
-	urlStr := "https://api.twilio.com/2010-04-01/Accounts/" + accountSid + "/Messages.json"
-	msgData := url.Values{}
-	msgData.Set("To", mobile)
-	msgData.Set("From", twillioNumber)
-	msgData.Set("Body", fmt.Sprintf("Your Tasarruf verification code : %s. \n TASARRUF üyelik doğrulama kodunuz: %s.\n", code, code))
-	msgDataReader := *strings.NewReader(msgData.Encode())
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", urlStr, &msgDataReader)
-	req.SetBasicAuth(accountSid, authToken)
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	log.Info(req.URL)
-	resp, err := client.Do(req)
-	if err != nil {
-		return errors.Wrap(err, "error making request to twilio API")
-	}
-	log.Info(resp)
-	switch resp.StatusCode {
-	case 201:
-		return nil
-	default:
-		b, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
+// startContactChange saves a pending change of the contact of the user and sends its code to the new value
+func (c *UserUsecase) startContactChange(ctx context.Context, user *entities.User, kind string, newValue string) (*entities.ContactChange, error) {
+	code, err := randomString("0123456789", 6)
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating verification code")
+	}
+	hashedCode, err := entities.EncryptPassword(code)
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating verification code hash")
+	}
+	change, err := entities.NewContactChange(user, kind, newValue, hashedCode)
+	if err != nil {
+		return nil, err
+	}
+	change, err = c.UserRepository.CreateContactChange(ctx, change)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case entities.ContactEmail:
+		err = mailer.SendTemplate(ctx, c.Mailer, mailer.Address{Name: user.GetFullName(), Email: newValue}, mailer.TemplateVerification, mailer.Data{
+			"Name": user.FirstName,
+			"Code": code,
+		})
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "fetch : reading %s : %v\n", resp.Status, err)
-			os.Exit(1)
+			return nil, errors.Wrap(err, "error sending verification email")
 		}
-		fmt.Printf("%s", b)
-		return errors.New(resp.Status)
-	}
-}
-
-func sendYouGotVerifiedMessage(mobile string) error {
-	accountSid := os.Getenv("TWILLIO_SID")
-	authToken := os.Getenv("TWILLIO_AUTH_TOKEN")
-	twillioNumber := os.Getenv("TWILLIO_NUMBER")
-	urlStr := "https://api.twilio.com/2010-04-01/Accounts/" + accountSid + "/Messages.json"
-	msgData := url.Values{}
-	msgData.Set("To", mobile)
-	msgData.Set("From", twillioNumber)
-	msgData.Set("Body", fmt.Sprintf("Your tasarruf account got verified.\n TASARRUF hesabınız doğrulandı.\n"))
-	msgDataReader := *strings.NewReader(msgData.Encode())
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", urlStr, &msgDataReader)
-	req.SetBasicAuth(accountSid, authToken)
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	log.Info(req.URL)
-	resp, err := client.Do(req)
-	if err != nil {
-		return errors.Wrap(err, "error making request to twilio API")
-	}
-	log.Info(resp)
-	switch resp.StatusCode {
-	case 201:
-		return nil
-	default:
-		b, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
+	case entities.ContactMobile:
+		err = sms.SendTemplate(ctx, c.SMSSender, newValue, sms.TemplateVerification, sms.Data{"Code": code})
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "fetch : reading %s : %v\n", resp.Status, err)
-			os.Exit(1)
+			return nil, errors.Wrap(err, "error sending verification SMS")
 		}
-		fmt.Printf("%s", b)
-		return errors.New(resp.Status)
 	}
+	return change, nil
+}
+
+// saveUser saves the changes of the given user whatever its account type is
+func (c *UserUsecase) saveUser(ctx context.Context, user *entities.User) (*entities.User, error) {
+	if user.IsPartner() {
+		return c.UserRepository.UpdatePartner(ctx, user, &user.PartnerProfile)
+	}
+	return c.UserRepository.UpdateCustomer(ctx, user)
+}
+
+// sendWelcomeEmail emails a welcome message to a newly registered user
+func (c *UserUsecase) sendWelcomeEmail(ctx context.Context, u *entities.User) {
+	if u.Email == "" {
+		return
+	}
+	err := mailer.SendTemplate(ctx, c.Mailer, mailer.Address{Name: u.GetFullName(), Email: u.Email}, mailer.TemplateWelcome, mailer.Data{
+		"Name": u.FirstName,
+	})
+	if err != nil {
+		log.Error(errors.Wrap(err, "error sending welcome email"))
+	}
+}
 
+// randomString returns a string of the given length made of letters picked uniformly with crypto/rand
+func randomString(letters string, length int) (string, error) {
+	max := big.NewInt(int64(len(letters)))
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = letters[n.Int64()]
+	}
+	return string(b), nil
 }
 
-// ValidateCustomerPartnerIntegrity validates the partner customer integrity
-func (c *UserUsecase) ValidateCustomerPartnerIntegrity(ctx context.Context, customerID uint, partnerID uint) (*entities.User, *entities.Subscription, error) {
+// ValidateCustomerPartnerIntegrity validates the partner customer integrity.
+// The customer is identified by their redemption token, which is checked without being used.
+func (c *UserUsecase) ValidateCustomerPartnerIntegrity(ctx context.Context, redemptionToken string, partnerID uint) (*entities.User, *entities.Subscription, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
 	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	if currentUserID != partnerID {
+	currentUser, err := c.UserRepository.GetByID(ctx, currentUserID)
+	if err != nil {
+		cancelFunc()
+		return nil, nil, errors.Wrap(err, "error getting current user")
+	}
+	if scanningPartnerID := currentUser.ScanningPartnerID(); scanningPartnerID == 0 || scanningPartnerID != partnerID {
 		err := errors.New("current user ID doesn't match with the given partner ID")
 		cancelFunc()
 		log.Error(err)
 		return nil, nil, err
 	}
+	secret, err := entities.RedemptionSecret()
+	if err != nil {
+		cancelFunc()
+		log.Error(err)
+		return nil, nil, err
+	}
+	claims, err := entities.ParseRedemptionToken(redemptionToken, secret, time.Now())
+	if err != nil {
+		cancelFunc()
+		log.Error(err)
+		return nil, nil, err
+	}
+	used, err := c.OfferRepo.IsRedemptionTokenUsed(ctx, claims.Nonce)
+	if err != nil {
+		cancelFunc()
+		log.Error(err)
+		return nil, nil, err
+	}
+	if used {
+		cancelFunc()
+		return nil, nil, entities.ErrRedemptionTokenUsed
+	}
+	customerID := claims.CustomerID
 	user, err := c.GetCustomerByID(ctx, customerID)
 	if err != nil {
 		err := errors.Wrap(err, "error getting customer")
@@ -993,18 +1187,14 @@ func (c *UserUsecase) ValidateCustomerPartnerIntegrity(ctx context.Context, cust
 		log.Error(err)
 		return nil, nil, err
 	}
-	partner, err := c.getPartnerByID(ctx, partnerID)
-	if err != nil {
-		return nil, nil, err
-	}
-	remainingOffers, err := c.SubscriptionRepository.GetCountOfOffersWithPartner(ctx, partner, subscription)
+	remainingOffers, err := c.SubscriptionRepository.GetRemainingOffersWithPartner(ctx, subscription, partnerID)
 	if err != nil {
-		err := errors.New("subscription has expired, please renew or upgrade the subscription")
+		err := errors.Wrap(err, "error getting remaining offers")
 		cancelFunc()
 		log.Error(err)
 		return nil, nil, err
 	}
-	subscription.RemainingOffers = remainingOffers.CountOfOffers
+	subscription.RemainingOffers = remainingOffers
 	plan, err := c.SubscriptionRepository.GetPlanByID(ctx, subscription.PlanID)
 	if err != nil {
 		err := errors.Wrap(err, "error getting plan")
@@ -1053,14 +1243,9 @@ func (c *UserUsecase) UpdateUser(ctx context.Context, user *entities.User) (*ent
 // GetCustomersCount returns the count of customer users
 func (c *UserUsecase) GetCustomersCount(ctx context.Context) (int, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := c.UserRepository.GetByID(ctx, currentUserID)
+	_, err := c.Authorize(ctx, entities.PermissionViewUsers)
 	if err != nil {
-		cancelFunc()
-		return 0, errors.Wrap(err, "error getting user")
-	}
-	if !currentUser.IsAdmin() {
-		err := errors.New("only admins are authorized to perform this task")
+		log.Error(err)
 		cancelFunc()
 		return 0, err
 	}
@@ -1076,14 +1261,9 @@ func (c *UserUsecase) GetCustomersCount(ctx context.Context) (int, error) {
 // GetPartnersCount returns the count of customer users
 func (c *UserUsecase) GetPartnersCount(ctx context.Context) (int, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := c.UserRepository.GetByID(ctx, currentUserID)
+	_, err := c.Authorize(ctx, entities.PermissionViewUsers)
 	if err != nil {
-		cancelFunc()
-		return 0, errors.Wrap(err, "error getting user")
-	}
-	if !currentUser.IsAdmin() {
-		err := errors.New("only admins are authorized to perform this task")
+		log.Error(err)
 		cancelFunc()
 		return 0, err
 	}
@@ -1099,14 +1279,9 @@ func (c *UserUsecase) GetPartnersCount(ctx context.Context) (int, error) {
 // GetAllCustomers returns all customer users
 func (c *UserUsecase) GetAllCustomers(ctx context.Context) ([]entities.User, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := c.UserRepository.GetByID(ctx, currentUserID)
+	_, err := c.Authorize(ctx, entities.PermissionViewUsers)
 	if err != nil {
-		cancelFunc()
-		return nil, errors.Wrap(err, "error getting user")
-	}
-	if !currentUser.IsAdmin() {
-		err := errors.New("only admins are authorized to perform this task")
+		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
@@ -1122,14 +1297,9 @@ func (c *UserUsecase) GetAllCustomers(ctx context.Context) ([]entities.User, err
 // GetAllParnters returns all the partner users
 func (c *UserUsecase) GetAllParnters(ctx context.Context) ([]entities.Partner, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := c.UserRepository.GetByID(ctx, currentUserID)
+	_, err := c.Authorize(ctx, entities.PermissionViewUsers)
 	if err != nil {
-		cancelFunc()
-		return nil, errors.Wrap(err, "error getting user")
-	}
-	if !currentUser.IsAdmin() {
-		err := errors.New("only admins are authorized to perform this task")
+		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
@@ -1154,14 +1324,9 @@ func (c *UserUsecase) GetAllParnters(ctx context.Context) ([]entities.Partner, e
 // GetNotApprovedPartners returns a list of all not approved partner users
 func (c *UserUsecase) GetNotApprovedPartners(ctx context.Context) ([]entities.User, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := c.UserRepository.GetByID(ctx, currentUserID)
+	_, err := c.Authorize(ctx, entities.PermissionViewUsers)
 	if err != nil {
-		cancelFunc()
-		return nil, errors.Wrap(err, "error getting user")
-	}
-	if !currentUser.IsAdmin() {
-		err := errors.New("only admins are authorized to perform this task")
+		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
@@ -1185,14 +1350,9 @@ func (c *UserUsecase) GetNotApprovedPartners(ctx context.Context) ([]entities.Us
 // ApprovePartner sets the partner as approved
 func (c *UserUsecase) ApprovePartner(ctx context.Context, partnerID uint) (*entities.User, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := c.UserRepository.GetByID(ctx, currentUserID)
+	_, err := c.Authorize(ctx, entities.PermissionManagePartners)
 	if err != nil {
-		cancelFunc()
-		return nil, errors.Wrap(err, "error getting user")
-	}
-	if !currentUser.IsAdmin() {
-		err := errors.New("only admins are authorized to perform this task")
+		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
@@ -1209,7 +1369,7 @@ func (c *UserUsecase) ApprovePartner(ctx context.Context, partnerID uint) (*enti
 	}
 	SEND_APPROVAL_MSG_FEATUE := false
 	if SEND_APPROVAL_MSG_FEATUE {
-		err = sendYouGotVerifiedMessage(partner.Mobile)
+		err = sms.SendTemplate(ctx, c.SMSSender, partner.Mobile, sms.TemplateVerified, nil)
 		if err != nil {
 			log.Error(err)
 		}
@@ -1222,14 +1382,9 @@ func (c *UserUsecase) ApprovePartner(ctx context.Context, partnerID uint) (*enti
 // SetPartnerAsExclusive sets the partner with the given ID as exclusive
 func (c *UserUsecase) SetPartnerAsExclusive(ctx context.Context, partnerID uint) (*entities.Partner, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := c.UserRepository.GetByID(ctx, currentUserID)
+	_, err := c.Authorize(ctx, entities.PermissionManagePartners)
 	if err != nil {
-		cancelFunc()
-		return nil, errors.Wrap(err, "error getting user")
-	}
-	if !currentUser.IsAdmin() {
-		err := errors.New("only admins are authorized to perform this task")
+		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
@@ -1254,14 +1409,9 @@ func (c *UserUsecase) SetPartnerAsExclusive(ctx context.Context, partnerID uint)
 // RemovePartnerAsExclusive removes the partner with the given ID from exclusive group
 func (c *UserUsecase) RemovePartnerAsExclusive(ctx context.Context, partnerID uint) (*entities.Partner, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	currentUser, err := c.UserRepository.GetByID(ctx, currentUserID)
+	_, err := c.Authorize(ctx, entities.PermissionManagePartners)
 	if err != nil {
-		cancelFunc()
-		return nil, errors.Wrap(err, "error getting user")
-	}
-	if !currentUser.IsAdmin() {
-		err := errors.New("only admins are authorized to perform this task")
+		log.Error(err)
 		cancelFunc()
 		return nil, err
 	}
@@ -1294,27 +1444,31 @@ func (c *UserUsecase) RemovePartnerAsExclusive(ctx context.Context, partnerID ui
 
 func (c *UserUsecase) AdminDeleteUser(ctx context.Context, userID uint) (*entities.User, error) {
 	ctx, cancelFunc := context.WithTimeout(ctx, 5*time.Second)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
 	toDeleteUser, err := c.UserRepository.GetByID(ctx, userID)
 	if err != nil {
 		cancelFunc()
 		return nil, errors.Wrap(err, "repository error while deleting user")
 	}
-	currentUser, err := c.UserRepository.GetByID(ctx, currentUserID)
+	currentUser, err := c.Authorize(ctx, entities.PermissionManageUsers)
 	if err != nil {
+		log.Error(err)
 		cancelFunc()
-		return nil, errors.Wrap(err, "repository error while deleting user")
+		return nil, err
 	}
-	if !currentUser.IsAdmin() {
-		err = errors.New("not authorized to delete user")
+	if toDeleteUser.GetRole().IsStaff() && !currentUser.Can(entities.PermissionManageRoles) {
 		cancelFunc()
-		return nil, errors.Wrap(err, "repository error while deleting user")
+		return nil, errors.Wrap(entities.ErrForbidden, "only super admins can delete staff accounts")
 	}
 	deletedUser, err := c.UserRepository.Delete(ctx, toDeleteUser)
 	if err != nil {
 		cancelFunc()
 		return nil, err
 	}
+	err = c.UserRepository.RevokeUserSessions(ctx, deletedUser.ID, 0)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
 	if !deletedUser.IsPartner() {
 		city, err := c.BranchRepository.GetCityByID(ctx, deletedUser.CityID)
 		if err != nil {
@@ -1396,16 +1550,6 @@ func (c *UserUsecase) Share(ctx context.Context) error {
 		cancelFunc()
 		return err
 	}
-	for _, sharable := range sharables {
-		partner, err := c.GetPartnerByID(ctx, sharable.ID)
-		if err != nil {
-			log.Error(err)
-		}
-		_, err = c.SubscriptionRepository.GetCountOfOffersWithPartner(ctx, partner, sub)
-		if err != nil {
-			log.Error(err)
-		}
-	}
 	share := entities.Share{
 		CustomerID: currentUser.ID,
 	}
@@ -1418,19 +1562,15 @@ func (c *UserUsecase) Share(ctx context.Context) error {
 		cancelFunc()
 		return errors.Wrap(err, "error creating share database record")
 	}
+	// Give a bonus offer with every sharable partner
+	var bonuses []entities.OfferLedgerEntry
 	for _, sharable := range sharables {
-		partner, err := c.GetPartnerByID(ctx, sharable.ID)
-		if err != nil {
-			log.Error(err)
-		}
-		currentRemainingOffers, err := c.SubscriptionRepository.GetCountOfOffersWithPartner(ctx, partner, sub)
-		if err != nil {
-			log.Error(err)
-		}
-		err = c.SubscriptionRepository.SetCountOfOffersWithPartner(ctx, partner, sub, currentRemainingOffers.CountOfOffers+1)
-		if err != nil {
-			log.Error(err)
-		}
+		bonuses = append(bonuses, *entities.NewShareBonus(sub, sharable.ID, &share))
+	}
+	err = c.SubscriptionRepository.CreateLedgerEntries(ctx, bonuses)
+	if err != nil {
+		cancelFunc()
+		return errors.Wrap(err, "error giving share bonus offers")
 	}
 	cancelFunc()
 	return nil
@@ -1469,18 +1609,21 @@ func (c *UserUsecase) SearchUsers(ctx context.Context, searchTerm string) ([]ent
 // ToggleActiveProperty toggles the active property of a user.
 func (c *UserUsecase) ToggleActiveProperty(ctx context.Context, userID uint) (entities.IUser, error) {
 	ctx, cancelFunc := context.WithCancel(ctx)
-	currentUserID := ctx.Value(entities.UserIDKey).(uint)
-	log.Info(currentUserID, userID)
-	currentUser, err := c.UserRepository.GetByID(ctx, currentUserID)
+	currentUser, err := c.Authorize(ctx, entities.PermissionManageUsers)
 	if err != nil {
+		log.Error(err)
 		cancelFunc()
-		return nil, errors.Wrap(err, "error getting user")
+		return nil, err
 	}
 	user, err := c.UserRepository.GetByID(ctx, userID)
 	if err != nil {
 		cancelFunc()
 		return nil, errors.Wrap(err, "error getting user")
 	}
+	if user.GetRole().IsStaff() && !currentUser.Can(entities.PermissionManageRoles) {
+		cancelFunc()
+		return nil, errors.Wrap(entities.ErrForbidden, "only super admins can activate or deactivate staff accounts")
+	}
 	err = user.ToggleActive(currentUser)
 	if err != nil {
 		cancelFunc()
@@ -1491,6 +1634,13 @@ func (c *UserUsecase) ToggleActiveProperty(ctx context.Context, userID uint) (en
 		cancelFunc()
 		return nil, errors.Wrap(err, "error updating user")
 	}
+	if !user.Active {
+		err = c.UserRepository.RevokeUserSessions(ctx, user.ID, 0)
+		if err != nil {
+			cancelFunc()
+			return nil, err
+		}
+	}
 	cancelFunc()
 	return user, nil
 }
@@ -1578,3 +1728,1079 @@ func (c *UserUsecase) getPartnerByID(ctx context.Context, ID uint) (*entities.Pa
 	}
 	return partner, nil
 }
+
+// IssueTokens starts a new session for the given user and returns its tokens
+func (c *UserUsecase) IssueTokens(ctx context.Context, userID uint) (*entities.TokenPair, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	tokens, err := c.createSession(ctx, userID)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	cancelFunc()
+	return tokens, nil
+}
+
+// Authenticate validates the given access token and makes sure the session it was issued for is still active
+func (c *UserUsecase) Authenticate(ctx context.Context, token string) (*entities.Claims, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	claims, err := entities.ParseAuthToken(token)
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "invalid token")
+	}
+	session, err := c.UserRepository.GetSessionByID(ctx, claims.SessionID)
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "invalid session")
+	}
+	if session.UserID != claims.ID || !session.IsActive() {
+		cancelFunc()
+		return nil, errors.New("session has been revoked or expired")
+	}
+	if session.NeedsTouch() {
+		session.SetClientInfo(clientInfoFromContext(ctx))
+		_, err = c.UserRepository.UpdateSession(ctx, session)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	cancelFunc()
+	return claims, nil
+}
+
+// RefreshToken exchanges a refresh token for a new pair of tokens.
+// The refresh token is rotated on every call. Presenting an already rotated token, or the same token twice at once,
+// revokes the whole session.
+func (c *UserUsecase) RefreshToken(ctx context.Context, refreshToken string) (*entities.TokenPair, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	hash := entities.HashRefreshToken(refreshToken)
+	session, err := c.UserRepository.GetSessionByRefreshTokenHash(ctx, hash)
+	if err != nil {
+		reused, rerr := c.UserRepository.GetSessionByPreviousRefreshTokenHash(ctx, hash)
+		if rerr == nil && !reused.IsRevoked() {
+			log.Warnf("refresh token reuse detected for session %d, revoking it", reused.ID)
+			reused.Revoke()
+			_, rerr = c.UserRepository.UpdateSession(ctx, reused)
+			if rerr != nil {
+				log.Error(rerr)
+			}
+		}
+		cancelFunc()
+		return nil, errors.Wrap(err, "invalid refresh token")
+	}
+	if !session.IsActive() {
+		cancelFunc()
+		return nil, errors.New("session has been revoked or expired")
+	}
+	user, err := c.UserRepository.GetByID(ctx, session.UserID)
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "error getting user")
+	}
+	if !user.Active {
+		cancelFunc()
+		return nil, errors.New("Your account has been deactivated please contact us")
+	}
+	newRefreshToken, err := entities.GenerateRefreshToken()
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "error generating refresh token")
+	}
+	session.PreviousRefreshTokenHash = hash
+	session.RefreshTokenHash = entities.HashRefreshToken(newRefreshToken)
+	session.ExpiresAt = time.Now().Add(entities.RefreshTokenLifetime)
+	session.SetClientInfo(clientInfoFromContext(ctx))
+	rotated, err := c.UserRepository.RotateSession(ctx, session, hash)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	if !rotated {
+		// A concurrent refresh used the same token, which is reused the same as a rotated one
+		log.Warnf("refresh token reuse detected for session %d, revoking it", session.ID)
+		reused, err := c.UserRepository.GetSessionByID(ctx, session.ID)
+		if err == nil && !reused.IsRevoked() {
+			reused.Revoke()
+			_, err = c.UserRepository.UpdateSession(ctx, reused)
+		}
+		if err != nil {
+			log.Error(err)
+		}
+		cancelFunc()
+		return nil, errors.New("invalid refresh token")
+	}
+	accessToken, err := entities.GenerateAuthToken(user.ID, session.ID)
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "error generating auth token")
+	}
+	cancelFunc()
+	return &entities.TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: newRefreshToken,
+	}, nil
+}
+
+// Logout revokes the session of the current request
+func (c *UserUsecase) Logout(ctx context.Context) error {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	sessionID := ctx.Value(entities.SessionIDKey).(uint)
+	session, err := c.UserRepository.GetSessionByID(ctx, sessionID)
+	if err != nil {
+		cancelFunc()
+		return errors.Wrap(err, "error getting session")
+	}
+	if session.UserID != currentUserID {
+		cancelFunc()
+		return errors.New("session does not belong to the current user")
+	}
+	session.Revoke()
+	_, err = c.UserRepository.UpdateSession(ctx, session)
+	if err != nil {
+		cancelFunc()
+		return err
+	}
+	cancelFunc()
+	return nil
+}
+
+// GetSessions returns the active sessions of the given user.
+// Users can list their own sessions and staff allowed to view users can list the sessions of any user.
+func (c *UserUsecase) GetSessions(ctx context.Context, userID uint) ([]entities.Session, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	err := c.authorizeSessionAccess(ctx, userID, entities.PermissionViewUsers)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	sessions, err := c.UserRepository.GetActiveSessionsByUser(ctx, userID)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	currentSessionID, _ := ctx.Value(entities.SessionIDKey).(uint)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSessionID
+	}
+	cancelFunc()
+	return sessions, nil
+}
+
+// RevokeSession revokes a single session of the given user
+func (c *UserUsecase) RevokeSession(ctx context.Context, userID uint, sessionID uint) error {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	err := c.authorizeSessionAccess(ctx, userID, entities.PermissionManageUsers)
+	if err != nil {
+		cancelFunc()
+		return err
+	}
+	session, err := c.UserRepository.GetSessionByID(ctx, sessionID)
+	if err != nil {
+		cancelFunc()
+		return errors.Wrap(err, "error getting session")
+	}
+	if session.UserID != userID {
+		cancelFunc()
+		return errors.New("session not found")
+	}
+	session.Revoke()
+	_, err = c.UserRepository.UpdateSession(ctx, session)
+	if err != nil {
+		cancelFunc()
+		return err
+	}
+	cancelFunc()
+	return nil
+}
+
+// RevokeAllSessions revokes every session of the given user, logging them out of all devices
+func (c *UserUsecase) RevokeAllSessions(ctx context.Context, userID uint) error {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	err := c.authorizeSessionAccess(ctx, userID, entities.PermissionManageUsers)
+	if err != nil {
+		cancelFunc()
+		return err
+	}
+	err = c.UserRepository.RevokeUserSessions(ctx, userID, 0)
+	if err != nil {
+		cancelFunc()
+		return err
+	}
+	cancelFunc()
+	return nil
+}
+
+// Authorize returns the current user if their role grants the given permission
+func (c *UserUsecase) Authorize(ctx context.Context, permission entities.Permission) (*entities.User, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUser, err := user.Authorize(ctx, c.UserRepository, permission)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	cancelFunc()
+	return currentUser, nil
+}
+
+// SetUserRole changes the role of the user with the given ID
+func (c *UserUsecase) SetUserRole(ctx context.Context, userID uint, role entities.Role) (*entities.User, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUser, err := c.Authorize(ctx, entities.PermissionManageRoles)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	toUpdateUser, err := c.UserRepository.GetByID(ctx, userID)
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "error getting user")
+	}
+	err = toUpdateUser.SetRole(role, currentUser)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	toUpdateUser, err = c.UserRepository.UpdateCustomer(ctx, toUpdateUser)
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "error updating user")
+	}
+	cancelFunc()
+	return toUpdateUser, nil
+}
+
+func (c *UserUsecase) authorizeSessionAccess(ctx context.Context, userID uint, permission entities.Permission) error {
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	if currentUserID == userID {
+		return nil
+	}
+	_, err := user.Authorize(ctx, c.UserRepository, permission)
+	return err
+}
+
+// UnlockUser clears the failed login and verification attempts of the given user
+func (c *UserUsecase) UnlockUser(ctx context.Context, userID uint) error {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUser, err := c.Authorize(ctx, entities.PermissionManageUsers)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return err
+	}
+	user, err := c.UserRepository.GetByID(ctx, userID)
+	if err != nil {
+		cancelFunc()
+		return errors.Wrap(err, "error getting user")
+	}
+	keys := []string{
+		entities.AccountAttemptKey(loginAttempts.name, user.Email),
+		entities.AccountAttemptKey(loginAttempts.name, user.Mobile),
+		entities.AccountAttemptKey(verificationAttempts.name, fmt.Sprint(user.ID)),
+		entities.AccountAttemptKey(twoFactorAttempts.name, fmt.Sprint(user.ID)),
+	}
+	err = c.UserRepository.DeleteLoginAttempts(ctx, keys)
+	if err != nil {
+		cancelFunc()
+		return err
+	}
+	c.audit(ctx, &entities.AuditEntry{
+		Action:  entities.AuditUnlocked,
+		UserID:  user.ID,
+		ActorID: currentUser.ID,
+	})
+	cancelFunc()
+	return nil
+}
+
+// GetAuditEntries returns the audit entries of the given user
+func (c *UserUsecase) GetAuditEntries(ctx context.Context, userID uint) ([]entities.AuditEntry, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	_, err := c.Authorize(ctx, entities.PermissionViewUsers)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	entries, err := c.UserRepository.GetAuditEntriesByUser(ctx, userID)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	cancelFunc()
+	return entries, nil
+}
+
+// attemptAction describes an action protected against brute force
+type attemptAction struct {
+	name   string
+	policy entities.AttemptPolicy
+	failed string
+	locked string
+}
+
+var loginAttempts = attemptAction{
+	name:   "login",
+	policy: entities.LoginAttemptPolicy,
+	failed: entities.AuditLoginFailed,
+	locked: entities.AuditLoginLocked,
+}
+
+var verificationAttempts = attemptAction{
+	name:   "verification",
+	policy: entities.VerificationAttemptPolicy,
+	failed: entities.AuditVerificationFailed,
+	locked: entities.AuditVerificationLocked,
+}
+
+var twoFactorAttempts = attemptAction{
+	name:   "2fa",
+	policy: entities.VerificationAttemptPolicy,
+	failed: entities.AuditTwoFactorFailed,
+	locked: entities.AuditTwoFactorLocked,
+}
+
+type attemptKey struct {
+	key    string
+	policy entities.AttemptPolicy
+	// locked is set once the attempt reserved against the key locked it
+	locked bool
+}
+
+// attemptKeys returns the keys failed attempts of the given account are counted against.
+// The account key always comes first.
+func attemptKeys(ctx context.Context, action attemptAction, account string) []attemptKey {
+	keys := []attemptKey{{key: entities.AccountAttemptKey(action.name, account), policy: action.policy}}
+	info := clientInfoFromContext(ctx)
+	if info.IPAddress != "" {
+		keys = append(keys, attemptKey{key: entities.ClientAttemptKey(action.name, info.IPAddress), policy: entities.ClientAttemptPolicy})
+	}
+	return keys
+}
+
+// checkAttempts returns a TooManyAttemptsError if any of the given keys is throttled or locked.
+// The attempt is counted against the account key before it's made, so concurrent attempts can't all pass the check
+// before any of them fails. A successful attempt clears the account key again.
+func (c *UserUsecase) checkAttempts(ctx context.Context, keys []attemptKey) error {
+	now := time.Now()
+	for _, k := range keys[1:] {
+		attempt, err := c.UserRepository.GetLoginAttempt(ctx, k.key)
+		if err != nil {
+			return err
+		}
+		retryAfter := attempt.RetryAfter(k.policy, now)
+		if retryAfter > 0 {
+			return &entities.TooManyAttemptsError{RetryAfter: retryAfter}
+		}
+	}
+	locked, err := c.UserRepository.ReserveLoginAttempt(ctx, keys[0].key, keys[0].policy)
+	if err != nil {
+		return err
+	}
+	keys[0].locked = locked
+	return nil
+}
+
+// recordFailedAttempt counts a failure against the client keys and audits it, the account key already counted it in checkAttempts.
+// Errors are only logged so that they don't hide the reason the attempt failed.
+func (c *UserUsecase) recordFailedAttempt(ctx context.Context, userID uint, action attemptAction, keys []attemptKey) {
+	ip := clientInfoFromContext(ctx).IPAddress
+	for i, k := range keys {
+		locked := k.locked
+		if i > 0 {
+			var err error
+			locked, err = c.UserRepository.RecordLoginFailure(ctx, k.key, k.policy)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+		}
+		if locked {
+			c.audit(ctx, &entities.AuditEntry{
+				Action:    action.locked,
+				UserID:    userID,
+				IPAddress: ip,
+				Detail:    k.key,
+			})
+		}
+	}
+	c.audit(ctx, &entities.AuditEntry{
+		Action:    action.failed,
+		UserID:    userID,
+		IPAddress: ip,
+		Detail:    keys[0].key,
+	})
+}
+
+// clearAttempts resets the failed attempts of the given key after a successful attempt
+func (c *UserUsecase) clearAttempts(ctx context.Context, key attemptKey) {
+	err := c.UserRepository.DeleteLoginAttempts(ctx, []string{key.key})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (c *UserUsecase) audit(ctx context.Context, entry *entities.AuditEntry) {
+	err := c.UserRepository.CreateAuditEntry(ctx, entry)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func clientInfoFromContext(ctx context.Context) entities.ClientInfo {
+	info, _ := ctx.Value(entities.ClientInfoKey).(entities.ClientInfo)
+	return info
+}
+
+func (c *UserUsecase) createSession(ctx context.Context, userID uint) (*entities.TokenPair, error) {
+	refreshToken, err := entities.GenerateRefreshToken()
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating refresh token")
+	}
+	session := &entities.Session{
+		UserID:           userID,
+		RefreshTokenHash: entities.HashRefreshToken(refreshToken),
+		ExpiresAt:        time.Now().Add(entities.RefreshTokenLifetime),
+	}
+	session.SetClientInfo(clientInfoFromContext(ctx))
+	session, err = c.UserRepository.CreateSession(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := entities.GenerateAuthToken(userID, session.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating auth token")
+	}
+	return &entities.TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// VerifyLoginChallenge completes the login of a user with two-factor authentication.
+// The code can be either a TOTP code or one of the recovery codes of the user.
+func (c *UserUsecase) VerifyLoginChallenge(ctx context.Context, challengeToken string, code string) (*entities.User, *entities.TokenPair, error) {
+	ctx, cancelFunc := context.WithTimeout(ctx, 5*time.Second)
+	challenge, err := c.UserRepository.GetLoginChallengeByTokenHash(ctx, entities.HashRefreshToken(challengeToken))
+	if err != nil || !challenge.IsValid() {
+		cancelFunc()
+		return nil, nil, errors.New("login challenge is invalid or has expired, please login again")
+	}
+	keys := attemptKeys(ctx, twoFactorAttempts, fmt.Sprint(challenge.UserID))
+	err = c.checkAttempts(ctx, keys)
+	if err != nil {
+		cancelFunc()
+		return nil, nil, err
+	}
+	user, err := c.UserRepository.GetByID(ctx, challenge.UserID)
+	if err != nil {
+		cancelFunc()
+		return nil, nil, errors.Wrap(err, "error getting user")
+	}
+	if !user.Active {
+		cancelFunc()
+		return nil, nil, errors.New("Your account has been deactivated please contact us")
+	}
+	ok, err := c.checkSecondFactor(ctx, user, code)
+	if err != nil {
+		cancelFunc()
+		return nil, nil, err
+	}
+	if !ok {
+		c.recordFailedAttempt(ctx, user.ID, twoFactorAttempts, keys)
+		cancelFunc()
+		return nil, nil, errors.New("two-factor authentication code doesn't match")
+	}
+	c.clearAttempts(ctx, keys[0])
+	challenge.Use()
+	_, err = c.UserRepository.UpdateLoginChallenge(ctx, challenge)
+	if err != nil {
+		cancelFunc()
+		return nil, nil, err
+	}
+	tokens, err := c.createSession(ctx, user.ID)
+	if err != nil {
+		cancelFunc()
+		return nil, nil, err
+	}
+	if user.CityID != 0 {
+		city, err := c.BranchRepository.GetCityByID(ctx, user.CityID)
+		if err != nil {
+			cancelFunc()
+			return nil, nil, err
+		}
+		user.City = *city
+		if user.IsPartner() {
+			user.PartnerProfile.City = *city
+		}
+	}
+	cancelFunc()
+	return user, tokens, nil
+}
+
+// StartTwoFactorEnrollment sets a new TOTP secret to the current user.
+// It returns the secret and the otpauth URI to add it to an authenticator app with.
+func (c *UserUsecase) StartTwoFactorEnrollment(ctx context.Context) (string, string, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	user, err := c.UserRepository.GetByID(ctx, currentUserID)
+	if err != nil {
+		cancelFunc()
+		return "", "", errors.Wrap(err, "error getting current user")
+	}
+	err = user.StartTOTPEnrollment()
+	if err != nil {
+		cancelFunc()
+		return "", "", err
+	}
+	_, err = c.saveUser(ctx, user)
+	if err != nil {
+		cancelFunc()
+		return "", "", errors.Wrap(err, "error saving TOTP secret")
+	}
+	cancelFunc()
+	return user.TOTPSecret, entities.TOTPURI(user.TOTPSecret, user.Email), nil
+}
+
+// EnableTwoFactor finishes the enrollment of the current user with a code from their authenticator app.
+// It returns the recovery codes of the user, they are only shown once.
+func (c *UserUsecase) EnableTwoFactor(ctx context.Context, code string) ([]string, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	keys := attemptKeys(ctx, twoFactorAttempts, fmt.Sprint(currentUserID))
+	err := c.checkAttempts(ctx, keys)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	user, err := c.UserRepository.GetByID(ctx, currentUserID)
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "error getting current user")
+	}
+	err = user.FinishTOTPEnrollment(code, time.Now())
+	if err != nil {
+		if user.TOTPSecret != "" && !user.TOTPEnabled {
+			c.recordFailedAttempt(ctx, user.ID, twoFactorAttempts, keys)
+		}
+		cancelFunc()
+		return nil, err
+	}
+	c.clearAttempts(ctx, keys[0])
+	codes, records, err := entities.GenerateRecoveryCodes(user.ID)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	err = c.UserRepository.ReplaceRecoveryCodes(ctx, user.ID, records)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	_, err = c.saveUser(ctx, user)
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "error enabling two-factor authentication")
+	}
+	c.audit(ctx, &entities.AuditEntry{
+		Action:    entities.AuditTwoFactorEnabled,
+		UserID:    user.ID,
+		ActorID:   user.ID,
+		IPAddress: clientInfoFromContext(ctx).IPAddress,
+	})
+	cancelFunc()
+	return codes, nil
+}
+
+// DisableTwoFactor disables two-factor authentication of the current user.
+// Both the password and a TOTP or recovery code are required.
+func (c *UserUsecase) DisableTwoFactor(ctx context.Context, password string, code string) error {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	keys := attemptKeys(ctx, twoFactorAttempts, fmt.Sprint(currentUserID))
+	err := c.checkAttempts(ctx, keys)
+	if err != nil {
+		cancelFunc()
+		return err
+	}
+	user, err := c.UserRepository.GetByID(ctx, currentUserID)
+	if err != nil {
+		cancelFunc()
+		return errors.Wrap(err, "error getting current user")
+	}
+	if !user.TOTPEnabled {
+		cancelFunc()
+		return errors.New("two-factor authentication is not enabled")
+	}
+	if !user.VerifyPassword(password) {
+		c.recordFailedAttempt(ctx, user.ID, twoFactorAttempts, keys)
+		cancelFunc()
+		return errors.New("password or code doesn't match")
+	}
+	ok, err := c.checkSecondFactor(ctx, user, code)
+	if err != nil {
+		cancelFunc()
+		return err
+	}
+	if !ok {
+		c.recordFailedAttempt(ctx, user.ID, twoFactorAttempts, keys)
+		cancelFunc()
+		return errors.New("password or code doesn't match")
+	}
+	c.clearAttempts(ctx, keys[0])
+	err = c.disableTwoFactor(ctx, user, user.ID)
+	if err != nil {
+		cancelFunc()
+		return err
+	}
+	cancelFunc()
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the current user after checking a TOTP or recovery code
+func (c *UserUsecase) RegenerateRecoveryCodes(ctx context.Context, code string) ([]string, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	keys := attemptKeys(ctx, twoFactorAttempts, fmt.Sprint(currentUserID))
+	err := c.checkAttempts(ctx, keys)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	user, err := c.UserRepository.GetByID(ctx, currentUserID)
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "error getting current user")
+	}
+	if !user.TOTPEnabled {
+		cancelFunc()
+		return nil, errors.New("two-factor authentication is not enabled")
+	}
+	ok, err := c.checkSecondFactor(ctx, user, code)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	if !ok {
+		c.recordFailedAttempt(ctx, user.ID, twoFactorAttempts, keys)
+		cancelFunc()
+		return nil, errors.New("two-factor authentication code doesn't match")
+	}
+	c.clearAttempts(ctx, keys[0])
+	codes, records, err := entities.GenerateRecoveryCodes(user.ID)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	err = c.UserRepository.ReplaceRecoveryCodes(ctx, user.ID, records)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	cancelFunc()
+	return codes, nil
+}
+
+// AdminDisableTwoFactor disables two-factor authentication of a user who lost both their authenticator and recovery codes
+func (c *UserUsecase) AdminDisableTwoFactor(ctx context.Context, userID uint) error {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUser, err := c.Authorize(ctx, entities.PermissionManageUsers)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return err
+	}
+	user, err := c.UserRepository.GetByID(ctx, userID)
+	if err != nil {
+		cancelFunc()
+		return errors.Wrap(err, "error getting user")
+	}
+	if user.GetRole().IsStaff() && !currentUser.Can(entities.PermissionManageRoles) {
+		cancelFunc()
+		return errors.Wrap(entities.ErrForbidden, "only super admins can disable two-factor authentication of staff accounts")
+	}
+	err = c.disableTwoFactor(ctx, user, currentUser.ID)
+	if err != nil {
+		cancelFunc()
+		return err
+	}
+	cancelFunc()
+	return nil
+}
+
+// startLoginChallenge creates a login challenge for the user and returns it as a TwoFactorRequiredError
+func (c *UserUsecase) startLoginChallenge(ctx context.Context, userID uint) error {
+	token, err := entities.GenerateRefreshToken()
+	if err != nil {
+		return errors.Wrap(err, "error generating login challenge")
+	}
+	challenge := &entities.LoginChallenge{
+		UserID:    userID,
+		TokenHash: entities.HashRefreshToken(token),
+		ExpiresAt: time.Now().Add(entities.LoginChallengeLifetime),
+	}
+	challenge, err = c.UserRepository.CreateLoginChallenge(ctx, challenge)
+	if err != nil {
+		return err
+	}
+	return &entities.TwoFactorRequiredError{
+		ChallengeToken: token,
+		ExpiresAt:      challenge.ExpiresAt,
+	}
+}
+
+// checkSecondFactor returns true if the code is a valid TOTP code or an unused recovery code of the user.
+// Used codes are saved so that they can't be used again.
+func (c *UserUsecase) checkSecondFactor(ctx context.Context, user *entities.User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if user.CheckTOTP(code, time.Now()) {
+		_, err := c.saveUser(ctx, user)
+		if err != nil {
+			return false, errors.Wrap(err, "error saving used TOTP code")
+		}
+		return true, nil
+	}
+	recoveryCode, err := c.UserRepository.GetUnusedRecoveryCode(ctx, user.ID, entities.HashRecoveryCode(code))
+	if err != nil {
+		return false, nil
+	}
+	now := time.Now()
+	recoveryCode.UsedAt = &now
+	_, err = c.UserRepository.UpdateRecoveryCode(ctx, recoveryCode)
+	if err != nil {
+		return false, err
+	}
+	c.audit(ctx, &entities.AuditEntry{
+		Action:    entities.AuditRecoveryCodeUsed,
+		UserID:    user.ID,
+		ActorID:   user.ID,
+		IPAddress: clientInfoFromContext(ctx).IPAddress,
+	})
+	return true, nil
+}
+
+func (c *UserUsecase) disableTwoFactor(ctx context.Context, user *entities.User, actorID uint) error {
+	user.DisableTOTP()
+	_, err := c.saveUser(ctx, user)
+	if err != nil {
+		return errors.Wrap(err, "error disabling two-factor authentication")
+	}
+	err = c.UserRepository.ReplaceRecoveryCodes(ctx, user.ID, nil)
+	if err != nil {
+		return err
+	}
+	c.audit(ctx, &entities.AuditEntry{
+		Action:    entities.AuditTwoFactorDisabled,
+		UserID:    user.ID,
+		ActorID:   actorID,
+		IPAddress: clientInfoFromContext(ctx).IPAddress,
+	})
+	return nil
+}
+
+// CreateCashier creates a staff account for the current partner.
+// The cashier can only scan offers, at the given branch if it isn't 0.
+func (c *UserUsecase) CreateCashier(ctx context.Context, u *entities.User, branchID uint, password string) (*entities.User, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUser, err := c.Authorize(ctx, entities.PermissionManageCashiers)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	branch, err := c.getCashierBranch(ctx, branchID)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	err = u.AssignCashier(currentUser, branch)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	u.ProfileImageURL = os.Getenv("DEFAULT_PROFILE_IMAGE_URL")
+	err = u.SetHashedPassword(password, u)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	cashier, err := c.UserRepository.CreateCustomer(ctx, u)
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "repository error")
+	}
+	c.audit(ctx, &entities.AuditEntry{
+		Action:    entities.AuditCashierCreated,
+		UserID:    cashier.ID,
+		ActorID:   currentUser.ID,
+		IPAddress: clientInfoFromContext(ctx).IPAddress,
+	})
+	cancelFunc()
+	return cashier, nil
+}
+
+// GetCashiers returns the staff accounts of the current partner
+func (c *UserUsecase) GetCashiers(ctx context.Context) ([]entities.User, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUser, err := c.Authorize(ctx, entities.PermissionManageCashiers)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	cashiers, err := c.UserRepository.GetCashiersByPartner(ctx, currentUser.ID)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	cancelFunc()
+	return cashiers, nil
+}
+
+// UpdateCashierBranch moves a cashier of the current partner to the given branch.
+// A branch ID of 0 lets the cashier scan offers at any branch.
+func (c *UserUsecase) UpdateCashierBranch(ctx context.Context, cashierID uint, branchID uint) (*entities.User, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUser, cashier, err := c.getCashier(ctx, cashierID)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	branch, err := c.getCashierBranch(ctx, branchID)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	err = cashier.AssignCashier(currentUser, branch)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	cashier, err = c.saveUser(ctx, cashier)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	c.audit(ctx, &entities.AuditEntry{
+		Action:    entities.AuditCashierUpdated,
+		UserID:    cashier.ID,
+		ActorID:   currentUser.ID,
+		IPAddress: clientInfoFromContext(ctx).IPAddress,
+		Detail:    fmt.Sprintf("branch %d", cashier.BranchID),
+	})
+	cancelFunc()
+	return cashier, nil
+}
+
+// DeleteCashier deletes a cashier of the current partner and logs them out.
+// The offers they scanned keep their ID.
+func (c *UserUsecase) DeleteCashier(ctx context.Context, cashierID uint) error {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUser, cashier, err := c.getCashier(ctx, cashierID)
+	if err != nil {
+		cancelFunc()
+		return err
+	}
+	_, err = c.UserRepository.SoftDelete(ctx, cashier)
+	if err != nil {
+		cancelFunc()
+		return err
+	}
+	err = c.UserRepository.RevokeUserSessions(ctx, cashier.ID, 0)
+	if err != nil {
+		cancelFunc()
+		return err
+	}
+	c.audit(ctx, &entities.AuditEntry{
+		Action:    entities.AuditCashierDeleted,
+		UserID:    cashier.ID,
+		ActorID:   currentUser.ID,
+		IPAddress: clientInfoFromContext(ctx).IPAddress,
+	})
+	cancelFunc()
+	return nil
+}
+
+// GetRole returns the role of the user with the given ID
+func (c *UserUsecase) GetRole(ctx context.Context, userID uint) (entities.Role, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	user, err := c.UserRepository.GetByID(ctx, userID)
+	if err != nil {
+		cancelFunc()
+		return "", errors.Wrap(err, "error getting user")
+	}
+	cancelFunc()
+	return user.GetRole(), nil
+}
+
+// getCashier returns the current partner and their cashier with the given ID
+func (c *UserUsecase) getCashier(ctx context.Context, cashierID uint) (*entities.User, *entities.User, error) {
+	currentUser, err := c.Authorize(ctx, entities.PermissionManageCashiers)
+	if err != nil {
+		log.Error(err)
+		return nil, nil, err
+	}
+	cashier, err := c.UserRepository.GetByID(ctx, cashierID)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error getting cashier")
+	}
+	if !currentUser.CanManageCashier(cashier) {
+		return nil, nil, errors.Wrap(entities.ErrForbidden, "cashier does not belong to the current partner")
+	}
+	return currentUser, cashier, nil
+}
+
+// getCashierBranch returns the branch with the given ID, or nil if the ID is 0
+func (c *UserUsecase) getCashierBranch(ctx context.Context, branchID uint) (*entities.Branch, error) {
+	if branchID == 0 {
+		return nil, nil
+	}
+	branch, err := c.BranchRepository.GetByID(ctx, branchID)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting branch")
+	}
+	return branch, nil
+}
+
+// CreateAPIKey creates an API key for the point of sale system of the current partner.
+// The returned key is only available here, the API key record holds its hash.
+func (c *UserUsecase) CreateAPIKey(ctx context.Context, name string) (*entities.APIKey, string, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUser, err := c.Authorize(ctx, entities.PermissionManageAPIKeys)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, "", err
+	}
+	apiKey, key, err := entities.NewAPIKey(currentUser, name)
+	if err != nil {
+		cancelFunc()
+		return nil, "", err
+	}
+	apiKey, err = c.UserRepository.CreateAPIKey(ctx, apiKey)
+	if err != nil {
+		cancelFunc()
+		return nil, "", err
+	}
+	c.audit(ctx, &entities.AuditEntry{
+		Action:    entities.AuditAPIKeyCreated,
+		UserID:    currentUser.ID,
+		ActorID:   currentUser.ID,
+		IPAddress: clientInfoFromContext(ctx).IPAddress,
+		Detail:    apiKey.Prefix,
+	})
+	cancelFunc()
+	return apiKey, key, nil
+}
+
+// GetAPIKeys returns the API keys of the current partner
+func (c *UserUsecase) GetAPIKeys(ctx context.Context) ([]entities.APIKey, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUser, err := c.Authorize(ctx, entities.PermissionManageAPIKeys)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return nil, err
+	}
+	apiKeys, err := c.UserRepository.GetAPIKeysByPartner(ctx, currentUser.ID)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	cancelFunc()
+	return apiKeys, nil
+}
+
+// RevokeAPIKey revokes the API key of the current partner with the given ID
+func (c *UserUsecase) RevokeAPIKey(ctx context.Context, apiKeyID uint) error {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUser, err := c.Authorize(ctx, entities.PermissionManageAPIKeys)
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return err
+	}
+	apiKey, err := c.UserRepository.GetAPIKeyByID(ctx, apiKeyID)
+	if err != nil {
+		cancelFunc()
+		return err
+	}
+	err = apiKey.Revoke(currentUser)
+	if err != nil {
+		cancelFunc()
+		return err
+	}
+	_, err = c.UserRepository.UpdateAPIKey(ctx, apiKey)
+	if err != nil {
+		cancelFunc()
+		return err
+	}
+	c.audit(ctx, &entities.AuditEntry{
+		Action:    entities.AuditAPIKeyRevoked,
+		UserID:    currentUser.ID,
+		ActorID:   currentUser.ID,
+		IPAddress: clientInfoFromContext(ctx).IPAddress,
+		Detail:    apiKey.Prefix,
+	})
+	cancelFunc()
+	return nil
+}
+
+// AuthenticateAPIKey returns the API key record of the given key if it can still be used.
+// Keys of deactivated or deleted partners are rejected.
+func (c *UserUsecase) AuthenticateAPIKey(ctx context.Context, key string) (*entities.APIKey, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	apiKey, err := c.UserRepository.GetAPIKeyByHash(ctx, entities.HashAPIKey(key))
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "invalid API key")
+	}
+	if apiKey.IsRevoked() {
+		cancelFunc()
+		return nil, errors.New("API key has been revoked")
+	}
+	partner, err := c.UserRepository.GetByID(ctx, apiKey.PartnerID)
+	if err != nil {
+		cancelFunc()
+		return nil, errors.Wrap(err, "invalid API key")
+	}
+	if !partner.Active || !partner.Can(entities.PermissionManageAPIKeys) {
+		cancelFunc()
+		return nil, errors.New("the partner of the API key can't use it")
+	}
+	if apiKey.Touch() {
+		_, err = c.UserRepository.UpdateAPIKey(ctx, apiKey)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	cancelFunc()
+	return apiKey, nil
+}
+
+// CreateRedemptionToken returns a short lived redemption token of the current customer and its expiry.
+// The customer app shows it as a QR code for the partner to consume an offer with.
+func (c *UserUsecase) CreateRedemptionToken(ctx context.Context) (string, time.Time, error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	currentUserID := ctx.Value(entities.UserIDKey).(uint)
+	currentUser, err := c.UserRepository.GetByID(ctx, currentUserID)
+	if err != nil {
+		cancelFunc()
+		return "", time.Time{}, errors.Wrap(err, "error getting current user")
+	}
+	secret, err := entities.RedemptionSecret()
+	if err != nil {
+		log.Error(err)
+		cancelFunc()
+		return "", time.Time{}, err
+	}
+	token, claims, err := entities.NewRedemptionToken(currentUser, secret, time.Now())
+	if err != nil {
+		cancelFunc()
+		return "", time.Time{}, err
+	}
+	cancelFunc()
+	return token, claims.ExpiresAt, nil
+}
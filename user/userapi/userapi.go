@@ -62,6 +62,37 @@ type emailLoginRequest struct {
 	Password string `json:"password"`
 }
 
+type newCashierRequest struct {
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Email     string `json:"email"`
+	Mobile    string `json:"mobile"`
+	Password  string `json:"password"`
+	BranchID  uint   `json:"branchID"`
+}
+
+type updateCashierRequest struct {
+	BranchID uint `json:"branchID"`
+}
+
+type newAPIKeyRequest struct {
+	Name string `json:"name"`
+}
+
+type loginChallengeRequest struct {
+	ChallengeToken string `json:"challengeToken"`
+	Code           string `json:"code"`
+}
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type disableTwoFactorRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
 type phoneLoginRequest struct {
 	Phone    string `json:"phone"`
 	Password string `json:"password"`
@@ -71,6 +102,14 @@ type verifyUserRequest struct {
 	Code string `json:"code"`
 }
 
+type changeEmailRequest struct {
+	Email string `json:"email"`
+}
+
+type changeMobileRequest struct {
+	Mobile string `json:"mobile"`
+}
+
 type forgetPasswordRequest struct {
 	Mobile string `json:"mobile"`
 }
@@ -79,6 +118,14 @@ type updatePassword struct {
 	NewPassword string `json:"newPassword"`
 }
 
+type setRoleRequest struct {
+	Role string `json:"role"`
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
 // CreateUserAPI creates a new user api instance
 func CreateUserAPI(u user.Usecase) UserAPI {
 	api := UserAPI{
@@ -123,19 +170,52 @@ func (req *updateUserRequest) Validate() error {
 		validation.Field(&req.LastName, validation.Required, is.LowerCase),
 		validation.Field(&req.Country, validation.Required, is.LowerCase),
 		validation.Field(&req.CityID, validation.Required),
-		validation.Field(&req.Mobile, validation.Required),
-		validation.Field(&req.Email, validation.Required, is.Email),
+		validation.Field(&req.Email, is.Email),
 	)
 }
+
+// CastUser copies the updated fields to the given user.
+// Email and mobile are changed through their own verification flow and are never copied.
 func (req *updateUserRequest) CastUser(original *entities.User) *entities.User {
 	original.FirstName = req.FirstName
 	original.LastName = req.LastName
 	original.Country = req.Country
 	original.CityID = req.CityID
-	original.Email = req.Email
 	return original
 }
 
+// Validate validates the new cashier request
+func (req *newCashierRequest) Validate() error {
+	return validation.ValidateStruct(req,
+		validation.Field(&req.FirstName, validation.Required, validation.Length(2, 50)),
+		validation.Field(&req.LastName, validation.Required, validation.Length(2, 50)),
+		validation.Field(&req.Mobile, validation.Required),
+		validation.Field(&req.Email, validation.Required, is.Email),
+		validation.Field(&req.Password, validation.Required, validation.Length(8, 50)),
+	)
+}
+
+// Validate validates the new API key request
+func (req *newAPIKeyRequest) Validate() error {
+	return validation.ValidateStruct(req,
+		validation.Field(&req.Name, validation.Required, validation.Length(2, 50)),
+	)
+}
+
+// Validate validates the change email request
+func (req *changeEmailRequest) Validate() error {
+	return validation.ValidateStruct(req,
+		validation.Field(&req.Email, validation.Required, is.Email),
+	)
+}
+
+// Validate validates the change mobile request
+func (req *changeMobileRequest) Validate() error {
+	return validation.ValidateStruct(req,
+		validation.Field(&req.Mobile, validation.Required),
+	)
+}
+
 // Validate handles new user request validations
 func (req *newUserRequest) Validate() error {
 	switch req.AccountType {
@@ -145,6 +225,8 @@ func (req *newUserRequest) Validate() error {
 		return req.ValidatePartner()
 	case "admin":
 		return req.ValidateUser()
+	case entities.AccountTypeCashier:
+		return errors.New("cashier accounts are created by their partner")
 	default:
 		return req.ValidateUser()
 	}
@@ -153,6 +235,7 @@ func (req *newUserRequest) Validate() error {
 // CreateUser handles the user creation endpoint
 func (h *UserAPI) CreateUser(c *gin.Context) {
 	ctx := context.Background()
+	ctx = context.WithValue(ctx, entities.ClientInfoKey, entities.GetClientInfo(c))
 	var req newUserRequest
 	err := c.BindJSON(&req)
 	if err != nil {
@@ -205,15 +288,16 @@ func (h *UserAPI) CreateUser(c *gin.Context) {
 			return
 		}
 	}
-	token, err := entities.GenerateAuthToken(user.ID)
+	tokens, err := h.UserUsecase.IssueTokens(ctx, user.ID)
 	if err != nil {
 		entities.SendServerError(c, "There has been a server error , please try again", err)
 		return
 	}
 	c.JSON(200, gin.H{
-		"message": "User Created Successfully",
-		"user":    user,
-		"token":   token,
+		"message":      "User Created Successfully",
+		"user":         user,
+		"token":        tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
 	})
 }
 
@@ -252,6 +336,7 @@ func (h *UserAPI) IsPhoneRegistered(c *gin.Context) {
 // EmailLogin handles login with Email
 func (h *UserAPI) EmailLogin(c *gin.Context) {
 	ctx := context.Background()
+	ctx = context.WithValue(ctx, entities.ClientInfoKey, entities.GetClientInfo(c))
 	var req emailLoginRequest
 	err := c.BindJSON(&req)
 	if err != nil {
@@ -259,9 +344,17 @@ func (h *UserAPI) EmailLogin(c *gin.Context) {
 		return
 	}
 	req.Email = strings.ToLower(req.Email)
-	user, token, err := h.UserUsecase.EmailLogin(ctx, req.Email, req.Password)
+	user, tokens, err := h.UserUsecase.EmailLogin(ctx, req.Email, req.Password)
 	if err != nil {
 		log.Error(err)
+		if challenge, ok := errors.Cause(err).(*entities.TwoFactorRequiredError); ok {
+			sendLoginChallenge(c, challenge)
+			return
+		}
+		if tooMany, ok := errors.Cause(err).(*entities.TooManyAttemptsError); ok {
+			entities.SendTooManyAttemptsError(c, tooMany)
+			return
+		}
 		if err.Error() == "not registered" {
 			entities.SendNotFoundError(c, "This email is not registered, please signup instead", err)
 			return
@@ -274,34 +367,242 @@ func (h *UserAPI) EmailLogin(c *gin.Context) {
 		return
 	}
 	c.JSON(200, gin.H{
-		"message": "Login Successful",
-		"user":    user,
-		"token":   token,
+		"message":      "Login Successful",
+		"user":         user,
+		"token":        tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+	})
+}
+
+// VerifyLoginChallenge handles POST request to /public/login/2fa
+func (h *UserAPI) VerifyLoginChallenge(c *gin.Context) {
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, entities.ClientInfoKey, entities.GetClientInfo(c))
+	var req loginChallengeRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error sending your information to the server, please try again", err)
+		return
+	}
+	user, tokens, err := h.UserUsecase.VerifyLoginChallenge(ctx, req.ChallengeToken, req.Code)
+	if err != nil {
+		if tooMany, ok := errors.Cause(err).(*entities.TooManyAttemptsError); ok {
+			entities.SendTooManyAttemptsError(c, tooMany)
+			return
+		}
+		entities.SendAuthError(c, err.Error(), err)
+		return
+	}
+	c.JSON(200, gin.H{
+		"message":      "Login Successful",
+		"user":         user,
+		"token":        tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+	})
+}
+
+// sendLoginChallenge responds to a login of a user with two-factor authentication.
+// The client has to send the challenge token back with a code to /public/login/2fa.
+func sendLoginChallenge(c *gin.Context, challenge *entities.TwoFactorRequiredError) {
+	c.JSON(200, gin.H{
+		"message":           "Two-factor authentication code required",
+		"twoFactorRequired": true,
+		"challengeToken":    challenge.ChallengeToken,
+		"expiresAt":         challenge.ExpiresAt,
 	})
 }
 
 // PhoneLogin handles login with phone number
 func (h *UserAPI) PhoneLogin(c *gin.Context) {
 	ctx := context.Background()
+	ctx = context.WithValue(ctx, entities.ClientInfoKey, entities.GetClientInfo(c))
 	var req phoneLoginRequest
 	err := c.BindJSON(&req)
 	if err != nil {
 		entities.SendParsingError(c, "There has been a trouble sending your information to the server, please try again", err)
 		return
 	}
-	user, token, err := h.UserUsecase.PhoneLogin(ctx, req.Phone, req.Password)
+	user, tokens, err := h.UserUsecase.PhoneLogin(ctx, req.Phone, req.Password)
 	if err != nil {
+		if challenge, ok := errors.Cause(err).(*entities.TwoFactorRequiredError); ok {
+			sendLoginChallenge(c, challenge)
+			return
+		}
+		if tooMany, ok := errors.Cause(err).(*entities.TooManyAttemptsError); ok {
+			entities.SendTooManyAttemptsError(c, tooMany)
+			return
+		}
 		if err.Error() == "not registered" {
 			entities.SendNotFoundError(c, "This phone number is not registered, please signup instaed", err)
 			return
 		}
+		if err.Error() == "Your account has been deactivated please contact us" {
+			entities.SendAuthError(c, err.Error(), err)
+			return
+		}
 		entities.SendNotFoundError(c, "Password is incorrect", err)
 		return
 	}
 	c.JSON(200, gin.H{
-		"message": "Login Successful",
-		"user":    user,
-		"token":   token,
+		"message":      "Login Successful",
+		"user":         user,
+		"token":        tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+	})
+}
+
+// RefreshToken handles POST /public/refresh
+func (h *UserAPI) RefreshToken(c *gin.Context) {
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, entities.ClientInfoKey, entities.GetClientInfo(c))
+	var req refreshTokenRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error sending your information to the server, please try again", err)
+		return
+	}
+	tokens, err := h.UserUsecase.RefreshToken(ctx, req.RefreshToken)
+	if err != nil {
+		entities.SendAuthError(c, "Your session has expired, please login again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"token":        tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+	})
+}
+
+// Logout handles POST /user/logout
+func (h *UserAPI) Logout(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	sessionID := c.MustGet("sessionID").(uint)
+	ctx = context.WithValue(ctx, entities.SessionIDKey, sessionID)
+	err := h.UserUsecase.Logout(ctx)
+	if err != nil {
+		entities.SendServerError(c, "There has been an error while processing your request, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": "logged out successfully",
+	})
+}
+
+// GetMySessions handles GET /user/sessions
+func (h *UserAPI) GetMySessions(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	sessionID := c.MustGet("sessionID").(uint)
+	ctx = context.WithValue(ctx, entities.SessionIDKey, sessionID)
+	sessions, err := h.UserUsecase.GetSessions(ctx, userID)
+	if err != nil {
+		entities.SendServerError(c, "There has been an error while processing your request, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"sessions": sessions,
+	})
+}
+
+// RevokeMySession handles DELETE /user/sessions/:id
+func (h *UserAPI) RevokeMySession(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	err = h.UserUsecase.RevokeSession(ctx, userID, uint(id))
+	if err != nil {
+		entities.SendNotFoundError(c, "This session was not found", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": "session revoked successfully",
+	})
+}
+
+// RevokeMySessions handles DELETE /user/sessions
+func (h *UserAPI) RevokeMySessions(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	err := h.UserUsecase.RevokeAllSessions(ctx, userID)
+	if err != nil {
+		entities.SendServerError(c, "There has been an error while processing your request, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": "all sessions revoked successfully",
+	})
+}
+
+// GetUserSessions handles GET /admin/user/:userID/sessions
+func (h *UserAPI) GetUserSessions(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	id, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	sessions, err := h.UserUsecase.GetSessions(ctx, uint(id))
+	if err != nil {
+		entities.SendAuthError(c, "You are not authorized to view the sessions of this user", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"sessions": sessions,
+	})
+}
+
+// RevokeUserSession handles DELETE /admin/user/:userID/sessions/:id
+func (h *UserAPI) RevokeUserSession(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	id, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	sessionID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	err = h.UserUsecase.RevokeSession(ctx, uint(id), uint(sessionID))
+	if err != nil {
+		entities.SendValidationError(c, "There has been an error while processing your request, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": "session revoked successfully",
+	})
+}
+
+// RevokeUserSessions handles DELETE /admin/user/:userID/sessions
+func (h *UserAPI) RevokeUserSessions(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	id, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	err = h.UserUsecase.RevokeAllSessions(ctx, uint(id))
+	if err != nil {
+		entities.SendValidationError(c, "There has been an error while processing your request, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": "all sessions revoked successfully",
 	})
 }
 
@@ -348,6 +649,10 @@ func (h *UserAPI) AdminDeleteUser(c *gin.Context) {
 	}
 	user, err := h.UserUsecase.AdminDeleteUser(ctx, uint(id))
 	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "You are not authorized to delete this user", err)
+			return
+		}
 		entities.SendValidationError(c, "You have been logged out , please login", err)
 		return
 	}
@@ -462,6 +767,7 @@ func (h *UserAPI) VerifyUser(c *gin.Context) {
 	ctx := context.Background()
 	userID := c.MustGet("userID").(uint)
 	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	ctx = context.WithValue(ctx, entities.ClientInfoKey, entities.GetClientInfo(c))
 	var req verifyUserRequest
 	err := c.BindJSON(&req)
 	if err != nil {
@@ -470,6 +776,10 @@ func (h *UserAPI) VerifyUser(c *gin.Context) {
 	}
 	user, err := h.UserUsecase.VerifyUser(ctx, req.Code)
 	if err != nil {
+		if tooMany, ok := errors.Cause(err).(*entities.TooManyAttemptsError); ok {
+			entities.SendTooManyAttemptsError(c, tooMany)
+			return
+		}
 		entities.SendValidationError(c, "There has been an error processing your request , please try again", err)
 		return
 	}
@@ -479,88 +789,190 @@ func (h *UserAPI) VerifyUser(c *gin.Context) {
 	})
 }
 
-// ForgetPassword handles POST request to /forget-password
-func (h *UserAPI) ForgetPassword(c *gin.Context) {
+// RequestEmailVerification handles POST request to /user/email/verification
+func (h *UserAPI) RequestEmailVerification(c *gin.Context) {
 	ctx := context.Background()
-	var req forgetPasswordRequest
-	err := c.BindJSON(&req)
-	if err != nil {
-		entities.SendParsingError(c, "There has been an error parsing your request , please try again", err)
-		return
-	}
-	err = h.UserUsecase.RecoverPassword(ctx, req.Mobile)
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	change, err := h.UserUsecase.RequestEmailVerification(ctx)
 	if err != nil {
 		entities.SendValidationError(c, "There has been an error processing your request , please try again", err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{
-		"success": "One time password was sent to your mobile phone",
+		"success":       "Verification code sent",
+		"contactChange": change,
 	})
 }
 
-// ForgetPassword handles POST request to /forget-password
-func (h *UserAPI) AdminForgetPassword(c *gin.Context) {
-	ctx := context.Background()
-	var req forgetPasswordRequest
+// ChangeEmail handles PUT request to /user/email
+func (h *UserAPI) ChangeEmail(c *gin.Context) {
+	var req changeEmailRequest
 	err := c.BindJSON(&req)
 	if err != nil {
 		entities.SendParsingError(c, "There has been an error parsing your request , please try again", err)
 		return
 	}
-	err = h.UserUsecase.AdminRecoverPassword(ctx, req.Mobile)
+	req.Email = strings.ToLower(req.Email)
+	err = req.Validate()
 	if err != nil {
-		entities.SendValidationError(c, "There has been an error processing your request , please try again", err)
+		entities.SendValidationError(c, "Please provide a valid email", err)
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{
-		"success": "One time password was sent to your mobile phone",
-	})
+	h.requestContactChange(c, entities.ContactEmail, req.Email)
 }
 
-// UpdatePartnerProfile updates the partner profile
-func (h *UserAPI) UpdatePartnerProfile(c *gin.Context) {
-	ctx := context.Background()
-	userID := c.MustGet("userID").(uint)
-	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
-	var req updateMainBranch
+// ChangeMobile handles PUT request to /user/mobile
+func (h *UserAPI) ChangeMobile(c *gin.Context) {
+	var req changeMobileRequest
 	err := c.BindJSON(&req)
 	if err != nil {
 		entities.SendParsingError(c, "There has been an error parsing your request , please try again", err)
 		return
 	}
-	profile := &entities.PartnerProfile{
-		DiscountValue:     req.DiscountValue,
-		MainBranchAddress: req.MainBranchAddress,
-		Phone:             req.Phone,
-		CityID:            req.CityID,
-		Country:           req.Country,
-		BrandName:         req.BrandName,
-		OfferDiscription:  req.OfferDiscription,
-		CategoryID:        uint(req.CategoryID),
+	err = req.Validate()
+	if err != nil {
+		entities.SendValidationError(c, "Please provide a valid mobile", err)
+		return
 	}
-	updatedUser, err := h.UserUsecase.UpdatePartnerProfile(ctx, profile)
+	h.requestContactChange(c, entities.ContactMobile, req.Mobile)
+}
+
+// ConfirmEmail handles POST request to /user/email/confirm
+func (h *UserAPI) ConfirmEmail(c *gin.Context) {
+	h.confirmContactChange(c, entities.ContactEmail)
+}
+
+// ConfirmMobile handles POST request to /user/mobile/confirm
+func (h *UserAPI) ConfirmMobile(c *gin.Context) {
+	h.confirmContactChange(c, entities.ContactMobile)
+}
+
+func (h *UserAPI) requestContactChange(c *gin.Context, kind string, newValue string) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	change, err := h.UserUsecase.RequestContactChange(ctx, kind, newValue)
 	if err != nil {
 		entities.SendValidationError(c, "There has been an error processing your request , please try again", err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{
-		"success": "Main branch details updated successfully",
-		"user":    updatedUser,
+		"success":       "Verification code sent",
+		"contactChange": change,
 	})
 }
 
-// UpdatePassword handles POST request to /update-pass endpoint
-func (h *UserAPI) UpdatePassword(c *gin.Context) {
+func (h *UserAPI) confirmContactChange(c *gin.Context, kind string) {
 	ctx := context.Background()
 	userID := c.MustGet("userID").(uint)
 	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
-	var req updatePassword
+	ctx = context.WithValue(ctx, entities.ClientInfoKey, entities.GetClientInfo(c))
+	var req verifyUserRequest
 	err := c.BindJSON(&req)
 	if err != nil {
 		entities.SendParsingError(c, "There has been an error parsing your request , please try again", err)
 		return
 	}
-	updatedUser, err := h.UserUsecase.UpdatePassword(ctx, req.NewPassword)
+	user, err := h.UserUsecase.ConfirmContactChange(ctx, kind, req.Code)
+	if err != nil {
+		if tooMany, ok := errors.Cause(err).(*entities.TooManyAttemptsError); ok {
+			entities.SendTooManyAttemptsError(c, tooMany)
+			return
+		}
+		entities.SendValidationError(c, "There has been an error processing your request , please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": "Contact confirmed",
+		"user":    user,
+	})
+}
+
+// ForgetPassword handles POST request to /forget-password
+func (h *UserAPI) ForgetPassword(c *gin.Context) {
+	ctx := context.Background()
+	var req forgetPasswordRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error parsing your request , please try again", err)
+		return
+	}
+	err = h.UserUsecase.RecoverPassword(ctx, req.Mobile)
+	if err != nil {
+		entities.SendValidationError(c, "There has been an error processing your request , please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": "One time password was sent to your mobile phone",
+	})
+}
+
+// ForgetPassword handles POST request to /forget-password
+func (h *UserAPI) AdminForgetPassword(c *gin.Context) {
+	ctx := context.Background()
+	var req forgetPasswordRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error parsing your request , please try again", err)
+		return
+	}
+	err = h.UserUsecase.AdminRecoverPassword(ctx, req.Mobile)
+	if err != nil {
+		entities.SendValidationError(c, "There has been an error processing your request , please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": "One time password was sent to your mobile phone",
+	})
+}
+
+// UpdatePartnerProfile updates the partner profile
+func (h *UserAPI) UpdatePartnerProfile(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	var req updateMainBranch
+	err := c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error parsing your request , please try again", err)
+		return
+	}
+	profile := &entities.PartnerProfile{
+		DiscountValue:     req.DiscountValue,
+		MainBranchAddress: req.MainBranchAddress,
+		Phone:             req.Phone,
+		CityID:            req.CityID,
+		Country:           req.Country,
+		BrandName:         req.BrandName,
+		OfferDiscription:  req.OfferDiscription,
+		CategoryID:        uint(req.CategoryID),
+	}
+	updatedUser, err := h.UserUsecase.UpdatePartnerProfile(ctx, profile)
+	if err != nil {
+		entities.SendValidationError(c, "There has been an error processing your request , please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": "Main branch details updated successfully",
+		"user":    updatedUser,
+	})
+}
+
+// UpdatePassword handles POST request to /update-pass endpoint
+func (h *UserAPI) UpdatePassword(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	sessionID := c.MustGet("sessionID").(uint)
+	ctx = context.WithValue(ctx, entities.SessionIDKey, sessionID)
+	var req updatePassword
+	err := c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error parsing your request , please try again", err)
+		return
+	}
+	updatedUser, err := h.UserUsecase.UpdatePassword(ctx, req.NewPassword)
 	if err != nil {
 		switch errors.Cause(err).Error() {
 		case "new password is same as the old password":
@@ -581,22 +993,23 @@ func (h *UserAPI) ValidateCustomer(c *gin.Context) {
 	ctx := context.Background()
 	userID := c.MustGet("userID").(uint)
 	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
-	customerID, err := strconv.ParseInt(c.Query("customerID"), 10, 64)
-	if err != nil {
-		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
-		return
-	}
+	redemptionToken := c.Query("redemptionToken")
 	partnerID, err := strconv.ParseInt(c.Query("partnerID"), 10, 64)
 	if err != nil {
 		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
 		return
 	}
-	user, subscription, err := h.UserUsecase.ValidateCustomerPartnerIntegrity(ctx, uint(customerID), uint(partnerID))
+	user, subscription, err := h.UserUsecase.ValidateCustomerPartnerIntegrity(ctx, redemptionToken, uint(partnerID))
 	if err != nil {
 		if errors.Cause(err).Error() == "user is not subscribed to any plan" {
 			entities.SendValidationError(c, "This user is not subscribed to any plan", err)
 			return
 		}
+		switch errors.Cause(err) {
+		case entities.ErrInvalidRedemptionToken, entities.ErrRedemptionTokenExpired, entities.ErrRedemptionTokenUsed:
+			entities.SendValidationError(c, errors.Cause(err).Error(), err)
+			return
+		}
 		entities.SendValidationError(c, "This offer is not owned by your account", err)
 		return
 	}
@@ -631,11 +1044,16 @@ func (h *UserAPI) UpdateUser(c *gin.Context) {
 			return
 		}
 	}
+	if (req.Email != "" && req.Email != user.Email) || (req.Mobile != "" && req.Mobile != user.Mobile) {
+		entities.SendValidationError(c, "Email and mobile can only be changed after verifying the new value", errors.New("contact details cannot be updated directly"))
+		return
+	}
 	user = req.CastUser(user)
 	user.DateOfBirth = dbt
 	updated, err := h.UserUsecase.UpdateUser(ctx, user)
 	if err != nil {
 		entities.SendValidationError(c, "There has been an error while processing your request, please try again", err)
+		return
 	}
 	c.JSON(http.StatusOK, gin.H{
 		"success": "user updated successfully",
@@ -895,6 +1313,10 @@ func (h *UserAPI) ToggleActive(c *gin.Context) {
 	}
 	user, err := h.UserUsecase.ToggleActiveProperty(ctx, uint(id))
 	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "You are not authorized to activate or deactivate this user", err)
+			return
+		}
 		entities.SendValidationError(c, "There has been an error while processing your request, please try again", err)
 		return
 	}
@@ -905,6 +1327,81 @@ func (h *UserAPI) ToggleActive(c *gin.Context) {
 	return
 }
 
+// SetUserRole handles POST /admin/user/:userID/role
+func (h *UserAPI) SetUserRole(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	id, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	var req setRoleRequest
+	err = c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	user, err := h.UserUsecase.SetUserRole(ctx, uint(id), entities.Role(req.Role))
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "You are not authorized to change the roles of users", err)
+			return
+		}
+		entities.SendValidationError(c, err.Error(), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": "role updated successfully",
+		"user":    user,
+	})
+}
+
+// UnlockUser handles POST /admin/user/:userID/unlock
+func (h *UserAPI) UnlockUser(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	id, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	err = h.UserUsecase.UnlockUser(ctx, uint(id))
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "You are not authorized to unlock users", err)
+			return
+		}
+		entities.SendValidationError(c, "There has been an error while processing your request, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": "user unlocked successfully",
+	})
+}
+
+// GetAuditEntries handles GET /admin/user/:userID/audit
+func (h *UserAPI) GetAuditEntries(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	id, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	entries, err := h.UserUsecase.GetAuditEntries(ctx, uint(id))
+	if err != nil {
+		entities.SendAuthError(c, "You are not authorized to view the audit entries of users", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"entries": entries,
+	})
+}
+
 // SearchUsers handles /admin/users/?q=
 func (h *UserAPI) SearchUsers(c *gin.Context) {
 	ctx := context.Background()
@@ -921,3 +1418,338 @@ func (h *UserAPI) SearchUsers(c *gin.Context) {
 		"users": result,
 	})
 }
+
+// StartTwoFactorEnrollment handles POST /user/2fa/enroll
+func (h *UserAPI) StartTwoFactorEnrollment(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	secret, uri, err := h.UserUsecase.StartTwoFactorEnrollment(ctx)
+	if err != nil {
+		entities.SendValidationError(c, "There has been an error while processing your request, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"secret": secret,
+		"uri":    uri,
+	})
+}
+
+// EnableTwoFactor handles POST /user/2fa/enable
+func (h *UserAPI) EnableTwoFactor(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	ctx = context.WithValue(ctx, entities.ClientInfoKey, entities.GetClientInfo(c))
+	var req twoFactorCodeRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	codes, err := h.UserUsecase.EnableTwoFactor(ctx, req.Code)
+	if err != nil {
+		if tooMany, ok := errors.Cause(err).(*entities.TooManyAttemptsError); ok {
+			entities.SendTooManyAttemptsError(c, tooMany)
+			return
+		}
+		entities.SendValidationError(c, "There has been an error while processing your request, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":       "two-factor authentication enabled",
+		"recoveryCodes": codes,
+	})
+}
+
+// DisableTwoFactor handles POST /user/2fa/disable
+func (h *UserAPI) DisableTwoFactor(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	ctx = context.WithValue(ctx, entities.ClientInfoKey, entities.GetClientInfo(c))
+	var req disableTwoFactorRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	err = h.UserUsecase.DisableTwoFactor(ctx, req.Password, req.Code)
+	if err != nil {
+		if tooMany, ok := errors.Cause(err).(*entities.TooManyAttemptsError); ok {
+			entities.SendTooManyAttemptsError(c, tooMany)
+			return
+		}
+		entities.SendValidationError(c, "There has been an error while processing your request, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": "two-factor authentication disabled",
+	})
+}
+
+// RegenerateRecoveryCodes handles POST /user/2fa/recovery-codes
+func (h *UserAPI) RegenerateRecoveryCodes(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	ctx = context.WithValue(ctx, entities.ClientInfoKey, entities.GetClientInfo(c))
+	var req twoFactorCodeRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	codes, err := h.UserUsecase.RegenerateRecoveryCodes(ctx, req.Code)
+	if err != nil {
+		if tooMany, ok := errors.Cause(err).(*entities.TooManyAttemptsError); ok {
+			entities.SendTooManyAttemptsError(c, tooMany)
+			return
+		}
+		entities.SendValidationError(c, "There has been an error while processing your request, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"recoveryCodes": codes,
+	})
+}
+
+// AdminDisableTwoFactor handles DELETE /admin/user/:userID/2fa
+func (h *UserAPI) AdminDisableTwoFactor(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	ctx = context.WithValue(ctx, entities.ClientInfoKey, entities.GetClientInfo(c))
+	id, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	err = h.UserUsecase.AdminDisableTwoFactor(ctx, uint(id))
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "You are not authorized to disable two-factor authentication of this user", err)
+			return
+		}
+		entities.SendValidationError(c, "There has been an error while processing your request, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": "two-factor authentication disabled",
+	})
+}
+
+// GetJWKS handles GET /.well-known/jwks.json
+// It returns the public keys other services can verify access tokens with.
+func (h *UserAPI) GetJWKS(c *gin.Context) {
+	c.JSON(http.StatusOK, entities.CurrentKeyring().JWKS())
+}
+
+// CreateCashier handles POST /user/cashiers
+func (h *UserAPI) CreateCashier(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	ctx = context.WithValue(ctx, entities.ClientInfoKey, entities.GetClientInfo(c))
+	var req newCashierRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	req.Email = strings.ToLower(req.Email)
+	err = req.Validate()
+	if err != nil {
+		entities.SendValidationError(c, err.Error(), err)
+		return
+	}
+	newCashier := entities.User{
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Email:     req.Email,
+		Mobile:    req.Mobile,
+	}
+	cashier, err := h.UserUsecase.CreateCashier(ctx, &newCashier, req.BranchID, req.Password)
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "Only partners can add cashiers", err)
+			return
+		}
+		entities.SendValidationError(c, "This email or phone number is already registered or the branch is not yours, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"cashier": cashier,
+	})
+}
+
+// GetCashiers handles GET /user/cashiers
+func (h *UserAPI) GetCashiers(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	cashiers, err := h.UserUsecase.GetCashiers(ctx)
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "Only partners have cashiers", err)
+			return
+		}
+		entities.SendValidationError(c, "There has been an error while getting your cashiers, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"cashiers": cashiers,
+	})
+}
+
+// UpdateCashier handles PUT /user/cashiers/:id
+func (h *UserAPI) UpdateCashier(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	ctx = context.WithValue(ctx, entities.ClientInfoKey, entities.GetClientInfo(c))
+	cashierID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	var req updateCashierRequest
+	err = c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	cashier, err := h.UserUsecase.UpdateCashierBranch(ctx, uint(cashierID), req.BranchID)
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "This cashier is not owned by your account", err)
+			return
+		}
+		entities.SendValidationError(c, "There has been an error while updating the cashier, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"cashier": cashier,
+	})
+}
+
+// DeleteCashier handles DELETE /user/cashiers/:id
+func (h *UserAPI) DeleteCashier(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	ctx = context.WithValue(ctx, entities.ClientInfoKey, entities.GetClientInfo(c))
+	cashierID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	err = h.UserUsecase.DeleteCashier(ctx, uint(cashierID))
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "This cashier is not owned by your account", err)
+			return
+		}
+		entities.SendValidationError(c, "There has been an error while deleting the cashier, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": "cashier deleted",
+	})
+}
+
+// CreateAPIKey handles POST /user/api-keys
+func (h *UserAPI) CreateAPIKey(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	ctx = context.WithValue(ctx, entities.ClientInfoKey, entities.GetClientInfo(c))
+	var req newAPIKeyRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	err = req.Validate()
+	if err != nil {
+		entities.SendValidationError(c, err.Error(), err)
+		return
+	}
+	apiKey, key, err := h.UserUsecase.CreateAPIKey(ctx, req.Name)
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "Only partners can create API keys", err)
+			return
+		}
+		entities.SendValidationError(c, "There has been an error while creating the API key, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"apiKey": apiKey,
+		"key":    key,
+	})
+}
+
+// GetAPIKeys handles GET /user/api-keys
+func (h *UserAPI) GetAPIKeys(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	apiKeys, err := h.UserUsecase.GetAPIKeys(ctx)
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "Only partners have API keys", err)
+			return
+		}
+		entities.SendValidationError(c, "There has been an error while getting your API keys, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"apiKeys": apiKeys,
+	})
+}
+
+// RevokeAPIKey handles DELETE /user/api-keys/:id
+func (h *UserAPI) RevokeAPIKey(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	ctx = context.WithValue(ctx, entities.ClientInfoKey, entities.GetClientInfo(c))
+	apiKeyID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		entities.SendParsingError(c, "There has been an error while parsing your information , please try again", err)
+		return
+	}
+	err = h.UserUsecase.RevokeAPIKey(ctx, uint(apiKeyID))
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "This API key is not owned by your account", err)
+			return
+		}
+		entities.SendValidationError(c, "There has been an error while revoking the API key, please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": "API key revoked",
+	})
+}
+
+// CreateRedemptionToken handles POST /user/redemption-token
+func (h *UserAPI) CreateRedemptionToken(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.MustGet("userID").(uint)
+	ctx = context.WithValue(ctx, entities.UserIDKey, userID)
+	token, expiresAt, err := h.UserUsecase.CreateRedemptionToken(ctx)
+	if err != nil {
+		if errors.Cause(err) == entities.ErrForbidden {
+			entities.SendAuthError(c, "Only customers can redeem offers", err)
+			return
+		}
+		entities.SendServerError(c, "There has been a server error , please try again", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"redemptionToken": token,
+		"expiresAt":       expiresAt,
+	})
+}